@@ -1,45 +1,169 @@
 package rest
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/lib/compression"
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/hashtree"
+	"github.com/hedisam/filesync/lib/psurls"
+)
+
+var (
+	// ErrCursorExpired is returned for changes after a cursor the server doesn't keep changes for anymore. A new
+	// snapshot has to be taken.
+	ErrCursorExpired = errors.New("cursor expired")
+	// ErrFileChanged is returned for a download of a file that has been changed or removed since it was planned.
+	ErrFileChanged = errors.New("file changed on the server")
+	// ErrConflict is returned for an upload or a deletion of a file that isn't at the version expected anymore, i.e.
+	// it's been changed on the server by someone else.
+	ErrConflict = errors.New("file changed on the server by someone else")
+	// ErrDeviceNotRegistered is returned for a sync report of a device the server doesn't know, e.g. after a restart.
+	// The device has to register again.
+	ErrDeviceNotRegistered = errors.New("device not registered")
+)
+
+const (
+	ChangePut    = "put"
+	ChangeDelete = "delete"
+)
+
+// The types of the files that aren't regular files.
+const (
+	// TypeSymlink is for symlinks, stored with their target as content.
+	TypeSymlink = "symlink"
+	// TypeDir is for directories, stored with no content.
+	TypeDir = "dir"
 )
 
+// treePrefixesPerRequest is the maximum number of tree nodes the server returns at once.
+const treePrefixesPerRequest = 1000
+
+// watchIdleTimeout is how long a change stream can go without a heartbeat before it's considered broken.
+const watchIdleTimeout = 45 * time.Second
+
 type File struct {
 	Key            string `json:"key"`
 	Size           int64  `json:"size"`
 	SHA256Checksum string `json:"sha256_checksum"`
+	ContentMAC     string `json:"content_mac,omitempty"`
+	MTime          int64  `json:"mtime,omitempty"`
+	// Version changes whenever the key is given another file. It's 0 for servers that don't version files.
+	Version uint64 `json:"version,omitempty"`
+	// Attributes are the file's attributes as reported by its uploader, if it reported any.
+	Attributes *fileattr.Attributes `json:"attributes,omitempty"`
+	// Type is TypeSymlink for symlinks, TypeDir for directories, and empty for regular files.
+	Type string `json:"type,omitempty"`
+}
+
+// Change is a change of the file under a key made on the server. File is only set for puts.
+type Change struct {
+	Seq  uint64 `json:"seq"`
+	Op   string `json:"op"`
+	Key  string `json:"key"`
+	File *File  `json:"metadata,omitempty"`
+}
+
+type Changes struct {
+	Changes []Change `json:"changes"`
+	// Cursor is the cursor to get the next changes with.
+	Cursor string `json:"cursor"`
+	// HasMore reports whether there might be more changes to get right away.
+	HasMore bool `json:"has_more"`
 }
 
 type Client struct {
-	logger  *logrus.Logger
-	baseURL string
-	cli     *http.Client
+	logger    *logrus.Logger
+	baseURL   string
+	namespace string
+	cli       *http.Client
+	// streamCli is for the long-lived requests, and the ones whose response bodies are streamed to the caller, which
+	// have no timeout
+	streamCli *http.Client
+	// uploadEncoding is the content encoding uploads are compressed with in transit
+	uploadEncoding compression.Encoding
+	attribution    Attribution
+	// accessKeyID and secretKey sign the requests changing files, so the changes are attributed to the access key
+	accessKeyID string
+	secretKey   string
+
+	// linkUnsupported is set once the server tells us it doesn't store content-addressed objects
+	linkUnsupported atomic.Bool
+}
+
+type ClientOption func(c *Client)
+
+// WithUploadEncoding makes the client compress the content of uploads with the given encoding in transit. The server
+// verifies the checksum of the decompressed content, so presigned urls are generated the same way.
+func WithUploadEncoding(enc compression.Encoding) ClientOption {
+	return func(c *Client) {
+		c.uploadEncoding = enc
+	}
+}
+
+// Attribution identifies the client to the server, which records it along with every change the client makes, so
+// one can tell who changed a file and from where.
+type Attribution struct {
+	DeviceID string
+	Hostname string
+	User     string
+}
+
+// WithAttribution makes the client identify itself to the server as given. Deletions carry it in headers; uploads
+// must carry it in their presigned urls, see Client.Attribution.
+func WithAttribution(a Attribution) ClientOption {
+	return func(c *Client) {
+		c.attribution = a
+	}
+}
+
+// WithCredentials makes the client sign the requests changing files with the given access key, so the server
+// attributes the changes to it, as it does with uploads, whose presigned urls are signed with it.
+func WithCredentials(accessKeyID, secretKey string) ClientOption {
+	return func(c *Client) {
+		c.accessKeyID = accessKeyID
+		c.secretKey = secretKey
+	}
 }
 
-func NewClient(logger *logrus.Logger, baseURL string) (*Client, error) {
+// NewClient returns a Client for the server at baseURL. Every call made by the client is scoped to the given
+// namespace.
+func NewClient(logger *logrus.Logger, baseURL, namespace string, opts ...ClientOption) (*Client, error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse base url: %w", err)
 	}
 
-	return &Client{
-		logger:  logger,
-		baseURL: u.String(),
+	c := &Client{
+		logger:    logger,
+		baseURL:   u.String(),
+		namespace: namespace,
 		cli: &http.Client{
 			Timeout: 10 * time.Second,
 		},
-	}, nil
+		streamCli: &http.Client{},
+	}
+	for opt := range slices.Values(opts) {
+		opt(c)
+	}
+	return c, nil
 }
 
 func (c *Client) UploadURL() string {
@@ -47,8 +171,124 @@ func (c *Client) UploadURL() string {
 	return result
 }
 
-func (c *Client) Snapshot(ctx context.Context) (map[string]*File, error) {
-	u, err := url.JoinPath(c.baseURL, "v1/snapshot")
+func (c *Client) LinkURL() string {
+	result, _ := url.JoinPath(c.baseURL, "/v1/files/link")
+	return result
+}
+
+func (c *Client) DownloadURL() string {
+	result, _ := url.JoinPath(c.baseURL, "/v1/files/download")
+	return result
+}
+
+// Namespace returns the namespace the client is scoped to.
+func (c *Client) Namespace() string {
+	return c.namespace
+}
+
+// Attribution returns what the client identifies itself to the server as.
+func (c *Client) Attribution() Attribution {
+	return c.attribution
+}
+
+// setAttributionHeaders identifies the client on a request changing a file, and signs it with the client's access key
+// if it has one.
+func (c *Client) setAttributionHeaders(req *http.Request) {
+	for name, value := range map[string]string{
+		"X-Filesync-Device-Id": c.attribution.DeviceID,
+		"X-Filesync-Hostname":  c.attribution.Hostname,
+		"X-Filesync-User":      c.attribution.User,
+	} {
+		if value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	if c.accessKeyID != "" {
+		psurls.SignRequest(req, c.accessKeyID, c.secretKey)
+	}
+}
+
+// Snapshot streams the files stored on the server. It returns the cursor to get the changes made after the snapshot
+// with, and the files, which are decoded as they're iterated, so the snapshot is never held in memory as a whole. The
+// files must be iterated once, which releases the connection; the iteration ends with an error if the snapshot is cut
+// short.
+func (c *Client) Snapshot(ctx context.Context) (string, iter.Seq2[*File, error], error) {
+	u, err := c.endpointURL("v1/snapshot/stream")
+	if err != nil {
+		return "", nil, fmt.Errorf("create url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not create request: %w", err)
+	}
+
+	// a large snapshot can take longer to stream than any request timeout
+	resp, err := c.streamCli.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("http get snapshot: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		c.logger.WithField(
+			"resp", fmt.Sprintf("%q", string(body)),
+		).Error("Get snapshot failed with unexpected status code")
+		return "", nil, fmt.Errorf("http get snapshot failed: %s", resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	var header snapshotRecord
+	err = dec.Decode(&header)
+	if err != nil {
+		resp.Body.Close()
+		return "", nil, fmt.Errorf("json decode snapshot header: %w", err)
+	}
+
+	files := func(yield func(*File, error) bool) {
+		defer resp.Body.Close()
+
+		var count int
+		for {
+			var record snapshotRecord
+			err := dec.Decode(&record)
+			if err != nil {
+				yield(nil, fmt.Errorf("json decode snapshot record: %w", err))
+				return
+			}
+			if record.End {
+				if record.Count != count {
+					yield(nil, fmt.Errorf("snapshot has %d files, got %d", record.Count, count))
+				}
+				return
+			}
+			if record.File == nil {
+				continue
+			}
+			count++
+			if !yield(record.File, nil) {
+				return
+			}
+		}
+	}
+	return header.Cursor, files, nil
+}
+
+// snapshotRecord is a record of a streamed snapshot: the header with the cursor, a file, or the trailer.
+type snapshotRecord struct {
+	Cursor string `json:"cursor"`
+	File   *File  `json:"file"`
+	End    bool   `json:"end"`
+	Count  int    `json:"count"`
+}
+
+// Changes returns the changes made on the server after the given cursor, oldest first. It returns ErrCursorExpired if
+// the server doesn't keep all of them anymore.
+func (c *Client) Changes(ctx context.Context, since string) (*Changes, error) {
+	u, err := c.endpointURL("v1/changes")
+	if err != nil {
+		return nil, fmt.Errorf("create url: %w", err)
+	}
+	u, err = withQuery(u, url.Values{"since": {since}})
 	if err != nil {
 		return nil, fmt.Errorf("create url: %w", err)
 	}
@@ -57,58 +297,343 @@ func (c *Client) Snapshot(ctx context.Context) (map[string]*File, error) {
 		return nil, fmt.Errorf("could not create request: %w", err)
 	}
 
-	resp, err := c.doRequestWithRetry(req, "Snapshot")
+	resp, err := c.doRequestWithRetry(req, "Changes")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get snapshot with retrying: %w", err)
+		return nil, fmt.Errorf("failed to get changes with retrying: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return nil, ErrCursorExpired
+	default:
 		body, _ := io.ReadAll(resp.Body)
 		c.logger.WithField(
 			"resp", fmt.Sprintf("%q", string(body)),
-		).Error("Get snapshot failed with unexpected status code")
-		return nil, fmt.Errorf("http get snapshot failed: %s", resp.Status)
+		).Error("Get changes failed with unexpected status code")
+		return nil, fmt.Errorf("http get changes failed: %s", resp.Status)
+	}
+
+	var changes Changes
+	err = json.NewDecoder(resp.Body).Decode(&changes)
+	if err != nil {
+		return nil, fmt.Errorf("json decode response: %w", err)
 	}
 
-	type Response struct {
-		KeyToMetadata map[string]*File `json:"key_to_metadata"`
+	return &changes, nil
+}
+
+// File returns the server's file under the given key, nil if there's none.
+func (c *Client) File(ctx context.Context, key string) (*File, error) {
+	u, err := c.endpointURL("v1/files")
+	if err != nil {
+		return nil, fmt.Errorf("create url: %w", err)
+	}
+	// the key itself sorts first among the keys it's a prefix of
+	u, err = withQuery(u, url.Values{"prefix": {key}, "limit": {"1"}})
+	if err != nil {
+		return nil, fmt.Errorf("create url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
 	}
 
-	var response Response
-	err = json.NewDecoder(resp.Body).Decode(&response)
+	resp, err := c.doRequestWithRetry(req, "File")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files with retrying: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		c.logger.WithField(
+			"resp", fmt.Sprintf("%q", string(body)),
+		).Error("List files failed with unexpected status code")
+		return nil, fmt.Errorf("http list files failed: %s", resp.Status)
+	}
+
+	var page struct {
+		Files []*File `json:"files"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
 	if err != nil {
 		return nil, fmt.Errorf("json decode response: %w", err)
 	}
+	if len(page.Files) == 0 || page.Files[0].Key != key {
+		return nil, nil
+	}
+
+	return page.Files[0], nil
+}
+
+// TreeNodes returns the nodes of the server's hash tree under the given prefixes, along with the cursor to get the
+// changes made after the first of them were read with. Prefixes with no directory under them are left out. They're
+// asked for in as few requests as the server allows.
+func (c *Client) TreeNodes(ctx context.Context, prefixes []string) ([]*hashtree.Node, string, error) {
+	u, err := c.endpointURL("v1/tree")
+	if err != nil {
+		return nil, "", fmt.Errorf("create url: %w", err)
+	}
+
+	var nodes []*hashtree.Node
+	var cursor string
+	for batch := range slices.Chunk(prefixes, treePrefixesPerRequest) {
+		body, err := json.Marshal(map[string][]string{"prefixes": batch})
+		if err != nil {
+			return nil, "", fmt.Errorf("json encode request: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, "", fmt.Errorf("could not create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.doRequestWithRetry(req, "TreeNodes")
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get tree nodes with retrying: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			c.logger.WithField(
+				"resp", fmt.Sprintf("%q", string(body)),
+			).Error("Get tree nodes failed with unexpected status code")
+			return nil, "", fmt.Errorf("http get tree nodes failed: %s", resp.Status)
+		}
+
+		var treeNodes struct {
+			Nodes  []*hashtree.Node `json:"nodes"`
+			Cursor string           `json:"cursor"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&treeNodes)
+		resp.Body.Close()
+		if err != nil {
+			return nil, "", fmt.Errorf("json decode response: %w", err)
+		}
+		nodes = append(nodes, treeNodes.Nodes...)
+		if cursor == "" {
+			cursor = treeNodes.Cursor
+		}
+	}
+
+	return nodes, cursor, nil
+}
+
+// WatchChanges streams the changes made on the server after the given cursor, calling onChange with each of them,
+// and the cursor to resume after it with, as soon as they're made. It returns once the context is done, or with an
+// error if the stream breaks, or ErrCursorExpired if the server doesn't keep all the changes anymore.
+func (c *Client) WatchChanges(ctx context.Context, since string, onChange func(change Change, cursor string)) error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	u, err := c.endpointURL("v1/changes/watch")
+	if err != nil {
+		return fmt.Errorf("create url: %w", err)
+	}
+	u, err = withQuery(u, url.Values{"since": {since}})
+	if err != nil {
+		return fmt.Errorf("create url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.streamCli.Do(req)
+	if err != nil {
+		return fmt.Errorf("http watch changes: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return ErrCursorExpired
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		c.logger.WithField(
+			"resp", fmt.Sprintf("%q", string(body)),
+		).Error("Watch changes failed with unexpected status code")
+		return fmt.Errorf("http watch changes failed: %s", resp.Status)
+	}
+
+	// the server sends heartbeats on an idle stream; without them, the connection is gone
+	idle := time.AfterFunc(watchIdleTimeout, cancel)
+	defer idle.Stop()
+
+	var id, event string
+	var data []string
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		idle.Reset(watchIdleTimeout)
+		line := sc.Text()
+		if line == "" {
+			switch event {
+			case "expired":
+				return ErrCursorExpired
+			case "change":
+				var change Change
+				err = json.Unmarshal([]byte(strings.Join(data, "\n")), &change)
+				if err != nil {
+					return fmt.Errorf("json decode change: %w", err)
+				}
+				onChange(change, id)
+			}
+			event, data = "", nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// a heartbeat
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case streamCtx.Err() != nil:
+		return errors.New("change stream idle for too long")
+	case sc.Err() != nil:
+		return fmt.Errorf("read change stream: %w", sc.Err())
+	default:
+		return errors.New("change stream ended")
+	}
+}
+
+// Download returns the content of the file described by the presigned url, which the caller must close. It returns
+// ErrFileChanged if the file doesn't have the content the url commits to anymore.
+func (c *Client) Download(ctx context.Context, presignedURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, presignedURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create download request: %w", err)
+	}
+
+	// the content is read by the caller after we return, which the timeout of c.cli would cut short for large files
+	resp, err := c.retryRequest(c.streamCli, req, "Download")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download with retry: %w", err)
+	}
 
-	return response.KeyToMetadata, nil
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound, http.StatusPreconditionFailed:
+		resp.Body.Close()
+		return nil, ErrFileChanged
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.logger.WithField("resp", fmt.Sprintf("%q", string(body))).Error("Download failed with unexpected status code")
+		return nil, fmt.Errorf("http download failed: %s", resp.Status)
+	}
 }
 
-func (c *Client) Upload(ctx context.Context, r io.Reader, presignedURL string, size int64) error {
+// Upload uploads the content described by the presigned url and returns the version of the file it creates, 0 if the
+// server didn't tell. It returns ErrConflict if the url is conditioned on a version the file isn't at anymore.
+func (c *Client) Upload(ctx context.Context, r io.Reader, presignedURL string, size int64) (uint64, error) {
+	if c.uploadEncoding != compression.Identity {
+		rc := compression.Compress(r, c.uploadEncoding)
+		defer rc.Close()
+		r = rc
+	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodPut, presignedURL, r)
 	if err != nil {
-		return fmt.Errorf("could not create upload request: %w", err)
+		return 0, fmt.Errorf("could not create upload request: %w", err)
+	}
+	if c.uploadEncoding == compression.Identity {
+		req.ContentLength = size
+		req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	} else {
+		// the compressed size isn't known upfront, so the body is sent chunked
+		req.ContentLength = -1
+		req.Header.Set("Content-Encoding", string(c.uploadEncoding))
 	}
-	req.ContentLength = size
-	req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
 
 	resp, err := c.doRequestWithRetry(req, "Upload")
 	if err != nil {
-		return fmt.Errorf("failed to upload with retry: %w", err)
+		return 0, fmt.Errorf("failed to upload with retry: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return versionOf(resp), nil
+	case http.StatusPreconditionFailed:
+		return 0, ErrConflict
+	default:
 		body, _ := io.ReadAll(resp.Body)
 		c.logger.WithField("resp", fmt.Sprintf("%q", string(body))).Error("Upload failed with unexpected status code")
-		return fmt.Errorf("http upload failed: %s", resp.Status)
+		return 0, fmt.Errorf("http upload failed: %s", resp.Status)
 	}
+}
 
-	return nil
+// Link asks the server to create the object described by the presigned url from content it already stores, so the
+// content doesn't have to be uploaded again. It returns false if the content must be uploaded, and the version of the
+// file it creates otherwise, like Upload.
+func (c *Client) Link(ctx context.Context, presignedURL string) (bool, uint64, error) {
+	if c.linkUnsupported.Load() {
+		return false, 0, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, presignedURL, http.NoBody)
+	if err != nil {
+		return false, 0, fmt.Errorf("could not create link request: %w", err)
+	}
+
+	resp, err := c.doRequestWithRetry(req, "Link")
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to link with retry: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, versionOf(resp), nil
+	case http.StatusNotFound:
+		return false, 0, nil
+	case http.StatusPreconditionFailed:
+		return false, 0, ErrConflict
+	case http.StatusNotImplemented:
+		c.logger.Debug("Server does not support linking existing content, uploading files in full")
+		c.linkUnsupported.Store(true)
+		return false, 0, nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		c.logger.WithField("resp", fmt.Sprintf("%q", string(body))).Error("Link failed with unexpected status code")
+		return false, 0, fmt.Errorf("http link failed: %s", resp.Status)
+	}
+}
+
+// versionOf returns the version of the file the response has the entity tag of, 0 if it has none.
+func versionOf(resp *http.Response) uint64 {
+	etag, err := strconv.Unquote(resp.Header.Get("ETag"))
+	if err != nil {
+		return 0
+	}
+	version, err := strconv.ParseUint(etag, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return version
 }
 
-func (c *Client) Delete(ctx context.Context, fileKey string) error {
-	u, err := url.JoinPath(c.baseURL, "v1/files", url.PathEscape(fileKey))
+// Delete deletes the file under the given key. Given ifMatch, the file is only deleted if it's at that version, or if
+// there's none for version 0; it returns ErrConflict otherwise.
+func (c *Client) Delete(ctx context.Context, fileKey string, ifMatch *uint64) error {
+	u, err := c.endpointURL("v1/files", url.PathEscape(fileKey))
 	if err != nil {
 		return fmt.Errorf("create url: %w", err)
 	}
@@ -117,6 +642,10 @@ func (c *Client) Delete(ctx context.Context, fileKey string) error {
 	if err != nil {
 		return fmt.Errorf("could not create delete request: %w", err)
 	}
+	if ifMatch != nil {
+		req.Header.Set("If-Match", strconv.Quote(strconv.FormatUint(*ifMatch, 10)))
+	}
+	c.setAttributionHeaders(req)
 
 	resp, err := c.doRequestWithRetry(req, "Delete")
 	if err != nil {
@@ -124,6 +653,13 @@ func (c *Client) Delete(ctx context.Context, fileKey string) error {
 	}
 	defer resp.Body.Close()
 
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		// gone already, e.g. deleted by another device
+		return nil
+	case http.StatusPreconditionFailed:
+		return ErrConflict
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		c.logger.WithField(
@@ -135,10 +671,177 @@ func (c *Client) Delete(ctx context.Context, fileKey string) error {
 	return nil
 }
 
+// SetAttributes changes the attributes of the file under the given key, keeping its content, and returns the version
+// the file is at then. Given ifMatch, the attributes are only changed if the file is at that version; it returns
+// ErrConflict otherwise, or if there's no file anymore.
+func (c *Client) SetAttributes(ctx context.Context, fileKey string, attrs *fileattr.Attributes, ifMatch *uint64) (uint64, error) {
+	u, err := c.endpointURL("v1/files", url.PathEscape(fileKey), "attributes")
+	if err != nil {
+		return 0, fmt.Errorf("create url: %w", err)
+	}
+	body, err := json.Marshal(map[string]any{"attributes": attrs})
+	if err != nil {
+		return 0, fmt.Errorf("json encode request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("could not create set attributes request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ifMatch != nil {
+		req.Header.Set("If-Match", strconv.Quote(strconv.FormatUint(*ifMatch, 10)))
+	}
+	c.setAttributionHeaders(req)
+
+	resp, err := c.doRequestWithRetry(req, "SetAttributes")
+	if err != nil {
+		return 0, fmt.Errorf("failed to set attributes with retry: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusPreconditionFailed:
+		return 0, ErrConflict
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		c.logger.WithField(
+			"resp", fmt.Sprintf("%q", string(body)),
+		).Error("Set file attributes failed with unexpected status code")
+		return 0, fmt.Errorf("http set attributes failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Version uint64 `json:"version"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return 0, fmt.Errorf("json decode response: %w", err)
+	}
+	return result.Version, nil
+}
+
+// Device is what a device registers with the server as.
+type Device struct {
+	ID            string `json:"-"`
+	Name          string `json:"name"`
+	ClientVersion string `json:"client_version"`
+}
+
+// SyncReport is the sync state a device reports to the server.
+type SyncReport struct {
+	// Cursor is the cursor of the server changes synced so far.
+	Cursor        string   `json:"cursor"`
+	ClientVersion string   `json:"client_version"`
+	SyncRoot      SyncRoot `json:"sync_root"`
+}
+
+// SyncRoot summarizes the files of the synced directory.
+type SyncRoot struct {
+	Files    int64  `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	RootHash string `json:"root_hash,omitempty"`
+}
+
+// RegisterDevice registers the device syncing the client's namespace with the server, or updates its registration.
+func (c *Client) RegisterDevice(ctx context.Context, device Device) error {
+	_, err := c.sendDeviceRequest(ctx, http.MethodPut, device.ID, "RegisterDevice", device)
+	return err
+}
+
+// ReportSync reports the sync state of the given registered device. It returns ErrDeviceNotRegistered if the server
+// doesn't know the device.
+func (c *Client) ReportSync(ctx context.Context, deviceID string, report SyncReport) error {
+	status, err := c.sendDeviceRequest(ctx, http.MethodPost, deviceID, "ReportSync", report, "sync")
+	if status == http.StatusNotFound {
+		return ErrDeviceNotRegistered
+	}
+	return err
+}
+
+// sendDeviceRequest sends the given body to the endpoint of the given device, returning the status code responded
+// with.
+func (c *Client) sendDeviceRequest(ctx context.Context, httpMethod, deviceID, method string, reqBody any, elem ...string) (int, error) {
+	u, err := c.endpointURL(append([]string{"v1/devices", url.PathEscape(deviceID)}, elem...)...)
+	if err != nil {
+		return 0, fmt.Errorf("create url: %w", err)
+	}
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return 0, fmt.Errorf("json encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, httpMethod, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.doRequestWithRetry(req, method)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send device request with retrying: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, fmt.Errorf("http device request failed: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		c.logger.WithFields(logrus.Fields{
+			"method": method,
+			"resp":   fmt.Sprintf("%q", string(body)),
+		}).Error("Device request failed with unexpected status code")
+		return resp.StatusCode, fmt.Errorf("http device request failed: %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// endpointURL joins the given path elements to the base url and scopes the result to the client's namespace.
+func (c *Client) endpointURL(elem ...string) (string, error) {
+	u, err := url.JoinPath(c.baseURL, elem...)
+	if err != nil {
+		return "", err
+	}
+	if c.namespace == "" {
+		return u, nil
+	}
+
+	return fmt.Sprintf("%s?%s", u, url.Values{"namespace": {c.namespace}}.Encode()), nil
+}
+
+// withQuery adds the given values to the query of the given url.
+func withQuery(rawURL string, values url.Values) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for k, v := range values {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
 func (c *Client) doRequestWithRetry(req *http.Request, method string) (*http.Response, error) {
+	return c.retryRequest(c.cli, req, method)
+}
+
+// retryRequest makes the given request with the given http client, retrying it if it fails.
+func (c *Client) retryRequest(cli *http.Client, req *http.Request, method string) (*http.Response, error) {
 	bk := newExponentialBackoffConfig()
 	resp, err := backoff.RetryWithData[*http.Response](func() (*http.Response, error) {
-		resp, err := c.cli.Do(req)
+		if req.GetBody != nil {
+			// a retry must send the body again
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, backoff.Permanent(fmt.Errorf("could not rewind request body: %w", err))
+			}
+			req.Body = body
+		}
+		resp, err := cli.Do(req)
 		if err != nil {
 			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
 				return nil, backoff.Permanent(fmt.Errorf("could not make http call: %w", err))
@@ -0,0 +1,209 @@
+// Package conflict holds how the client resolves conflicts, i.e. files changed both locally and on the server since
+// they were last synced, and the log of the conflicts it resolved.
+package conflict
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strategy is how a conflict is resolved.
+type Strategy string
+
+const (
+	// KeepBoth keeps the local version as a conflict copy next to the file, which takes the server's version.
+	KeepBoth Strategy = "keep_both"
+	// LocalWins writes the local version over the server's.
+	LocalWins Strategy = "local_wins"
+	// RemoteWins writes the server's version over the local one.
+	RemoteWins Strategy = "remote_wins"
+	// NewestWins keeps the version modified last, by mtime. A version changed on one side wins over a deletion on the
+	// other, as a deletion has no mtime.
+	NewestWins Strategy = "newest_wins"
+)
+
+// DefaultStrategy loses neither version.
+const DefaultStrategy = KeepBoth
+
+var strategies = []Strategy{KeepBoth, LocalWins, RemoteWins, NewestWins}
+
+// ParseStrategy parses a Strategy.
+func ParseStrategy(s string) (Strategy, error) {
+	if !slices.Contains(strategies, Strategy(s)) {
+		return "", fmt.Errorf("unknown conflict strategy %q, must be one of %v", s, strategies)
+	}
+	return Strategy(s), nil
+}
+
+// Rule applies a strategy to the files matching a pattern.
+type Rule struct {
+	// Pattern is matched, as by path.Match, with the slash-separated path of a file relative to the sync root, or with
+	// its name alone if it has no slash, e.g. "*.docx" or "notes/*.md".
+	Pattern  string   `json:"pattern"`
+	Strategy Strategy `json:"strategy"`
+}
+
+// Policy decides the strategy of every file: the one of the first rule matching it, or the default one.
+type Policy struct {
+	Default Strategy `json:"default"`
+	Rules   []Rule   `json:"rules"`
+}
+
+// LoadPolicy loads a conflict policy from the given JSON file. A policy without a default strategy takes the given
+// one.
+func LoadPolicy(path string, defaultStrategy Strategy) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read conflict policy file: %w", err)
+	}
+
+	var p Policy
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal conflict policy: %w", err)
+	}
+	if p.Default == "" {
+		p.Default = defaultStrategy
+	}
+	err = p.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	_, err := ParseStrategy(string(p.Default))
+	if err != nil {
+		return err
+	}
+	for rule := range slices.Values(p.Rules) {
+		_, err = path.Match(rule.Pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", rule.Pattern, err)
+		}
+		_, err = ParseStrategy(string(rule.Strategy))
+		if err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// Strategy returns the strategy of the file at the given slash-separated path, relative to the sync root.
+func (p *Policy) Strategy(relPath string) Strategy {
+	for rule := range slices.Values(p.Rules) {
+		name := relPath
+		if !strings.Contains(rule.Pattern, "/") {
+			name = path.Base(relPath)
+		}
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule.Strategy
+		}
+	}
+	return p.Default
+}
+
+// CopyName returns the path the local version of the file at the given path is kept at by KeepBoth, e.g.
+// "notes (conflict from laptop 2024-06-01 150405).txt".
+func CopyName(filePath, device string, at time.Time) string {
+	ext := filepath.Ext(filePath)
+	base := strings.TrimSuffix(filePath, ext)
+	return fmt.Sprintf("%s (conflict from %s %s)%s", base, device, at.Local().Format("2006-01-02 150405"), ext)
+}
+
+// Record is a conflict resolved.
+type Record struct {
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	Strategy Strategy  `json:"strategy"`
+	// Resolution is what was done, e.g. "kept both".
+	Resolution string `json:"resolution"`
+	// LocalDeleted and RemoteDeleted tell whether the file had been deleted, rather than changed, on either side.
+	LocalDeleted  bool `json:"local_deleted,omitempty"`
+	RemoteDeleted bool `json:"remote_deleted,omitempty"`
+	// Copy is where the local version was kept, if it was.
+	Copy string `json:"copy,omitempty"`
+}
+
+// Log is an append-only log of the conflicts resolved, one JSON record per line. It's safe for concurrent use.
+type Log struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewLog returns the log kept in the given file, which is created on the first record along with its directory.
+func NewLog(path string) *Log {
+	return &Log{
+		path: path,
+	}
+}
+
+// Append appends the given record to the log.
+func (l *Log) Append(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal conflict record: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(l.path), 0755)
+	if err != nil {
+		return fmt.Errorf("create conflict log directory: %w", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open conflict log: %w", err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("write conflict log: %w", err)
+	}
+	return f.Close()
+}
+
+// ReadLog returns the records of the log kept in the given file, oldest first, none if there's no log yet.
+func ReadLog(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open conflict log: %w", err)
+	}
+	defer f.Close()
+
+	var records []Record
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var r Record
+		err = json.Unmarshal(sc.Bytes(), &r)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal conflict record: %w", err)
+		}
+		records = append(records, r)
+	}
+	err = sc.Err()
+	if err != nil {
+		return nil, fmt.Errorf("read conflict log: %w", err)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,137 @@
+package conflict_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/client/conflict"
+)
+
+func TestPolicyStrategy(t *testing.T) {
+	policy := &conflict.Policy{
+		Default: conflict.KeepBoth,
+		Rules: []conflict.Rule{
+			{Pattern: "notes/*.md", Strategy: conflict.LocalWins},
+			{Pattern: "*.md", Strategy: conflict.NewestWins},
+			{Pattern: "build/*", Strategy: conflict.RemoteWins},
+		},
+	}
+
+	tests := map[string]struct {
+		path string
+		want conflict.Strategy
+	}{
+		"first matching rule wins": {
+			path: "notes/todo.md",
+			want: conflict.LocalWins,
+		},
+		"pattern without a slash matches the name": {
+			path: "docs/guide/readme.md",
+			want: conflict.NewestWins,
+		},
+		"pattern with a slash matches the whole path": {
+			path: "build/out.bin",
+			want: conflict.RemoteWins,
+		},
+		"nested file doesn't match a single level pattern": {
+			path: "build/sub/out.bin",
+			want: conflict.KeepBoth,
+		},
+		"default": {
+			path: "report.docx",
+			want: conflict.KeepBoth,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, policy.Strategy(tc.path))
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		want    *conflict.Policy
+		wantErr bool
+	}{
+		"rules with the given default": {
+			content: `{"rules": [{"pattern": "*.docx", "strategy": "local_wins"}]}`,
+			want: &conflict.Policy{
+				Default: conflict.RemoteWins,
+				Rules:   []conflict.Rule{{Pattern: "*.docx", Strategy: conflict.LocalWins}},
+			},
+		},
+		"own default": {
+			content: `{"default": "newest_wins"}`,
+			want:    &conflict.Policy{Default: conflict.NewestWins},
+		},
+		"unknown strategy": {
+			content: `{"rules": [{"pattern": "*.docx", "strategy": "coin_flip"}]}`,
+			wantErr: true,
+		},
+		"invalid pattern": {
+			content: `{"rules": [{"pattern": "[", "strategy": "local_wins"}]}`,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.json")
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0644))
+
+			policy, err := conflict.LoadPolicy(path, conflict.RemoteWins)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, policy)
+		})
+	}
+}
+
+func TestCopyName(t *testing.T) {
+	at := time.Date(2024, 6, 1, 15, 4, 5, 0, time.Local)
+	assert.Equal(t, filepath.Join("docs", "notes (conflict from laptop 2024-06-01 150405).txt"), conflict.CopyName(filepath.Join("docs", "notes.txt"), "laptop", at))
+	assert.Equal(t, "Makefile (conflict from laptop 2024-06-01 150405)", conflict.CopyName("Makefile", "laptop", at))
+}
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filesync", "conflicts.log")
+	records, err := conflict.ReadLog(path)
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	want := []conflict.Record{
+		{
+			Time:       time.Date(2024, 6, 1, 15, 4, 5, 0, time.UTC),
+			Path:       "notes.txt",
+			Strategy:   conflict.KeepBoth,
+			Resolution: "kept both",
+			Copy:       "notes (conflict from laptop 2024-06-01 150405).txt",
+		},
+		{
+			Time:         time.Date(2024, 6, 2, 9, 0, 0, 0, time.UTC),
+			Path:         "todo.md",
+			Strategy:     conflict.LocalWins,
+			Resolution:   "kept local",
+			LocalDeleted: true,
+		},
+	}
+	log := conflict.NewLog(path)
+	for _, r := range want {
+		require.NoError(t, log.Append(r))
+	}
+
+	records, err = conflict.ReadLog(path)
+	require.NoError(t, err)
+	assert.Equal(t, want, records)
+}
@@ -0,0 +1,216 @@
+// Package e2e implements the client-side end-to-end encryption mode, where file content, and optionally file names,
+// are encrypted with keys derived from a passphrase before they leave the client, so the server only ever sees
+// ciphertext.
+//
+// Content is encrypted convergently: the key of a file is derived from a keyed MAC of its content, so the same
+// content always encrypts to the same ciphertext. That's what lets the client commit to the checksum and size of
+// the ciphertext in a presigned url before uploading it, and lets the server keep deduplicating content, while it
+// only reveals to the server which files have the same content, as the MAC used for change detection already does.
+//
+// Names are encrypted one path segment at a time with a deterministic, SIV-like construction, so a file always has
+// the same encrypted name, and the encrypted names of files in the same directory share a prefix.
+package e2e
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/hedisam/filesync/lib/streamcrypt"
+)
+
+const (
+	// Iterations is the PBKDF2 iteration count passphrases are stretched with.
+	Iterations = 600_000
+	// HeaderSize is the size of the header encrypted content starts with.
+	HeaderSize = len(magic) + sha256.Size
+
+	magic      = "FSC1"
+	keySize    = 32
+	nameIVSize = 16
+	saltPrefix = "filesync-e2e:"
+)
+
+var (
+	ErrInvalidContent = errors.New("invalid encrypted content")
+	ErrInvalidName    = errors.New("invalid encrypted name")
+)
+
+// Keys holds the keys derived from a passphrase.
+type Keys struct {
+	content []byte
+	mac     []byte
+	nameEnc cipher.Block
+	nameMAC []byte
+}
+
+// DeriveKeys derives the encryption keys from the given passphrase. The namespace is used as the salt: every client
+// syncing the same namespace with the same passphrase must derive the same keys, with no place to keep a random salt
+// that the server couldn't tamper with, so the passphrase must be strong enough on its own.
+func DeriveKeys(passphrase, namespace string) (*Keys, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase is required")
+	}
+	master, err := pbkdf2.Key(sha256.New, passphrase, []byte(saltPrefix+namespace), Iterations, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("derive master key: %w", err)
+	}
+
+	subkeys := make(map[string][]byte)
+	for info := range slices.Values([]string{"content", "mac", "name-enc", "name-mac"}) {
+		subkeys[info], err = hkdf.Expand(sha256.New, master, info, keySize)
+		if err != nil {
+			return nil, fmt.Errorf("derive %s key: %w", info, err)
+		}
+	}
+	nameEnc, err := aes.NewCipher(subkeys["name-enc"])
+	if err != nil {
+		return nil, fmt.Errorf("create name cipher: %w", err)
+	}
+
+	return &Keys{
+		content: subkeys["content"],
+		mac:     subkeys["mac"],
+		nameEnc: nameEnc,
+		nameMAC: subkeys["name-mac"],
+	}, nil
+}
+
+// NewMAC returns a hash computing the keyed MAC of file content. Its hex encoded sum is the content MAC.
+func (k *Keys) NewMAC() hash.Hash {
+	return hmac.New(sha256.New, k.mac)
+}
+
+// EncryptedSize returns the size of the encrypted content of a file of the given size.
+func (k *Keys) EncryptedSize(size int64) int64 {
+	return int64(HeaderSize) + streamcrypt.EncryptedSize(size, streamcrypt.DefaultChunkSize)
+}
+
+// Encrypt returns a WriteCloser encrypting the content written to it, whose MAC is the given one, to w. Close must be
+// called to write the end of the encrypted content; it doesn't close w.
+func (k *Keys) Encrypt(w io.Writer, contentMAC string) (io.WriteCloser, error) {
+	mac, err := hex.DecodeString(contentMAC)
+	if err != nil || len(mac) != sha256.Size {
+		return nil, fmt.Errorf("invalid content MAC %q", contentMAC)
+	}
+
+	_, err = w.Write(append([]byte(magic), mac...))
+	if err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+	return streamcrypt.NewDeterministicWriter(w, k.fileKey(mac), streamcrypt.DefaultChunkSize)
+}
+
+// EncryptReader returns a ReadCloser reading the encrypted content of r, whose MAC is the given one. Closing it stops
+// reading from r.
+func (k *Keys) EncryptReader(r io.Reader, contentMAC string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(func() error {
+			w, err := k.Encrypt(pw, contentMAC)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, r)
+			if err != nil {
+				return err
+			}
+			return w.Close()
+		}())
+	}()
+
+	return &encryptingReader{PipeReader: pr, done: done}
+}
+
+// Decrypt returns a Reader decrypting the encrypted content read from r. Reading fails with
+// streamcrypt.ErrInvalidStream if the content has been tampered with.
+func (k *Keys) Decrypt(r io.Reader) (io.Reader, error) {
+	header := make([]byte, HeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: read header: %w", ErrInvalidContent, err)
+	}
+	if !bytes.HasPrefix(header, []byte(magic)) {
+		return nil, fmt.Errorf("%w: not encrypted", ErrInvalidContent)
+	}
+	return streamcrypt.NewReader(r, k.fileKey(header[len(magic):]))
+}
+
+// fileKey returns the key of the file content with the given MAC.
+func (k *Keys) fileKey(contentMAC []byte) []byte {
+	h := hmac.New(sha256.New, k.content)
+	h.Write(contentMAC)
+	return h.Sum(nil)
+}
+
+// EncryptName encrypts every segment of the given slash separated path.
+func (k *Keys) EncryptName(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		iv := k.nameIV(segment)
+		out := make([]byte, nameIVSize+len(segment))
+		copy(out, iv)
+		cipher.NewCTR(k.nameEnc, iv).XORKeyStream(out[nameIVSize:], []byte(segment))
+		segments[i] = base64.RawURLEncoding.EncodeToString(out)
+	}
+	return strings.Join(segments, "/")
+}
+
+// DecryptName decrypts a path encrypted by EncryptName. It fails with ErrInvalidName if any segment wasn't
+// encrypted with these keys.
+func (k *Keys) DecryptName(name string) (string, error) {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		data, err := base64.RawURLEncoding.DecodeString(segment)
+		if err != nil || len(data) <= nameIVSize {
+			return "", fmt.Errorf("%w: %q", ErrInvalidName, name)
+		}
+		iv, ciphertext := data[:nameIVSize], data[nameIVSize:]
+		plaintext := make([]byte, len(ciphertext))
+		cipher.NewCTR(k.nameEnc, iv).XORKeyStream(plaintext, ciphertext)
+		if !hmac.Equal(iv, k.nameIV(string(plaintext))) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidName, name)
+		}
+		segments[i] = string(plaintext)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// nameIV returns the synthetic IV of a name segment, which doubles as its authentication tag.
+func (k *Keys) nameIV(segment string) []byte {
+	h := hmac.New(sha256.New, k.nameMAC)
+	h.Write([]byte(segment))
+	return h.Sum(nil)[:nameIVSize]
+}
+
+type encryptingReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close stops the encryption and waits for it to return, so the source isn't read anymore.
+func (r *encryptingReader) Close() error {
+	err := r.PipeReader.Close()
+	<-r.done
+	return err
+}
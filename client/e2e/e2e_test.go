@@ -0,0 +1,129 @@
+package e2e_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/client/e2e"
+	"github.com/hedisam/filesync/lib/streamcrypt"
+)
+
+func contentMAC(keys *e2e.Keys, content []byte) string {
+	mac := keys.NewMAC()
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func encrypt(t *testing.T, keys *e2e.Keys, content []byte) []byte {
+	t.Helper()
+	rc := keys.EncryptReader(bytes.NewReader(content), contentMAC(keys, content))
+	defer rc.Close()
+	encrypted, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return encrypted
+}
+
+func TestContentEncryption(t *testing.T) {
+	keys, err := e2e.DeriveKeys("correct horse battery staple", "default")
+	require.NoError(t, err)
+	// another device syncing the same namespace with the same passphrase
+	sameKeys, err := e2e.DeriveKeys("correct horse battery staple", "default")
+	require.NoError(t, err)
+	otherKeys, err := e2e.DeriveKeys("correct horse battery staple", "other-namespace")
+	require.NoError(t, err)
+
+	content := make([]byte, 2*streamcrypt.DefaultChunkSize+3)
+	_, _ = rand.Read(content)
+	plainSum := sha256.Sum256(content)
+
+	encrypted := encrypt(t, keys, content)
+	assert.EqualValues(t, keys.EncryptedSize(int64(len(content))), len(encrypted))
+	assert.False(t, bytes.Contains(encrypted, content[:64]))
+	assert.False(t, bytes.Contains(encrypted, plainSum[:]), "the plaintext checksum must not be revealed")
+	assert.Equal(t, encrypted, encrypt(t, sameKeys, content), "encryption must be deterministic")
+	assert.Equal(t, contentMAC(keys, content), contentMAC(sameKeys, content))
+	assert.NotEqual(t, contentMAC(keys, content), contentMAC(otherKeys, content))
+
+	r, err := sameKeys.Decrypt(bytes.NewReader(encrypted))
+	require.NoError(t, err)
+	decrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(content, decrypted))
+
+	r, err = otherKeys.Decrypt(bytes.NewReader(encrypted))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, streamcrypt.ErrInvalidStream)
+
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-1] ^= 1
+	r, err = keys.Decrypt(bytes.NewReader(tampered))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, streamcrypt.ErrInvalidStream)
+
+	_, err = keys.Decrypt(bytes.NewReader([]byte("plaintext content")))
+	assert.ErrorIs(t, err, e2e.ErrInvalidContent)
+}
+
+func TestEncryptReaderClose(t *testing.T) {
+	keys, err := e2e.DeriveKeys("passphrase", "default")
+	require.NoError(t, err)
+
+	content := make([]byte, 4*streamcrypt.DefaultChunkSize)
+	rc := keys.EncryptReader(bytes.NewReader(content), contentMAC(keys, content))
+	_, err = rc.Read(make([]byte, 10))
+	require.NoError(t, err)
+	// must not block on the pending encryption
+	require.NoError(t, rc.Close())
+
+	rc = keys.EncryptReader(bytes.NewReader(content), "not a mac")
+	_, err = io.ReadAll(rc)
+	assert.ErrorContains(t, err, "invalid content MAC")
+}
+
+func TestNameEncryption(t *testing.T) {
+	keys, err := e2e.DeriveKeys("passphrase", "default")
+	require.NoError(t, err)
+	otherKeys, err := e2e.DeriveKeys("another passphrase", "default")
+	require.NoError(t, err)
+
+	tests := []string{
+		"file.txt",
+		"/home/user/docs/report.pdf",
+		"dir/with//double/slash",
+		"unicode/ファイル.txt",
+	}
+
+	for name := range slices.Values(tests) {
+		t.Run(name, func(t *testing.T) {
+			encrypted := keys.EncryptName(name)
+			assert.NotContains(t, encrypted, "report")
+			assert.NotContains(t, encrypted, "file")
+			assert.Equal(t, encrypted, keys.EncryptName(name), "name encryption must be deterministic")
+
+			decrypted, err := keys.DecryptName(encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, name, decrypted)
+
+			_, err = otherKeys.DecryptName(encrypted)
+			assert.ErrorIs(t, err, e2e.ErrInvalidName)
+		})
+	}
+
+	// files in the same directory share the encrypted directory prefix
+	a, b := keys.EncryptName("/docs/a.txt"), keys.EncryptName("/docs/b.txt")
+	assert.Equal(t, path.Dir(a), path.Dir(b))
+
+	_, err = keys.DecryptName("/home/plain.txt")
+	assert.ErrorIs(t, err, e2e.ErrInvalidName)
+}
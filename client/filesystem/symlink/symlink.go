@@ -0,0 +1,202 @@
+// Package symlink decides how the symlinks under the sync root are synced.
+package symlink
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Policy is how symlinks are synced. The zero Policy is Ignore.
+type Policy string
+
+const (
+	// Ignore leaves symlinks out of the sync.
+	Ignore Policy = "ignore"
+	// Store syncs symlinks as such, with their target as content, so they're recreated on the other devices.
+	Store Policy = "store"
+	// Follow syncs what symlinks point to as if it were under the symlinks' paths, for the symlinks to files and
+	// directories under the sync root. The others, and the ones leading back to their own directories, are ignored.
+	Follow Policy = "follow"
+)
+
+var (
+	// ErrOutsideRoot is returned for a symlink pointing outside the sync root, which isn't followed.
+	ErrOutsideRoot = errors.New("symlink points outside the sync root")
+	// ErrCycle is returned for a symlink pointing to one of the directories it's in, which isn't followed.
+	ErrCycle = errors.New("symlink points to one of its parent directories")
+)
+
+// ParsePolicy returns the Policy of the given name, Ignore for an empty one.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case "":
+		return Ignore, nil
+	case Ignore, Store, Follow:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown symlink policy %q", name)
+	}
+}
+
+// Resolve returns the real path of what the symlink at the given path points to, for following it, along with its
+// file info. It returns ErrOutsideRoot if it isn't under the given root, and ErrCycle if it's a directory the symlink
+// is in, through other symlinks or not, which would be walked endlessly.
+func Resolve(root, path string) (string, fs.FileInfo, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", nil, fmt.Errorf("resolve root: %w", err)
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("resolve symlink: %w", err)
+	}
+	if !inside(realRoot, target) {
+		return "", nil, ErrOutsideRoot
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", nil, fmt.Errorf("stat symlink target: %w", err)
+	}
+	if !info.IsDir() {
+		return target, info, nil
+	}
+
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if realDir, err := filepath.EvalSymlinks(dir); err == nil && realDir == target {
+			return "", nil, ErrCycle
+		}
+		if !inside(root, dir) || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return target, info, nil
+}
+
+// Target returns the target of the symlink at the given path as it's stored, so it points to the same file on every
+// device: with slashes as separators, and relative to the symlink's directory if it's an absolute path under the
+// given root, whose path differs across devices. Targets outside the root are kept as they are.
+func Target(root, path string) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(target) {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return "", fmt.Errorf("resolve root: %w", err)
+		}
+		absDir, err := filepath.Abs(filepath.Dir(path))
+		if err != nil {
+			return "", fmt.Errorf("resolve symlink directory: %w", err)
+		}
+		if inside(absRoot, target) {
+			target, err = filepath.Rel(absDir, target)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return filepath.ToSlash(target), nil
+}
+
+// Create makes a symlink at the given path to the given target, as stored, replacing whatever is there atomically. The
+// temporary symlink is named so the walker and the watcher ignore it.
+func Create(path, target string) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	// reserve a unique name for the temporary symlink
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*~")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	err = os.Remove(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	err = os.Symlink(filepath.FromSlash(target), tmp.Name())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// CheckTarget returns ErrOutsideRoot unless the given target, as stored, of a symlink at the given path points under
+// the given root, through other symlinks or not, so nothing can be written outside the root through a downloaded
+// symlink. Absolute targets are refused, as Target only keeps the ones outside the root absolute.
+func CheckTarget(root, path, target string) error {
+	target = filepath.FromSlash(target)
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return ErrOutsideRoot
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return fmt.Errorf("resolve root: %w", err)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("resolve symlink path: %w", err)
+	}
+	resolved := filepath.Join(filepath.Dir(absPath), target)
+	if !inside(absRoot, resolved) {
+		return ErrOutsideRoot
+	}
+	return checkResolved(root, resolved)
+}
+
+// CheckParents returns ErrOutsideRoot if the directory the given path is in isn't under the given root once symlinks
+// are resolved, so nothing is written to or removed from outside the root through a symlinked directory. The path
+// itself isn't resolved, as it's replaced or removed rather than followed.
+func CheckParents(root, path string) error {
+	return checkResolved(root, filepath.Dir(path))
+}
+
+// checkResolved returns ErrOutsideRoot if the given path, or the nearest of its parents that exists if it doesn't, isn't
+// under the given root once symlinks are resolved.
+func checkResolved(root, path string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("resolve root: %w", err)
+	}
+	for {
+		realPath, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			if !inside(realRoot, realPath) {
+				return ErrOutsideRoot
+			}
+			return nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("resolve path: %w", err)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return nil
+		}
+		path = parent
+	}
+}
+
+// IsSymlink reports whether the file at the given path is a symlink.
+func IsSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&fs.ModeSymlink != 0
+}
+
+// inside reports whether the given path is the given directory or under it.
+func inside(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
@@ -0,0 +1,162 @@
+package symlink_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/client/filesystem/symlink"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for name, want := range map[string]symlink.Policy{"": symlink.Ignore, "store": symlink.Store, "follow": symlink.Follow} {
+		got, err := symlink.ParsePolicy(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := symlink.ParsePolicy("copy")
+	assert.Error(t, err)
+}
+
+func TestResolve(t *testing.T) {
+	outside := t.TempDir()
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a", "b"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "c"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "file.txt"), []byte("content"), 0644))
+	links := map[string]string{
+		"a/file":    "../file.txt",
+		"a/sibling": filepath.Join(root, "c"),
+		"a/b/loop":  "..",
+		"a/self":    ".",
+		"c/cross":   "../a/sibling",
+		"escape":    outside,
+		"dangling":  "missing.txt",
+	}
+	for link, target := range links {
+		require.NoError(t, os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))))
+	}
+
+	tests := map[string]struct {
+		link    string
+		wantDir bool
+		wantErr error
+	}{
+		"file":                 {link: "a/file"},
+		"directory":            {link: "a/sibling", wantDir: true},
+		"parent directory":     {link: "a/b/loop", wantErr: symlink.ErrCycle},
+		"own directory":        {link: "a/self", wantErr: symlink.ErrCycle},
+		"through another link": {link: "a/sibling/cross", wantErr: symlink.ErrCycle},
+		"outside the root":     {link: "escape", wantErr: symlink.ErrOutsideRoot},
+		"pointing to nothing":  {link: "dangling", wantErr: os.ErrNotExist},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, info, err := symlink.Resolve(root, filepath.Join(root, filepath.FromSlash(tc.link)))
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantDir, info.IsDir())
+		})
+	}
+}
+
+func TestTarget(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a"), 0755))
+
+	tests := map[string]struct {
+		target string
+		want   string
+	}{
+		"relative":              {target: filepath.Join("..", "b", "file.txt"), want: "../b/file.txt"},
+		"absolute under root":   {target: filepath.Join(root, "b", "file.txt"), want: "../b/file.txt"},
+		"absolute outside root": {target: filepath.Join(filepath.Dir(root), "file.txt"), want: filepath.ToSlash(filepath.Join(filepath.Dir(root), "file.txt"))},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			link := filepath.Join(root, "a", "link")
+			require.NoError(t, os.Symlink(tc.target, link))
+			t.Cleanup(func() { _ = os.Remove(link) })
+
+			got, err := symlink.Target(root, link)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a"), 0755))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "away")))
+
+	tests := map[string]struct {
+		target  string
+		wantErr error
+	}{
+		"under root":              {target: "../b/file.txt"},
+		"root":                    {target: ".."},
+		"outside root":            {target: "../../etc", wantErr: symlink.ErrOutsideRoot},
+		"absolute":                {target: filepath.ToSlash(filepath.Join(root, "b")), wantErr: symlink.ErrOutsideRoot},
+		"through symlink outside": {target: "../away/file.txt", wantErr: symlink.ErrOutsideRoot},
+		"missing under root":      {target: "../missing/file.txt"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := symlink.CheckTarget(root, filepath.Join(root, "a", "link"), tc.target)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCheckParents(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a"), 0755))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "away")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "a", "link")))
+
+	assert.NoError(t, symlink.CheckParents(root, filepath.Join(root, "a", "file.txt")))
+	assert.NoError(t, symlink.CheckParents(root, filepath.Join(root, "a", "missing", "file.txt")))
+	assert.NoError(t, symlink.CheckParents(root, filepath.Join(root, "a", "link")), "the symlink itself isn't followed")
+	assert.ErrorIs(t, symlink.CheckParents(root, filepath.Join(root, "away", "file.txt")), symlink.ErrOutsideRoot)
+	assert.ErrorIs(t, symlink.CheckParents(root, filepath.Join(root, "away", "missing", "file.txt")), symlink.ErrOutsideRoot)
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "link")
+
+	require.NoError(t, symlink.Create(path, "../file.txt"))
+	target, err := os.Readlink(path)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("..", "file.txt"), target)
+
+	// replaces a regular file, and another symlink
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.WriteFile(path, []byte("content"), 0644))
+	require.NoError(t, symlink.Create(path, "other.txt"))
+	require.NoError(t, symlink.Create(path, "file.txt"))
+	target, err = os.Readlink(path)
+	require.NoError(t, err)
+	assert.Equal(t, "file.txt", target)
+	assert.True(t, symlink.IsSymlink(path))
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "no temporary symlinks must be left behind")
+}
@@ -6,12 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/hedisam/filesync/client/filesystem/symlink"
 	"github.com/hedisam/filesync/client/ops"
 	"github.com/hedisam/filesync/lib/wal"
 	"github.com/hedisam/pipeline/chans"
@@ -22,12 +24,14 @@ type Watcher interface {
 }
 
 // Walk walks through the given directory recursively performing the following actions:
-//  1. Add every non-hidden directory to the filesystem watcher
+//  1. Add every non-hidden directory to the filesystem watcher, and to the indexer but for the root itself.
 //  2. Add every non-hidden regular file to the indexer.
-//  3. Increment the watcher's stage by one so we know fs change events with the next stage number have not happened
+//  3. Handle symlinks as the given policy says: add them to the indexer as they are, follow them as if what they
+//     point to were under their paths, or skip them.
+//  4. Increment the watcher's stage by one so we know fs change events with the next stage number have not happened
 //
 // during this recursive Walk.
-func Walk(ctx context.Context, log *logrus.Logger, rootDir string, watcher Watcher, w *wal.WAL) <-chan error {
+func Walk(ctx context.Context, log *logrus.Logger, rootDir string, symlinks symlink.Policy, watcher Watcher, w *wal.WAL) <-chan error {
 	logger := log.WithField("root_dir", rootDir)
 	logger.Info("Walking directory")
 
@@ -36,7 +40,8 @@ func Walk(ctx context.Context, log *logrus.Logger, rootDir string, watcher Watch
 	go func() {
 		defer close(errorCh)
 
-		err := filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+		var visit fs.WalkDirFunc
+		visit = func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
@@ -60,11 +65,34 @@ func Walk(ctx context.Context, log *logrus.Logger, rootDir string, watcher Watch
 				if err != nil {
 					return fmt.Errorf("add dir to watcher: %w", err)
 				}
-				return nil
-			}
-
-			if !d.Type().IsRegular() {
-				// skip irregular files e.g. symlinks
+				if path == rootDir {
+					return nil
+				}
+				// indexed too, so empty directories are synced
+			} else if d.Type()&fs.ModeSymlink != 0 {
+				switch symlinks {
+				case symlink.Store:
+					// indexed with its target as content
+				case symlink.Follow:
+					_, info, err := symlink.Resolve(rootDir, path)
+					if err != nil {
+						logger.WithError(err).WithField("path", path).Warn("Not following symlink")
+						return nil
+					}
+					if info.IsDir() {
+						// walked as if the directory were under the symlink's path
+						return fs.WalkDir(os.DirFS(path), ".", func(name string, d fs.DirEntry, err error) error {
+							return visit(filepath.Join(path, filepath.FromSlash(name)), d, err)
+						})
+					}
+					if !info.Mode().IsRegular() {
+						return nil
+					}
+				default:
+					return nil
+				}
+			} else if !d.Type().IsRegular() {
+				// skip irregular files e.g. devices and sockets
 				return nil
 			}
 
@@ -85,7 +113,8 @@ func Walk(ctx context.Context, log *logrus.Logger, rootDir string, watcher Watch
 			logger.WithField("path", path).Debug("File picked up by Walker")
 
 			return nil
-		})
+		}
+		err := filepath.WalkDir(rootDir, visit)
 		if err != nil && !errors.Is(err, context.Canceled) {
 			chans.SendOrDone(ctx, errorCh, fmt.Errorf("error occurred while walking directory: %w", err))
 		}
@@ -1,124 +1,189 @@
 package filesystem_test
 
-//
-//import (
-//	"context"
-//	"os"
-//	"path/filepath"
-//	"testing"
-//
-//	"github.com/sirupsen/logrus"
-//	"github.com/stretchr/testify/assert"
-//	"github.com/stretchr/testify/require"
-//
-//	"github.com/hedisam/filesync/client/filesystem"
-//	"github.com/hedisam/filesync/client/filesystem/mocks"
-//	"github.com/hedisam/filesync/client/index"
-//)
-//
-////go:generate moq -out mocks/watcher.go -pkg mocks -skip-ensure . Watcher
-//
-//func TestWalk(t *testing.T) {
-//	t.Parallel()
-//
-//	cases := map[string]struct {
-//		existingDirs         []string
-//		existingFiles        []string
-//		existingSymlinks     map[string]string
-//		expectedWatchedDirs  []string
-//		expectedIndexedFiles []string
-//	}{
-//		"empty": {
-//			existingDirs:         []string{},
-//			existingFiles:        []string{},
-//			existingSymlinks:     nil,
-//			expectedWatchedDirs:  []string{"."},
-//			expectedIndexedFiles: []string{},
-//		},
-//		"single file": {
-//			existingDirs:         []string{},
-//			existingFiles:        []string{"file1.txt"},
-//			existingSymlinks:     nil,
-//			expectedWatchedDirs:  []string{"."},
-//			expectedIndexedFiles: []string{"file1.txt"},
-//		},
-//		"nested structure": {
-//			existingDirs:         []string{"a", "a/b"},
-//			existingFiles:        []string{"a/b/c.txt"},
-//			existingSymlinks:     nil,
-//			expectedWatchedDirs:  []string{".", "a", "a/b"},
-//			expectedIndexedFiles: []string{"a/b/c.txt"},
-//		},
-//		"skip hidden and temp": {
-//			existingDirs:         []string{},
-//			existingFiles:        []string{".hidden", "temp~", "visible.txt"},
-//			existingSymlinks:     nil,
-//			expectedWatchedDirs:  []string{"."},
-//			expectedIndexedFiles: []string{"visible.txt"},
-//		},
-//		"skip symlinks": {
-//			existingDirs:         []string{},
-//			existingFiles:        []string{"real.txt"},
-//			existingSymlinks:     map[string]string{"link": "real.txt"},
-//			expectedWatchedDirs:  []string{"."},
-//			expectedIndexedFiles: []string{"real.txt"},
-//		},
-//	}
-//
-//	for name, tc := range cases {
-//		t.Run(name, func(t *testing.T) {
-//			t.Parallel()
-//
-//			root, err := os.MkdirTemp("", "walker_test")
-//			require.NoError(t, err)
-//			t.Cleanup(func() {
-//				_ = os.RemoveAll(root)
-//			})
-//
-//			for _, d := range tc.existingDirs {
-//				path := filepath.Join(root, d)
-//				err := os.MkdirAll(path, 0755)
-//				require.NoError(t, err)
-//			}
-//
-//			for _, f := range tc.existingFiles {
-//				path := filepath.Join(root, f)
-//				err := os.WriteFile(path, []byte("data"), 0644)
-//				require.NoError(t, err)
-//			}
-//
-//			for link, target := range tc.existingSymlinks {
-//				linkPath := filepath.Join(root, link)
-//				targetPath := filepath.Join(root, target)
-//				err := os.Symlink(targetPath, linkPath)
-//				require.NoError(t, err)
-//			}
-//
-//			watcherMock := &mocks.WatcherMock{
-//				AddFunc: func(dirPath string) error {
-//					rel, err := filepath.Rel(root, dirPath)
-//					require.NoError(t, err)
-//					assert.Contains(t, tc.expectedWatchedDirs, rel)
-//					return nil
-//				},
-//				IncStageNumFunc: func() {},
-//			}
-//
-//			indexerMock := &mocks.FileIndexerMock{
-//				IndexFunc: func(_ context.Context, md *indexer.FileMetadata) error {
-//					rel, err := filepath.Rel(root, md.Path)
-//					require.NoError(t, err)
-//					assert.Contains(t, tc.expectedIndexedFiles, rel)
-//					return nil
-//				},
-//			}
-//			logger := logrus.New()
-//			err = filesystem.Walk(context.Background(), logger, root, watcherMock, indexerMock)
-//			require.NoError(t, err)
-//
-//			assert.Equal(t, len(tc.expectedWatchedDirs), len(watcherMock.AddCalls()))
-//			assert.Equal(t, len(tc.expectedIndexedFiles), len(indexerMock.IndexCalls()))
-//			assert.Equal(t, 1, len(watcherMock.IncStageNumCalls()))
-//		})
-//	}
-//}
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/client/filesystem"
+	"github.com/hedisam/filesync/client/filesystem/mocks"
+	"github.com/hedisam/filesync/client/filesystem/symlink"
+	"github.com/hedisam/filesync/client/index"
+	"github.com/hedisam/filesync/client/ops"
+	"github.com/hedisam/filesync/lib/wal"
+)
+
+//go:generate moq -out mocks/watcher.go -pkg mocks -skip-ensure . Watcher
+
+func TestWalk(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		existingDirs  []string
+		existingFiles []string
+		// existingSymlinks are the symlinks by their paths, to their targets. The root has a sibling directory named
+		// outside with a file.txt in it to point to.
+		existingSymlinks    map[string]string
+		symlinks            symlink.Policy
+		expectedWatchedDirs []string
+		// expectedIndexed are the indexed paths, and whether they're directories
+		expectedIndexed map[string]bool
+		// expectedLinkTargets are the targets the symlinks stored as such are indexed with
+		expectedLinkTargets map[string]string
+	}{
+		"empty": {
+			expectedWatchedDirs: []string{"."},
+			expectedIndexed:     map[string]bool{},
+		},
+		"single file": {
+			existingFiles:       []string{"file1.txt"},
+			expectedWatchedDirs: []string{"."},
+			expectedIndexed:     map[string]bool{"file1.txt": false},
+		},
+		"nested structure": {
+			existingDirs:        []string{"a", "a/b"},
+			existingFiles:       []string{"a/b/c.txt"},
+			expectedWatchedDirs: []string{".", "a", "a/b"},
+			expectedIndexed:     map[string]bool{"a": true, "a/b": true, "a/b/c.txt": false},
+		},
+		"empty directory": {
+			existingDirs:        []string{"empty"},
+			expectedWatchedDirs: []string{".", "empty"},
+			expectedIndexed:     map[string]bool{"empty": true},
+		},
+		"skip hidden and temp": {
+			existingDirs:        []string{".git", ".git/objects"},
+			existingFiles:       []string{".hidden", "temp~", "visible.txt", ".git/HEAD"},
+			expectedWatchedDirs: []string{"."},
+			expectedIndexed:     map[string]bool{"visible.txt": false},
+		},
+		"ignore symlinks": {
+			existingDirs:        []string{"dir"},
+			existingFiles:       []string{"real.txt"},
+			existingSymlinks:    map[string]string{"link": "real.txt", "dirlink": "dir"},
+			symlinks:            symlink.Ignore,
+			expectedWatchedDirs: []string{".", "dir"},
+			expectedIndexed:     map[string]bool{"dir": true, "real.txt": false},
+		},
+		"store symlinks": {
+			existingDirs:        []string{"dir"},
+			existingFiles:       []string{"real.txt"},
+			existingSymlinks:    map[string]string{"link": "real.txt", "dir/up": "../real.txt", "out": "../outside/file.txt"},
+			symlinks:            symlink.Store,
+			expectedWatchedDirs: []string{".", "dir"},
+			expectedIndexed:     map[string]bool{"dir": true, "dir/up": false, "link": false, "out": false, "real.txt": false},
+			expectedLinkTargets: map[string]string{"link": "real.txt", "dir/up": "../real.txt", "out": "../outside/file.txt"},
+		},
+		"follow symlinks": {
+			existingDirs:  []string{"dir", "dir/sub"},
+			existingFiles: []string{"real.txt", "dir/sub/file.txt"},
+			existingSymlinks: map[string]string{
+				"link":     "real.txt",
+				"dirlink":  "dir",
+				"dir/loop": "..",
+				"out":      "../outside",
+				"outfile":  "../outside/file.txt",
+			},
+			symlinks: symlink.Follow,
+			// what the directory symlink points to is walked as if it were under its path, the loop back to the root
+			// isn't followed, and neither are the symlinks outside the root
+			expectedWatchedDirs: []string{".", "dir", "dir/sub", "dirlink", "dirlink/sub"},
+			expectedIndexed: map[string]bool{
+				"dir": true, "dir/sub": true, "dir/sub/file.txt": false,
+				"dirlink": true, "dirlink/sub": true, "dirlink/sub/file.txt": false,
+				"link": false, "real.txt": false,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := filepath.Join(t.TempDir(), "root")
+			outside := filepath.Join(filepath.Dir(root), "outside")
+			require.NoError(t, os.MkdirAll(outside, 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(outside, "file.txt"), []byte("secret"), 0644))
+			require.NoError(t, os.Mkdir(root, 0755))
+			for d := range slices.Values(tc.existingDirs) {
+				require.NoError(t, os.MkdirAll(filepath.Join(root, filepath.FromSlash(d)), 0755))
+			}
+			for f := range slices.Values(tc.existingFiles) {
+				require.NoError(t, os.WriteFile(filepath.Join(root, filepath.FromSlash(f)), []byte("data"), 0644))
+			}
+
+			for link, target := range tc.existingSymlinks {
+				require.NoError(t, os.Symlink(filepath.FromSlash(target), filepath.Join(root, filepath.FromSlash(link))))
+			}
+
+			watched, indexed := walk(t, root, tc.symlinks)
+			assert.ElementsMatch(t, tc.expectedWatchedDirs, watched)
+			got := make(map[string]bool, len(indexed))
+			var linkTargets map[string]string
+			for path, md := range indexed {
+				got[path] = md.Dir
+				if md.LinkTarget != "" {
+					if linkTargets == nil {
+						linkTargets = make(map[string]string)
+					}
+					linkTargets[path] = md.LinkTarget
+				}
+			}
+			assert.Equal(t, tc.expectedIndexed, got)
+			assert.Equal(t, tc.expectedLinkTargets, linkTargets)
+		})
+	}
+}
+
+// walk walks the given root with the given symlink policy, returning the directories added to the watcher and the
+// metadata the index extracts from the files walked, by their paths relative to the root.
+func walk(t *testing.T, root string, symlinks symlink.Policy) ([]string, map[string]*index.FileMetadata) {
+	t.Helper()
+
+	var watched []string
+	watcherMock := &mocks.WatcherMock{
+		AddFunc: func(dirPath string) error {
+			watched = append(watched, rel(t, root, dirPath))
+			return nil
+		},
+	}
+	walPath := filepath.Join(t.TempDir(), "wal")
+	w, err := wal.New(logrus.New(), walPath)
+	require.NoError(t, err)
+	t.Cleanup(w.Close)
+
+	for err := range filesystem.Walk(context.Background(), logrus.New(), root, symlinks, watcherMock, w) {
+		require.NoError(t, err)
+	}
+
+	data, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	extract := index.New(logrus.New(), 0, index.WithSymlinks(symlinks, root)).MetadataExtractorProcessor()
+	indexed := make(map[string]*index.FileMetadata)
+	for line := range bytes.Lines(data) {
+		var op ops.FileOp
+		require.NoError(t, json.Unmarshal(line, &op))
+		out, drop, err := extract(context.Background(), &op)
+		require.NoError(t, err)
+		if drop {
+			continue
+		}
+		indexed[rel(t, root, op.Path)] = out.(*index.FileMetadata)
+	}
+	return watched, indexed
+}
+
+func rel(t *testing.T, root, path string) string {
+	t.Helper()
+	r, err := filepath.Rel(root, path)
+	require.NoError(t, err)
+	return filepath.ToSlash(r)
+}
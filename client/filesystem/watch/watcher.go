@@ -3,7 +3,9 @@ package watch
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"slices"
 	"strings"
@@ -13,6 +15,7 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 
+	"github.com/hedisam/filesync/client/filesystem/symlink"
 	"github.com/hedisam/filesync/client/ops"
 	"github.com/hedisam/filesync/lib/wal"
 )
@@ -22,19 +25,38 @@ type Watcher struct {
 	watcher  *fsnotify.Watcher
 	wal      *wal.WAL
 	stageNum atomic.Int64
+	// symlinks is how the symlinks created under root are handled, which are ignored by default
+	symlinks symlink.Policy
+	root     string
 }
 
-func New(logger *logrus.Logger, w *wal.WAL) (*Watcher, error) {
+type Option func(*Watcher)
+
+// WithSymlinks makes the Watcher handle the symlinks created under the given root as the given policy says: report
+// them as files, so they're indexed as they are, or follow them, watching the directories they point to under the
+// root as if they were under their paths.
+func WithSymlinks(policy symlink.Policy, root string) Option {
+	return func(w *Watcher) {
+		w.symlinks = policy
+		w.root = root
+	}
+}
+
+func New(logger *logrus.Logger, w *wal.WAL, opts ...Option) (*Watcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Watcher{
+	wt := &Watcher{
 		logger:  logger,
 		watcher: watcher,
 		wal:     w,
-	}, nil
+	}
+	for opt := range slices.Values(opts) {
+		opt(wt)
+	}
+	return wt, nil
 }
 
 func (w *Watcher) Add(dirPath string) error {
@@ -67,17 +89,24 @@ func (w *Watcher) Start(ctx context.Context) <-chan error {
 				}
 
 				if event.Has(fsnotify.Create) {
-					info, err := os.Stat(event.Name)
+					info, err := os.Lstat(event.Name)
 					if err != nil {
 						w.logger.WithField("path", event.Name).WithError(err).Warn("Failed to get stat info processing fs watcher event, ignoring")
 						continue
 					}
+					if info.Mode()&fs.ModeSymlink != 0 {
+						info, err = w.symlinkTarget(event.Name)
+						if err != nil {
+							w.logger.WithField("path", event.Name).WithError(err).Debug("Ignoring symlink")
+							continue
+						}
+					}
 					if info.IsDir() {
 						err = w.Add(event.Name)
 						if err != nil {
 							w.logger.WithError(err).Warn("Failed to add newly created directory to watcher, ignoring")
 						}
-						continue
+						// reported too, so empty directories are synced
 					}
 				}
 
@@ -112,6 +141,20 @@ func (w *Watcher) Start(ctx context.Context) <-chan error {
 	return errChan
 }
 
+// symlinkTarget returns the file info of what the symlink at the given path is reported as: itself if symlinks are
+// stored, and what it points to if they're followed. It returns an error if it's to be ignored.
+func (w *Watcher) symlinkTarget(path string) (fs.FileInfo, error) {
+	switch w.symlinks {
+	case symlink.Store:
+		return os.Lstat(path)
+	case symlink.Follow:
+		_, info, err := symlink.Resolve(w.root, path)
+		return info, err
+	default:
+		return nil, errors.New("symlinks are ignored")
+	}
+}
+
 func (w *Watcher) IncStageNum() {
 	w.stageNum.Add(1)
 }
@@ -141,6 +184,10 @@ func (w *Watcher) marshalEvent(event fsnotify.Event, stageNum int64) ([][]byte,
 	if event.Op&fsnotify.Write == fsnotify.Write {
 		w.logger.WithField("file", event.Name).Debug("File modified")
 		fileOps = append(fileOps, ops.OpModified)
+	} else if event.Has(fsnotify.Chmod) {
+		// e.g. its mode or mtime changed; it's indexed again so attribute-only changes are synced too
+		w.logger.WithField("file", event.Name).Debug("File attributes changed")
+		fileOps = append(fileOps, ops.OpModified)
 	}
 
 	var result [][]byte
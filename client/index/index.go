@@ -6,15 +6,20 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"maps"
 	"os"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/hedisam/filesync/client/filesystem/symlink"
 	"github.com/hedisam/filesync/client/ops"
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/hashtree"
 	"github.com/hedisam/pipeline"
 	"github.com/hedisam/pipeline/stage"
 )
@@ -28,6 +33,15 @@ type FileMetadata struct {
 	Size   int64
 	SHA256 string
 	MTime  int64
+	// ContentMAC is the keyed MAC of the content, only computed in end-to-end encryption mode.
+	ContentMAC string
+	// Attributes are the file's mode, precise mtime, owner and extended attributes.
+	Attributes *fileattr.Attributes
+	// LinkTarget is the target of a symlink stored as such, see symlink.Target, which is then its content. It's empty
+	// for regular files.
+	LinkTarget string
+	// Dir is set for directories, which are indexed with no content, so empty ones are synced too.
+	Dir bool
 
 	Op        ops.Op
 	Timestamp time.Time
@@ -38,14 +52,56 @@ type Index struct {
 	size   uint
 	idx    map[string]*FileMetadata
 	mu     sync.RWMutex
+	newMAC func() hash.Hash
+	// files holds all the files indexed, unlike idx, which is purged on snapshots
+	files map[string]*FileMetadata
+	// tree is the hash tree over the object keys of files
+	tree      *hashtree.Tree
+	objectKey func(path string) string
+	// symlinks is how symlinks are indexed, which are dropped by default
+	symlinks symlink.Policy
+	root     string
 }
 
-func New(logger *logrus.Logger, size uint) *Index {
-	return &Index{
+type Option func(*Index)
+
+// WithContentMAC makes the Index compute the keyed MAC of the content of files, in the same pass as their checksum.
+func WithContentMAC(newMAC func() hash.Hash) Option {
+	return func(i *Index) {
+		i.newMAC = newMAC
+	}
+}
+
+// WithHashTree makes the Index maintain a hash tree over the files it indexes, keyed by their object keys as given by
+// objectKey, so they can be reconciled with the server's hash tree. Files are identified by their content MAC if it's
+// computed, and their checksum otherwise, as the server does.
+func WithHashTree(objectKey func(path string) string) Option {
+	return func(i *Index) {
+		i.tree = hashtree.New()
+		i.objectKey = objectKey
+	}
+}
+
+// WithSymlinks makes the Index index the symlinks under the given root as the given policy says: as they are, with
+// their target as content, or as what they point to.
+func WithSymlinks(policy symlink.Policy, root string) Option {
+	return func(i *Index) {
+		i.symlinks = policy
+		i.root = root
+	}
+}
+
+func New(logger *logrus.Logger, size uint, opts ...Option) *Index {
+	i := &Index{
 		logger: logger,
 		size:   size,
 		idx:    make(map[string]*FileMetadata, size),
+		files:  make(map[string]*FileMetadata),
+	}
+	for opt := range slices.Values(opts) {
+		opt(i)
 	}
+	return i
 }
 
 func (i *Index) UnmarshalWALDataProcessor() stage.Processor {
@@ -86,6 +142,18 @@ func (i *Index) MetadataExtractorProcessor() stage.Processor {
 			}, false, nil
 		}
 
+		if symlink.IsSymlink(fileOp.Path) {
+			switch i.symlinks {
+			case symlink.Store:
+				return i.symlinkMetadata(fileOp)
+			case symlink.Follow:
+				// indexed as what it points to, which the walker and the watcher checked
+			default:
+				logger.Debug("Symlink has been queued for indexing, dropping")
+				return nil, true, nil
+			}
+		}
+
 		f, err := os.Open(fileOp.Path)
 		if err != nil {
 			logger.WithError(err).Warn("Could not open file to extract metadata, dropping")
@@ -101,28 +169,90 @@ func (i *Index) MetadataExtractorProcessor() stage.Processor {
 		}
 
 		if st.IsDir() {
-			logger.Warn("Directory has been queued for indexing, dropping")
-			return nil, true, nil
+			// a directory has no content, nor attributes synced, as its mtime changes with its entries
+			sum, contentMAC := i.checksums(nil)
+			return &FileMetadata{
+				Path:       fileOp.Path,
+				SHA256:     sum,
+				MTime:      st.ModTime().UTC().Unix(),
+				ContentMAC: contentMAC,
+				Dir:        true,
+				Op:         fileOp.Op,
+				Timestamp:  fileOp.Timestamp,
+			}, false, nil
 		}
 
 		hasher := sha256.New()
-		_, err = io.Copy(hasher, f)
+		var w io.Writer = hasher
+		var mac hash.Hash
+		if i.newMAC != nil {
+			mac = i.newMAC()
+			w = io.MultiWriter(hasher, mac)
+		}
+		_, err = io.Copy(w, f)
 		if err != nil {
 			logger.WithError(err).Warn("Could calculate sha256 checksum, dropping")
 			return nil, true, nil
 		}
+		var contentMAC string
+		if mac != nil {
+			contentMAC = hex.EncodeToString(mac.Sum(nil))
+		}
 
 		return &FileMetadata{
-			Path:      fileOp.Path,
-			Size:      st.Size(),
-			SHA256:    hex.EncodeToString(hasher.Sum(nil)),
-			MTime:     st.ModTime().UTC().Unix(),
-			Op:        fileOp.Op,
-			Timestamp: fileOp.Timestamp,
+			Path:       fileOp.Path,
+			Size:       st.Size(),
+			SHA256:     hex.EncodeToString(hasher.Sum(nil)),
+			MTime:      st.ModTime().UTC().Unix(),
+			ContentMAC: contentMAC,
+			Attributes: fileattr.Read(fileOp.Path, st),
+			Op:         fileOp.Op,
+			Timestamp:  fileOp.Timestamp,
 		}, false, nil
 	}
 }
 
+// symlinkMetadata returns the metadata of the symlink the given op is for, whose content is its target. Symlinks have
+// no attributes of their own to sync.
+func (i *Index) symlinkMetadata(fileOp *ops.FileOp) (any, bool, error) {
+	logger := i.logger.WithField("path", fileOp.Path)
+
+	st, err := os.Lstat(fileOp.Path)
+	if err != nil {
+		logger.WithError(err).Warn("Could not get symlink stats to extract metadata, dropping")
+		return nil, true, nil
+	}
+	target, err := symlink.Target(i.root, fileOp.Path)
+	if err != nil {
+		logger.WithError(err).Warn("Could not read symlink target, dropping")
+		return nil, true, nil
+	}
+
+	sum, contentMAC := i.checksums([]byte(target))
+	return &FileMetadata{
+		Path:       fileOp.Path,
+		Size:       int64(len(target)),
+		SHA256:     sum,
+		MTime:      st.ModTime().UTC().Unix(),
+		ContentMAC: contentMAC,
+		LinkTarget: target,
+		Op:         fileOp.Op,
+		Timestamp:  fileOp.Timestamp,
+	}, false, nil
+}
+
+// checksums returns the checksum of the given content, and its MAC if it's computed.
+func (i *Index) checksums(content []byte) (string, string) {
+	sum := sha256.Sum256(content)
+	var contentMAC string
+	if i.newMAC != nil {
+		mac := i.newMAC()
+		mac.Write(content)
+		contentMAC = hex.EncodeToString(mac.Sum(nil))
+	}
+	return hex.EncodeToString(sum[:]), contentMAC
+}
+
 // IndexerSink returns a pipeline.Sink that receives processed file info and stores them in the index.
 func (i *Index) IndexerSink() pipeline.Sink {
 	return func(_ context.Context, payload any) error {
@@ -148,6 +278,18 @@ func (i *Index) IndexerSink() pipeline.Sink {
 
 		// add new metadata or replace any existing one from a more recent file change event
 		i.idx[md.Path] = md
+		switch md.Op {
+		case ops.OpCreated, ops.OpModified:
+			i.files[md.Path] = md
+			if i.tree != nil {
+				i.tree.Put(i.objectKey(md.Path), treeContentID(md))
+			}
+		case ops.OpRemoved:
+			delete(i.files, md.Path)
+			if i.tree != nil {
+				i.tree.Delete(i.objectKey(md.Path))
+			}
+		}
 		return nil
 	}
 }
@@ -160,3 +302,60 @@ func (i *Index) SnapshotAndPurge() map[string]*FileMetadata {
 	i.idx = make(map[string]*FileMetadata, i.size)
 	return snapshot
 }
+
+// State returns the metadata of all the files indexed so far, i.e. the full local state, unlike snapshots, which only
+// have the files changed since the previous one.
+func (i *Index) State() map[string]*FileMetadata {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return maps.Clone(i.files)
+}
+
+// Summary summarizes the files indexed so far.
+type Summary struct {
+	Files int64
+	Bytes int64
+	// RootHash is the root hash of the hash tree, only maintained with WithHashTree.
+	RootHash string
+}
+
+// Summary returns the summary of the files indexed so far, i.e. of the full local state.
+func (i *Index) Summary() Summary {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	summary := Summary{
+		Files: int64(len(i.files)),
+	}
+	for md := range maps.Values(i.files) {
+		summary.Bytes += md.Size
+	}
+	if i.tree != nil {
+		summary.RootHash = i.tree.Hash()
+	}
+	return summary
+}
+
+// TreeNodes returns the nodes of the hash tree under the given prefixes, leaving out the prefixes with no directory
+// under them. It's a hashtree.Source of the files indexed so far; none without WithHashTree.
+func (i *Index) TreeNodes(prefixes []string) ([]*hashtree.Node, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.tree == nil {
+		return nil, nil
+	}
+	return i.tree.Nodes(prefixes), nil
+}
+
+// treeContentID returns what identifies the content of the given file in the hash tree, as the server does.
+func treeContentID(md *FileMetadata) string {
+	switch {
+	case md.LinkTarget != "":
+		return hashtree.LinkContentID(md.SHA256, md.ContentMAC)
+	case md.Dir:
+		return hashtree.DirContentID(md.SHA256, md.ContentMAC)
+	}
+	return hashtree.ContentID(md.SHA256, md.ContentMAC)
+}
@@ -2,46 +2,108 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
 	"os"
 	"os/signal"
+	"os/user"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
 	restapi "github.com/hedisam/filesync/client/api/rest"
+	"github.com/hedisam/filesync/client/conflict"
+	"github.com/hedisam/filesync/client/e2e"
 	"github.com/hedisam/filesync/client/filesystem"
+	"github.com/hedisam/filesync/client/filesystem/symlink"
 	"github.com/hedisam/filesync/client/filesystem/watch"
 	"github.com/hedisam/filesync/client/index"
 	"github.com/hedisam/filesync/client/plan"
 	"github.com/hedisam/filesync/client/syncpipeline"
+	"github.com/hedisam/filesync/lib/compression"
 	"github.com/hedisam/filesync/lib/wal"
 	"github.com/hedisam/pipeline"
 	"github.com/hedisam/pipeline/chans"
 	"github.com/hedisam/pipeline/stage"
 )
 
+// version is the version of the client, set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 type Options struct {
-	SourceDir    string
-	ServerAddr   string
-	AccessKeyID  string
-	SecretKey    string
-	SyncInterval time.Duration
-	Verbose      bool
+	SourceDir      string
+	ServerAddr     string
+	Namespace      string
+	AccessKeyID    string
+	SecretKey      string
+	SyncInterval   time.Duration
+	PassphraseFile string
+	EncryptNames   bool
+	UploadEncoding string
+	PullChanges    bool
+	Watch          bool
+	TreeReconcile  bool
+	ReconcileEvery time.Duration
+	MetricsAddr    string
+	// ConflictStrategy is how conflicts are resolved, unless ConflictPolicy has a rule for the file.
+	ConflictStrategy string
+	ConflictPolicy   string
+	ConflictLog      string
+	DeviceName       string
+	DeviceID         string
+	ReportInterval   time.Duration
+	// Symlinks is how symlinks are synced: ignore, store or follow.
+	Symlinks string
+	Verbose  bool
 }
 
 func main() {
 	logger := logrus.New()
 
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		err := status(os.Args[2:])
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to report status")
+		}
+		return
+	}
+
 	var opts Options
 	flag.StringVar(&opts.SourceDir, "src-dir", ".", "Source directory to sync its content with the server.")
 	flag.StringVar(&opts.AccessKeyID, "aki", "", "Your access key ID as printed by the server (required).")
 	flag.StringVar(&opts.SecretKey, "secret", "", "Your secret key as printed by the server (required).")
 	flag.StringVar(&opts.ServerAddr, "server-addr", "http://localhost:8080", "FileServer address to connect to.")
+	flag.StringVar(&opts.Namespace, "namespace", "default", "Server namespace to sync the source directory with.")
 	flag.DurationVar(&opts.SyncInterval, "sync-interval", time.Second*10, "How often to sync up with the server")
+	flag.StringVar(&opts.PassphraseFile, "e2e-passphrase-file", "", "Path to a file with the passphrase to encrypt file content with before uploading it, so the server only sees ciphertext; every client of the namespace must use the same passphrase (optional)")
+	flag.BoolVar(&opts.EncryptNames, "e2e-encrypt-names", false, "Encrypt file names too in end-to-end encryption mode")
+	flag.StringVar(&opts.UploadEncoding, "upload-encoding", "", "Compress uploads in transit with this content encoding: gzip or zstd (optional)")
+	flag.BoolVar(&opts.PullChanges, "pull", true, "Apply the changes other devices make on the server to the source directory; conflicting local changes are resolved as the conflict strategy says")
+	flag.BoolVar(&opts.Watch, "watch", true, "Sync the changes made on the server as soon as they're made, rather than every sync interval")
+	flag.BoolVar(&opts.TreeReconcile, "tree-reconcile", true, "Reconcile with the server on startups by comparing hash trees of the files, rather than every file")
+	flag.DurationVar(&opts.ReconcileEvery, "reconcile-interval", time.Hour, "How often to reconcile all the local files with the server to correct any drift; 0 disables it")
+	flag.StringVar(&opts.MetricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9090 (optional)")
+	flag.StringVar(&opts.ConflictStrategy, "conflict-strategy", string(conflict.DefaultStrategy), "How to resolve files changed both locally and on the server since they were last synced: keep_both, local_wins, remote_wins or newest_wins")
+	flag.StringVar(&opts.ConflictPolicy, "conflict-policy", "", "Path to a JSON file with conflict strategies per path pattern, e.g. {\"rules\": [{\"pattern\": \"*.docx\", \"strategy\": \"local_wins\"}]} (optional)")
+	flag.StringVar(&opts.ConflictLog, "conflict-log", defaultConflictLog(), "Path to the log of the conflicts resolved, as reported by the status command")
+	flag.StringVar(&opts.DeviceName, "device-name", "", "Name of this device, as shown in the names of conflict copies (default: the hostname)")
+	flag.StringVar(&opts.DeviceID, "device-id", "", "ID to register this device with the server as (default: a random one, kept in the user's config directory per source directory and namespace)")
+	flag.DurationVar(&opts.ReportInterval, "report-interval", time.Minute, "How often to report the sync state of this device to the server; 0 disables device registration")
+	flag.StringVar(&opts.Symlinks, "symlinks", string(symlink.Ignore), "How to sync symlinks: ignore them, store them as symlinks to recreate them on the other devices, or follow the ones to files and directories under the source directory")
 	flag.BoolVar(&opts.Verbose, "v", false, "Verbose output")
 	flag.Parse()
 
@@ -49,12 +111,56 @@ func main() {
 		logger.SetLevel(logrus.DebugLevel)
 	}
 
-	if opts.SourceDir == "" || opts.AccessKeyID == "" || opts.SecretKey == "" {
+	if opts.SourceDir == "" || opts.AccessKeyID == "" || opts.SecretKey == "" || (opts.EncryptNames && opts.PassphraseFile == "") {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	restClient, err := restapi.NewClient(logger, opts.ServerAddr)
+	symlinks, err := symlink.ParsePolicy(opts.Symlinks)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid symlink policy")
+	}
+	indexOpts := []index.Option{index.WithSymlinks(symlinks, opts.SourceDir)}
+	plannerOpts := []plan.PlannerOption{plan.WithSymlinks(symlinks)}
+	objectKey := func(path string) string { return path }
+	if opts.PassphraseFile != "" {
+		keys := mustDeriveKeys(logger, opts.PassphraseFile, opts.Namespace)
+		indexOpts = append(indexOpts, index.WithContentMAC(keys.NewMAC))
+		plannerOpts = append(plannerOpts, plan.WithEncryption(keys, opts.EncryptNames))
+		if opts.EncryptNames {
+			objectKey = keys.EncryptName
+		}
+	}
+	if opts.TreeReconcile {
+		indexOpts = append(indexOpts, index.WithHashTree(objectKey))
+	}
+	if opts.PullChanges {
+		plannerOpts = append(plannerOpts,
+			plan.WithRemoteChanges(opts.SourceDir),
+			plan.WithConflictResolution(
+				mustLoadConflictPolicy(logger, opts.ConflictStrategy, opts.ConflictPolicy),
+				conflict.NewLog(opts.ConflictLog),
+				deviceName(opts.DeviceName),
+			),
+		)
+	}
+
+	uploadEncoding, err := compression.ParseEncoding(opts.UploadEncoding)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid upload encoding")
+	}
+	if uploadEncoding != compression.Identity && opts.PassphraseFile != "" {
+		// ciphertext doesn't compress
+		logger.Warn("Upload encoding is ignored in end-to-end encryption mode")
+		uploadEncoding = compression.Identity
+	}
+
+	deviceID := mustLoadDeviceID(logger, opts.DeviceID, opts.SourceDir, opts.Namespace)
+	restClient, err := restapi.NewClient(logger, opts.ServerAddr, opts.Namespace,
+		restapi.WithUploadEncoding(uploadEncoding),
+		restapi.WithAttribution(clientAttribution(deviceID)),
+		restapi.WithCredentials(opts.AccessKeyID, opts.SecretKey),
+	)
 	if err != nil {
 		logger.WithError(err).Fatal("Failed to create rest client")
 	}
@@ -71,7 +177,7 @@ func main() {
 
 	watchWAL := mustCreateWal(logger, filepath.Join(tmpDir, "watch.log"))
 	defer watchWAL.Close()
-	watcher, err := watch.New(logger, watchWAL)
+	watcher, err := watch.New(logger, watchWAL, watch.WithSymlinks(symlinks, opts.SourceDir))
 	if err != nil {
 		logger.WithError(err).Error("Failed to initialize file watcher")
 		return
@@ -83,7 +189,7 @@ func main() {
 	// create the baseline index by walking through the source dir recursively.
 	walkWAL := mustCreateWal(logger, filepath.Join(tmpDir, "watcher.log"))
 	defer walkWAL.Close()
-	walkErrCh := filesystem.Walk(ctx, logger, opts.SourceDir, watcher, walkWAL)
+	walkErrCh := filesystem.Walk(ctx, logger, opts.SourceDir, symlinks, watcher, walkWAL)
 	walkErrCh1, walkErrCh2 := chans.Tee2(ctx, walkErrCh)
 	errorChans = append(errorChans, walkErrCh1)
 	chans.OnDone(ctx, walkErrCh2, func(_ context.Context) {
@@ -92,7 +198,7 @@ func main() {
 		walkWAL.Close()
 	})
 
-	idx := index.New(logger, index.DefaultIndexSize)
+	idx := index.New(logger, index.DefaultIndexSize, indexOpts...)
 
 	// a pipeline with multiple sequential sources; first consume the walker WAL and then the file watcher's
 	filesPipeline := pipeline.NewPipeline(
@@ -111,9 +217,30 @@ func main() {
 
 	// todo: add a debounce layer between the WAL consumer and the indexer to filter out noise
 
-	planner := plan.NewPlanner(logger)
+	planner := plan.NewPlanner(logger, plannerOpts...)
 	syncClient := syncpipeline.New(logger, restClient, planner, opts.AccessKeyID, opts.SecretKey)
-	snapshotSource := syncpipeline.NewSnapshotSource(ctx, restClient, idx, opts.SyncInterval)
+	var sourceOpts []syncpipeline.SnapshotSourceOption
+	if opts.Watch {
+		sourceOpts = append(sourceOpts, syncpipeline.WithWatch())
+	}
+	if opts.TreeReconcile {
+		sourceOpts = append(sourceOpts, syncpipeline.WithTreeReconcile(idx))
+	}
+	if opts.ReconcileEvery > 0 {
+		sourceOpts = append(sourceOpts, syncpipeline.WithReconcileInterval(opts.ReconcileEvery))
+	}
+	if opts.ReportInterval > 0 {
+		sourceOpts = append(sourceOpts, syncpipeline.WithDeviceReports(restapi.Device{
+			ID:            deviceID,
+			Name:          deviceName(opts.DeviceName),
+			ClientVersion: version,
+		}, opts.ReportInterval))
+	}
+	if opts.MetricsAddr != "" {
+		prometheus.MustRegister(planner)
+		errorChans = append(errorChans, serveMetrics(ctx, logger, opts.MetricsAddr))
+	}
+	snapshotSource := syncpipeline.NewSnapshotSource(ctx, logger, restClient, idx, opts.SyncInterval, sourceOpts...)
 	sp := pipeline.NewPipeline(snapshotSource, syncClient.OutputSink())
 	spErrCh := sp.RunAsync(ctx,
 		stage.FIFORunner(syncClient.PlanGenerator()),
@@ -132,6 +259,143 @@ func main() {
 	}
 }
 
+func mustDeriveKeys(logger *logrus.Logger, passphraseFile, namespace string) *e2e.Keys {
+	passphrase, err := os.ReadFile(passphraseFile)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to read end-to-end encryption passphrase")
+	}
+
+	keys, err := e2e.DeriveKeys(strings.TrimRight(string(passphrase), "\r\n"), namespace)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to derive end-to-end encryption keys")
+	}
+
+	return keys
+}
+
+func mustLoadConflictPolicy(logger *logrus.Logger, strategy, policyFile string) *conflict.Policy {
+	defaultStrategy, err := conflict.ParseStrategy(strategy)
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid conflict strategy")
+	}
+	if policyFile == "" {
+		return &conflict.Policy{
+			Default: defaultStrategy,
+		}
+	}
+
+	policy, err := conflict.LoadPolicy(policyFile, defaultStrategy)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to load conflict policy")
+	}
+	return policy
+}
+
+// defaultConflictLog returns where the conflict log is kept by default: in the user's config directory, or the
+// temporary one if there's none.
+func defaultConflictLog() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "filesync", "conflicts.log")
+}
+
+func deviceName(name string) string {
+	if name != "" {
+		return name
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "unknown device"
+	}
+	return hostname
+}
+
+// clientAttribution returns what the server records the changes made by this client as made by: the device, and the
+// host and user it runs on.
+func clientAttribution(deviceID string) restapi.Attribution {
+	a := restapi.Attribution{DeviceID: deviceID}
+	a.Hostname, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		a.User = u.Username
+	}
+	return a
+}
+
+// mustLoadDeviceID returns the given device ID, or the one this device syncs the given directory with the given
+// namespace as, generating it on the first run.
+func mustLoadDeviceID(logger *logrus.Logger, id, sourceDir, namespace string) string {
+	if id != "" {
+		return id
+	}
+
+	absDir, err := filepath.Abs(sourceDir)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to get absolute path of the source directory")
+	}
+	sum := sha256.Sum256([]byte(namespace + "\x00" + absDir))
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	path := filepath.Join(dir, "filesync", "device-"+hex.EncodeToString(sum[:8]))
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		logger.WithError(err).Fatal("Failed to read device ID")
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id = hex.EncodeToString(b)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(id+"\n"), 0644)
+	}
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to save device ID")
+	}
+	return id
+}
+
+// status prints the conflicts resolved so far, oldest first.
+func status(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	logPath := fs.String("conflict-log", defaultConflictLog(), "Path to the log of the conflicts resolved")
+	_ = fs.Parse(args)
+
+	records, err := conflict.ReadLog(*logPath)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Println("No conflicts recorded.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tPATH\tSTRATEGY\tRESOLUTION\tDETAILS")
+	for r := range slices.Values(records) {
+		var details []string
+		if r.LocalDeleted {
+			details = append(details, "deleted locally")
+		}
+		if r.RemoteDeleted {
+			details = append(details, "deleted on the server")
+		}
+		if r.Copy != "" {
+			details = append(details, "local version kept at "+r.Copy)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Time.Local().Format(time.DateTime), r.Path, r.Strategy, r.Resolution, strings.Join(details, ", "))
+	}
+	fmt.Printf("%d conflicts recorded in %s\n\n", len(records), *logPath)
+	return w.Flush()
+}
+
 func mustCreateWal(logger *logrus.Logger, path string) *wal.WAL {
 	w, err := wal.New(logger, path)
 	if err != nil {
@@ -140,3 +404,31 @@ func mustCreateWal(logger *logrus.Logger, path string) *wal.WAL {
 
 	return w
 }
+
+// serveMetrics serves the registered metrics on the given address until the context is done. The returned channel
+// gets the error the server fails with, if it does.
+func serveMetrics(ctx context.Context, logger *logrus.Logger, addr string) <-chan error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		logger.WithField("addr", addr).Info("Serving metrics")
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- fmt.Errorf("serve metrics: %w", err)
+		}
+		close(errCh)
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	return errCh
+}
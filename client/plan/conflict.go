@@ -0,0 +1,274 @@
+package plan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	restapi "github.com/hedisam/filesync/client/api/rest"
+	"github.com/hedisam/filesync/client/conflict"
+	"github.com/hedisam/filesync/client/filesystem/symlink"
+)
+
+// WithConflictResolution makes the Planner resolve conflicts, i.e. files changed both locally and on the server since
+// they were last synced, with the strategies of the given policy, recording every one in the given log. Conflict
+// copies are named after the given device. It only applies along with WithRemoteChanges; otherwise conflicting
+// uploads and deletions fail.
+func WithConflictResolution(policy *conflict.Policy, log *conflict.Log, device string) PlannerOption {
+	return func(p *Planner) {
+		p.conflicts = &resolver{
+			planner: p,
+			policy:  policy,
+			log:     log,
+			device:  device,
+			now:     time.Now,
+		}
+	}
+}
+
+// resolver resolves the conflicts of the files under the sync root.
+type resolver struct {
+	planner *Planner
+	policy  *conflict.Policy
+	log     *conflict.Log
+	device  string
+	now     func() time.Time
+}
+
+// resolver returns the resolver of the Planner, nil if it doesn't resolve conflicts.
+func (p *Planner) resolver() *resolver {
+	if p.syncRoot == "" {
+		return nil
+	}
+	return p.conflicts
+}
+
+// localVersion is the local side of a conflict.
+type localVersion struct {
+	exists bool
+	mtime  time.Time
+	// dir is set if it's a directory, which has no content to keep a copy of
+	dir bool
+	// upload retries the upload of the local version, if it's the one conflicting, over the given version of the
+	// server's file, 0 for none
+	upload func(ifMatch uint64) error
+}
+
+// resolveUpload resolves the conflict of a local change the server refused, as the file changed on the server too.
+func (r *resolver) resolveUpload(ctx context.Context, client RestClient, opts []Option, pr *uploadRequest) error {
+	remote, err := client.File(ctx, pr.encryption.objectKey(pr.fileMetadata.Path))
+	if err != nil {
+		return fmt.Errorf("get server file: %w", err)
+	}
+	local, err := statLocal(pr.fileMetadata.Path)
+	if err != nil {
+		return err
+	}
+	if local.exists {
+		local.upload = func(ifMatch uint64) error {
+			retry := *pr
+			retry.ifMatch = &ifMatch
+			retry.resolver = nil
+			return retry.Apply(ctx, client, opts...)
+		}
+	}
+	return r.resolve(ctx, client, opts, pr.fileMetadata.Path, local, remote)
+}
+
+// resolveDelete resolves the conflict of a local deletion the server refused, as the file changed on the server too.
+func (r *resolver) resolveDelete(ctx context.Context, client RestClient, opts []Option, pr *deleteRequest) error {
+	remote, err := client.File(ctx, pr.encryption.objectKey(pr.filePath))
+	if err != nil {
+		return fmt.Errorf("get server file: %w", err)
+	}
+	local, err := statLocal(pr.filePath)
+	if err != nil {
+		return err
+	}
+	return r.resolve(ctx, client, opts, pr.filePath, local, remote)
+}
+
+// resolveRemote resolves the conflict of a remote change, to the given file or a deletion if it's nil, with a local
+// change that wasn't synced yet.
+func (r *resolver) resolveRemote(ctx context.Context, client RestClient, opts []Option, filePath string, remote *restapi.File) error {
+	local, err := statLocal(filePath)
+	if err != nil {
+		return err
+	}
+	return r.resolve(ctx, client, opts, filePath, local, remote)
+}
+
+func statLocal(filePath string) (*localVersion, error) {
+	st, err := os.Stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// a symlink pointing to nothing still exists
+		st, err = os.Lstat(filePath)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return &localVersion{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stat local file: %w", err)
+	}
+	return &localVersion{
+		exists: true,
+		mtime:  st.ModTime(),
+		dir:    st.IsDir(),
+	}, nil
+}
+
+// resolve resolves the conflict of the file at the given path between its local version and the server's, nil if
+// it's been deleted there.
+func (r *resolver) resolve(ctx context.Context, client RestClient, opts []Option, filePath string, local *localVersion, remote *restapi.File) error {
+	p := r.planner
+	if !local.exists && remote == nil {
+		// deleted on both sides
+		p.state.remove(filePath)
+		return nil
+	}
+
+	relPath, err := filepath.Rel(p.syncRoot, filePath)
+	if err != nil {
+		return fmt.Errorf("get path relative to the sync root: %w", err)
+	}
+	record := conflict.Record{
+		Time:          r.now().UTC(),
+		Path:          filepath.ToSlash(relPath),
+		Strategy:      r.policy.Strategy(filepath.ToSlash(relPath)),
+		LocalDeleted:  !local.exists,
+		RemoteDeleted: remote == nil,
+	}
+	logger := p.logger.WithFields(logrus.Fields{
+		"path":     filePath,
+		"strategy": record.Strategy,
+	})
+
+	keepLocal := false
+	switch record.Strategy {
+	case conflict.LocalWins:
+		keepLocal = true
+	case conflict.RemoteWins:
+	case conflict.NewestWins:
+		// a deletion has no mtime, so the side that changed the file wins over it
+		keepLocal = remote == nil || (local.exists && local.mtime.Unix() >= remote.MTime)
+	default:
+		// neither version is lost: the local one is kept as a copy unless it's a deletion, which the server's version
+		// is restored over
+		keepLocal = remote == nil
+		if local.exists && !local.dir && remote != nil {
+			record.Copy = conflict.CopyName(filePath, r.device, record.Time)
+			if p.symlinks == symlink.Store && symlink.IsSymlink(filePath) {
+				err = copySymlink(filePath, record.Copy)
+			} else {
+				err = copyFile(filePath, record.Copy)
+			}
+			if err != nil {
+				return fmt.Errorf("keep conflict copy of %q: %w", filePath, err)
+			}
+		}
+	}
+
+	switch {
+	case record.Copy != "":
+		record.Resolution = "kept both"
+	case keepLocal:
+		record.Resolution = "kept local"
+	default:
+		record.Resolution = "kept remote"
+	}
+	logger.WithField("resolution", record.Resolution).Warn("File changed both locally and on the server, resolving conflict")
+	err = r.log.Append(record)
+	if err != nil {
+		logger.WithError(err).Error("Failed to record conflict in the conflict log")
+	}
+
+	if keepLocal {
+		return r.keepLocal(ctx, client, filePath, local, remote)
+	}
+	return r.keepRemote(ctx, client, opts, filePath, remote)
+}
+
+// keepLocal writes the local version of the file over the server's.
+func (r *resolver) keepLocal(ctx context.Context, client RestClient, filePath string, local *localVersion, remote *restapi.File) error {
+	p := r.planner
+	var version uint64
+	if remote != nil {
+		version = remote.Version
+	}
+
+	switch {
+	case local.upload != nil:
+		return local.upload(version)
+	case !local.exists:
+		err := client.Delete(ctx, p.encryption.objectKey(filePath), &version)
+		if err != nil {
+			return fmt.Errorf("delete via rest client for file %q: %w", filePath, err)
+		}
+		p.state.remove(filePath)
+	case remote == nil:
+		// the local change is uploaded as a new file
+		p.state.remove(filePath)
+	default:
+		// the local change, yet to be indexed, is uploaded over the server's version
+		p.state.set(filePath, p.encryption.remoteContentID(remote), remote.Version)
+	}
+	return nil
+}
+
+// keepRemote writes the server's version of the file over the local one.
+func (r *resolver) keepRemote(ctx context.Context, client RestClient, opts []Option, filePath string, remote *restapi.File) error {
+	p := r.planner
+	if p.links().escapes(p.logger.WithField("path", filePath), filePath) {
+		return nil
+	}
+	if remote == nil {
+		err := os.Remove(filePath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove local file %q: %w", filePath, err)
+		}
+		p.state.remove(filePath)
+		return nil
+	}
+	return p.newDownloadRequest(filePath, remote.Key, remote).download(ctx, client, opts...)
+}
+
+// copyFile copies the file at src to dst, which mustn't exist. The copy is written rather than the file moved, so the
+// file isn't seen removed meanwhile, which would delete it on the server.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copySymlink copies the symlink at src to dst, which mustn't exist, pointing to the same target.
+func copySymlink(src, dst string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, dst)
+}
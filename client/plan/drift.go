@@ -0,0 +1,191 @@
+package plan
+
+import (
+	"fmt"
+	"iter"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	restapi "github.com/hedisam/filesync/client/api/rest"
+	"github.com/hedisam/filesync/client/index"
+	"github.com/hedisam/filesync/client/ops"
+)
+
+// The corrections a reconcile can plan for a file that drifted.
+const (
+	driftUpload      = "upload"
+	driftDownload    = "download"
+	driftDelete      = "delete"
+	driftRemoveLocal = "remove_local"
+	driftAttributes  = "attributes"
+)
+
+var driftActions = []string{driftUpload, driftDownload, driftDelete, driftRemoveLocal, driftAttributes}
+
+var (
+	reconcilesDesc = prometheus.NewDesc(
+		"filesync_client_reconciles_total",
+		"Number of periodic reconciles of the local files with the server's",
+		nil, nil,
+	)
+	driftFilesDesc = prometheus.NewDesc(
+		"filesync_client_drift_files_total",
+		"Number of files found drifted from the server by periodic reconciles, by the correction planned",
+		[]string{"action"}, nil,
+	)
+	lastDriftFilesDesc = prometheus.NewDesc(
+		"filesync_client_last_reconcile_drift_files",
+		"Number of files found drifted from the server by the last periodic reconcile",
+		nil, nil,
+	)
+	lastReconcileDesc = prometheus.NewDesc(
+		"filesync_client_last_reconcile_timestamp_seconds",
+		"When the last periodic reconcile was planned, as a unix timestamp",
+		nil, nil,
+	)
+)
+
+type driftMetrics struct {
+	reconciles    int64
+	driftFiles    map[string]int64
+	lastDrift     int
+	lastReconcile time.Time
+}
+
+// CorrectDrift plans correcting the drift between the full local state and the server's, e.g. changes missed by
+// either side, or uploads dropped after failing. Unlike a startup compare, where local files win, which side is right
+// for a file is told by its sync state: a file changed on one side only since it was last synced takes that side's
+// version, and one never synced is new on its side. Without remote changes applied, the server is made the same as
+// the local files. A nil server snapshot means they're known to be the same already, e.g. by their hash trees.
+func (p *Planner) CorrectDrift(localState map[string]*index.FileMetadata, serverSnapshot iter.Seq2[*restapi.File, error]) (*Plan, error) {
+	drift := make(map[string]int, len(driftActions))
+	var requests []PlanRequest
+	correct := func(action string, req PlanRequest) {
+		drift[action]++
+		requests = append(requests, req)
+	}
+
+	if serverSnapshot == nil {
+		for filePath, localFile := range localState {
+			if localFile.Op == ops.OpCreated || localFile.Op == ops.OpModified {
+				p.state.set(filePath, p.encryption.indexedContentID(localFile), 0)
+			}
+		}
+		p.recordReconcile(drift)
+		return &Plan{}, nil
+	}
+
+	// the local files the server has
+	seen := make(map[string]bool)
+	for remoteFile, err := range serverSnapshot {
+		if err != nil {
+			return nil, fmt.Errorf("read server snapshot: %w", err)
+		}
+		filePath, ok := p.localPath(remoteFile.Key)
+		if !ok {
+			continue
+		}
+		seen[filePath] = true
+		synced, wasSynced := p.state.get(filePath)
+		pull := p.pulls(filePath, remoteFile)
+
+		localFile, ok := localState[filePath]
+		if !ok || (localFile.Op != ops.OpCreated && localFile.Op != ops.OpModified) {
+			if p.ignoresRemote(remoteFile) {
+				continue
+			}
+			if !wasSynced && pull {
+				// a remote change missed
+				correct(driftDownload, p.newDownloadRequest(filePath, remoteFile.Key, remoteFile))
+				continue
+			}
+			correct(driftDelete, p.newDeleteRequest(filePath, p.expectedVersion(filePath, remoteFile, true)))
+			continue
+		}
+		if p.sameContent(localFile, remoteFile) {
+			p.state.set(filePath, p.encryption.remoteContentID(remoteFile), remoteFile.Version)
+			if !p.sameAttributes(localFile, remoteFile) {
+				// attributes aren't kept in the sync state, so the local ones are taken as right
+				correct(driftAttributes, p.newAttributesRequest(localFile, p.expectedVersion(filePath, remoteFile, true)))
+			}
+			continue
+		}
+		if wasSynced && synced == p.encryption.indexedContentID(localFile) && pull {
+			// changed on the server only
+			correct(driftDownload, p.newDownloadRequest(filePath, remoteFile.Key, remoteFile))
+			continue
+		}
+		correct(driftUpload, p.newUploadRequest(localFile, p.expectedVersion(filePath, remoteFile, true)))
+	}
+
+	for filePath, localFile := range localState {
+		if seen[filePath] || (localFile.Op != ops.OpCreated && localFile.Op != ops.OpModified) {
+			continue
+		}
+		synced, wasSynced := p.state.get(filePath)
+		if wasSynced && synced == p.encryption.indexedContentID(localFile) && p.syncRoot != "" && insideRoot(p.syncRoot, filePath) {
+			// deleted on the server, and not changed locally since
+			correct(driftRemoveLocal, p.newRemoveLocalRequest(filePath))
+			continue
+		}
+		correct(driftUpload, p.newUploadRequest(localFile, p.expectedVersion(filePath, nil, true)))
+	}
+
+	p.recordReconcile(drift)
+	if len(requests) > 0 {
+		fields := make(logrus.Fields, len(drift))
+		for action, n := range drift {
+			fields[action] = n
+		}
+		p.logger.WithFields(fields).Info("Reconcile found files drifted from the server")
+	}
+
+	return &Plan{
+		Requests: requests,
+	}, nil
+}
+
+// pulls reports whether the server's version of the file at the given path can be downloaded.
+func (p *Planner) pulls(filePath string, remoteFile *restapi.File) bool {
+	return p.syncRoot != "" && insideRoot(p.syncRoot, filePath) && p.encryption.remoteContentID(remoteFile) != ""
+}
+
+func (p *Planner) recordReconcile(drift map[string]int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.metrics.reconciles++
+	p.metrics.lastDrift = 0
+	for action, n := range drift {
+		p.metrics.driftFiles[action] += int64(n)
+		p.metrics.lastDrift += n
+	}
+	p.metrics.lastReconcile = time.Now()
+}
+
+// Describe implements prometheus.Collector.
+func (p *Planner) Describe(ch chan<- *prometheus.Desc) {
+	ch <- reconcilesDesc
+	ch <- driftFilesDesc
+	ch <- lastDriftFilesDesc
+	ch <- lastReconcileDesc
+}
+
+// Collect implements prometheus.Collector.
+func (p *Planner) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m := p.metrics
+	ch <- prometheus.MustNewConstMetric(reconcilesDesc, prometheus.CounterValue, float64(m.reconciles))
+	for action := range slices.Values(driftActions) {
+		ch <- prometheus.MustNewConstMetric(driftFilesDesc, prometheus.CounterValue, float64(m.driftFiles[action]), action)
+	}
+	ch <- prometheus.MustNewConstMetric(lastDriftFilesDesc, prometheus.GaugeValue, float64(m.lastDrift))
+	if !m.lastReconcile.IsZero() {
+		ch <- prometheus.MustNewConstMetric(lastReconcileDesc, prometheus.GaugeValue, float64(m.lastReconcile.Unix()))
+	}
+}
@@ -0,0 +1,99 @@
+package plan_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	restapi "github.com/hedisam/filesync/client/api/rest"
+	"github.com/hedisam/filesync/client/index"
+	"github.com/hedisam/filesync/client/ops"
+	"github.com/hedisam/filesync/client/plan"
+)
+
+func TestCorrectDrift(t *testing.T) {
+	local := map[string]*index.FileMetadata{
+		"/src/synced.txt":           {Path: "/src/synced.txt", SHA256: "sha-1", Op: ops.OpCreated},
+		"/src/changed-remotely.txt": {Path: "/src/changed-remotely.txt", SHA256: "sha-2", Op: ops.OpCreated},
+		"/src/changed-locally.txt":  {Path: "/src/changed-locally.txt", SHA256: "sha-3", Op: ops.OpCreated},
+		"/src/deleted-remotely.txt": {Path: "/src/deleted-remotely.txt", SHA256: "sha-4", Op: ops.OpCreated},
+		"/src/deleted-locally.txt":  {Path: "/src/deleted-locally.txt", SHA256: "sha-5", Op: ops.OpCreated},
+	}
+	server := map[string]*restapi.File{
+		"/src/synced.txt":           {SHA256Checksum: "sha-1"},
+		"/src/changed-remotely.txt": {SHA256Checksum: "sha-2"},
+		"/src/changed-locally.txt":  {SHA256Checksum: "sha-3"},
+		"/src/deleted-remotely.txt": {SHA256Checksum: "sha-4"},
+		"/src/deleted-locally.txt":  {SHA256Checksum: "sha-5"},
+	}
+	planner := plan.NewPlanner(logrus.New(), plan.WithRemoteChanges("/src"))
+	p, err := planner.Generate(local, serverSnapshot(server), nil)
+	require.NoError(t, err)
+	require.Empty(t, p.Requests)
+
+	// drifted in ways the changes followed since didn't tell
+	localState := map[string]*index.FileMetadata{
+		"/src/synced.txt":           local["/src/synced.txt"],
+		"/src/changed-remotely.txt": local["/src/changed-remotely.txt"],
+		"/src/changed-locally.txt":  {Path: "/src/changed-locally.txt", SHA256: "new-sha-3", Op: ops.OpModified},
+		"/src/deleted-remotely.txt": local["/src/deleted-remotely.txt"],
+		"/src/dropped-upload.txt":   {Path: "/src/dropped-upload.txt", SHA256: "sha-6", Op: ops.OpCreated},
+	}
+	server = map[string]*restapi.File{
+		"/src/synced.txt":           {SHA256Checksum: "sha-1"},
+		"/src/changed-remotely.txt": {SHA256Checksum: "new-sha-2"},
+		"/src/changed-locally.txt":  {SHA256Checksum: "sha-3"},
+		"/src/deleted-locally.txt":  {SHA256Checksum: "sha-5"},
+		"/src/new-remotely.txt":     {SHA256Checksum: "sha-7"},
+		"/elsewhere/file.txt":       {SHA256Checksum: "sha-8"},
+	}
+	p, err = planner.CorrectDrift(localState, serverSnapshot(server))
+	require.NoError(t, err)
+
+	var requests []string
+	for req := range slices.Values(p.Requests) {
+		requests = append(requests, req.String())
+	}
+	assert.ElementsMatch(t, []string{
+		fmt.Sprintf("Planned request to download %q", "/src/changed-remotely.txt"),
+		fmt.Sprintf("Planned request to upload %q", "/src/changed-locally.txt"),
+		fmt.Sprintf("Planned request to remove local %q", "/src/deleted-remotely.txt"),
+		fmt.Sprintf("Planned request to delete %q", "/src/deleted-locally.txt"),
+		fmt.Sprintf("Planned request to upload %q", "/src/dropped-upload.txt"),
+		fmt.Sprintf("Planned request to download %q", "/src/new-remotely.txt"),
+		// remote changes only apply under the sync root
+		fmt.Sprintf("Planned request to delete %q", "/elsewhere/file.txt"),
+	}, requests)
+
+	// known to be the same already
+	p, err = planner.CorrectDrift(localState, nil)
+	require.NoError(t, err)
+	assert.Empty(t, p.Requests)
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(planner))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for family := range slices.Values(families) {
+		for m := range slices.Values(family.GetMetric()) {
+			name := family.GetName()
+			for label := range slices.Values(m.GetLabel()) {
+				name += "/" + label.GetValue()
+			}
+			values[name] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+	assert.Equal(t, 2.0, values["filesync_client_reconciles_total"])
+	assert.Equal(t, 2.0, values["filesync_client_drift_files_total/upload"])
+	assert.Equal(t, 2.0, values["filesync_client_drift_files_total/download"])
+	assert.Equal(t, 2.0, values["filesync_client_drift_files_total/delete"])
+	assert.Equal(t, 1.0, values["filesync_client_drift_files_total/remove_local"])
+	assert.Equal(t, 0.0, values["filesync_client_last_reconcile_drift_files"])
+	assert.Contains(t, values, "filesync_client_last_reconcile_timestamp_seconds")
+}
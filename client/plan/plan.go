@@ -2,22 +2,37 @@ package plan
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	restapi "github.com/hedisam/filesync/client/api/rest"
+	"github.com/hedisam/filesync/client/e2e"
 	"github.com/hedisam/filesync/client/index"
+	"github.com/hedisam/filesync/lib/fileattr"
 	"github.com/hedisam/filesync/lib/psurls"
 )
 
 type RestClient interface {
+	Namespace() string
+	Attribution() restapi.Attribution
 	UploadURL() string
-	Upload(ctx context.Context, reader io.Reader, presignedURL string, size int64) error
-	Delete(ctx context.Context, key string) error
+	LinkURL() string
+	DownloadURL() string
+	Link(ctx context.Context, presignedURL string) (bool, uint64, error)
+	Upload(ctx context.Context, reader io.Reader, presignedURL string, size int64) (uint64, error)
+	Delete(ctx context.Context, key string, ifMatch *uint64) error
+	SetAttributes(ctx context.Context, key string, attrs *fileattr.Attributes, ifMatch *uint64) (uint64, error)
+	Download(ctx context.Context, presignedURL string) (io.ReadCloser, error)
+	File(ctx context.Context, key string) (*restapi.File, error)
 }
 
 type PlanRequest interface {
@@ -43,9 +58,40 @@ func ApplyWithCreds(accessKeyID, secretKey string) Option {
 	}
 }
 
+// encryption holds the settings of the end-to-end encryption mode.
+type encryption struct {
+	keys         *e2e.Keys
+	encryptNames bool
+}
+
+// objectKey returns the key the file at the given path is stored under on the server.
+func (e *encryption) objectKey(filePath string) string {
+	if e == nil || !e.encryptNames {
+		return filePath
+	}
+	return e.keys.EncryptName(filePath)
+}
+
+// attributes returns the attributes of a file as they're synced. In end-to-end encryption mode, the server only gets
+// their mode and mtime: extended attributes can hold anything, and owners tell who's behind the files.
+func (e *encryption) attributes(a *fileattr.Attributes) *fileattr.Attributes {
+	if e == nil || a == nil {
+		return a
+	}
+	return &fileattr.Attributes{
+		Mode:  a.Mode,
+		MTime: a.MTime,
+	}
+}
+
 type uploadRequest struct {
 	logger       *logrus.Logger
+	state        *syncState
 	fileMetadata *index.FileMetadata
+	encryption   *encryption
+	// ifMatch is the version the server's file must be at for the upload to replace it, if any
+	ifMatch  *uint64
+	resolver *resolver
 }
 
 func (pr *uploadRequest) Apply(ctx context.Context, client RestClient, opts ...Option) error {
@@ -55,21 +101,70 @@ func (pr *uploadRequest) Apply(ctx context.Context, client RestClient, opts ...O
 	}
 
 	md := pr.fileMetadata
-	f, err := os.Open(md.Path)
-	if err != nil {
-		// must've been deleted; ignore
-		pr.logger.WithError(err).WithField("path", md.Path).Warn("Failed to open file for upload, ignoring")
-		return nil
+	var content io.ReadSeeker
+	switch {
+	case md.LinkTarget != "":
+		// a symlink's content is its target as indexed; if it's changed since, it's indexed and uploaded again
+		content = strings.NewReader(md.LinkTarget)
+	case md.Dir:
+		content = strings.NewReader("")
+	default:
+		f, err := os.Open(md.Path)
+		if err != nil {
+			// must've been deleted; ignore
+			pr.logger.WithError(err).WithField("path", md.Path).Warn("Failed to open file for upload, ignoring")
+			return nil
+		}
+		defer f.Close()
+		content = f
 	}
-	defer f.Close()
 
 	urlData := psurls.URLData{
+		Namespace:      client.Namespace(),
 		ObjectKey:      md.Path,
 		SHA256Checksum: md.SHA256,
 		Size:           md.Size,
 		MTime:          md.MTime,
 		Expiry:         time.Now().UTC().Add(10 * time.Minute).Unix(),
 		AccessKeyID:    cfg.accessKeyID,
+		IfMatch:        pr.ifMatch,
+		DeviceID:       client.Attribution().DeviceID,
+		Hostname:       client.Attribution().Hostname,
+		User:           client.Attribution().User,
+		Attributes:     pr.encryption.attributes(md.Attributes),
+	}
+	urlData.Type = fileType(md)
+	var body io.Reader = content
+	if pr.encryption != nil {
+		unchanged, err := pr.prepareEncryptedUpload(content, &urlData)
+		if err != nil {
+			return fmt.Errorf("prepare encrypted upload for %q: %w", md.Path, err)
+		}
+		if !unchanged {
+			// the file will be indexed and uploaded again
+			pr.logger.WithField("path", md.Path).Warn("File changed since it was indexed, skipping upload")
+			return nil
+		}
+		rc := pr.encryption.keys.EncryptReader(content, md.ContentMAC)
+		defer rc.Close()
+		body = rc
+	}
+
+	// ask the server to reuse the content if it's already stored, before uploading it
+	linkURL, err := psurls.Generate(urlData, client.LinkURL(), cfg.secretKey)
+	if err != nil {
+		return fmt.Errorf("generate presigned link url for %q: %w", md.Path, err)
+	}
+	linked, version, err := client.Link(ctx, linkURL)
+	if errors.Is(err, restapi.ErrConflict) && pr.resolver != nil {
+		return pr.resolver.resolveUpload(ctx, client, opts, pr)
+	}
+	if err != nil {
+		return fmt.Errorf("link via presigned url for %q: %w", md.Path, err)
+	}
+	if linked {
+		pr.state.set(md.Path, pr.contentID(), version)
+		return nil
 	}
 
 	url, err := psurls.Generate(urlData, client.UploadURL(), cfg.secretKey)
@@ -77,27 +172,111 @@ func (pr *uploadRequest) Apply(ctx context.Context, client RestClient, opts ...O
 		return fmt.Errorf("generate presigned url for %q: %w", md.Path, err)
 	}
 
-	err = client.Upload(ctx, f, url, md.Size)
+	version, err = client.Upload(ctx, body, url, urlData.Size)
+	if errors.Is(err, restapi.ErrConflict) && pr.resolver != nil {
+		return pr.resolver.resolveUpload(ctx, client, opts, pr)
+	}
 	if err != nil {
 		return fmt.Errorf("upload via presigned url for %q: %w", md.Path, err)
 	}
+	pr.state.set(md.Path, pr.contentID(), version)
 
 	return nil
 }
 
+// contentID returns what identifies the uploaded content, the same way remoteContentID does once it's stored.
+func (pr *uploadRequest) contentID() string {
+	if pr.encryption != nil {
+		return pr.fileMetadata.ContentMAC
+	}
+	return pr.fileMetadata.SHA256
+}
+
+// prepareEncryptedUpload makes the url data describe the encrypted content of the file rather than its plaintext. As
+// the content is encrypted deterministically, the checksum of the ciphertext can be computed without keeping it
+// around. It reports false if the content doesn't match its indexed MAC anymore. The content is rewound on return.
+func (pr *uploadRequest) prepareEncryptedUpload(f io.ReadSeeker, urlData *psurls.URLData) (bool, error) {
+	md := pr.fileMetadata
+	keys := pr.encryption.keys
+	if md.ContentMAC == "" {
+		return false, errors.New("file has no content MAC")
+	}
+
+	hasher := sha256.New()
+	w, err := keys.Encrypt(hasher, md.ContentMAC)
+	if err != nil {
+		return false, err
+	}
+	mac := keys.NewMAC()
+	written, err := io.Copy(w, io.TeeReader(f, mac))
+	if err != nil {
+		return false, fmt.Errorf("encrypt file: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return false, fmt.Errorf("encrypt file: %w", err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, fmt.Errorf("rewind file: %w", err)
+	}
+	if hex.EncodeToString(mac.Sum(nil)) != md.ContentMAC || written != md.Size {
+		return false, nil
+	}
+
+	urlData.ObjectKey = pr.encryption.objectKey(md.Path)
+	urlData.SHA256Checksum = hex.EncodeToString(hasher.Sum(nil))
+	urlData.Size = keys.EncryptedSize(md.Size)
+	urlData.ContentMAC = md.ContentMAC
+	return true, nil
+}
+
 func (pr *uploadRequest) String() string {
 	return fmt.Sprintf("Planned request to upload %q", pr.fileMetadata.Path)
 }
 
+// attributesRequest changes the attributes of a file the server has the content of already.
+type attributesRequest struct {
+	state        *syncState
+	fileMetadata *index.FileMetadata
+	encryption   *encryption
+	// ifMatch is the version the server's file must be at for its attributes to be changed, if any
+	ifMatch *uint64
+}
+
+func (pr *attributesRequest) Apply(ctx context.Context, client RestClient, _ ...Option) error {
+	md := pr.fileMetadata
+	version, err := client.SetAttributes(ctx, pr.encryption.objectKey(md.Path), pr.encryption.attributes(md.Attributes), pr.ifMatch)
+	if err != nil {
+		return fmt.Errorf("set attributes via rest client for file %q: %w", md.Path, err)
+	}
+	pr.state.set(md.Path, pr.encryption.indexedContentID(md), version)
+
+	return nil
+}
+
+func (pr *attributesRequest) String() string {
+	return fmt.Sprintf("Planned request to set the attributes of %q", pr.fileMetadata.Path)
+}
+
 type deleteRequest struct {
-	filePath string
+	state      *syncState
+	filePath   string
+	encryption *encryption
+	// ifMatch is the version the server's file must be at for the deletion to remove it, if any
+	ifMatch  *uint64
+	resolver *resolver
 }
 
-func (pr *deleteRequest) Apply(ctx context.Context, client RestClient, _ ...Option) error {
-	err := client.Delete(ctx, pr.filePath)
+func (pr *deleteRequest) Apply(ctx context.Context, client RestClient, opts ...Option) error {
+	err := client.Delete(ctx, pr.encryption.objectKey(pr.filePath), pr.ifMatch)
+	if errors.Is(err, restapi.ErrConflict) && pr.resolver != nil {
+		return pr.resolver.resolveDelete(ctx, client, opts, pr)
+	}
 	if err != nil {
 		return fmt.Errorf("delete via rest client for file %q: %w", pr.filePath, err)
 	}
+	pr.state.remove(pr.filePath)
 
 	return nil
 }
@@ -0,0 +1,755 @@
+package plan_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	restapi "github.com/hedisam/filesync/client/api/rest"
+	"github.com/hedisam/filesync/client/conflict"
+	"github.com/hedisam/filesync/client/e2e"
+	"github.com/hedisam/filesync/client/filesystem/symlink"
+	"github.com/hedisam/filesync/client/index"
+	"github.com/hedisam/filesync/client/ops"
+	"github.com/hedisam/filesync/client/plan"
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/psurls"
+)
+
+// fakeClient records the uploads it's asked to do, and serves the files it stores. Like the server, it versions the
+// uploaded files, rejecting the writes conditioned on other versions.
+type fakeClient struct {
+	uploads  map[string][]byte
+	urls     map[string]psurls.URLData
+	files    map[string][]byte
+	versions map[string]uint64
+	version  uint64
+	mtimes   map[string]int64
+	attrs    map[string]*fileattr.Attributes
+}
+
+func (c *fakeClient) Namespace() string { return "default" }
+func (c *fakeClient) Attribution() restapi.Attribution {
+	return restapi.Attribution{DeviceID: "laptop-1", Hostname: "laptop", User: "alice"}
+}
+func (c *fakeClient) UploadURL() string   { return "http://localhost/v1/files/upload" }
+func (c *fakeClient) LinkURL() string     { return "http://localhost/v1/files/link" }
+func (c *fakeClient) DownloadURL() string { return "http://localhost/v1/files/download" }
+
+func (c *fakeClient) Link(context.Context, string) (bool, uint64, error) {
+	return false, 0, nil
+}
+
+func (c *fakeClient) Upload(_ context.Context, r io.Reader, presignedURL string, size int64) (uint64, error) {
+	u, err := url.Parse(presignedURL)
+	if err != nil {
+		return 0, err
+	}
+	data, err := psurls.Validate(u.Query(), "secret")
+	if err != nil {
+		return 0, err
+	}
+	if data.IfMatch != nil && *data.IfMatch != c.versions[data.ObjectKey] {
+		return 0, restapi.ErrConflict
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	c.uploads[data.ObjectKey] = content
+	c.urls[data.ObjectKey] = data
+	if c.versions == nil {
+		c.versions = make(map[string]uint64)
+	}
+	c.version++
+	c.versions[data.ObjectKey] = c.version
+	return c.version, nil
+}
+
+func (c *fakeClient) Delete(_ context.Context, key string, ifMatch *uint64) error {
+	if ifMatch != nil && *ifMatch != c.versions[key] {
+		return restapi.ErrConflict
+	}
+	delete(c.versions, key)
+	return nil
+}
+
+func (c *fakeClient) SetAttributes(_ context.Context, key string, attrs *fileattr.Attributes, ifMatch *uint64) (uint64, error) {
+	version, ok := c.versions[key]
+	if !ok || ifMatch != nil && *ifMatch != version {
+		return 0, restapi.ErrConflict
+	}
+	if c.attrs == nil {
+		c.attrs = make(map[string]*fileattr.Attributes)
+	}
+	c.attrs[key] = attrs
+	c.version++
+	c.versions[key] = c.version
+	return c.version, nil
+}
+
+func (c *fakeClient) Download(_ context.Context, presignedURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(presignedURL)
+	if err != nil {
+		return nil, err
+	}
+	data, err := psurls.Validate(u.Query(), "secret")
+	if err != nil {
+		return nil, err
+	}
+	content, ok := c.files[data.ObjectKey]
+	if !ok {
+		return nil, restapi.ErrFileChanged
+	}
+	if data.SHA256Checksum != checksum(content) {
+		return nil, restapi.ErrFileChanged
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (c *fakeClient) File(_ context.Context, key string) (*restapi.File, error) {
+	version, ok := c.versions[key]
+	if !ok {
+		return nil, nil
+	}
+	content, ok := c.files[key]
+	if !ok {
+		content = c.uploads[key]
+	}
+	return &restapi.File{
+		Key:            key,
+		SHA256Checksum: checksum(content),
+		MTime:          c.mtimes[key],
+		Version:        version,
+	}, nil
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestApplyEncryptedUpload(t *testing.T) {
+	keys, err := e2e.DeriveKeys("passphrase", "default")
+	require.NoError(t, err)
+
+	content := []byte("top secret content")
+	path := filepath.Join(t.TempDir(), "secret.txt")
+	require.NoError(t, os.WriteFile(path, content, 0644))
+	mac := keys.NewMAC()
+	mac.Write(content)
+	md := &index.FileMetadata{
+		Path:       path,
+		Size:       int64(len(content)),
+		SHA256:     "plaintext-sha",
+		ContentMAC: hex.EncodeToString(mac.Sum(nil)),
+		Op:         ops.OpCreated,
+	}
+
+	client := &fakeClient{uploads: make(map[string][]byte), urls: make(map[string]psurls.URLData)}
+	planner := plan.NewPlanner(logrus.New(), plan.WithEncryption(keys, true))
+	p, err := planner.Generate(map[string]*index.FileMetadata{path: md}, nil, nil)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 1)
+	require.NoError(t, p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+
+	require.Len(t, client.uploads, 1)
+	key := keys.EncryptName(path)
+	uploaded, ok := client.uploads[key]
+	require.True(t, ok, "the file must be uploaded under its encrypted name")
+	assert.False(t, bytes.Contains(uploaded, content))
+
+	// the url commits to the ciphertext, which the server verifies, and carries the MAC for change detection
+	sum := sha256.Sum256(uploaded)
+	urlData := client.urls[key]
+	assert.Equal(t, hex.EncodeToString(sum[:]), urlData.SHA256Checksum)
+	assert.EqualValues(t, len(uploaded), urlData.Size)
+	assert.Equal(t, md.ContentMAC, urlData.ContentMAC)
+	// and tells who's uploading it
+	assert.Equal(t, "laptop-1", urlData.DeviceID)
+	assert.Equal(t, "laptop", urlData.Hostname)
+	assert.Equal(t, "alice", urlData.User)
+
+	r, err := keys.Decrypt(bytes.NewReader(uploaded))
+	require.NoError(t, err)
+	decrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content, decrypted)
+
+	// a file changed since it was indexed is skipped rather than uploaded with a stale MAC
+	require.NoError(t, os.WriteFile(path, []byte("changed"), 0644))
+	client.uploads = make(map[string][]byte)
+	require.NoError(t, p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	assert.Empty(t, client.uploads)
+}
+
+func TestApplyRemoteChanges(t *testing.T) {
+	dir := t.TempDir()
+	synced := filepath.Join(dir, "synced.txt")
+	edited := filepath.Join(dir, "edited.txt")
+	created := filepath.Join(dir, "sub", "created.txt")
+	for path := range slices.Values([]string{synced, edited}) {
+		require.NoError(t, os.WriteFile(path, []byte("v1"), 0600))
+	}
+
+	local := map[string]*index.FileMetadata{
+		synced: {Path: synced, SHA256: checksum([]byte("v1")), Op: ops.OpCreated},
+		edited: {Path: edited, SHA256: checksum([]byte("v1")), Op: ops.OpCreated},
+	}
+	server := map[string]*restapi.File{
+		synced: {SHA256Checksum: checksum([]byte("v1"))},
+		edited: {SHA256Checksum: checksum([]byte("v1"))},
+	}
+	planner := plan.NewPlanner(logrus.New(), plan.WithRemoteChanges(dir))
+	p, err := planner.Generate(local, serverSnapshot(server), nil)
+	require.NoError(t, err)
+	require.Empty(t, p.Requests)
+
+	// edited locally after the changes were planned, but before they're applied
+	require.NoError(t, os.WriteFile(edited, []byte("local v2"), 0600))
+	client := &fakeClient{files: map[string][]byte{
+		synced:  []byte("remote v2"),
+		edited:  []byte("remote v2"),
+		created: []byte("remote v1"),
+	}}
+	remote := &plan.Remote{
+		Changes: []restapi.Change{
+			{Op: restapi.ChangePut, Key: synced, File: &restapi.File{SHA256Checksum: checksum([]byte("remote v2"))}},
+			{Op: restapi.ChangePut, Key: edited, File: &restapi.File{SHA256Checksum: checksum([]byte("remote v2"))}},
+			{Op: restapi.ChangePut, Key: created, File: &restapi.File{SHA256Checksum: checksum([]byte("remote v1"))}},
+		},
+	}
+	p, err = planner.Generate(nil, nil, remote)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 3)
+	for req := range slices.Values(p.Requests) {
+		require.NoError(t, req.Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	}
+
+	content, err := os.ReadFile(synced)
+	require.NoError(t, err)
+	assert.Equal(t, "remote v2", string(content))
+	st, err := os.Stat(synced)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), st.Mode().Perm(), "the file mode must be kept")
+	content, err = os.ReadFile(edited)
+	require.NoError(t, err)
+	assert.Equal(t, "local v2", string(content), "local changes must win")
+	content, err = os.ReadFile(created)
+	require.NoError(t, err)
+	assert.Equal(t, "remote v1", string(content))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3, "no temporary files must be left behind")
+
+	// deleted on the server; the file edited locally is kept
+	remote = &plan.Remote{
+		Changes: []restapi.Change{
+			{Op: restapi.ChangeDelete, Key: synced},
+			{Op: restapi.ChangeDelete, Key: created},
+		},
+	}
+	p, err = planner.Generate(nil, nil, remote)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 2)
+	require.NoError(t, os.WriteFile(created, []byte("local v2"), 0644))
+	for req := range slices.Values(p.Requests) {
+		require.NoError(t, req.Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	}
+	_, err = os.Stat(synced)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(created)
+	assert.NoError(t, err)
+}
+
+func TestApplyAttributes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "run.sh")
+	created := filepath.Join(dir, "tool.sh")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"), 0644))
+	mtime := time.Date(2024, 6, 1, 12, 0, 0, 123456789, time.UTC)
+
+	// made executable locally; only the attributes are sent
+	require.NoError(t, os.Chmod(path, 0755))
+	st, err := os.Stat(path)
+	require.NoError(t, err)
+	local := map[string]*index.FileMetadata{
+		path: {Path: path, SHA256: checksum([]byte("#!/bin/sh\n")), Op: ops.OpModified, Attributes: fileattr.Read(path, st)},
+	}
+	server := map[string]*restapi.File{
+		path: {SHA256Checksum: checksum([]byte("#!/bin/sh\n")), Version: 1, Attributes: &fileattr.Attributes{Mode: 0o644}},
+	}
+	planner := plan.NewPlanner(logrus.New(), plan.WithRemoteChanges(dir))
+	p, err := planner.Generate(local, serverSnapshot(server), nil)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 1)
+	client := &fakeClient{
+		files:    map[string][]byte{created: []byte("#!/bin/sh\n")},
+		versions: map[string]uint64{path: 1},
+		version:  1,
+	}
+	require.NoError(t, p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	require.Contains(t, client.attrs, path)
+	assert.Equal(t, uint32(0o755), client.attrs[path].Mode)
+	assert.Equal(t, uint64(2), client.versions[path])
+
+	// changed on the server: the attributes of the file synced already are applied, and a downloaded file gets them
+	remote := &plan.Remote{
+		Changes: []restapi.Change{
+			{Op: restapi.ChangePut, Key: path, File: &restapi.File{
+				SHA256Checksum: checksum([]byte("#!/bin/sh\n")),
+				Version:        3,
+				Attributes:     &fileattr.Attributes{Mode: 0o700, MTime: mtime.UnixNano()},
+			}},
+			{Op: restapi.ChangePut, Key: created, File: &restapi.File{
+				SHA256Checksum: checksum([]byte("#!/bin/sh\n")),
+				Attributes:     &fileattr.Attributes{Mode: 0o750, MTime: mtime.UnixNano()},
+			}},
+		},
+	}
+	p, err = planner.Generate(nil, nil, remote)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 2)
+	for req := range slices.Values(p.Requests) {
+		require.NoError(t, req.Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	}
+
+	for path, mode := range map[string]os.FileMode{path: 0700, created: 0750} {
+		st, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, mode, st.Mode().Perm())
+		assert.True(t, mtime.Equal(st.ModTime()), "the mtime must be kept to the nanosecond")
+	}
+}
+
+func TestApplySymlinks(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Symlink("target.txt", link))
+	local := map[string]*index.FileMetadata{
+		link: {Path: link, SHA256: checksum([]byte("target.txt")), Size: 10, LinkTarget: "target.txt", Op: ops.OpCreated},
+	}
+
+	// the server has a regular file with the symlink's target as content, which isn't the same
+	server := map[string]*restapi.File{
+		link: {SHA256Checksum: checksum([]byte("target.txt")), Version: 1},
+	}
+	planner := plan.NewPlanner(logrus.New(), plan.WithRemoteChanges(dir), plan.WithSymlinks(symlink.Store))
+	p, err := planner.Generate(local, serverSnapshot(server), nil)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 1)
+	client := &fakeClient{
+		uploads:  make(map[string][]byte),
+		urls:     make(map[string]psurls.URLData),
+		versions: map[string]uint64{link: 1},
+		version:  1,
+	}
+	require.NoError(t, p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	assert.Equal(t, "target.txt", string(client.uploads[link]))
+	assert.Equal(t, psurls.TypeSymlink, client.urls[link].Type)
+
+	// created on the server by another device
+	created := filepath.Join(dir, "sub", "created")
+	client.files = map[string][]byte{created: []byte("../target.txt")}
+	remote := &plan.Remote{
+		Changes: []restapi.Change{
+			{Op: restapi.ChangePut, Key: created, File: &restapi.File{SHA256Checksum: checksum([]byte("../target.txt")), Type: restapi.TypeSymlink}},
+		},
+	}
+	p, err = planner.Generate(nil, nil, remote)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 1)
+	require.NoError(t, p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	target, err := os.Readlink(created)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("..", "target.txt"), target)
+
+	// left alone if symlinks aren't stored as such
+	ignoring := plan.NewPlanner(logrus.New(), plan.WithRemoteChanges(dir))
+	p, err = ignoring.Generate(nil, nil, remote)
+	require.NoError(t, err)
+	assert.Empty(t, p.Requests)
+	server = map[string]*restapi.File{
+		created: {SHA256Checksum: checksum([]byte("../target.txt")), Type: restapi.TypeSymlink, Version: 2},
+	}
+	p, err = ignoring.Generate(map[string]*index.FileMetadata{}, serverSnapshot(server), nil)
+	require.NoError(t, err)
+	assert.Empty(t, p.Requests, "the server's symlinks must not be deleted")
+}
+
+func TestApplyOutsideRoot(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	planner := plan.NewPlanner(logrus.New(), plan.WithRemoteChanges(dir), plan.WithSymlinks(symlink.Store))
+	client := &fakeClient{files: make(map[string][]byte)}
+	apply := func(t *testing.T, changes ...restapi.Change) {
+		p, err := planner.Generate(nil, nil, &plan.Remote{Changes: changes})
+		require.NoError(t, err)
+		for req := range slices.Values(p.Requests) {
+			require.NoError(t, req.Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+		}
+	}
+
+	t.Run("hostile symlink targets", func(t *testing.T) {
+		for target := range slices.Values([]string{"../../etc", "sub/../../..", filepath.ToSlash(outside)}) {
+			link := filepath.Join(dir, "sub", "link")
+			client.files[link] = []byte(target)
+			apply(t, restapi.Change{Op: restapi.ChangePut, Key: link, File: &restapi.File{SHA256Checksum: checksum([]byte(target)), Type: restapi.TypeSymlink}})
+			_, err := os.Lstat(link)
+			assert.ErrorIs(t, err, os.ErrNotExist, "a symlink to %q must not be created", target)
+		}
+
+		// nor one going through another symlink leading outside
+		require.NoError(t, os.Symlink(outside, filepath.Join(dir, "away")))
+		link := filepath.Join(dir, "link")
+		client.files[link] = []byte("away/docs")
+		apply(t, restapi.Change{Op: restapi.ChangePut, Key: link, File: &restapi.File{SHA256Checksum: checksum([]byte("away/docs")), Type: restapi.TypeSymlink}})
+		_, err := os.Lstat(link)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("writes and removes through symlinked directories", func(t *testing.T) {
+		require.NoError(t, os.Symlink(outside, filepath.Join(dir, "docs")))
+		victim := filepath.Join(outside, "victim.txt")
+		require.NoError(t, os.WriteFile(victim, []byte("keep"), 0644))
+
+		file := filepath.Join(dir, "docs", "x.txt")
+		client.files[file] = []byte("content")
+		apply(t,
+			restapi.Change{Op: restapi.ChangePut, Key: file, File: &restapi.File{SHA256Checksum: checksum([]byte("content"))}},
+			restapi.Change{Op: restapi.ChangePut, Key: filepath.Join(dir, "docs", "sub"), File: &restapi.File{SHA256Checksum: checksum(nil), Type: restapi.TypeDir}},
+		)
+		_, err := os.Stat(filepath.Join(outside, "x.txt"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = os.Stat(filepath.Join(outside, "sub"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		// synced before the directory was replaced with the symlink
+		synced := filepath.Join(dir, "docs", "victim.txt")
+		_, err = planner.Generate(
+			map[string]*index.FileMetadata{synced: {Path: synced, SHA256: checksum([]byte("keep")), Op: ops.OpCreated}},
+			serverSnapshot(map[string]*restapi.File{synced: {SHA256Checksum: checksum([]byte("keep"))}}),
+			nil,
+		)
+		require.NoError(t, err)
+		apply(t, restapi.Change{Op: restapi.ChangeDelete, Key: synced})
+		content, err := os.ReadFile(victim)
+		require.NoError(t, err)
+		assert.Equal(t, "keep", string(content))
+	})
+}
+
+func TestApplyDirectories(t *testing.T) {
+	dir := t.TempDir()
+	logs := filepath.Join(dir, "logs")
+	require.NoError(t, os.Mkdir(logs, 0755))
+	local := map[string]*index.FileMetadata{
+		logs: {Path: logs, SHA256: checksum(nil), Dir: true, Op: ops.OpCreated},
+	}
+
+	planner := plan.NewPlanner(logrus.New(), plan.WithRemoteChanges(dir))
+	p, err := planner.Generate(local, serverSnapshot(map[string]*restapi.File{}), nil)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 1)
+	client := &fakeClient{
+		uploads: make(map[string][]byte),
+		urls:    make(map[string]psurls.URLData),
+	}
+	require.NoError(t, p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	assert.Empty(t, client.uploads[logs])
+	assert.Equal(t, psurls.TypeDir, client.urls[logs].Type)
+
+	// created on the server by another device
+	tmp := filepath.Join(dir, "scaffold", "tmp")
+	remote := &plan.Remote{
+		Changes: []restapi.Change{
+			{Op: restapi.ChangePut, Key: tmp, File: &restapi.File{SHA256Checksum: checksum(nil), Type: restapi.TypeDir}},
+		},
+	}
+	p, err = planner.Generate(nil, nil, remote)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 1)
+	require.NoError(t, p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	st, err := os.Stat(tmp)
+	require.NoError(t, err)
+	assert.True(t, st.IsDir())
+
+	// deleted on the server; kept while it has files
+	require.NoError(t, os.WriteFile(filepath.Join(tmp, "file.txt"), []byte("content"), 0644))
+	remote = &plan.Remote{
+		Changes: []restapi.Change{{Op: restapi.ChangeDelete, Key: tmp}},
+	}
+	p, err = planner.Generate(nil, nil, remote)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 1)
+	require.NoError(t, p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	_, err = os.Stat(tmp)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Remove(filepath.Join(tmp, "file.txt")))
+	require.NoError(t, p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+	_, err = os.Stat(tmp)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestApplyConflict(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+	edit := func(content string) map[string]*index.FileMetadata {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return map[string]*index.FileMetadata{
+			path: {Path: path, SHA256: checksum([]byte(content)), Size: int64(len(content)), Op: ops.OpModified},
+		}
+	}
+	apply := func(client *fakeClient, p *plan.Plan) error {
+		require.Len(t, p.Requests, 1)
+		return p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret"))
+	}
+
+	planner := plan.NewPlanner(logrus.New(), plan.WithRemoteChanges(dir))
+	p, err := planner.Generate(edit("v1"), serverSnapshot(map[string]*restapi.File{
+		path: {SHA256Checksum: checksum([]byte("v1")), Version: 3},
+	}), nil)
+	require.NoError(t, err)
+	require.Empty(t, p.Requests)
+
+	client := &fakeClient{
+		uploads:  make(map[string][]byte),
+		urls:     make(map[string]psurls.URLData),
+		versions: map[string]uint64{path: 3},
+		version:  3,
+	}
+	// our own uploads aren't seen on the server yet
+	remote := &plan.Remote{
+		Files: map[string]*restapi.File{
+			path: {SHA256Checksum: checksum([]byte("v1")), Version: 3},
+		},
+	}
+	p, err = planner.Generate(edit("v2"), nil, remote)
+	require.NoError(t, err)
+	require.NoError(t, apply(client, p))
+	assert.Equal(t, uint64(3), *client.urls[path].IfMatch)
+	p, err = planner.Generate(edit("v3"), nil, remote)
+	require.NoError(t, err)
+	require.NoError(t, apply(client, p))
+	assert.Equal(t, uint64(4), *client.urls[path].IfMatch, "the local changes are based on our own upload")
+
+	// changed on the server by someone else, which is reported rather than written over
+	client.versions[path] = 9
+	p, err = planner.Generate(edit("v4"), nil, remote)
+	require.NoError(t, err)
+	assert.ErrorIs(t, apply(client, p), restapi.ErrConflict)
+	assert.Equal(t, "v3", string(client.uploads[path]))
+
+	require.NoError(t, os.Remove(path))
+	p, err = planner.Generate(map[string]*index.FileMetadata{path: {Path: path, Op: ops.OpRemoved}}, nil, remote)
+	require.NoError(t, err)
+	assert.ErrorIs(t, apply(client, p), restapi.ErrConflict)
+	assert.Equal(t, uint64(9), client.versions[path])
+
+	// a new file must not exist on the server yet
+	created := filepath.Join(dir, "created.txt")
+	require.NoError(t, os.WriteFile(created, []byte("new"), 0644))
+	client.versions[created] = 10
+	p, err = planner.Generate(map[string]*index.FileMetadata{
+		created: {Path: created, SHA256: checksum([]byte("new")), Size: 3, Op: ops.OpCreated},
+	}, serverSnapshot(map[string]*restapi.File{}), nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, apply(client, p), restapi.ErrConflict)
+	delete(client.versions, created)
+	require.NoError(t, apply(client, p))
+	assert.Equal(t, uint64(0), *client.urls[created].IfMatch)
+}
+
+func TestResolveConflict(t *testing.T) {
+	localTime := time.Date(2024, 6, 1, 15, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		strategy      conflict.Strategy
+		localDeleted  bool
+		remoteDeleted bool
+		// remoteChange makes the conflict found applying the remote change rather than uploading the local one
+		remoteChange   bool
+		remoteMTime    time.Time
+		wantLocal      string
+		wantCopy       bool
+		wantUpload     bool
+		wantDeleted    bool
+		wantResolution string
+	}{
+		"keep both": {
+			strategy:       conflict.KeepBoth,
+			wantLocal:      "remote v2",
+			wantCopy:       true,
+			wantResolution: "kept both",
+		},
+		"keep both found applying the remote change": {
+			strategy:       conflict.KeepBoth,
+			remoteChange:   true,
+			wantLocal:      "remote v2",
+			wantCopy:       true,
+			wantResolution: "kept both",
+		},
+		"keep both restores the file deleted locally": {
+			strategy:       conflict.KeepBoth,
+			localDeleted:   true,
+			wantLocal:      "remote v2",
+			wantResolution: "kept remote",
+		},
+		"keep both uploads the file deleted on the server again": {
+			strategy:       conflict.KeepBoth,
+			remoteDeleted:  true,
+			wantLocal:      "local v2",
+			wantUpload:     true,
+			wantResolution: "kept local",
+		},
+		"local wins": {
+			strategy:       conflict.LocalWins,
+			wantLocal:      "local v2",
+			wantUpload:     true,
+			wantResolution: "kept local",
+		},
+		"local wins deletes the file on the server": {
+			strategy:       conflict.LocalWins,
+			localDeleted:   true,
+			wantDeleted:    true,
+			wantResolution: "kept local",
+		},
+		"remote wins": {
+			strategy:       conflict.RemoteWins,
+			wantLocal:      "remote v2",
+			wantResolution: "kept remote",
+		},
+		"remote wins removes the local file": {
+			strategy:       conflict.RemoteWins,
+			remoteDeleted:  true,
+			wantResolution: "kept remote",
+		},
+		"newest wins with the local version": {
+			strategy:       conflict.NewestWins,
+			remoteMTime:    localTime.Add(-time.Minute),
+			wantLocal:      "local v2",
+			wantUpload:     true,
+			wantResolution: "kept local",
+		},
+		"newest wins with the remote version": {
+			strategy:       conflict.NewestWins,
+			remoteMTime:    localTime.Add(time.Minute),
+			wantLocal:      "remote v2",
+			wantResolution: "kept remote",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "doc.txt")
+			logPath := filepath.Join(t.TempDir(), "conflicts.log")
+			planner := plan.NewPlanner(
+				logrus.New(),
+				plan.WithRemoteChanges(dir),
+				plan.WithConflictResolution(&conflict.Policy{Default: tc.strategy}, conflict.NewLog(logPath), "laptop"),
+			)
+
+			require.NoError(t, os.WriteFile(path, []byte("v1"), 0644))
+			p, err := planner.Generate(map[string]*index.FileMetadata{
+				path: {Path: path, SHA256: checksum([]byte("v1")), Size: 2, Op: ops.OpCreated},
+			}, serverSnapshot(map[string]*restapi.File{
+				path: {SHA256Checksum: checksum([]byte("v1")), Version: 3},
+			}), nil)
+			require.NoError(t, err)
+			require.Empty(t, p.Requests)
+
+			client := &fakeClient{
+				uploads:  make(map[string][]byte),
+				urls:     make(map[string]psurls.URLData),
+				files:    make(map[string][]byte),
+				versions: make(map[string]uint64),
+				version:  5,
+				mtimes:   map[string]int64{path: tc.remoteMTime.Unix()},
+			}
+			remoteFile := &restapi.File{Key: path, SHA256Checksum: checksum([]byte("remote v2")), Version: 5}
+			if !tc.remoteDeleted {
+				client.files[path] = []byte("remote v2")
+				client.versions[path] = 5
+			}
+
+			local := map[string]*index.FileMetadata{
+				path: {Path: path, Op: ops.OpRemoved},
+			}
+			if tc.localDeleted {
+				require.NoError(t, os.Remove(path))
+			} else {
+				require.NoError(t, os.WriteFile(path, []byte("local v2"), 0644))
+				require.NoError(t, os.Chtimes(path, localTime, localTime))
+				local[path] = &index.FileMetadata{Path: path, SHA256: checksum([]byte("local v2")), Size: 8, Op: ops.OpModified}
+			}
+			var remote *plan.Remote
+			if tc.remoteChange {
+				// the local change is yet to be indexed
+				local = nil
+				remote = &plan.Remote{
+					Changes: []restapi.Change{{Op: restapi.ChangePut, Key: path, File: remoteFile}},
+				}
+			}
+			p, err = planner.Generate(local, nil, remote)
+			require.NoError(t, err)
+			require.Len(t, p.Requests, 1)
+			require.NoError(t, p.Requests[0].Apply(context.Background(), client, plan.ApplyWithCreds("aki", "secret")))
+
+			content, err := os.ReadFile(path)
+			if tc.wantLocal == "" {
+				assert.ErrorIs(t, err, os.ErrNotExist)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.wantLocal, string(content))
+			}
+			copies, err := filepath.Glob(filepath.Join(dir, "doc (conflict from laptop *).txt"))
+			require.NoError(t, err)
+			if tc.wantCopy {
+				require.Len(t, copies, 1)
+				content, err = os.ReadFile(copies[0])
+				require.NoError(t, err)
+				assert.Equal(t, "local v2", string(content))
+			} else {
+				assert.Empty(t, copies)
+			}
+			if tc.wantUpload {
+				assert.Equal(t, "local v2", string(client.uploads[path]))
+				var wantIfMatch uint64
+				if !tc.remoteDeleted {
+					wantIfMatch = 5
+				}
+				assert.Equal(t, wantIfMatch, *client.urls[path].IfMatch, "the local version must be written over the server's")
+			} else {
+				assert.Empty(t, client.uploads)
+			}
+			_, exists := client.versions[path]
+			assert.Equal(t, tc.wantDeleted, !exists && !tc.remoteDeleted)
+
+			records, err := conflict.ReadLog(logPath)
+			require.NoError(t, err)
+			require.Len(t, records, 1)
+			assert.Equal(t, "doc.txt", records[0].Path)
+			assert.Equal(t, tc.strategy, records[0].Strategy)
+			assert.Equal(t, tc.wantResolution, records[0].Resolution)
+			assert.Equal(t, tc.localDeleted, records[0].LocalDeleted)
+			assert.Equal(t, tc.remoteDeleted, records[0].RemoteDeleted)
+			if tc.wantCopy {
+				assert.Equal(t, copies[0], records[0].Copy)
+			}
+		})
+	}
+}
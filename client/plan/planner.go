@@ -1,26 +1,145 @@
 package plan
 
 import (
+	"fmt"
+	"iter"
 	"maps"
+	"slices"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 
 	restapi "github.com/hedisam/filesync/client/api/rest"
+	"github.com/hedisam/filesync/client/e2e"
+	"github.com/hedisam/filesync/client/filesystem/symlink"
 	"github.com/hedisam/filesync/client/index"
 	"github.com/hedisam/filesync/client/ops"
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/hashtree"
 )
 
 type Planner struct {
-	logger *logrus.Logger
+	logger     *logrus.Logger
+	encryption *encryption
+	state      *syncState
+	// syncRoot is the directory remote changes are applied to, if they are
+	syncRoot string
+	// conflicts resolves the conflicts of the files under the sync root, if they are
+	conflicts *resolver
+	// symlinks is how symlinks are synced, which are ignored by default
+	symlinks symlink.Policy
+
+	mu      sync.Mutex
+	metrics driftMetrics
+}
+
+type PlannerOption func(*Planner)
+
+// WithEncryption makes the Planner plan uploads of end-to-end encrypted files, with their names encrypted too if
+// encryptNames is set. Files are then compared with the server's by their content MAC instead of their checksum,
+// since the server only knows the checksum of the ciphertext.
+func WithEncryption(keys *e2e.Keys, encryptNames bool) PlannerOption {
+	return func(p *Planner) {
+		p.encryption = &encryption{
+			keys:         keys,
+			encryptNames: encryptNames,
+		}
+	}
 }
 
-func NewPlanner(logger *logrus.Logger) *Planner {
-	return &Planner{
+// WithRemoteChanges makes the Planner plan applying the changes made on the server by other devices to the files
+// under the given directory, downloading the files put and removing the ones deleted. Local changes win: files
+// changed locally since they were last synced are uploaded instead, whatever the server has.
+func WithRemoteChanges(syncRoot string) PlannerOption {
+	return func(p *Planner) {
+		p.syncRoot = syncRoot
+	}
+}
+
+// WithSymlinks makes the Planner sync symlinks as the given policy says, which must be the one they're indexed with.
+// The symlinks the server has are only recreated locally if they're stored as such; otherwise, they're neither
+// downloaded nor deleted from the server.
+func WithSymlinks(policy symlink.Policy) PlannerOption {
+	return func(p *Planner) {
+		p.symlinks = policy
+	}
+}
+
+func NewPlanner(logger *logrus.Logger, opts ...PlannerOption) *Planner {
+	p := &Planner{
 		logger: logger,
+		state:  newSyncState(),
+		metrics: driftMetrics{
+			driftFiles: make(map[string]int64, len(driftActions)),
+		},
+	}
+	for opt := range slices.Values(opts) {
+		opt(p)
+	}
+	return p
+}
+
+func (p *Planner) newUploadRequest(md *index.FileMetadata, ifMatch *uint64) *uploadRequest {
+	return &uploadRequest{
+		logger:       p.logger,
+		state:        p.state,
+		fileMetadata: md,
+		encryption:   p.encryption,
+		ifMatch:      ifMatch,
+		resolver:     p.resolver(),
 	}
 }
 
-func (p *Planner) Generate(localSnapshot map[string]*index.FileMetadata, serverSnapshot map[string]*restapi.File) *Plan {
+func (p *Planner) newAttributesRequest(md *index.FileMetadata, ifMatch *uint64) *attributesRequest {
+	return &attributesRequest{
+		state:        p.state,
+		fileMetadata: md,
+		encryption:   p.encryption,
+		ifMatch:      ifMatch,
+	}
+}
+
+func (p *Planner) newDeleteRequest(filePath string, ifMatch *uint64) *deleteRequest {
+	return &deleteRequest{
+		state:      p.state,
+		filePath:   filePath,
+		encryption: p.encryption,
+		ifMatch:    ifMatch,
+		resolver:   p.resolver(),
+	}
+}
+
+// expectedVersion returns the version the server's file must be at for the local changes of the file at the given
+// path to be written over it, so changes made on the server meanwhile are reported as conflicts rather than lost.
+// When remote changes are applied, it's the version the file was last synced with, as the local changes are based on
+// it. Otherwise, or if it's not known, it's the version the server was seen to have the file at, 0 for none, which
+// only guards against changes made since. seen tells whether the given remote file, nil if the server has none, was
+// seen at all; the write is unconditional if no version is known.
+func (p *Planner) expectedVersion(filePath string, remoteFile *restapi.File, seen bool) *uint64 {
+	if p.syncRoot != "" {
+		if version := p.state.version(filePath); version != 0 {
+			return &version
+		}
+	}
+	if !seen {
+		return nil
+	}
+	var version uint64
+	if remoteFile != nil {
+		if remoteFile.Version == 0 {
+			// the server doesn't version files
+			return nil
+		}
+		version = remoteFile.Version
+	}
+	return &version
+}
+
+// Generate plans syncing the local changes with the server. Given the server snapshot, the local snapshot is compared
+// with it as a whole, as the server's files are read, so the server snapshot is never held in memory. Otherwise, the
+// local changes are planned as they are, unless the given remote view shows the server has them already, along with
+// the remote changes if the Planner applies them.
+func (p *Planner) Generate(localSnapshot map[string]*index.FileMetadata, serverSnapshot iter.Seq2[*restapi.File, error], remote *Remote) (*Plan, error) {
 	if serverSnapshot != nil {
 		return p.generateWithServerSnapshot(localSnapshot, serverSnapshot)
 	}
@@ -30,13 +149,24 @@ func (p *Planner) Generate(localSnapshot map[string]*index.FileMetadata, serverS
 	for filePath, localFile := range localSnapshot {
 		switch localFile.Op {
 		case ops.OpCreated, ops.OpModified:
-			requests = append(requests, &uploadRequest{
-				fileMetadata: localFile,
-			})
+			remoteFile, seen := remote.file(p.encryption.objectKey(filePath))
+			if remoteFile != nil && p.sameContent(localFile, remoteFile) {
+				// e.g. a file we've just downloaded
+				p.state.set(filePath, p.encryption.remoteContentID(remoteFile), remoteFile.Version)
+				if !p.sameAttributes(localFile, remoteFile) {
+					requests = append(requests, p.newAttributesRequest(localFile, p.expectedVersion(filePath, remoteFile, seen)))
+				}
+				continue
+			}
+			requests = append(requests, p.newUploadRequest(localFile, p.expectedVersion(filePath, remoteFile, seen)))
 		case ops.OpRemoved:
-			requests = append(requests, &deleteRequest{
-				filePath: filePath,
-			})
+			remoteFile, seen := remote.file(p.encryption.objectKey(filePath))
+			if remoteFile == nil && seen {
+				// e.g. a file we've just removed as it was deleted on the server
+				p.state.remove(filePath)
+				continue
+			}
+			requests = append(requests, p.newDeleteRequest(filePath, p.expectedVersion(filePath, remoteFile, seen)))
 		default:
 			p.logger.WithFields(logrus.Fields{
 				"op":        localFile.Op,
@@ -46,12 +176,16 @@ func (p *Planner) Generate(localSnapshot map[string]*index.FileMetadata, serverS
 		}
 	}
 
+	if remote != nil && p.syncRoot != "" {
+		requests = append(requests, p.remoteRequests(localSnapshot, remote.Changes)...)
+	}
+
 	return &Plan{
 		Requests: requests,
-	}
+	}, nil
 }
 
-func (p *Planner) generateWithServerSnapshot(localSnapshot map[string]*index.FileMetadata, serverSnapshot map[string]*restapi.File) *Plan {
+func (p *Planner) generateWithServerSnapshot(localSnapshot map[string]*index.FileMetadata, serverSnapshot iter.Seq2[*restapi.File, error]) (*Plan, error) {
 	var requests []PlanRequest
 
 	// delete the removed ops; we simply compare the local snapshot with the server's and plan a deletion
@@ -60,6 +194,38 @@ func (p *Planner) generateWithServerSnapshot(localSnapshot map[string]*index.Fil
 		return md.Op == ops.OpRemoved
 	})
 
+	// the local files the server has
+	seen := make(map[string]bool)
+	for remoteFile, err := range serverSnapshot {
+		if err != nil {
+			return nil, fmt.Errorf("read server snapshot: %w", err)
+		}
+		filePath, ok := p.localPath(remoteFile.Key)
+		if !ok {
+			continue
+		}
+		localFile, ok := localSnapshot[filePath]
+		if !ok {
+			if p.ignoresRemote(remoteFile) {
+				continue
+			}
+			requests = append(requests, p.newDeleteRequest(filePath, p.expectedVersion(filePath, remoteFile, true)))
+			continue
+		}
+		seen[filePath] = true
+		if localFile.Op != ops.OpCreated && localFile.Op != ops.OpModified {
+			continue
+		}
+		if !p.sameContent(localFile, remoteFile) {
+			requests = append(requests, p.newUploadRequest(localFile, p.expectedVersion(filePath, remoteFile, true)))
+			continue
+		}
+		p.state.set(filePath, p.encryption.remoteContentID(remoteFile), remoteFile.Version)
+		if !p.sameAttributes(localFile, remoteFile) {
+			requests = append(requests, p.newAttributesRequest(localFile, p.expectedVersion(filePath, remoteFile, true)))
+		}
+	}
+
 	for fileName, localFile := range localSnapshot {
 		if localFile.Op != ops.OpCreated && localFile.Op != ops.OpModified {
 			p.logger.WithFields(logrus.Fields{
@@ -68,24 +234,115 @@ func (p *Planner) generateWithServerSnapshot(localSnapshot map[string]*index.Fil
 			}).Warn("Unknown file operation while generating plan with server snapshot, dropping")
 			continue
 		}
-
-		remoteFile, ok := serverSnapshot[fileName]
-		if !ok || localFile.SHA256 != remoteFile.SHA256Checksum {
-			requests = append(requests, &uploadRequest{
-				fileMetadata: localFile,
-			})
+		if !seen[fileName] {
+			requests = append(requests, p.newUploadRequest(localFile, p.expectedVersion(fileName, nil, true)))
 		}
 	}
-	for filePath := range serverSnapshot {
-		_, ok := localSnapshot[filePath]
+
+	return &Plan{
+		Requests: requests,
+	}, nil
+}
+
+// Reconcile plans syncing the local files with the server's by comparing their hash trees, descending only into the
+// directories that differ rather than comparing every file. It plans the same as Generate given the server snapshot:
+// local files the server doesn't have, or has with other content, are uploaded, and the server's files missing
+// locally are deleted. The local snapshot must have all the local files, as the first one does.
+func (p *Planner) Reconcile(localSnapshot map[string]*index.FileMetadata, localTree, serverTree hashtree.Source) (*Plan, error) {
+	diffs, err := hashtree.Diff(localTree, serverTree)
+	if err != nil {
+		return nil, fmt.Errorf("diff hash trees: %w", err)
+	}
+
+	var requests []PlanRequest
+	differs := make(map[string]bool, len(diffs))
+	for diff := range slices.Values(diffs) {
+		filePath, ok := p.localPath(diff.Key)
 		if !ok {
-			requests = append(requests, &deleteRequest{
-				filePath: filePath,
-			})
+			continue
 		}
+		differs[filePath] = true
+		// hash trees don't have the versions of the files
+		if diff.Local == "" {
+			if hashtree.IsLink(diff.Remote) && p.symlinks != symlink.Store {
+				continue
+			}
+			requests = append(requests, p.newDeleteRequest(filePath, p.expectedVersion(filePath, nil, false)))
+			continue
+		}
+		localFile, ok := localSnapshot[filePath]
+		if !ok || (localFile.Op != ops.OpCreated && localFile.Op != ops.OpModified) {
+			// indexed since the snapshot was taken; it's planned with the next one
+			continue
+		}
+		requests = append(requests, p.newUploadRequest(localFile, p.expectedVersion(filePath, nil, false)))
+	}
+
+	// the server has the same content for the other files
+	for filePath, localFile := range localSnapshot {
+		if differs[filePath] || (localFile.Op != ops.OpCreated && localFile.Op != ops.OpModified) {
+			continue
+		}
+		p.state.set(filePath, p.encryption.indexedContentID(localFile), 0)
 	}
 
 	return &Plan{
 		Requests: requests,
+	}, nil
+}
+
+// sameContent reports whether the local file has the same content as the file stored on the server. Files of other
+// types, e.g. a symlink and a regular file with its target as content, never have.
+func (p *Planner) sameContent(localFile *index.FileMetadata, remoteFile *restapi.File) bool {
+	if fileType(localFile) != remoteFile.Type {
+		return false
+	}
+	if p.encryption != nil {
+		// files uploaded before encryption was enabled have no MAC, so they're uploaded again, encrypted
+		return remoteFile.ContentMAC != "" && localFile.ContentMAC == remoteFile.ContentMAC
+	}
+	return localFile.SHA256 == remoteFile.SHA256Checksum
+}
+
+// sameAttributes reports whether the local file has the attributes of the file stored on the server, as far as they're
+// synced. A file whose attributes couldn't be read has them.
+func (p *Planner) sameAttributes(localFile *index.FileMetadata, remoteFile *restapi.File) bool {
+	if localFile.Attributes == nil {
+		return true
+	}
+	return fileattr.Same(p.encryption.attributes(localFile.Attributes), remoteFile.Attributes)
+}
+
+// fileType returns the type the given file is stored with.
+func fileType(md *index.FileMetadata) string {
+	switch {
+	case md.LinkTarget != "":
+		return restapi.TypeSymlink
+	case md.Dir:
+		return restapi.TypeDir
+	default:
+		return ""
+	}
+}
+
+// ignoresRemote reports whether the given file stored on the server is left alone, as it's a symlink and symlinks
+// aren't stored as such.
+func (p *Planner) ignoresRemote(remoteFile *restapi.File) bool {
+	return remoteFile.Type == restapi.TypeSymlink && p.symlinks != symlink.Store
+}
+
+// localPath returns the local path of the file stored under the given key, which is the key itself unless names are
+// encrypted. It reports false for files whose names can't be decrypted: they weren't uploaded with our keys, so
+// they're neither compared nor deleted.
+func (p *Planner) localPath(key string) (string, bool) {
+	if p.encryption == nil || !p.encryption.encryptNames {
+		return key, true
+	}
+
+	filePath, err := p.encryption.keys.DecryptName(key)
+	if err != nil {
+		p.logger.WithError(err).WithField("key", key).Warn("Ignoring server file with a name we can't decrypt")
+		return "", false
 	}
+	return filePath, true
 }
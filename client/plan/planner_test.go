@@ -0,0 +1,259 @@
+package plan_test
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	restapi "github.com/hedisam/filesync/client/api/rest"
+	"github.com/hedisam/filesync/client/e2e"
+	"github.com/hedisam/filesync/client/index"
+	"github.com/hedisam/filesync/client/ops"
+	"github.com/hedisam/filesync/client/plan"
+	"github.com/hedisam/filesync/lib/hashtree"
+)
+
+// serverSnapshot streams the given server files, keyed by their keys, the way the client does.
+func serverSnapshot(files map[string]*restapi.File) iter.Seq2[*restapi.File, error] {
+	return func(yield func(*restapi.File, error) bool) {
+		for key := range slices.Values(slices.Sorted(maps.Keys(files))) {
+			file := files[key]
+			file.Key = key
+			if !yield(file, nil) {
+				return
+			}
+		}
+	}
+}
+
+func TestGenerateWithServerSnapshot(t *testing.T) {
+	local := map[string]*index.FileMetadata{
+		"/src/unchanged.txt": {Path: "/src/unchanged.txt", SHA256: "sha-1", Op: ops.OpCreated},
+		"/src/changed.txt":   {Path: "/src/changed.txt", SHA256: "sha-2", Op: ops.OpModified},
+		"/src/new.txt":       {Path: "/src/new.txt", SHA256: "sha-3", Op: ops.OpCreated},
+		"/src/removed.txt":   {Path: "/src/removed.txt", SHA256: "sha-4", Op: ops.OpRemoved},
+	}
+	server := map[string]*restapi.File{
+		"/src/unchanged.txt": {SHA256Checksum: "sha-1"},
+		"/src/changed.txt":   {SHA256Checksum: "old-sha-2"},
+		"/src/removed.txt":   {SHA256Checksum: "sha-4"},
+		"/src/gone.txt":      {SHA256Checksum: "sha-5"},
+	}
+
+	planner := plan.NewPlanner(logrus.New())
+	p, err := planner.Generate(local, serverSnapshot(server), nil)
+	require.NoError(t, err)
+
+	var requests []string
+	for req := range slices.Values(p.Requests) {
+		requests = append(requests, req.String())
+	}
+	assert.ElementsMatch(t, []string{
+		fmt.Sprintf("Planned request to upload %q", "/src/changed.txt"),
+		fmt.Sprintf("Planned request to upload %q", "/src/new.txt"),
+		fmt.Sprintf("Planned request to delete %q", "/src/removed.txt"),
+		fmt.Sprintf("Planned request to delete %q", "/src/gone.txt"),
+	}, requests)
+
+	// a snapshot cut short can't tell which files are gone
+	cutShort := func(yield func(*restapi.File, error) bool) {
+		if yield(&restapi.File{Key: "/src/unchanged.txt", SHA256Checksum: "sha-1"}, nil) {
+			yield(nil, errors.New("unexpected EOF"))
+		}
+	}
+	_, err = planner.Generate(local, cutShort, nil)
+	require.Error(t, err)
+}
+
+func TestGenerateWithEncryption(t *testing.T) {
+	keys, err := e2e.DeriveKeys("passphrase", "default")
+	require.NoError(t, err)
+
+	local := map[string]*index.FileMetadata{
+		"/src/unchanged.txt": {Path: "/src/unchanged.txt", SHA256: "sha-1", ContentMAC: "mac-1", Op: ops.OpCreated},
+		"/src/changed.txt":   {Path: "/src/changed.txt", SHA256: "sha-2", ContentMAC: "mac-2", Op: ops.OpModified},
+		"/src/legacy.txt":    {Path: "/src/legacy.txt", SHA256: "sha-3", ContentMAC: "mac-3", Op: ops.OpCreated},
+		"/src/new.txt":       {Path: "/src/new.txt", SHA256: "sha-4", ContentMAC: "mac-4", Op: ops.OpCreated},
+	}
+	server := map[string]*restapi.File{
+		// the server only knows the checksums of the ciphertext
+		keys.EncryptName("/src/unchanged.txt"): {SHA256Checksum: "encrypted-sha-1", ContentMAC: "mac-1"},
+		keys.EncryptName("/src/changed.txt"):   {SHA256Checksum: "encrypted-sha-2", ContentMAC: "old-mac-2"},
+		// uploaded in plaintext, before encryption was enabled
+		keys.EncryptName("/src/legacy.txt"):  {SHA256Checksum: "sha-3"},
+		keys.EncryptName("/src/removed.txt"): {SHA256Checksum: "encrypted-sha-5", ContentMAC: "mac-5"},
+		// not uploaded with our keys
+		"/src/foreign.txt": {SHA256Checksum: "sha-6"},
+	}
+
+	planner := plan.NewPlanner(logrus.New(), plan.WithEncryption(keys, true))
+	p, err := planner.Generate(local, serverSnapshot(server), nil)
+	require.NoError(t, err)
+
+	var requests []string
+	for req := range slices.Values(p.Requests) {
+		requests = append(requests, req.String())
+	}
+	assert.ElementsMatch(t, []string{
+		fmt.Sprintf("Planned request to upload %q", "/src/changed.txt"),
+		fmt.Sprintf("Planned request to upload %q", "/src/legacy.txt"),
+		fmt.Sprintf("Planned request to upload %q", "/src/new.txt"),
+		fmt.Sprintf("Planned request to delete %q", "/src/removed.txt"),
+	}, requests)
+}
+
+func TestGenerateWithRemoteChanges(t *testing.T) {
+	local := map[string]*index.FileMetadata{
+		"/src/synced.txt":     {Path: "/src/synced.txt", SHA256: "sha-1", Op: ops.OpCreated},
+		"/src/deleted.txt":    {Path: "/src/deleted.txt", SHA256: "sha-2", Op: ops.OpCreated},
+		"/src/echoed.txt":     {Path: "/src/echoed.txt", SHA256: "sha-3", Op: ops.OpCreated},
+		"/src/conflicted.txt": {Path: "/src/conflicted.txt", SHA256: "sha-4", Op: ops.OpCreated},
+	}
+	server := map[string]*restapi.File{
+		"/src/synced.txt":     {SHA256Checksum: "sha-1"},
+		"/src/deleted.txt":    {SHA256Checksum: "sha-2"},
+		"/src/echoed.txt":     {SHA256Checksum: "sha-3"},
+		"/src/conflicted.txt": {SHA256Checksum: "sha-4"},
+	}
+	planner := plan.NewPlanner(logrus.New(), plan.WithRemoteChanges("/src"))
+	p, err := planner.Generate(local, serverSnapshot(server), nil)
+	require.NoError(t, err)
+	require.Empty(t, p.Requests)
+
+	local = map[string]*index.FileMetadata{
+		"/src/conflicted.txt": {Path: "/src/conflicted.txt", SHA256: "local-sha-4", Op: ops.OpModified},
+		// e.g. downloaded by another device's change seen earlier
+		"/src/downloaded.txt": {Path: "/src/downloaded.txt", SHA256: "sha-5", Op: ops.OpCreated},
+	}
+	remote := &plan.Remote{
+		Files: map[string]*restapi.File{
+			"/src/synced.txt":     {SHA256Checksum: "new-sha-1"},
+			"/src/echoed.txt":     {SHA256Checksum: "sha-3"},
+			"/src/conflicted.txt": {SHA256Checksum: "remote-sha-4"},
+			"/src/downloaded.txt": {SHA256Checksum: "sha-5"},
+			"/src/new.txt":        {SHA256Checksum: "sha-6"},
+			"/elsewhere/file.txt": {SHA256Checksum: "sha-7"},
+		},
+		Changes: []restapi.Change{
+			{Seq: 1, Op: restapi.ChangePut, Key: "/src/synced.txt", File: &restapi.File{SHA256Checksum: "stale-sha-1"}},
+			{Seq: 2, Op: restapi.ChangeDelete, Key: "/src/deleted.txt"},
+			{Seq: 3, Op: restapi.ChangePut, Key: "/src/echoed.txt", File: &restapi.File{SHA256Checksum: "sha-3"}},
+			{Seq: 4, Op: restapi.ChangePut, Key: "/src/conflicted.txt", File: &restapi.File{SHA256Checksum: "remote-sha-4"}},
+			{Seq: 5, Op: restapi.ChangePut, Key: "/src/new.txt", File: &restapi.File{SHA256Checksum: "sha-6"}},
+			{Seq: 6, Op: restapi.ChangePut, Key: "/elsewhere/file.txt", File: &restapi.File{SHA256Checksum: "sha-7"}},
+			{Seq: 7, Op: restapi.ChangeDelete, Key: "/src/never-synced.txt"},
+			{Seq: 8, Op: restapi.ChangePut, Key: "/src/synced.txt", File: &restapi.File{SHA256Checksum: "new-sha-1"}},
+		},
+	}
+	p, err = planner.Generate(local, nil, remote)
+	require.NoError(t, err)
+
+	var requests []string
+	for req := range slices.Values(p.Requests) {
+		requests = append(requests, req.String())
+	}
+	assert.ElementsMatch(t, []string{
+		// local changes win
+		fmt.Sprintf("Planned request to upload %q", "/src/conflicted.txt"),
+		fmt.Sprintf("Planned request to download %q", "/src/synced.txt"),
+		fmt.Sprintf("Planned request to remove local %q", "/src/deleted.txt"),
+		fmt.Sprintf("Planned request to download %q", "/src/new.txt"),
+	}, requests)
+}
+
+// treeSource is a Source of the given tree.
+func treeSource(tree *hashtree.Tree) hashtree.Source {
+	return func(prefixes []string) ([]*hashtree.Node, error) {
+		return tree.Nodes(prefixes), nil
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	local := map[string]*index.FileMetadata{
+		"/src/unchanged.txt":      {Path: "/src/unchanged.txt", SHA256: "sha-1", Op: ops.OpCreated},
+		"/src/docs/changed.txt":   {Path: "/src/docs/changed.txt", SHA256: "sha-2", Op: ops.OpCreated},
+		"/src/docs/new/file.txt":  {Path: "/src/docs/new/file.txt", SHA256: "sha-3", Op: ops.OpCreated},
+		"/src/docs/unchanged.txt": {Path: "/src/docs/unchanged.txt", SHA256: "sha-4", Op: ops.OpCreated},
+	}
+	localTree := hashtree.New()
+	for path, md := range local {
+		localTree.Put(path, md.SHA256)
+	}
+	// indexed after the local snapshot was taken
+	localTree.Put("/src/later.txt", "sha-5")
+
+	serverTree := hashtree.New()
+	serverTree.Put("/src/unchanged.txt", "sha-1")
+	serverTree.Put("/src/docs/changed.txt", "old-sha-2")
+	serverTree.Put("/src/docs/unchanged.txt", "sha-4")
+	serverTree.Put("/src/old/gone.txt", "sha-6")
+
+	planner := plan.NewPlanner(logrus.New(), plan.WithRemoteChanges("/src"))
+	p, err := planner.Reconcile(local, treeSource(localTree), treeSource(serverTree))
+	require.NoError(t, err)
+
+	var requests []string
+	for req := range slices.Values(p.Requests) {
+		requests = append(requests, req.String())
+	}
+	assert.ElementsMatch(t, []string{
+		fmt.Sprintf("Planned request to upload %q", "/src/docs/changed.txt"),
+		fmt.Sprintf("Planned request to upload %q", "/src/docs/new/file.txt"),
+		fmt.Sprintf("Planned request to delete %q", "/src/old/gone.txt"),
+	}, requests)
+
+	// the files found the same are synced, so their remote changes apply
+	remote := &plan.Remote{
+		Files:   map[string]*restapi.File{},
+		Partial: true,
+		Changes: []restapi.Change{
+			{Seq: 1, Op: restapi.ChangeDelete, Key: "/src/unchanged.txt"},
+		},
+	}
+	p, err = planner.Generate(nil, nil, remote)
+	require.NoError(t, err)
+	require.Len(t, p.Requests, 1)
+	assert.Equal(t, fmt.Sprintf("Planned request to remove local %q", "/src/unchanged.txt"), p.Requests[0].String())
+
+	_, err = planner.Reconcile(local, treeSource(localTree), func([]string) ([]*hashtree.Node, error) {
+		return nil, errors.New("connection refused")
+	})
+	require.Error(t, err)
+}
+
+func TestGenerateWithPartialRemote(t *testing.T) {
+	local := map[string]*index.FileMetadata{
+		"/src/deleted-remotely.txt": {Path: "/src/deleted-remotely.txt", Op: ops.OpRemoved},
+		"/src/unknown.txt":          {Path: "/src/unknown.txt", Op: ops.OpRemoved},
+		"/src/downloaded.txt":       {Path: "/src/downloaded.txt", SHA256: "sha-1", Op: ops.OpCreated},
+		"/src/changed.txt":          {Path: "/src/changed.txt", SHA256: "sha-2", Op: ops.OpModified},
+	}
+	remote := &plan.Remote{
+		Files: map[string]*restapi.File{
+			"/src/deleted-remotely.txt": nil,
+			"/src/downloaded.txt":       {SHA256Checksum: "sha-1"},
+		},
+		Partial: true,
+	}
+
+	planner := plan.NewPlanner(logrus.New())
+	p, err := planner.Generate(local, nil, remote)
+	require.NoError(t, err)
+
+	var requests []string
+	for req := range slices.Values(p.Requests) {
+		requests = append(requests, req.String())
+	}
+	assert.ElementsMatch(t, []string{
+		// the server may or may not have the files it's not known to have
+		fmt.Sprintf("Planned request to delete %q", "/src/unknown.txt"),
+		fmt.Sprintf("Planned request to upload %q", "/src/changed.txt"),
+	}, requests)
+}
@@ -0,0 +1,617 @@
+package plan
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	restapi "github.com/hedisam/filesync/client/api/rest"
+	"github.com/hedisam/filesync/client/filesystem/symlink"
+	"github.com/hedisam/filesync/client/index"
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/psurls"
+)
+
+// Remote is what's known of the server's files between full snapshots.
+type Remote struct {
+	// Files are the server's files, by key, as of the last change seen.
+	Files map[string]*restapi.File
+	// Partial is set if Files only has the files changed since the server was last reconciled with, the deleted ones
+	// as nil. Whether the server has the others isn't known.
+	Partial bool
+	// Changes are the changes made on the server since the previous plan, oldest first.
+	Changes []restapi.Change
+}
+
+// file returns the server's file under the given key, nil if the server has none, and whether it's known at all.
+func (r *Remote) file(key string) (*restapi.File, bool) {
+	if r == nil {
+		return nil, false
+	}
+	f, ok := r.Files[key]
+	return f, ok || !r.Partial
+}
+
+// syncState holds the content of the files as last synced with the server, i.e. uploaded, downloaded or found to be
+// the same, by path. It's what tells a file changed locally since, whose local changes must win over remote ones,
+// from a file that can be updated with the server's version. The version of the server's file it was synced with is
+// kept too, if known, as the one the server must still have for the local changes to be written over it.
+type syncState struct {
+	mu       sync.Mutex
+	content  map[string]string
+	versions map[string]uint64
+}
+
+func newSyncState() *syncState {
+	return &syncState{
+		content:  make(map[string]string),
+		versions: make(map[string]uint64),
+	}
+}
+
+func (s *syncState) get(path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.content[path]
+	return id, ok
+}
+
+// version returns the version of the server's file the file at the given path was last synced with, 0 if it's not
+// known.
+func (s *syncState) version(path string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.versions[path]
+}
+
+// set records the file at the given path as synced with the given content, at the given version of the server's
+// file, 0 if it's not known. The version known already is kept if the content is the same.
+func (s *syncState) set(path, contentID string, version uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case version != 0:
+		s.versions[path] = version
+	case s.content[path] != contentID:
+		delete(s.versions, path)
+	}
+	s.content[path] = contentID
+}
+
+func (s *syncState) remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.content, path)
+	delete(s.versions, path)
+}
+
+// remoteContentID returns what identifies the content of a file stored on the server: its content MAC in end-to-end
+// encryption mode, since the server only has the checksum of the ciphertext, and its checksum otherwise.
+func (e *encryption) remoteContentID(f *restapi.File) string {
+	if e != nil {
+		return f.ContentMAC
+	}
+	return f.SHA256Checksum
+}
+
+// indexedContentID returns what identifies the content of an indexed file, the same way remoteContentID does for
+// stored ones.
+func (e *encryption) indexedContentID(md *index.FileMetadata) string {
+	if e != nil {
+		return md.ContentMAC
+	}
+	return md.SHA256
+}
+
+// links tells how the symlinks under a sync root are synced.
+type links struct {
+	policy symlink.Policy
+	root   string
+}
+
+func (p *Planner) links() links {
+	return links{
+		policy: p.symlinks,
+		root:   p.syncRoot,
+	}
+}
+
+// escapes reports whether the local file at the given path would be written to or removed outside the sync root,
+// through symlinked directories, logging why if so. Remote changes of such files are ignored, like the ones of paths
+// outside the root.
+func (l links) escapes(logger *logrus.Entry, path string) bool {
+	if l.root == "" {
+		return false
+	}
+	err := symlink.CheckParents(l.root, path)
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, symlink.ErrOutsideRoot) {
+		logger.Warn("Ignoring remote change of a file outside the sync root through symlinks")
+	} else {
+		logger.WithError(err).Warn("Ignoring remote change of a file we can't tell is inside the sync root")
+	}
+	return true
+}
+
+// localContentID returns what identifies the content of the local file at the given path, the same way
+// remoteContentID does for stored ones. Symlinks stored as such have their target as content, and directories have none.
+// It reports false if the file doesn't exist.
+func (e *encryption) localContentID(l links, path string) (string, bool, error) {
+	if l.policy == symlink.Store && symlink.IsSymlink(path) {
+		target, err := symlink.Target(l.root, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		h := sha256.New()
+		if e != nil {
+			h = e.keys.NewMAC()
+		}
+		h.Write([]byte(target))
+		return hex.EncodeToString(h.Sum(nil)), true, nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if e != nil {
+		h = e.keys.NewMAC()
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return "", false, err
+	}
+	if !st.IsDir() {
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), true, nil
+}
+
+// insideRoot reports whether the given path is inside the given directory.
+func insideRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// maxLinkTarget is the longest symlink target downloaded, as long as paths can be.
+const maxLinkTarget = 4 << 10
+
+// remoteRequests plans applying the changes made on the server to the local files. Files changed locally since they
+// were last synced keep their local changes, which are uploaded instead.
+func (p *Planner) remoteRequests(localSnapshot map[string]*index.FileMetadata, changes []restapi.Change) []PlanRequest {
+	// only the latest change of every file matters
+	latest := make(map[string]restapi.Change)
+	var paths []string
+	for change := range slices.Values(changes) {
+		path := change.Key
+		if p.encryption != nil && p.encryption.encryptNames {
+			var err error
+			path, err = p.encryption.keys.DecryptName(change.Key)
+			if err != nil {
+				p.logger.WithError(err).WithField("key", change.Key).Warn("Ignoring remote change of a file with a name we can't decrypt")
+				continue
+			}
+		}
+		if _, ok := latest[path]; !ok {
+			paths = append(paths, path)
+		}
+		latest[path] = change
+	}
+
+	var requests []PlanRequest
+	for path := range slices.Values(paths) {
+		change := latest[path]
+		logger := p.logger.WithFields(logrus.Fields{
+			"path": path,
+			"op":   change.Op,
+		})
+		if _, ok := localSnapshot[path]; ok {
+			logger.Debug("File changed locally too, keeping the local change")
+			continue
+		}
+		if !insideRoot(p.syncRoot, path) {
+			logger.Warn("Ignoring remote change of a file outside the sync root")
+			continue
+		}
+
+		synced, ok := p.state.get(path)
+		switch change.Op {
+		case restapi.ChangePut:
+			if change.File == nil {
+				continue
+			}
+			contentID := p.encryption.remoteContentID(change.File)
+			if contentID == "" {
+				logger.Warn("Ignoring remote change of a file not uploaded with our keys")
+				continue
+			}
+			if p.ignoresRemote(change.File) {
+				logger.Debug("Ignoring remote symlink, symlinks aren't stored as such")
+				continue
+			}
+			if ok && synced == contentID {
+				// e.g. our own upload, or a change of the attributes only
+				if change.File.Attributes != nil {
+					requests = append(requests, p.newApplyAttributesRequest(path, change.File))
+				}
+				continue
+			}
+			requests = append(requests, p.newDownloadRequest(path, change.Key, change.File))
+		case restapi.ChangeDelete:
+			if !ok {
+				// never synced, so it's either gone already or a local file the server never had
+				continue
+			}
+			requests = append(requests, p.newRemoveLocalRequest(path))
+		default:
+			logger.Warn("Unknown remote change, dropping")
+		}
+	}
+
+	return requests
+}
+
+func (p *Planner) newDownloadRequest(filePath, key string, file *restapi.File) *downloadRequest {
+	return &downloadRequest{
+		logger:     p.logger,
+		state:      p.state,
+		filePath:   filePath,
+		key:        key,
+		file:       file,
+		encryption: p.encryption,
+		resolver:   p.resolver(),
+		links:      p.links(),
+	}
+}
+
+func (p *Planner) newApplyAttributesRequest(filePath string, file *restapi.File) *applyAttributesRequest {
+	return &applyAttributesRequest{
+		logger:     p.logger,
+		state:      p.state,
+		filePath:   filePath,
+		file:       file,
+		encryption: p.encryption,
+		links:      p.links(),
+	}
+}
+
+func (p *Planner) newRemoveLocalRequest(filePath string) *removeLocalRequest {
+	return &removeLocalRequest{
+		logger:     p.logger,
+		state:      p.state,
+		filePath:   filePath,
+		encryption: p.encryption,
+		resolver:   p.resolver(),
+		links:      p.links(),
+	}
+}
+
+// localStatus is how the local file a remote change is planned for compares with the server's.
+type localStatus int
+
+const (
+	// localMissing is for a file that doesn't exist locally.
+	localMissing localStatus = iota
+	// localSynced is for a file that has the remote content already.
+	localSynced
+	// localUnchanged is for a file that hasn't changed since it was last synced.
+	localUnchanged
+	// localChanged is for a file with local changes that weren't synced, which conflict with the remote change.
+	localChanged
+)
+
+// checkLocal compares the local file at the given path with the remote change planned for it. It records the file as
+// synced if it has the remote content already.
+func checkLocal(state *syncState, e *encryption, l links, path, remoteContentID string) (localStatus, error) {
+	localContentID, exists, err := e.localContentID(l, path)
+	if err != nil {
+		return 0, fmt.Errorf("read local file: %w", err)
+	}
+	if !exists {
+		return localMissing, nil
+	}
+	if localContentID == remoteContentID {
+		state.set(path, localContentID, 0)
+		return localSynced, nil
+	}
+	synced, ok := state.get(path)
+	if !ok || synced != localContentID {
+		return localChanged, nil
+	}
+	return localUnchanged, nil
+}
+
+type downloadRequest struct {
+	logger     *logrus.Logger
+	state      *syncState
+	filePath   string
+	key        string
+	file       *restapi.File
+	encryption *encryption
+	resolver   *resolver
+	links      links
+}
+
+func (pr *downloadRequest) Apply(ctx context.Context, client RestClient, opts ...Option) error {
+	if pr.links.escapes(pr.logger.WithField("path", pr.filePath), pr.filePath) {
+		return nil
+	}
+	status, err := checkLocal(pr.state, pr.encryption, pr.links, pr.filePath, pr.encryption.remoteContentID(pr.file))
+	if err != nil {
+		return fmt.Errorf("check local file %q before download: %w", pr.filePath, err)
+	}
+	switch status {
+	case localSynced:
+		return nil
+	case localChanged:
+		if pr.resolver != nil {
+			return pr.resolver.resolveRemote(ctx, client, opts, pr.filePath, pr.file)
+		}
+		pr.logger.WithField("path", pr.filePath).Info("File changed locally since it was last synced, keeping the local version")
+		return nil
+	}
+
+	return pr.download(ctx, client, opts...)
+}
+
+// download downloads the file over the local one, whatever it has.
+func (pr *downloadRequest) download(ctx context.Context, client RestClient, opts ...Option) error {
+	cfg := &applyConfig{}
+	for opt := range slices.Values(opts) {
+		opt(cfg)
+	}
+	logger := pr.logger.WithField("path", pr.filePath)
+	contentID := pr.encryption.remoteContentID(pr.file)
+	if pr.file.Type == restapi.TypeDir {
+		// nothing to download
+		err := os.MkdirAll(pr.filePath, 0755)
+		if err != nil {
+			return fmt.Errorf("create directory %q: %w", pr.filePath, err)
+		}
+		pr.state.set(pr.filePath, contentID, pr.file.Version)
+		return nil
+	}
+
+	urlData := psurls.URLData{
+		Namespace:      client.Namespace(),
+		ObjectKey:      pr.key,
+		SHA256Checksum: pr.file.SHA256Checksum,
+		Expiry:         time.Now().UTC().Add(10 * time.Minute).Unix(),
+		AccessKeyID:    cfg.accessKeyID,
+		Operation:      psurls.OpDownload,
+	}
+	url, err := psurls.Generate(urlData, client.DownloadURL(), cfg.secretKey)
+	if err != nil {
+		return fmt.Errorf("generate presigned download url for %q: %w", pr.filePath, err)
+	}
+	rc, err := client.Download(ctx, url)
+	if errors.Is(err, restapi.ErrFileChanged) {
+		// its latest change is yet to be seen
+		logger.Debug("File changed on the server since the download was planned, skipping")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("download via presigned url for %q: %w", pr.filePath, err)
+	}
+	defer rc.Close()
+
+	err = pr.write(rc)
+	if errors.Is(err, symlink.ErrOutsideRoot) {
+		// files written through it would end up outside the root
+		logger.Warn("Ignoring remote symlink pointing outside the sync root")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("write downloaded file %q: %w", pr.filePath, err)
+	}
+	pr.state.set(pr.filePath, contentID, pr.file.Version)
+
+	return nil
+}
+
+// write replaces the local file with the downloaded content, atomically. The temporary file is named so the walker
+// and the watcher ignore it.
+func (pr *downloadRequest) write(r io.Reader) error {
+	if pr.file.Type == restapi.TypeSymlink {
+		return pr.writeSymlink(r)
+	}
+
+	dir := filepath.Dir(pr.filePath)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(pr.filePath)+".*~")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	r = io.TeeReader(r, hasher)
+	if pr.encryption != nil {
+		r, err = pr.encryption.keys.Decrypt(r)
+		if err != nil {
+			return fmt.Errorf("decrypt: %w", err)
+		}
+	}
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != pr.file.SHA256Checksum {
+		return errors.New("downloaded content doesn't match its checksum")
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	if pr.file.Attributes != nil {
+		err = fileattr.Apply(tmp.Name(), pr.file.Attributes)
+		if err != nil {
+			return fmt.Errorf("apply attributes: %w", err)
+		}
+	} else {
+		mode := fs.FileMode(0644)
+		if st, err := os.Stat(pr.filePath); err == nil {
+			mode = st.Mode().Perm()
+		}
+		err = os.Chmod(tmp.Name(), mode)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), pr.filePath)
+}
+
+// writeSymlink replaces the local file with a symlink to the downloaded target, atomically.
+func (pr *downloadRequest) writeSymlink(r io.Reader) error {
+	hasher := sha256.New()
+	r = io.TeeReader(r, hasher)
+	var err error
+	if pr.encryption != nil {
+		r, err = pr.encryption.keys.Decrypt(r)
+		if err != nil {
+			return fmt.Errorf("decrypt: %w", err)
+		}
+	}
+	target, err := io.ReadAll(io.LimitReader(r, maxLinkTarget+1))
+	if err != nil {
+		return err
+	}
+	if len(target) > maxLinkTarget {
+		return errors.New("downloaded symlink target is too long")
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != pr.file.SHA256Checksum {
+		return errors.New("downloaded content doesn't match its checksum")
+	}
+	if pr.links.root != "" {
+		err = symlink.CheckTarget(pr.links.root, pr.filePath, string(target))
+		if err != nil {
+			return err
+		}
+	}
+	return symlink.Create(pr.filePath, string(target))
+}
+
+func (pr *downloadRequest) String() string {
+	return fmt.Sprintf("Planned request to download %q", pr.filePath)
+}
+
+// applyAttributesRequest gives a local file the attributes the server's file has, if it has the same content.
+type applyAttributesRequest struct {
+	logger     *logrus.Logger
+	state      *syncState
+	filePath   string
+	file       *restapi.File
+	encryption *encryption
+	links      links
+}
+
+func (pr *applyAttributesRequest) Apply(_ context.Context, _ RestClient, _ ...Option) error {
+	if pr.links.escapes(pr.logger.WithField("path", pr.filePath), pr.filePath) {
+		return nil
+	}
+	status, err := checkLocal(pr.state, pr.encryption, pr.links, pr.filePath, pr.encryption.remoteContentID(pr.file))
+	if err != nil {
+		return fmt.Errorf("check local file %q before applying attributes: %w", pr.filePath, err)
+	}
+	if status != localSynced {
+		// changed locally since, or gone; the local change is synced instead
+		return nil
+	}
+
+	info, err := os.Stat(pr.filePath)
+	if err != nil {
+		return fmt.Errorf("stat local file %q: %w", pr.filePath, err)
+	}
+	if !fileattr.Same(pr.encryption.attributes(fileattr.Read(pr.filePath, info)), pr.file.Attributes) {
+		err = fileattr.Apply(pr.filePath, pr.file.Attributes)
+		if err != nil {
+			return fmt.Errorf("apply attributes to local file %q: %w", pr.filePath, err)
+		}
+		pr.logger.WithField("path", pr.filePath).Debug("Applied attributes changed on the server")
+	}
+	pr.state.set(pr.filePath, pr.encryption.remoteContentID(pr.file), pr.file.Version)
+
+	return nil
+}
+
+func (pr *applyAttributesRequest) String() string {
+	return fmt.Sprintf("Planned request to apply the attributes of %q", pr.filePath)
+}
+
+type removeLocalRequest struct {
+	logger     *logrus.Logger
+	state      *syncState
+	filePath   string
+	encryption *encryption
+	resolver   *resolver
+	links      links
+}
+
+func (pr *removeLocalRequest) Apply(ctx context.Context, client RestClient, opts ...Option) error {
+	if pr.links.escapes(pr.logger.WithField("path", pr.filePath), pr.filePath) {
+		return nil
+	}
+	status, err := checkLocal(pr.state, pr.encryption, pr.links, pr.filePath, "")
+	if err != nil {
+		return fmt.Errorf("check local file %q before removing it: %w", pr.filePath, err)
+	}
+	if status == localChanged {
+		if pr.resolver != nil {
+			return pr.resolver.resolveRemote(ctx, client, opts, pr.filePath, nil)
+		}
+		pr.logger.WithField("path", pr.filePath).Info("File changed locally since it was last synced, keeping the local version")
+		return nil
+	}
+
+	err = os.Remove(pr.filePath)
+	if errors.Is(err, fs.ErrExist) {
+		// a directory with files the server still has, or unsynced ones; it's kept as synced, so it's removed once
+		// they're gone, on the next reconcile
+		pr.logger.WithField("path", pr.filePath).Info("Directory deleted on the server isn't empty, keeping it for now")
+		return nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove local file %q: %w", pr.filePath, err)
+	}
+	pr.state.remove(pr.filePath)
+
+	return nil
+}
+
+func (pr *removeLocalRequest) String() string {
+	return fmt.Sprintf("Planned request to remove local %q", pr.filePath)
+}
@@ -2,60 +2,431 @@ package syncpipeline
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
+	"maps"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	restapi "github.com/hedisam/filesync/client/api/rest"
 	"github.com/hedisam/filesync/client/index"
+	"github.com/hedisam/filesync/client/plan"
+	"github.com/hedisam/filesync/lib/hashtree"
 	"github.com/hedisam/pipeline/chans"
 )
 
+const (
+	minWatchRetryDelay = time.Second
+	maxWatchRetryDelay = 30 * time.Second
+)
+
 type Snapshot struct {
-	Server map[string]*restapi.File
+	// Server is the server snapshot, streamed as it's iterated.
+	Server iter.Seq2[*restapi.File, error]
 	Local  map[string]*index.FileMetadata
+	// Remote is the server's view as followed through its change feed, set when Server isn't.
+	Remote *plan.Remote
+	// LocalTree and ServerTree are the hash trees to reconcile the local files with the server's through, set instead
+	// of Server in tree reconcile mode.
+	LocalTree  hashtree.Source
+	ServerTree hashtree.Source
+	// Reconcile is set if Local is the full local state, to correct its drift from Server with. Server is nil if
+	// they're known to be the same already.
+	Reconcile bool
 }
 
 type SnapshotSource struct {
+	logger                    *logrus.Logger
 	restClient                *restapi.Client
+	idx                       *index.Index
 	initialServerSnapshotDone bool
 	localSnapshotChan         <-chan map[string]*index.FileMetadata
+	// view is the server's files as of cursor
+	view map[string]*restapi.File
+	// viewDone is closed once the initial server snapshot has been read into the view
+	viewDone chan struct{}
+	// partial is set while the view only has the files changed since the server was reconciled with through the
+	// hash trees, the deleted ones as nil
+	partial bool
+	// localTree is set in tree reconcile mode
+	localTree hashtree.Source
+	// reconcileInterval is how often the full local state is reconciled with the server, if it is
+	reconcileInterval time.Duration
+	lastReconcile     time.Time
+
+	// cursor is read by the watcher too
+	mu     sync.Mutex
+	cursor string
+
+	// trigger, if set, makes the local snapshotting take a snapshot right away
+	trigger chan struct{}
+
+	// device is reported to the server every reportInterval, if set
+	device         *restapi.Device
+	reportInterval time.Duration
+}
+
+type SnapshotSourceOption func(*SnapshotSource)
+
+// WithTreeReconcile makes the SnapshotSource reconcile with the server through the hash trees of the given index and
+// the server on startups, rather than through a full server snapshot, which takes a few round trips however many
+// files there are. The index must maintain its hash tree.
+func WithTreeReconcile(idx *index.Index) SnapshotSourceOption {
+	return func(s *SnapshotSource) {
+		s.localTree = idx.TreeNodes
+	}
 }
 
-func NewSnapshotSource(ctx context.Context, restClient *restapi.Client, idx *index.Index, interval time.Duration) *SnapshotSource {
-	localSnapshotChan := startLocalSnapshotting(ctx, idx, interval)
+// WithReconcileInterval makes the SnapshotSource reconcile the full local state with the server every given interval,
+// so the drift following its changes can't catch, e.g. after a server restore or a dropped upload, gets corrected
+// without a restart. With tree reconcile, the server's files are only fetched if the hash trees differ.
+func WithReconcileInterval(d time.Duration) SnapshotSourceOption {
+	return func(s *SnapshotSource) {
+		s.reconcileInterval = d
+	}
+}
 
-	return &SnapshotSource{
-		restClient:        restClient,
-		localSnapshotChan: localSnapshotChan,
+// WithWatch makes the SnapshotSource watch the changes made on the server and sync them as soon as they're made,
+// rather than on the next sync interval.
+func WithWatch() SnapshotSourceOption {
+	return func(s *SnapshotSource) {
+		s.trigger = make(chan struct{}, 1)
 	}
 }
 
+// WithDeviceReports makes the SnapshotSource register the given device with the server, and report its sync state
+// every given interval: the cursor of the server changes synced and a summary of the indexed files. The device is
+// registered again whenever the server turns out to have forgotten it.
+func WithDeviceReports(device restapi.Device, interval time.Duration) SnapshotSourceOption {
+	return func(s *SnapshotSource) {
+		s.device = &device
+		s.reportInterval = interval
+	}
+}
+
+func NewSnapshotSource(ctx context.Context, logger *logrus.Logger, restClient *restapi.Client, idx *index.Index, interval time.Duration, opts ...SnapshotSourceOption) *SnapshotSource {
+	s := &SnapshotSource{
+		logger:     logger,
+		restClient: restClient,
+		idx:        idx,
+	}
+	for opt := range slices.Values(opts) {
+		opt(s)
+	}
+	s.localSnapshotChan = startLocalSnapshotting(ctx, idx, interval, s.trigger)
+	if s.device != nil {
+		go s.reportDevice(ctx)
+	}
+
+	return s
+}
+
 func (s *SnapshotSource) Next(ctx context.Context) (any, error) {
-	var err error
-	var serverSnapshot map[string]*restapi.File
+	localSnapshot, ok := chans.ReceiveOrDone(ctx, s.localSnapshotChan)
+	if !ok {
+		return nil, io.EOF
+	}
 
+	if !s.initialServerSnapshotDone && s.localTree != nil {
+		// the server's files are only known as they change from now on
+		_, cursor, err := s.restClient.TreeNodes(ctx, []string{""})
+		if err != nil {
+			return nil, fmt.Errorf("get initial server tree: %w", err)
+		}
+		s.setCursor(cursor)
+		s.view = make(map[string]*restapi.File)
+		s.partial = true
+		s.viewDone = make(chan struct{})
+		close(s.viewDone)
+		s.initialServerSnapshotDone = true
+		s.lastReconcile = time.Now()
+		if s.trigger != nil {
+			go s.watch(ctx, cursor)
+		}
+		return &Snapshot{
+			Local:     localSnapshot,
+			LocalTree: s.localTree,
+			ServerTree: func(prefixes []string) ([]*hashtree.Node, error) {
+				nodes, _, err := s.restClient.TreeNodes(ctx, prefixes)
+				return nodes, err
+			},
+		}, nil
+	}
 	if !s.initialServerSnapshotDone {
-		// we want the server snapshot only once on startups
-		serverSnapshot, err = s.restClient.Snapshot(ctx)
+		// we want the server snapshot only once on startups; we follow its changes afterwards
+		cursor, serverSnapshot, err := s.restClient.Snapshot(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("get initial server snapshot: %w", err)
 		}
+		s.setCursor(cursor)
 		s.initialServerSnapshotDone = true
+		s.lastReconcile = time.Now()
+		if s.trigger != nil {
+			go s.watch(ctx, cursor)
+		}
+		return &Snapshot{
+			Server: s.record(serverSnapshot),
+			Local:  localSnapshot,
+		}, nil
 	}
 
-	localSnapshot, ok := chans.ReceiveOrDone(ctx, s.localSnapshotChan)
-	if !ok {
+	// the planner might still be reading the initial snapshot
+	select {
+	case <-ctx.Done():
 		return nil, io.EOF
+	case <-s.viewDone:
+	}
+	if s.reconcileInterval > 0 && time.Since(s.lastReconcile) >= s.reconcileInterval {
+		snapshot, err := s.reconcile(ctx)
+		if err == nil {
+			return snapshot, nil
+		}
+		// it's retried on the next sync
+		s.logger.WithError(err).Warn("Failed to reconcile with the server")
+	}
+	changes, err := s.pollChanges(ctx)
+	if err != nil {
+		// the changes are picked up on the next poll
+		s.logger.WithError(err).Warn("Failed to get server changes")
+	}
+	return &Snapshot{
+		Local: localSnapshot,
+		Remote: &plan.Remote{
+			Files:   maps.Clone(s.view),
+			Partial: s.partial,
+			Changes: changes,
+		},
+	}, nil
+}
+
+// record returns the given server snapshot, recording its files into the view as they're read.
+func (s *SnapshotSource) record(serverSnapshot iter.Seq2[*restapi.File, error]) iter.Seq2[*restapi.File, error] {
+	s.view = make(map[string]*restapi.File)
+	s.viewDone = make(chan struct{})
+	return func(yield func(*restapi.File, error) bool) {
+		defer close(s.viewDone)
+
+		for file, err := range serverSnapshot {
+			if err == nil {
+				s.view[file.Key] = file
+			}
+			if !yield(file, err) {
+				return
+			}
+		}
+	}
+}
+
+// reconcile returns the full local state along with a new server snapshot to correct the drift between them with. The
+// view and the cursor are replaced with the snapshot's, since the changes the snapshot has are corrected for too.
+// With tree reconcile, the snapshot is only taken if the hash trees differ.
+func (s *SnapshotSource) reconcile(ctx context.Context) (*Snapshot, error) {
+	localState := s.idx.State()
+	if s.localTree != nil {
+		localRoot, err := s.localTree([]string{""})
+		if err != nil {
+			return nil, fmt.Errorf("get local tree: %w", err)
+		}
+		serverRoot, _, err := s.restClient.TreeNodes(ctx, []string{""})
+		if err != nil {
+			return nil, fmt.Errorf("get server tree: %w", err)
+		}
+		if len(localRoot) == 1 && len(serverRoot) == 1 && localRoot[0].Hash == serverRoot[0].Hash {
+			s.lastReconcile = time.Now()
+			return &Snapshot{
+				Local:     localState,
+				Reconcile: true,
+			}, nil
+		}
 	}
 
+	cursor, serverSnapshot, err := s.restClient.Snapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get server snapshot: %w", err)
+	}
+	s.setCursor(cursor)
+	s.partial = false
+	s.lastReconcile = time.Now()
 	return &Snapshot{
-		Server: serverSnapshot,
-		Local:  localSnapshot,
+		Server:    s.record(serverSnapshot),
+		Local:     localState,
+		Reconcile: true,
 	}, nil
 }
 
-func startLocalSnapshotting(ctx context.Context, idx *index.Index, interval time.Duration) <-chan map[string]*index.FileMetadata {
+// pollChanges returns the changes made on the server since the last poll, applied to the view. If the server doesn't
+// keep all of them anymore, the view is replaced with a new snapshot, and the changes are what tells them apart.
+func (s *SnapshotSource) pollChanges(ctx context.Context) ([]restapi.Change, error) {
+	var changes []restapi.Change
+	for {
+		resp, err := s.restClient.Changes(ctx, s.currentCursor())
+		if errors.Is(err, restapi.ErrCursorExpired) {
+			s.logger.Info("Server changes cursor expired, taking a new snapshot")
+			return s.resnapshot(ctx)
+		}
+		if err != nil {
+			return changes, err
+		}
+		for change := range slices.Values(resp.Changes) {
+			s.apply(change)
+		}
+		changes = append(changes, resp.Changes...)
+		s.setCursor(resp.Cursor)
+		if !resp.HasMore {
+			return changes, nil
+		}
+	}
+}
+
+func (s *SnapshotSource) resnapshot(ctx context.Context) ([]restapi.Change, error) {
+	cursor, files, err := s.restClient.Snapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get server snapshot: %w", err)
+	}
+	snapshot := make(map[string]*restapi.File)
+	for file, err := range files {
+		if err != nil {
+			return nil, fmt.Errorf("read server snapshot: %w", err)
+		}
+		snapshot[file.Key] = file
+	}
+
+	var changes []restapi.Change
+	for key, file := range snapshot {
+		old, ok := s.view[key]
+		if !ok || old.SHA256Checksum != file.SHA256Checksum {
+			changes = append(changes, restapi.Change{Op: restapi.ChangePut, Key: key, File: file})
+		}
+	}
+	for key, file := range s.view {
+		if _, ok := snapshot[key]; !ok && file != nil {
+			changes = append(changes, restapi.Change{Op: restapi.ChangeDelete, Key: key})
+		}
+	}
+	s.view = snapshot
+	s.partial = false
+	s.setCursor(cursor)
+	return changes, nil
+}
+
+func (s *SnapshotSource) currentCursor() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cursor
+}
+
+func (s *SnapshotSource) setCursor(cursor string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cursor = cursor
+}
+
+// watch triggers a sync whenever a change is made on the server, until the context is done. The stream is reopened
+// with backoff if it breaks, resuming after the last change seen, or from the cursor of the last sync if it expired.
+func (s *SnapshotSource) watch(ctx context.Context, cursor string) {
+	delay := minWatchRetryDelay
+	for {
+		err := s.restClient.WatchChanges(ctx, cursor, func(_ restapi.Change, next string) {
+			cursor = next
+			delay = minWatchRetryDelay
+			select {
+			case s.trigger <- struct{}{}:
+			default:
+				// a sync is pending already
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, restapi.ErrCursorExpired) {
+			// the sync takes a new snapshot, whose cursor the stream is reopened with
+			select {
+			case s.trigger <- struct{}{}:
+			default:
+			}
+		}
+		s.logger.WithError(err).WithField("retry_in", delay).Warn("Watching server changes failed")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxWatchRetryDelay)
+		if errors.Is(err, restapi.ErrCursorExpired) {
+			cursor = s.currentCursor()
+		}
+	}
+}
+
+func (s *SnapshotSource) apply(change restapi.Change) {
+	switch change.Op {
+	case restapi.ChangePut:
+		s.view[change.Key] = change.File
+	case restapi.ChangeDelete:
+		if s.partial {
+			s.view[change.Key] = nil
+			return
+		}
+		delete(s.view, change.Key)
+	}
+}
+
+// reportDevice registers the device and reports its sync state every report interval, until the context is done.
+// Failures are retried on the next report.
+func (s *SnapshotSource) reportDevice(ctx context.Context) {
+	logger := s.logger.WithField("device_id", s.device.ID)
+	t := time.NewTicker(s.reportInterval)
+	defer t.Stop()
+
+	registered := false
+	for {
+		if !registered {
+			err := s.restClient.RegisterDevice(ctx, *s.device)
+			if err != nil {
+				logger.WithError(err).Warn("Failed to register device with the server")
+			} else {
+				logger.Debug("Registered device with the server")
+				registered = true
+			}
+		}
+		if cursor := s.currentCursor(); registered && cursor != "" {
+			summary := s.idx.Summary()
+			err := s.restClient.ReportSync(ctx, s.device.ID, restapi.SyncReport{
+				Cursor:        cursor,
+				ClientVersion: s.device.ClientVersion,
+				SyncRoot: restapi.SyncRoot{
+					Files:    summary.Files,
+					Bytes:    summary.Bytes,
+					RootHash: summary.RootHash,
+				},
+			})
+			switch {
+			case errors.Is(err, restapi.ErrDeviceNotRegistered):
+				logger.Info("Server forgot the device, registering it again on the next report")
+				registered = false
+			case err != nil:
+				logger.WithError(err).Warn("Failed to report sync state to the server")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// startLocalSnapshotting takes a local snapshot every interval, and whenever triggered.
+func startLocalSnapshotting(ctx context.Context, idx *index.Index, interval time.Duration, trigger <-chan struct{}) <-chan map[string]*index.FileMetadata {
 	out := make(chan map[string]*index.FileMetadata)
 
 	go func() {
@@ -63,7 +434,13 @@ func startLocalSnapshotting(ctx context.Context, idx *index.Index, interval time
 		defer t.Stop()
 		defer close(out)
 
-		for range chans.ReceiveOrDoneSeq(ctx, t.C) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			case <-trigger:
+			}
 			snapshot := idx.SnapshotAndPurge()
 			if !chans.SendOrDone(ctx, out, snapshot) {
 				return
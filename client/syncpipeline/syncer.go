@@ -2,6 +2,7 @@ package syncpipeline
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"iter"
 	"slices"
@@ -11,12 +12,15 @@ import (
 	restapi "github.com/hedisam/filesync/client/api/rest"
 	"github.com/hedisam/filesync/client/index"
 	"github.com/hedisam/filesync/client/plan"
+	"github.com/hedisam/filesync/lib/hashtree"
 	"github.com/hedisam/pipeline"
 	"github.com/hedisam/pipeline/stage"
 )
 
 type Planner interface {
-	Generate(localSnapshot map[string]*index.FileMetadata, serverSnapshot map[string]*restapi.File) *plan.Plan
+	Generate(localSnapshot map[string]*index.FileMetadata, serverSnapshot iter.Seq2[*restapi.File, error], remote *plan.Remote) (*plan.Plan, error)
+	Reconcile(localSnapshot map[string]*index.FileMetadata, localTree, serverTree hashtree.Source) (*plan.Plan, error)
+	CorrectDrift(localState map[string]*index.FileMetadata, serverSnapshot iter.Seq2[*restapi.File, error]) (*plan.Plan, error)
 }
 
 type RestClient = plan.RestClient
@@ -46,7 +50,25 @@ func (s *Syncer) PlanGenerator() stage.Processor {
 			return nil, false, fmt.Errorf("invalid payload type received by plan generator: %T", payload)
 		}
 
-		plan := s.planner.Generate(snapshot.Local, snapshot.Server)
+		if snapshot.Reconcile {
+			plan, err := s.planner.CorrectDrift(snapshot.Local, snapshot.Server)
+			if err != nil {
+				return nil, false, fmt.Errorf("correct drift: %w", err)
+			}
+			return plan, false, nil
+		}
+		if snapshot.ServerTree != nil {
+			plan, err := s.planner.Reconcile(snapshot.Local, snapshot.LocalTree, snapshot.ServerTree)
+			if err != nil {
+				return nil, false, fmt.Errorf("reconcile plan: %w", err)
+			}
+			return plan, false, nil
+		}
+
+		plan, err := s.planner.Generate(snapshot.Local, snapshot.Server, snapshot.Remote)
+		if err != nil {
+			return nil, false, fmt.Errorf("generate plan: %w", err)
+		}
 		return plan, false, nil
 	}
 }
@@ -75,6 +97,11 @@ func (s *Syncer) PlanRequestApplier() stage.Processor {
 		}
 
 		err = req.Apply(ctx, s.client, plan.ApplyWithCreds(s.accessKeyID, s.secretKey))
+		if errors.Is(err, restapi.ErrConflict) {
+			// both sides are left as they are, rather than one overwriting the other
+			s.logger.WithError(err).WithField("request", req.String()).Warn("File changed on the server by someone else, not applying planned request")
+			return nil, true, nil
+		}
 		if err != nil {
 			return nil, false, fmt.Errorf("could not apply planned request: %w", err)
 		}
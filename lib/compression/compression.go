@@ -0,0 +1,177 @@
+// Package compression implements the content codings files can be compressed with, in transit as the
+// Content-Encoding of requests and responses, and at rest.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoding is a content coding, named as in the Content-Encoding header.
+type Encoding string
+
+const (
+	Identity Encoding = ""
+	Gzip     Encoding = "gzip"
+	Zstd     Encoding = "zstd"
+)
+
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+// preferred lists the supported encodings, most preferred first.
+var preferred = []Encoding{Zstd, Gzip}
+
+// ParseEncoding returns the Encoding named by a Content-Encoding header. Only a single coding is supported.
+func ParseEncoding(s string) (Encoding, error) {
+	switch enc := Encoding(strings.ToLower(strings.TrimSpace(s))); enc {
+	case Identity, "identity":
+		return Identity, nil
+	case Gzip, Zstd:
+		return enc, nil
+	default:
+		return "", fmt.Errorf("%w %q", ErrUnsupportedEncoding, s)
+	}
+}
+
+// Negotiate returns the most preferred supported encoding accepted by the given Accept-Encoding header, or Identity
+// if none is.
+func Negotiate(acceptEncoding string) Encoding {
+	accepted := make(map[Encoding]bool)
+	wildcard := false
+	for part := range strings.SplitSeq(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		ok := true
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			weight, err := strconv.ParseFloat(q, 64)
+			ok = err == nil && weight > 0
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "*" {
+			wildcard = ok
+			continue
+		}
+		accepted[Encoding(name)] = ok
+	}
+
+	for enc := range slices.Values(preferred) {
+		ok, listed := accepted[enc]
+		if ok || (!listed && wildcard) {
+			return enc
+		}
+	}
+	return Identity
+}
+
+// NewReader returns a ReadCloser decompressing the content read from r. Closing it doesn't close r.
+func NewReader(r io.Reader, enc Encoding) (io.ReadCloser, error) {
+	switch enc {
+	case Identity:
+		return io.NopCloser(r), nil
+	case Gzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("create gzip reader: %w", err)
+		}
+		return gr, nil
+	case Zstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("create zstd reader: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedEncoding, enc)
+	}
+}
+
+// NewWriter returns a WriteCloser compressing the content written to it to w. Close must be called to flush the
+// compressed content; it doesn't close w.
+func NewWriter(w io.Writer, enc Encoding) (io.WriteCloser, error) {
+	switch enc {
+	case Identity:
+		return nopWriteCloser{Writer: w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("create zstd writer: %w", err)
+		}
+		return zw, nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedEncoding, enc)
+	}
+}
+
+// Compress returns a ReadCloser reading the compressed content of r. Closing it stops reading from r.
+func Compress(r io.Reader, enc Encoding) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(func() error {
+			w, err := NewWriter(pw, enc)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, r)
+			if err != nil {
+				return err
+			}
+			return w.Close()
+		}())
+	}()
+
+	return &compressingReader{PipeReader: pr, done: done}
+}
+
+// Ratio returns the size of the given sample once compressed, relative to its size.
+func Ratio(sample []byte, enc Encoding) (float64, error) {
+	if len(sample) == 0 {
+		return 1, nil
+	}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, enc)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(sample)
+	if err != nil {
+		return 0, err
+	}
+	err = w.Close()
+	if err != nil {
+		return 0, err
+	}
+	return float64(buf.Len()) / float64(len(sample)), nil
+}
+
+type compressingReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close stops the compression and waits for it to return, so the source isn't read anymore.
+func (r *compressingReader) Close() error {
+	err := r.PipeReader.Close()
+	<-r.done
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,123 @@
+package compression_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/lib/compression"
+)
+
+func TestRoundTrip(t *testing.T) {
+	content := []byte(strings.Repeat("2024-06-01 INFO request served in 3ms\n", 1000))
+
+	for enc := range map[compression.Encoding]struct{}{compression.Identity: {}, compression.Gzip: {}, compression.Zstd: {}} {
+		t.Run(string(enc), func(t *testing.T) {
+			rc := compression.Compress(bytes.NewReader(content), enc)
+			compressed, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			if enc != compression.Identity {
+				assert.Less(t, len(compressed), len(content)/10)
+			}
+
+			r, err := compression.NewReader(bytes.NewReader(compressed), enc)
+			require.NoError(t, err)
+			decompressed, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, content, decompressed)
+		})
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	tests := map[string]struct {
+		header      string
+		expected    compression.Encoding
+		expectedErr error
+	}{
+		"none":        {header: "", expected: compression.Identity},
+		"identity":    {header: "identity", expected: compression.Identity},
+		"zstd":        {header: "zstd", expected: compression.Zstd},
+		"gzip":        {header: " GZIP ", expected: compression.Gzip},
+		"unsupported": {header: "br", expectedErr: compression.ErrUnsupportedEncoding},
+		"stacked":     {header: "gzip, zstd", expectedErr: compression.ErrUnsupportedEncoding},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			enc, err := compression.ParseEncoding(tc.header)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, enc)
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]compression.Encoding{
+		"":                      compression.Identity,
+		"br":                    compression.Identity,
+		"gzip, deflate":         compression.Gzip,
+		"gzip, zstd":            compression.Zstd,
+		"zstd;q=0, gzip;q=0.5":  compression.Gzip,
+		"*":                     compression.Zstd,
+		"*, zstd;q=0":           compression.Gzip,
+		"identity, *;q=0":       compression.Identity,
+		"ZSTD":                  compression.Zstd,
+		"gzip;q=invalid, zstd ": compression.Zstd,
+	}
+
+	for header, expected := range tests {
+		t.Run(header, func(t *testing.T) {
+			assert.Equal(t, expected, compression.Negotiate(header))
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"extensions": [".log", ".CSV"], "max_ratio": 0.5}`), 0644))
+	policy, err := compression.LoadPolicy(path)
+	require.NoError(t, err)
+	assert.Equal(t, compression.Zstd, policy.Encoding)
+	assert.Equal(t, compression.DefaultSampleSize, policy.SampleLen())
+
+	random := make([]byte, 4096)
+	_, _ = rand.Read(random)
+	text := []byte(strings.Repeat("some very compressible text ", 200))
+
+	tests := map[string]struct {
+		key      string
+		sample   []byte
+		expected compression.Encoding
+	}{
+		"listed extension":       {key: "app.log", sample: random, expected: compression.Zstd},
+		"extension case":         {key: "data.csv", sample: random, expected: compression.Zstd},
+		"compressible content":   {key: "notes", sample: text, expected: compression.Zstd},
+		"incompressible content": {key: "photo.jpg", sample: random, expected: compression.Identity},
+		"empty":                  {key: "empty.bin", expected: compression.Identity},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			enc, err := policy.Choose(tc.key, tc.sample)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, enc)
+		})
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"encoding": "br"}`), 0644))
+	_, err = compression.LoadPolicy(path)
+	assert.ErrorIs(t, err, compression.ErrUnsupportedEncoding)
+}
@@ -0,0 +1,79 @@
+package compression
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// DefaultSampleSize is the size of the sample the compression ratio of a file is measured on, if not configured.
+const DefaultSampleSize = 64 << 10
+
+// Policy decides which files are compressed at rest: the ones with one of the listed extensions, and the ones whose
+// content compresses at least down to MaxRatio of its size, as measured on a sample of its first bytes.
+type Policy struct {
+	Encoding   Encoding `json:"encoding"`
+	Extensions []string `json:"extensions"`
+	MaxRatio   float64  `json:"max_ratio"`
+	SampleSize int      `json:"sample_size"`
+}
+
+// LoadPolicy loads a compression policy from the given JSON file.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read compression policy file: %w", err)
+	}
+
+	var p Policy
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal compression policy: %w", err)
+	}
+	if p.Encoding == Identity {
+		p.Encoding = Zstd
+	}
+	_, err = ParseEncoding(string(p.Encoding))
+	if err != nil {
+		return nil, err
+	}
+	if p.MaxRatio < 0 || p.MaxRatio > 1 {
+		return nil, fmt.Errorf("max ratio must be between 0 and 1, got %v", p.MaxRatio)
+	}
+
+	return &p, nil
+}
+
+// SampleLen returns how many bytes of a file are needed to decide whether it's compressed.
+func (p *Policy) SampleLen() int {
+	if p.MaxRatio == 0 {
+		return 0
+	}
+	if p.SampleSize <= 0 {
+		return DefaultSampleSize
+	}
+	return p.SampleSize
+}
+
+// Choose returns the encoding the file with the given key and first bytes is stored with.
+func (p *Policy) Choose(key string, sample []byte) (Encoding, error) {
+	ext := strings.ToLower(path.Ext(key))
+	if ext != "" && slices.ContainsFunc(p.Extensions, func(e string) bool { return strings.ToLower(e) == ext }) {
+		return p.Encoding, nil
+	}
+	if p.MaxRatio == 0 || len(sample) == 0 {
+		return Identity, nil
+	}
+
+	ratio, err := Ratio(sample, p.Encoding)
+	if err != nil {
+		return "", fmt.Errorf("measure compression ratio: %w", err)
+	}
+	if ratio > p.MaxRatio {
+		return Identity, nil
+	}
+	return p.Encoding, nil
+}
@@ -0,0 +1,145 @@
+// Package fileattr models the attributes of files synced along with their content: their permission modes, precise
+// modification times, owners and extended attributes.
+package fileattr
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+// MaxXattrsSize is the maximum total size of the names and values of the extended attributes kept for a file. They
+// travel in presigned urls, so the ones that don't fit are left out.
+const MaxXattrsSize = 4 << 10
+
+// The special mode bits, as POSIX has them.
+const (
+	modeSetuid = 0o4000
+	modeSetgid = 0o2000
+	modeSticky = 0o1000
+)
+
+// Attributes are the attributes of a file.
+type Attributes struct {
+	// Mode is the permission mode of the file, as POSIX has it, e.g. 0755, with the setuid, setgid and sticky bits.
+	Mode uint32 `json:"mode"`
+	// MTime is the modification time, in nanoseconds since the Unix epoch.
+	MTime int64 `json:"mtime_ns"`
+	// Owner and Group are the names of the user and group owning the file, if they're known. They're only applied by
+	// clients running as root, to the names that exist locally.
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Xattrs are the extended attributes of the file in the user namespace, by name, where they're supported.
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// Read returns the attributes of the file at the given path, whose info is given. The owner and the extended
+// attributes are left out if they can't be read.
+func Read(path string, info fs.FileInfo) *Attributes {
+	a := &Attributes{
+		Mode:  posixMode(info.Mode()),
+		MTime: info.ModTime().UnixNano(),
+	}
+	a.Owner, a.Group = owner(info)
+	a.Xattrs = readXattrs(path)
+	return a
+}
+
+// Apply gives the file at the given path the given attributes. Extended attributes are only added, not removed, and
+// are skipped where they're not supported.
+func Apply(path string, a *Attributes) error {
+	// changing the owner clears the setuid and setgid bits, so it goes first
+	err := chown(path, a.Owner, a.Group)
+	if err != nil {
+		return fmt.Errorf("change owner: %w", err)
+	}
+	err = os.Chmod(path, a.FileMode())
+	if err != nil {
+		return fmt.Errorf("change mode: %w", err)
+	}
+	for name := range slices.Values(slices.Sorted(maps.Keys(a.Xattrs))) {
+		err = setXattr(path, name, a.Xattrs[name])
+		if errors.Is(err, errors.ErrUnsupported) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("set extended attribute %q: %w", name, err)
+		}
+	}
+	// a zero access time is left as it is
+	err = os.Chtimes(path, time.Time{}, time.Unix(0, a.MTime))
+	if err != nil {
+		return fmt.Errorf("change times: %w", err)
+	}
+	return nil
+}
+
+// Same reports whether files with the given attributes, either of which may be unknown, have the same mode,
+// modification time and extended attributes. Owners aren't compared: they're only applied by clients running as root,
+// so others would never have them the same.
+func Same(a, b *Attributes) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Mode == b.Mode &&
+		a.MTime == b.MTime &&
+		maps.EqualFunc(a.Xattrs, b.Xattrs, slices.Equal)
+}
+
+// FileMode returns the mode of the file as fs.FileMode has it.
+func (a *Attributes) FileMode() fs.FileMode {
+	mode := fs.FileMode(a.Mode) & fs.ModePerm
+	if a.Mode&modeSetuid != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if a.Mode&modeSetgid != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if a.Mode&modeSticky != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+func posixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= modeSetuid
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= modeSetgid
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= modeSticky
+	}
+	return m
+}
+
+// Encode returns the url-safe form of the attributes presigned urls carry them in.
+func (a *Attributes) Encode() (string, error) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Decode returns the attributes in the given form returned by Encode.
+func Decode(s string) (*Attributes, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decode attributes: %w", err)
+	}
+	var a Attributes
+	err = json.Unmarshal(b, &a)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal attributes: %w", err)
+	}
+	return &a, nil
+}
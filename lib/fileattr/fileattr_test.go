@@ -0,0 +1,91 @@
+package fileattr_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/lib/fileattr"
+)
+
+func TestReadApply(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.sh")
+	require.NoError(t, os.WriteFile(src, []byte("#!/bin/sh\n"), 0644))
+	require.NoError(t, os.Chmod(src, 0750|fs.ModeSetgid))
+	mtime := time.Date(2024, 6, 1, 12, 0, 0, 123456789, time.UTC)
+	require.NoError(t, os.Chtimes(src, mtime, mtime))
+
+	info, err := os.Stat(src)
+	require.NoError(t, err)
+	attrs := fileattr.Read(src, info)
+	assert.Equal(t, uint32(0o2750), attrs.Mode)
+	assert.Equal(t, mtime.UnixNano(), attrs.MTime)
+	attrs.Xattrs = map[string][]byte{"user.origin": []byte("laptop")}
+
+	dst := filepath.Join(dir, "dst.sh")
+	require.NoError(t, os.WriteFile(dst, []byte("#!/bin/sh\n"), 0644))
+	require.NoError(t, fileattr.Apply(dst, attrs))
+	info, err = os.Stat(dst)
+	require.NoError(t, err)
+	assert.Equal(t, 0750|fs.ModeSetgid, info.Mode()&^fs.ModeType)
+	applied := fileattr.Read(dst, info)
+	if applied.Xattrs == nil {
+		// not supported by the filesystem
+		applied.Xattrs = attrs.Xattrs
+	}
+	assert.True(t, fileattr.Same(attrs, applied))
+}
+
+func TestEncode(t *testing.T) {
+	attrs := &fileattr.Attributes{
+		Mode:   0o755,
+		MTime:  1717243200123456789,
+		Owner:  "alice",
+		Group:  "staff",
+		Xattrs: map[string][]byte{"user.origin": {0, 1, 2}},
+	}
+	s, err := attrs.Encode()
+	require.NoError(t, err)
+	decoded, err := fileattr.Decode(s)
+	require.NoError(t, err)
+	assert.Equal(t, attrs, decoded)
+
+	_, err = fileattr.Decode("not base64!")
+	assert.Error(t, err)
+}
+
+func TestSame(t *testing.T) {
+	attrs := fileattr.Attributes{Mode: 0o644, MTime: 1, Owner: "alice", Xattrs: map[string][]byte{"user.a": []byte("1")}}
+	with := func(f func(a *fileattr.Attributes)) *fileattr.Attributes {
+		a := attrs
+		f(&a)
+		return &a
+	}
+
+	tests := map[string]struct {
+		a, b *fileattr.Attributes
+		want bool
+	}{
+		"same":             {a: &attrs, b: with(func(*fileattr.Attributes) {}), want: true},
+		"other owner":      {a: &attrs, b: with(func(a *fileattr.Attributes) { a.Owner = "bob" }), want: true},
+		"other mode":       {a: &attrs, b: with(func(a *fileattr.Attributes) { a.Mode = 0o755 }), want: false},
+		"other mtime":      {a: &attrs, b: with(func(a *fileattr.Attributes) { a.MTime = 2 }), want: false},
+		"other xattrs":     {a: &attrs, b: with(func(a *fileattr.Attributes) { a.Xattrs = nil }), want: false},
+		"unknown":          {a: &attrs, want: false},
+		"both unknown":     {want: true},
+		"no xattrs either": {a: &fileattr.Attributes{Xattrs: map[string][]byte{}}, b: &fileattr.Attributes{}, want: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, fileattr.Same(tc.a, tc.b))
+			assert.Equal(t, tc.want, fileattr.Same(tc.b, tc.a))
+		})
+	}
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package fileattr
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// owner returns the names of the user and group owning the file with the given info, empty if they're not known.
+func owner(info fs.FileInfo) (string, string) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", ""
+	}
+	var owner, group string
+	if u, err := user.LookupId(strconv.FormatUint(uint64(st.Uid), 10)); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.FormatUint(uint64(st.Gid), 10)); err == nil {
+		group = g.Name
+	}
+	return owner, group
+}
+
+// chown gives the file at the given path the given owner and group, if we're running as root and they exist locally.
+func chown(path, owner, group string) error {
+	if os.Geteuid() != 0 || (owner == "" && group == "") {
+		return nil
+	}
+	uid, gid := -1, -1
+	if u, err := user.Lookup(owner); err == nil {
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if g, err := user.LookupGroup(group); err == nil {
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	err := os.Lchown(path, uid, gid)
+	if errors.Is(err, fs.ErrPermission) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+package fileattr
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// userXattrPrefix is the prefix of the extended attributes in the user namespace; the others belong to the system.
+const userXattrPrefix = "user."
+
+// readXattrs returns the extended attributes of the file at the given path in the user namespace, up to
+// MaxXattrsSize, or none if they can't be read.
+func readXattrs(path string) map[string][]byte {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	list := make([]byte, size)
+	size, err = syscall.Listxattr(path, list)
+	if err != nil {
+		return nil
+	}
+
+	var xattrs map[string][]byte
+	total := 0
+	for name := range slices.Values(bytes.Split(list[:size], []byte{0})) {
+		if !strings.HasPrefix(string(name), userXattrPrefix) {
+			continue
+		}
+		value, ok := getXattr(path, string(name))
+		if !ok || total+len(name)+len(value) > MaxXattrsSize {
+			continue
+		}
+		total += len(name) + len(value)
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[string(name)] = value
+	}
+	return xattrs
+}
+
+func getXattr(path, name string) ([]byte, bool) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, false
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	if err != nil {
+		return nil, false
+	}
+	return value[:size], true
+}
+
+// setXattr sets an extended attribute in the user namespace of the file at the given path; the others are skipped.
+func setXattr(path, name string, value []byte) error {
+	if !strings.HasPrefix(name, userXattrPrefix) {
+		return nil
+	}
+	return syscall.Setxattr(path, name, value, 0)
+}
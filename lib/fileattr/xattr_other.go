@@ -0,0 +1,16 @@
+//go:build !linux
+
+package fileattr
+
+import (
+	"errors"
+)
+
+// readXattrs returns no extended attributes where they're not supported.
+func readXattrs(string) map[string][]byte {
+	return nil
+}
+
+func setXattr(string, string, []byte) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,337 @@
+// Package hashtree implements a hash tree over the directories of a set of files, so two sets can be reconciled by
+// comparing the hashes of their directories, descending only into the ones that differ.
+//
+// Keys are split into directories on "/": the directory of a key is its prefix up to, and including, the last "/",
+// with the root directory being the empty prefix. The hash of a directory is the XOR of the digests of its entries,
+// a file's being over its name and content ID, and a subdirectory's over its name and hash. Being order-independent,
+// it's updated with the digests of the entries changed alone, so putting or deleting a file only rehashes the
+// directories on its path, however large they are.
+package hashtree
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Node is a directory of a tree, with its hash and the hashes of its entries, sorted by name.
+type Node struct {
+	Prefix string  `json:"prefix"`
+	Hash   string  `json:"hash"`
+	Dirs   []Entry `json:"dirs"`
+	Files  []Entry `json:"files"`
+}
+
+// Entry is a subdirectory or a file of a directory. The hash of a file is its content ID.
+type Entry struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+// Source returns the nodes of a tree under the given prefixes. Prefixes with no directory under them are left out.
+type Source func(prefixes []string) ([]*Node, error)
+
+// ContentID returns what identifies the content of a file in a tree: its content MAC if it's end-to-end encrypted,
+// since only the checksum of the ciphertext is known otherwise, and its checksum if it's not.
+func ContentID(sha256Checksum, contentMAC string) string {
+	if contentMAC != "" {
+		return contentMAC
+	}
+	return sha256Checksum
+}
+
+// The prefixes of the content IDs of the entries that aren't regular files, so they differ from regular files with the
+// same content: symlinks, whose content is their target, and directories, which have none.
+const (
+	linkPrefix = "symlink:"
+	dirPrefix  = "dir:"
+)
+
+// LinkContentID returns what identifies the content of a symlink in a tree, the same way ContentID does for regular
+// files.
+func LinkContentID(sha256Checksum, contentMAC string) string {
+	return linkPrefix + ContentID(sha256Checksum, contentMAC)
+}
+
+// IsLink reports whether the given content ID is a symlink's.
+func IsLink(contentID string) bool {
+	return strings.HasPrefix(contentID, linkPrefix)
+}
+
+// DirContentID returns what identifies a directory in a tree, the same way ContentID does for regular files.
+func DirContentID(sha256Checksum, contentMAC string) string {
+	return dirPrefix + ContentID(sha256Checksum, contentMAC)
+}
+
+type digest [sha256.Size]byte
+
+func (d *digest) xor(other digest) {
+	for i := range d {
+		d[i] ^= other[i]
+	}
+}
+
+func fileDigest(name, contentID string) digest {
+	return sha256.Sum256([]byte("f\x00" + name + "\x00" + contentID))
+}
+
+func dirDigest(name string, hash digest) digest {
+	return sha256.Sum256(append([]byte("d\x00"+name+"\x00"), hash[:]...))
+}
+
+type dir struct {
+	hash  digest
+	dirs  map[string]*dir
+	files map[string]string
+}
+
+func newDir() *dir {
+	return &dir{
+		dirs:  make(map[string]*dir),
+		files: make(map[string]string),
+	}
+}
+
+func (d *dir) empty() bool {
+	return len(d.dirs) == 0 && len(d.files) == 0
+}
+
+// Tree is a hash tree over the keys of a set of files. It's not safe for concurrent use.
+type Tree struct {
+	root *dir
+}
+
+func New() *Tree {
+	return &Tree{
+		root: newDir(),
+	}
+}
+
+// Hash returns the hash of the root directory, which is the same for two trees of the same files.
+func (t *Tree) Hash() string {
+	return hex.EncodeToString(t.root.hash[:])
+}
+
+// Put adds the file under the given key, or replaces its content ID.
+func (t *Tree) Put(key, contentID string) {
+	t.update(key, true, func(d *dir, name string) {
+		if old, ok := d.files[name]; ok {
+			d.hash.xor(fileDigest(name, old))
+		}
+		d.files[name] = contentID
+		d.hash.xor(fileDigest(name, contentID))
+	})
+}
+
+// Delete removes the file under the given key, along with the directories left empty.
+func (t *Tree) Delete(key string) {
+	t.update(key, false, func(d *dir, name string) {
+		if old, ok := d.files[name]; ok {
+			d.hash.xor(fileDigest(name, old))
+			delete(d.files, name)
+		}
+	})
+}
+
+// update applies the given change to the directory of the given key, creating the directories on its path if told
+// to, then rehashes the directories up the path.
+func (t *Tree) update(key string, create bool, change func(d *dir, name string)) {
+	segments := strings.Split(key, "/")
+	name := segments[len(segments)-1]
+	segments = segments[:len(segments)-1]
+
+	// path holds the directories from the root to the key's, and old their hashes before the change
+	path := []*dir{t.root}
+	old := []digest{t.root.hash}
+	for segment := range slices.Values(segments) {
+		d, ok := path[len(path)-1].dirs[segment]
+		if !ok {
+			if !create {
+				return
+			}
+			// a new directory isn't an entry of its parent until it's rehashed below
+			d = newDir()
+		}
+		path = append(path, d)
+		old = append(old, d.hash)
+	}
+
+	change(path[len(path)-1], name)
+
+	for i := len(path) - 1; i > 0; i-- {
+		parent, d, segment := path[i-1], path[i], segments[i-1]
+		if _, ok := parent.dirs[segment]; ok {
+			parent.hash.xor(dirDigest(segment, old[i]))
+		}
+		if d.empty() {
+			delete(parent.dirs, segment)
+			continue
+		}
+		parent.dirs[segment] = d
+		parent.hash.xor(dirDigest(segment, d.hash))
+	}
+}
+
+// Nodes returns the nodes under the given prefixes, leaving out the prefixes with no directory under them. The root
+// always has one, empty if the tree is.
+func (t *Tree) Nodes(prefixes []string) []*Node {
+	var nodes []*Node
+	for prefix := range slices.Values(prefixes) {
+		d := t.lookup(prefix)
+		if d == nil {
+			continue
+		}
+		node := &Node{
+			Prefix: prefix,
+			Hash:   hex.EncodeToString(d.hash[:]),
+			Dirs:   make([]Entry, 0, len(d.dirs)),
+			Files:  make([]Entry, 0, len(d.files)),
+		}
+		for name := range slices.Values(slices.Sorted(maps.Keys(d.dirs))) {
+			node.Dirs = append(node.Dirs, Entry{Name: name, Hash: hex.EncodeToString(d.dirs[name].hash[:])})
+		}
+		for name := range slices.Values(slices.Sorted(maps.Keys(d.files))) {
+			node.Files = append(node.Files, Entry{Name: name, Hash: d.files[name]})
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (t *Tree) lookup(prefix string) *dir {
+	if prefix == "" {
+		return t.root
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		return nil
+	}
+
+	d := t.root
+	for segment := range strings.SplitSeq(strings.TrimSuffix(prefix, "/"), "/") {
+		var ok bool
+		d, ok = d.dirs[segment]
+		if !ok {
+			return nil
+		}
+	}
+	return d
+}
+
+// Difference is a file that differs between two trees. Local and Remote are its content IDs in each, empty if it's
+// not in one.
+type Difference struct {
+	Key    string
+	Local  string
+	Remote string
+}
+
+// Diff returns the files that differ between the two given trees. It descends both level by level, into the
+// directories whose hashes differ only, fetching the nodes of a level from each tree at once, so it takes as many
+// fetches as the differing directories are deep, whatever the size of the trees.
+func Diff(local, remote Source) ([]Difference, error) {
+	type pending struct {
+		prefix        string
+		local, remote bool
+	}
+
+	var diffs []Difference
+	level := []pending{{prefix: "", local: true, remote: true}}
+	for len(level) > 0 {
+		var localPrefixes, remotePrefixes []string
+		for p := range slices.Values(level) {
+			if p.local {
+				localPrefixes = append(localPrefixes, p.prefix)
+			}
+			if p.remote {
+				remotePrefixes = append(remotePrefixes, p.prefix)
+			}
+		}
+		localNodes, err := fetch(local, localPrefixes)
+		if err != nil {
+			return nil, err
+		}
+		remoteNodes, err := fetch(remote, remotePrefixes)
+		if err != nil {
+			return nil, err
+		}
+
+		var next []pending
+		for p := range slices.Values(level) {
+			l, r := localNodes[p.prefix], remoteNodes[p.prefix]
+			if l != nil && r != nil && l.Hash == r.Hash {
+				continue
+			}
+
+			localFiles, remoteFiles := l.entries(false), r.entries(false)
+			for name := range slices.Values(union(localFiles, remoteFiles)) {
+				if localFiles[name] != remoteFiles[name] {
+					diffs = append(diffs, Difference{
+						Key:    p.prefix + name,
+						Local:  localFiles[name],
+						Remote: remoteFiles[name],
+					})
+				}
+			}
+
+			localDirs, remoteDirs := l.entries(true), r.entries(true)
+			for name := range slices.Values(union(localDirs, remoteDirs)) {
+				localHash, inLocal := localDirs[name]
+				remoteHash, inRemote := remoteDirs[name]
+				if localHash != remoteHash {
+					next = append(next, pending{prefix: p.prefix + name + "/", local: inLocal, remote: inRemote})
+				}
+			}
+		}
+		level = next
+	}
+
+	return diffs, nil
+}
+
+// fetch returns the nodes under the given prefixes by prefix.
+func fetch(src Source, prefixes []string) (map[string]*Node, error) {
+	nodes := make(map[string]*Node, len(prefixes))
+	if len(prefixes) == 0 {
+		return nodes, nil
+	}
+
+	fetched, err := src(prefixes)
+	if err != nil {
+		return nil, err
+	}
+	for node := range slices.Values(fetched) {
+		nodes[node.Prefix] = node
+	}
+	return nodes, nil
+}
+
+// entries returns the hashes of the subdirectories, or the files, of the node by name, none if there's no node.
+func (n *Node) entries(dirs bool) map[string]string {
+	if n == nil {
+		return nil
+	}
+
+	entries := n.Files
+	if dirs {
+		entries = n.Dirs
+	}
+	hashes := make(map[string]string, len(entries))
+	for e := range slices.Values(entries) {
+		hashes[e.Name] = e.Hash
+	}
+	return hashes
+}
+
+// union returns the names in either of the given maps, sorted.
+func union(a, b map[string]string) []string {
+	names := slices.Collect(maps.Keys(a))
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
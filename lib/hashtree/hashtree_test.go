@@ -0,0 +1,104 @@
+package hashtree_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/lib/hashtree"
+)
+
+func TestTree(t *testing.T) {
+	a := hashtree.New()
+	a.Put("/src/a.txt", "sha-1")
+	a.Put("/src/docs/b.txt", "sha-2")
+	a.Put("/src/docs/c.txt", "sha-3")
+
+	// the same files, put in another order, through other content
+	b := hashtree.New()
+	b.Put("/src/docs/c.txt", "sha-3")
+	b.Put("/src/docs/b.txt", "old-sha-2")
+	b.Put("/src/a.txt", "sha-1")
+	assert.NotEqual(t, a.Hash(), b.Hash())
+	b.Put("/src/docs/b.txt", "sha-2")
+	assert.Equal(t, a.Hash(), b.Hash())
+
+	nodes := a.Nodes([]string{"/src/", "/src/docs/", "/src/missing/", "/src"})
+	require.Len(t, nodes, 2)
+	assert.Equal(t, "/src/", nodes[0].Prefix)
+	require.Len(t, nodes[0].Dirs, 1)
+	assert.Equal(t, "docs", nodes[0].Dirs[0].Name)
+	assert.Equal(t, nodes[1].Hash, nodes[0].Dirs[0].Hash)
+	assert.Equal(t, []hashtree.Entry{{Name: "a.txt", Hash: "sha-1"}}, nodes[0].Files)
+	assert.Equal(t, []hashtree.Entry{{Name: "b.txt", Hash: "sha-2"}, {Name: "c.txt", Hash: "sha-3"}}, nodes[1].Files)
+
+	// a file moved across directories changes the hashes of both
+	before := a.Nodes([]string{"/src/"})[0].Hash
+	a.Delete("/src/docs/c.txt")
+	a.Put("/src/c.txt", "sha-3")
+	assert.NotEqual(t, before, a.Nodes([]string{"/src/"})[0].Hash)
+
+	// directories left empty are removed
+	a.Delete("/src/docs/b.txt")
+	a.Delete("/src/docs/missing.txt")
+	assert.Empty(t, a.Nodes([]string{"/src/docs/"}))
+	a.Delete("/src/a.txt")
+	a.Delete("/src/c.txt")
+	assert.Equal(t, hashtree.New().Hash(), a.Hash())
+	assert.Equal(t, []*hashtree.Node{{Prefix: "", Hash: a.Hash(), Dirs: []hashtree.Entry{}, Files: []hashtree.Entry{}}}, a.Nodes([]string{""}))
+}
+
+// countingSource is a Source of a tree that records the prefixes it's asked for.
+func countingSource(tree *hashtree.Tree, fetched *[][]string) hashtree.Source {
+	return func(prefixes []string) ([]*hashtree.Node, error) {
+		*fetched = append(*fetched, prefixes)
+		return tree.Nodes(prefixes), nil
+	}
+}
+
+func TestDiff(t *testing.T) {
+	local, remote := hashtree.New(), hashtree.New()
+	for i := range 100 {
+		for j := range 10 {
+			key := fmt.Sprintf("/src/%d/%d/file-%d.txt", i%10, i, j)
+			local.Put(key, "sha-"+key)
+			remote.Put(key, "sha-"+key)
+		}
+	}
+	local.Put("/src/3/23/file-1.txt", "changed")
+	local.Put("/src/new/deep/file.txt", "sha-new")
+	remote.Delete("/src/7/57/file-9.txt")
+	remote.Put("/src/gone.txt", "sha-gone")
+
+	var localFetches, remoteFetches [][]string
+	diffs, err := hashtree.Diff(countingSource(local, &localFetches), countingSource(remote, &remoteFetches))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []hashtree.Difference{
+		{Key: "/src/3/23/file-1.txt", Local: "changed", Remote: "sha-/src/3/23/file-1.txt"},
+		{Key: "/src/new/deep/file.txt", Local: "sha-new"},
+		{Key: "/src/7/57/file-9.txt", Local: "sha-/src/7/57/file-9.txt"},
+		{Key: "/src/gone.txt", Remote: "sha-gone"},
+	}, diffs)
+
+	// one fetch per level, into the differing directories only, and only from the trees that have them
+	assert.Equal(t, [][]string{
+		{""},
+		{"/"},
+		{"/src/"},
+		{"/src/3/", "/src/7/", "/src/new/"},
+		{"/src/3/23/", "/src/7/57/", "/src/new/deep/"},
+	}, localFetches)
+	assert.Equal(t, [][]string{
+		{""},
+		{"/"},
+		{"/src/"},
+		{"/src/3/", "/src/7/"},
+		{"/src/3/23/", "/src/7/57/"},
+	}, remoteFetches)
+
+	diffs, err = hashtree.Diff(countingSource(local, &localFetches), countingSource(local, &remoteFetches))
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+}
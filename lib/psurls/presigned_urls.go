@@ -13,41 +13,109 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/hedisam/filesync/lib/fileattr"
 )
 
 const (
+	Namespace      = "ns"
 	ObjectKey      = "key"
 	SHA256Checksum = "sha256"
 	Size           = "size"
 	MTime          = "mtime"
 	Expiry         = "exp"
 	AccessKeyID    = "aki"
+	Operation      = "op"
+	ContentMAC     = "mac"
+	IfMatch        = "if_match"
+	DeviceID       = "device"
+	Hostname       = "host"
+	User           = "user"
+	Attributes     = "attrs"
+	Type           = "type"
 	Signature      = "sig"
 )
 
+// The operations a presigned url can grant. URLs without an operation are upload urls.
+const (
+	OpUpload   = "upload"
+	OpDownload = "download"
+)
+
+// The types of object an upload url can store. URLs without a type store regular files.
+const (
+	// TypeSymlink is for symlinks, stored with their target as content.
+	TypeSymlink = "symlink"
+	// TypeDir is for directories, stored with no content, so empty ones are synced too.
+	TypeDir = "dir"
+)
+
 var (
 	ErrURLExpired        = errors.New("url expired")
 	ErrSignatureMismatch = errors.New("signature mismatch")
 )
 
 type URLData struct {
+	Namespace      string
 	ObjectKey      string
 	SHA256Checksum string
 	Size           int64
 	MTime          int64
 	Expiry         int64
 	AccessKeyID    string
+	Operation      string
+	// ContentMAC is a keyed MAC of the plaintext content of end-to-end encrypted files, opaque to the server. It
+	// lets clients tell whether a stored file has changed without the server learning the checksum of its content.
+	ContentMAC string
+	// IfMatch, if set, makes an upload conditional on the version of the object stored under the key, which must be
+	// the given one, or none at all if it's 0. It's how a client that last saw a version keeps from overwriting a
+	// version it hasn't seen.
+	IfMatch *uint64
+	// DeviceID, Hostname and User tell the server which client, on which host, and as which user, uploads the file.
+	// They're signed along with the rest so an url can't be passed off as another device's.
+	DeviceID string
+	Hostname string
+	User     string
+	// Attributes are the attributes of the uploaded file, if they're synced.
+	Attributes *fileattr.Attributes
+	// Type is the type of the uploaded object, if it's not a regular file.
+	Type string
 }
 
 func Generate(data URLData, baseURL, secretKey string) (string, error) {
 	var qValues url.Values = map[string][]string{
+		Namespace:      {data.Namespace},
 		ObjectKey:      {data.ObjectKey},
 		SHA256Checksum: {data.SHA256Checksum},
 		Size:           {strconv.FormatInt(data.Size, 10)},
-		MTime:          {strconv.FormatInt(data.Expiry, 10)},
+		MTime:          {strconv.FormatInt(data.MTime, 10)},
 		Expiry:         {strconv.FormatInt(data.Expiry, 10)},
 		AccessKeyID:    {data.AccessKeyID},
 	}
+	if data.Operation != "" {
+		qValues.Set(Operation, data.Operation)
+	}
+	if data.ContentMAC != "" {
+		qValues.Set(ContentMAC, data.ContentMAC)
+	}
+	if data.Type != "" {
+		qValues.Set(Type, data.Type)
+	}
+	if data.IfMatch != nil {
+		qValues.Set(IfMatch, strconv.FormatUint(*data.IfMatch, 10))
+	}
+	for name, value := range map[string]string{DeviceID: data.DeviceID, Hostname: data.Hostname, User: data.User} {
+		if value != "" {
+			qValues.Set(name, value)
+		}
+	}
+	if data.Attributes != nil {
+		attrs, err := data.Attributes.Encode()
+		if err != nil {
+			return "", fmt.Errorf("encode attributes: %w", err)
+		}
+		qValues.Set(Attributes, attrs)
+	}
 
 	sigData := prepareSigData(qValues)
 	sigBytes := sign(sigData, secretKey)
@@ -90,14 +158,41 @@ func Validate(values url.Values, secretKey string) (URLData, error) {
 	if err != nil {
 		return URLData{}, fmt.Errorf("invalid or missing mtime: %w", err)
 	}
+	var ifMatch *uint64
+	if values.Has(IfMatch) {
+		version, err := strconv.ParseUint(values.Get(IfMatch), 10, 64)
+		if err != nil {
+			return URLData{}, fmt.Errorf("invalid if_match: %w", err)
+		}
+		ifMatch = &version
+	}
+	if typ := values.Get(Type); typ != "" && typ != TypeSymlink && typ != TypeDir {
+		return URLData{}, fmt.Errorf("invalid type: %q", typ)
+	}
+	var attrs *fileattr.Attributes
+	if values.Has(Attributes) {
+		attrs, err = fileattr.Decode(values.Get(Attributes))
+		if err != nil {
+			return URLData{}, fmt.Errorf("invalid attrs: %w", err)
+		}
+	}
 
 	return URLData{
+		Namespace:      values.Get(Namespace),
 		ObjectKey:      values.Get(ObjectKey),
 		SHA256Checksum: values.Get(SHA256Checksum),
 		Size:           size,
 		MTime:          mtime,
 		Expiry:         exp,
 		AccessKeyID:    values.Get(AccessKeyID),
+		Operation:      values.Get(Operation),
+		ContentMAC:     values.Get(ContentMAC),
+		IfMatch:        ifMatch,
+		DeviceID:       values.Get(DeviceID),
+		Hostname:       values.Get(Hostname),
+		User:           values.Get(User),
+		Attributes:     attrs,
+		Type:           values.Get(Type),
 		//Signature:      hex.EncodeToString(expectedSigBytes),
 	}, nil
 }
@@ -0,0 +1,68 @@
+package psurls
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The headers of a request signed with an access key, see SignRequest.
+const (
+	AccessKeyIDHeader = "X-Filesync-Access-Key-Id"
+	DateHeader        = "X-Filesync-Date"
+	SignatureHeader   = "X-Filesync-Signature"
+)
+
+// MaxClockSkew is how far the date of a signed request can be from the validating clock.
+const MaxClockSkew = 5 * time.Minute
+
+var (
+	ErrRequestExpired = errors.New("request date is too far from now")
+)
+
+// SignRequest signs the given request with the given access key, so the server can tell which access key it's made
+// with. Its method, path and query are signed along with the access key ID and the time it's made at; its body and
+// other headers aren't.
+func SignRequest(req *http.Request, accessKeyID, secretKey string) {
+	date := strconv.FormatInt(time.Now().UTC().Unix(), 10)
+	req.Header.Set(AccessKeyIDHeader, accessKeyID)
+	req.Header.Set(DateHeader, date)
+	req.Header.Set(SignatureHeader, hex.EncodeToString(sign(requestSigData(req, accessKeyID, date), secretKey)))
+}
+
+// ValidateRequest validates the signature of the given request, signed with the access key named in its headers, whose
+// secret key is the given one. It returns ErrRequestExpired if the request was signed longer than MaxClockSkew ago, or
+// as far in the future.
+func ValidateRequest(req *http.Request, secretKey string) error {
+	date := req.Header.Get(DateHeader)
+	unix, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid or missing date: %w", err)
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return ErrRequestExpired
+	}
+
+	providedSig := req.Header.Get(SignatureHeader)
+	if providedSig == "" {
+		return fmt.Errorf("missing signature")
+	}
+	providedSigBytes, err := hex.DecodeString(providedSig)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	expectedSigBytes := sign(requestSigData(req, req.Header.Get(AccessKeyIDHeader), date), secretKey)
+	if !hmac.Equal(expectedSigBytes, providedSigBytes) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+func requestSigData(req *http.Request, accessKeyID, date string) string {
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.RawQuery, accessKeyID, date)
+}
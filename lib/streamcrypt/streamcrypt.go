@@ -0,0 +1,278 @@
+// Package streamcrypt encrypts and decrypts streams of arbitrary size with AES-GCM without buffering them as a whole.
+// The plaintext is split into fixed-size chunks, each sealed on its own, in the spirit of the STREAM construction:
+// the nonce of a chunk is made of a random prefix chosen per stream, the index of the chunk and a flag marking the
+// last chunk, so chunks can't be reordered, dropped or appended, and a stream can't be truncated, without failing
+// decryption.
+//
+// The encrypted stream starts with a header: a version byte, the chunk size as a big-endian uint32 and the nonce
+// prefix. Every chunk but the last holds exactly chunk size bytes of plaintext; the last one holds fewer, possibly
+// none.
+package streamcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// DefaultChunkSize is the chunk size used when none is given.
+	DefaultChunkSize = 64 << 10
+	// MaxChunkSize bounds the chunk size, and so the memory needed to decrypt a stream, no matter what its header says.
+	MaxChunkSize = 4 << 20
+	// HeaderSize is the size of the header each stream starts with.
+	HeaderSize = 1 + 4 + noncePrefixSize
+
+	version         = 1
+	noncePrefixSize = 7
+	tagSize         = 16
+)
+
+var (
+	ErrInvalidStream = errors.New("invalid encrypted stream")
+)
+
+// EncryptedSize returns the size of the encrypted stream of a plaintext of the given size.
+func EncryptedSize(plainSize int64, chunkSize int) int64 {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	// the last chunk is never full, so there's always one more chunk than the number of full ones
+	chunks := plainSize/int64(chunkSize) + 1
+	return HeaderSize + plainSize + chunks*tagSize
+}
+
+type writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	buf     []byte
+	out     []byte
+	counter uint32
+	closed  bool
+}
+
+// NewWriter returns a WriteCloser encrypting everything written to it with the given AES key, and writing the
+// encrypted stream to w. Close must be called to write the last chunk; it doesn't close w.
+func NewWriter(w io.Writer, key []byte, chunkSize int) (io.WriteCloser, error) {
+	prefix := make([]byte, noncePrefixSize)
+	_, err := rand.Read(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("generate nonce prefix: %w", err)
+	}
+	return newWriter(w, key, chunkSize, prefix)
+}
+
+// NewDeterministicWriter is like NewWriter but the same plaintext always encrypts to the same stream, which lets
+// the size and checksum of a stream be computed before it's written. As the nonces are the same for every stream,
+// the key must never be used to encrypt a different plaintext, e.g. it must be derived from the plaintext itself.
+func NewDeterministicWriter(w io.Writer, key []byte, chunkSize int) (io.WriteCloser, error) {
+	return newWriter(w, key, chunkSize, make([]byte, noncePrefixSize))
+}
+
+func newWriter(w io.Writer, key []byte, chunkSize int, noncePrefix []byte) (io.WriteCloser, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("chunk size %d exceeds the maximum %d", chunkSize, MaxChunkSize)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, HeaderSize)
+	header[0] = version
+	binary.BigEndian.PutUint32(header[1:5], uint32(chunkSize))
+	copy(header[5:], noncePrefix)
+
+	sw := &writer{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, 0, chunkSize),
+		out:    make([]byte, 0, chunkSize+tagSize),
+	}
+	copy(sw.nonce, header[5:])
+
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+
+	return sw, nil
+}
+
+func (sw *writer) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errors.New("write to closed encrypted stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data comes in, since the last chunk must not be full
+		if len(sw.buf) == cap(sw.buf) {
+			err := sw.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := min(len(p), cap(sw.buf)-len(sw.buf))
+		sw.buf = append(sw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals and writes the last chunk.
+func (sw *writer) Close() error {
+	if sw.closed {
+		return nil
+	}
+	if len(sw.buf) == cap(sw.buf) {
+		err := sw.seal(false)
+		if err != nil {
+			return err
+		}
+	}
+	sw.closed = true
+	return sw.seal(true)
+}
+
+func (sw *writer) seal(last bool) error {
+	if sw.counter == math.MaxUint32 {
+		return errors.New("encrypted stream too large")
+	}
+	setNonce(sw.nonce, sw.counter, last)
+	sw.counter++
+
+	sw.out = sw.aead.Seal(sw.out[:0], sw.nonce, sw.buf, sw.header)
+	sw.buf = sw.buf[:0]
+
+	_, err := sw.w.Write(sw.out)
+	if err != nil {
+		return fmt.Errorf("write chunk: %w", err)
+	}
+	return nil
+}
+
+type reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	in      []byte
+	plain   []byte
+	counter uint32
+	done    bool
+	err     error
+}
+
+// NewReader returns a Reader decrypting the encrypted stream read from r with the given AES key. Read fails with
+// ErrInvalidStream as soon as a chunk fails authentication, so no plaintext is returned that wasn't written as is.
+func NewReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, HeaderSize)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: read header: %w", ErrInvalidStream, err)
+	}
+	if header[0] != version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidStream, header[0])
+	}
+	chunkSize := binary.BigEndian.Uint32(header[1:5])
+	if chunkSize == 0 || chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("%w: invalid chunk size %d", ErrInvalidStream, chunkSize)
+	}
+
+	sr := &reader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		nonce:  make([]byte, aead.NonceSize()),
+		in:     make([]byte, int(chunkSize)+tagSize),
+	}
+	copy(sr.nonce, header[5:])
+
+	return sr, nil
+}
+
+func (sr *reader) Read(p []byte) (int, error) {
+	for len(sr.plain) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		if sr.done {
+			return 0, io.EOF
+		}
+		sr.err = sr.open()
+	}
+
+	n := copy(p, sr.plain)
+	sr.plain = sr.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (sr *reader) open() error {
+	n, err := io.ReadFull(sr.r, sr.in)
+	last := false
+	switch {
+	case err == nil:
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("%w: truncated", ErrInvalidStream)
+	default:
+		return err
+	}
+	if n < tagSize {
+		return fmt.Errorf("%w: truncated chunk", ErrInvalidStream)
+	}
+
+	setNonce(sr.nonce, sr.counter, last)
+	sr.counter++
+
+	sr.plain, err = sr.aead.Open(sr.in[:0], sr.nonce, sr.in[:n], sr.header)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d failed authentication", ErrInvalidStream, sr.counter-1)
+	}
+	sr.done = last
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("create gcm: %w", err)
+	}
+	return aead, nil
+}
+
+// setNonce sets the chunk specific part of the nonce, following the nonce prefix.
+func setNonce(nonce []byte, counter uint32, last bool) {
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
@@ -0,0 +1,152 @@
+package streamcrypt_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/lib/streamcrypt"
+)
+
+func TestRoundTrip(t *testing.T) {
+	const chunkSize = 1024
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+
+	tests := map[string]int{
+		"empty":                0,
+		"less than a chunk":    100,
+		"exactly one chunk":    chunkSize,
+		"multiple chunks":      3*chunkSize + 17,
+		"exact chunk multiple": 4 * chunkSize,
+	}
+
+	for name, size := range tests {
+		t.Run(name, func(t *testing.T) {
+			plaintext := make([]byte, size)
+			_, _ = rand.Read(plaintext)
+
+			var encrypted bytes.Buffer
+			w, err := streamcrypt.NewWriter(&encrypted, key, chunkSize)
+			require.NoError(t, err)
+			// odd sized writes must not change the chunking
+			for chunk := range slices.Chunk(plaintext, 333) {
+				_, err = w.Write(chunk)
+				require.NoError(t, err)
+			}
+			require.NoError(t, w.Close())
+			assert.EqualValues(t, streamcrypt.EncryptedSize(int64(size), chunkSize), encrypted.Len())
+
+			r, err := streamcrypt.NewReader(bytes.NewReader(encrypted.Bytes()), key)
+			require.NoError(t, err)
+			decrypted, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(plaintext, decrypted))
+		})
+	}
+}
+
+func TestTampering(t *testing.T) {
+	const chunkSize = 64
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	plaintext := make([]byte, 3*chunkSize+10)
+	_, _ = rand.Read(plaintext)
+
+	var buf bytes.Buffer
+	w, err := streamcrypt.NewWriter(&buf, key, chunkSize)
+	require.NoError(t, err)
+	_, err = w.Write(plaintext)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	encrypted := buf.Bytes()
+	sealedChunk := chunkSize + 16
+
+	otherKey := make([]byte, 32)
+	_, _ = rand.Read(otherKey)
+
+	tests := map[string]struct {
+		key    []byte
+		tamper func(b []byte) []byte
+	}{
+		"wrong key": {
+			key:    otherKey,
+			tamper: func(b []byte) []byte { return b },
+		},
+		"flipped bit": {
+			key: key,
+			tamper: func(b []byte) []byte {
+				b[streamcrypt.HeaderSize+5] ^= 1
+				return b
+			},
+		},
+		"truncated at a chunk boundary": {
+			key: key,
+			tamper: func(b []byte) []byte {
+				return b[:streamcrypt.HeaderSize+2*sealedChunk]
+			},
+		},
+		"last chunk dropped": {
+			key: key,
+			tamper: func(b []byte) []byte {
+				return b[:streamcrypt.HeaderSize+3*sealedChunk]
+			},
+		},
+		"chunks reordered": {
+			key: key,
+			tamper: func(b []byte) []byte {
+				first := slices.Clone(b[streamcrypt.HeaderSize : streamcrypt.HeaderSize+sealedChunk])
+				copy(b[streamcrypt.HeaderSize:], b[streamcrypt.HeaderSize+sealedChunk:streamcrypt.HeaderSize+2*sealedChunk])
+				copy(b[streamcrypt.HeaderSize+sealedChunk:], first)
+				return b
+			},
+		},
+		"chunk size changed": {
+			key: key,
+			tamper: func(b []byte) []byte {
+				b[4]++
+				return b
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, err := streamcrypt.NewReader(bytes.NewReader(tc.tamper(slices.Clone(encrypted))), tc.key)
+			require.NoError(t, err)
+			_, err = io.ReadAll(r)
+			assert.ErrorIs(t, err, streamcrypt.ErrInvalidStream)
+		})
+	}
+}
+
+func TestDeterministicWriter(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	plaintext := make([]byte, 3*1024+5)
+	_, _ = rand.Read(plaintext)
+
+	encrypt := func() []byte {
+		var buf bytes.Buffer
+		w, err := streamcrypt.NewDeterministicWriter(&buf, key, 1024)
+		require.NoError(t, err)
+		_, err = w.Write(plaintext)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+
+	encrypted := encrypt()
+	assert.Equal(t, encrypted, encrypt())
+
+	r, err := streamcrypt.NewReader(bytes.NewReader(encrypted), key)
+	require.NoError(t, err)
+	decrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(plaintext, decrypted))
+}
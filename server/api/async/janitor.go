@@ -3,50 +3,110 @@ package async
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
 
-	"github.com/hedisam/filesync/server/internal/store"
-	"github.com/hedisam/pipeline/chans"
+	"github.com/hedisam/filesync/server/internal/outbox"
 )
 
 type FileStorage interface {
 	DeleteObject(ctx context.Context, objectID string) error
 }
 
+// ObjectReferences guards the deletion of objects against new references to them. BeginObjectDeletion reports
+// whether the object is unreferenced, in which case it's kept so until EndObjectDeletion is called.
+type ObjectReferences interface {
+	BeginObjectDeletion(ctx context.Context, objectID string) (bool, error)
+	EndObjectDeletion(ctx context.Context, objectID string) error
+}
+
+// Queue is the durable queue of objects to delete. An entry is only removed once it's acked; nacked entries are
+// retried later.
+type Queue interface {
+	Next(ctx context.Context) (outbox.Entry, error)
+	Ack(id uint64) error
+	Nack(id uint64, cause error) error
+}
+
 type Janitor struct {
 	logger  *logrus.Logger
 	storage FileStorage
+	refs    ObjectReferences
 }
 
-func NewJanitor(logger *logrus.Logger, storage FileStorage) *Janitor {
+func NewJanitor(logger *logrus.Logger, storage FileStorage, refs ObjectReferences) *Janitor {
 	return &Janitor{
 		logger:  logger,
 		storage: storage,
+		refs:    refs,
 	}
 }
 
-func (j *Janitor) Run(ctx context.Context, in <-chan *store.ObjectMetadata) {
-	j.logger.WithContext(ctx).Info("Running Janitor")
+func (j *Janitor) Run(ctx context.Context, queue Queue) {
+	logger := j.logger.WithContext(ctx)
+	logger.Info("Running Janitor")
 
-	for md := range chans.ReceiveOrDoneSeq(ctx, in) {
-		j.cleanup(ctx, md)
+	for {
+		entry, err := queue.Next(ctx)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, outbox.ErrClosed) {
+				logger.WithError(err).Error("Failed to receive object to clean up")
+			}
+			return
+		}
+
+		err = j.cleanup(ctx, &entry)
+		if err != nil {
+			if ctx.Err() != nil {
+				// the entry is left pending so that it's retried by the next run
+				return
+			}
+			err = queue.Nack(entry.ID, err)
+		} else {
+			err = queue.Ack(entry.ID)
+		}
+		if err != nil {
+			logger.WithError(err).WithField("entry_id", entry.ID).Error("Failed to update deletion queue entry")
+		}
 	}
 }
 
-func (j *Janitor) cleanup(ctx context.Context, md *store.ObjectMetadata) {
+// cleanup deletes the object of the given entry unless it's referenced again. A nil error means the entry can be
+// acknowledged.
+func (j *Janitor) cleanup(ctx context.Context, entry *outbox.Entry) error {
 	ctx, span := otel.Tracer("").Start(ctx, "janitor")
 	defer span.End()
 
 	logger := j.logger.WithContext(ctx).WithFields(logrus.Fields{
-		"object_id": md.ObjectID,
-		"key":       md.Key,
+		"entry_id":  entry.ID,
+		"object_id": entry.ObjectID,
+		"key":       entry.Key,
+		"attempts":  entry.Attempts,
 	})
 	logger.Debug("Cleaning up object")
 
+	// a content-addressed object can be referenced again, by a new upload of the same content, after it was queued
+	// for deletion; the object must be kept if that's the case, and mustn't be referenced again while it's deleted.
+	unreferenced, err := j.refs.BeginObjectDeletion(ctx, entry.ObjectID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to check object references in janitor")
+		return fmt.Errorf("check object references: %w", err)
+	}
+	if !unreferenced {
+		logger.Debug("Object is referenced again, skipping clean up")
+		return nil
+	}
+	defer func() {
+		err := j.refs.EndObjectDeletion(context.WithoutCancel(ctx), entry.ObjectID)
+		if err != nil {
+			logger.WithError(err).Error("Failed to end object deletion in janitor")
+		}
+	}()
+
 	bk := backoff.NewExponentialBackOff(
 		backoff.WithMaxElapsedTime(time.Second*3),
 		backoff.WithMaxInterval(time.Second),
@@ -54,12 +114,12 @@ func (j *Janitor) cleanup(ctx context.Context, md *store.ObjectMetadata) {
 		backoff.WithMultiplier(2),
 		backoff.WithRandomizationFactor(0.2),
 	)
-	err := backoff.Retry(func() error {
-		err := j.storage.DeleteObject(ctx, md.ObjectID)
+	err = backoff.Retry(func() error {
+		err := j.storage.DeleteObject(ctx, entry.ObjectID)
 		if err != nil {
 			if errors.Is(err, context.Canceled) {
 				logger.WithError(err).Error("Failed to cleanup object due to context cancellation; will be retried later")
-				// the event shouldn't be acknowledged so that it can be retried later
+				// the entry shouldn't be acknowledged so that it can be retried later
 				return backoff.Permanent(err)
 			}
 			logger.WithError(err).Error("Failed to delete object, retrying")
@@ -69,7 +129,9 @@ func (j *Janitor) cleanup(ctx context.Context, md *store.ObjectMetadata) {
 		return nil
 	}, backoff.WithContext(bk, ctx))
 	if err != nil {
-		logger.WithError(err).Error("Failed to clean up object in janitor")
-		return
+		logger.WithError(err).Error("Failed to clean up object in janitor; will be retried later")
+		return fmt.Errorf("delete object: %w", err)
 	}
+
+	return nil
 }
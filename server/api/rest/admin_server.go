@@ -0,0 +1,111 @@
+package rest
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/blobstorage/filesystem"
+)
+
+type StorageMigrator interface {
+	MigrationStatus() filesystem.MigrationStatus
+	StartMigration(ctx context.Context, to filesystem.Layout) error
+}
+
+// AdminServer implements the operator endpoints. It must only be registered behind WithBearerToken.
+type AdminServer struct {
+	logger   *logrus.Logger
+	migrator StorageMigrator
+}
+
+func NewAdminServer(logger *logrus.Logger, migrator StorageMigrator) *AdminServer {
+	return &AdminServer{
+		logger:   logger,
+		migrator: migrator,
+	}
+}
+
+// GetStorageLayout returns the layout of the blob store and the progress of any layout migration.
+func (s *AdminServer) GetStorageLayout(_ context.Context, _ *GetStorageLayoutRequest) (*StorageLayoutResponse, error) {
+	return newStorageLayoutResponse(s.migrator.MigrationStatus()), nil
+}
+
+// MigrateStorageLayout starts migrating the blob store to the requested layout in the background. The progress can be
+// followed with GetStorageLayout.
+func (s *AdminServer) MigrateStorageLayout(ctx context.Context, req *MigrateStorageLayoutRequest) (*StorageLayoutResponse, error) {
+	logger := s.logger.WithContext(ctx).WithField("layout", req.Layout)
+
+	layout, err := filesystem.ParseLayout(req.Layout)
+	if err != nil {
+		return nil, NewErrf(http.StatusBadRequest, "%v", err)
+	}
+
+	err = s.migrator.StartMigration(ctx, layout)
+	if err != nil {
+		if errors.Is(err, filesystem.ErrMigrationInProgress) || errors.Is(err, filesystem.ErrLayoutMismatch) {
+			return nil, NewErrf(http.StatusConflict, "%v", err)
+		}
+		logger.WithError(err).Error("Failed to start storage layout migration")
+		return nil, NewErrf(http.StatusInternalServerError, "start storage layout migration: %v", err)
+	}
+	logger.Info("Started storage layout migration")
+
+	return newStorageLayoutResponse(s.migrator.MigrationStatus()), nil
+}
+
+func newStorageLayoutResponse(status filesystem.MigrationStatus) *StorageLayoutResponse {
+	resp := &StorageLayoutResponse{
+		Layout:        string(status.Layout),
+		MigratingFrom: string(status.MigratingFrom),
+		Running:       status.Running,
+		Moved:         status.Moved,
+	}
+	if status.Err != nil {
+		resp.Error = status.Err.Error()
+	}
+	return resp
+}
+
+type GetStorageLayoutRequest struct{}
+
+type MigrateStorageLayoutRequest struct {
+	Layout string `json:"layout"`
+}
+
+type StorageLayoutResponse struct {
+	Layout        string `json:"layout"`
+	MigratingFrom string `json:"migrating_from,omitempty"`
+	Running       bool   `json:"running"`
+	Moved         int64  `json:"moved"`
+	Error         string `json:"error,omitempty"`
+}
+
+// WithBearerToken returns a Mux that only lets requests through to the handlers registered on it if they present the
+// given token in their Authorization header.
+func WithBearerToken(mux Mux, token string) Mux {
+	return &bearerTokenMux{
+		mux:   mux,
+		token: token,
+	}
+}
+
+type bearerTokenMux struct {
+	mux   Mux
+	token string
+}
+
+func (m *bearerTokenMux) HandleFunc(pattern string, f func(w http.ResponseWriter, r *http.Request)) {
+	m.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || m.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(m.token)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		f(w, r)
+	})
+}
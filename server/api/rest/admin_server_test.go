@@ -0,0 +1,144 @@
+package rest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	restapi "github.com/hedisam/filesync/server/api/rest"
+	"github.com/hedisam/filesync/server/api/rest/mocks"
+	"github.com/hedisam/filesync/server/internal/blobstorage/filesystem"
+)
+
+//go:generate moq -out mocks/storage_migrator.go -pkg mocks -skip-ensure . StorageMigrator
+
+func TestMigrateStorageLayout(t *testing.T) {
+	tests := map[string]struct {
+		req        *restapi.MigrateStorageLayoutRequest
+		migrateErr error
+
+		expectedResp *restapi.StorageLayoutResponse
+		expectedErr  *restapi.Err
+	}{
+		"migration started": {
+			req: &restapi.MigrateStorageLayoutRequest{Layout: "fanout"},
+			expectedResp: &restapi.StorageLayoutResponse{
+				Layout:        "fanout",
+				MigratingFrom: "flat",
+				Running:       true,
+			},
+		},
+		"unknown layout": {
+			req: &restapi.MigrateStorageLayoutRequest{Layout: "zigzag"},
+			expectedErr: &restapi.Err{
+				Message: `unknown storage layout "zigzag"`,
+				Status:  http.StatusBadRequest,
+			},
+		},
+		"migration in progress": {
+			req:        &restapi.MigrateStorageLayoutRequest{Layout: "fanout"},
+			migrateErr: filesystem.ErrMigrationInProgress,
+			expectedErr: &restapi.Err{
+				Message: "storage layout migration in progress",
+				Status:  http.StatusConflict,
+			},
+		},
+		"already migrated": {
+			req:        &restapi.MigrateStorageLayoutRequest{Layout: "fanout"},
+			migrateErr: fmt.Errorf("%w: store is already laid out as \"fanout\"", filesystem.ErrLayoutMismatch),
+			expectedErr: &restapi.Err{
+				Message: `storage layout mismatch: store is already laid out as "fanout"`,
+				Status:  http.StatusConflict,
+			},
+		},
+		"migration failure": {
+			req:        &restapi.MigrateStorageLayoutRequest{Layout: "fanout"},
+			migrateErr: errors.New("disk full"),
+			expectedErr: &restapi.Err{
+				Message: "start storage layout migration: disk full",
+				Status:  http.StatusInternalServerError,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			migrator := &mocks.StorageMigratorMock{
+				StartMigrationFunc: func(ctx context.Context, to filesystem.Layout) error {
+					assert.Equal(t, filesystem.LayoutFanout, to)
+					return tc.migrateErr
+				},
+				MigrationStatusFunc: func() filesystem.MigrationStatus {
+					return filesystem.MigrationStatus{
+						Layout:        filesystem.LayoutFanout,
+						MigratingFrom: filesystem.LayoutFlat,
+						Running:       true,
+					}
+				},
+			}
+
+			s := restapi.NewAdminServer(logrus.New(), migrator)
+			resp, err := s.MigrateStorageLayout(context.Background(), tc.req)
+			if tc.expectedErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedResp, resp)
+		})
+	}
+}
+
+func TestWithBearerToken(t *testing.T) {
+	tests := map[string]struct {
+		token         string
+		authorization string
+
+		wantStatus int
+	}{
+		"valid token": {
+			token:         "s3cret",
+			authorization: "Bearer s3cret",
+			wantStatus:    http.StatusNoContent,
+		},
+		"invalid token": {
+			token:         "s3cret",
+			authorization: "Bearer guess",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		"missing token": {
+			token:      "s3cret",
+			wantStatus: http.StatusUnauthorized,
+		},
+		"no token configured": {
+			authorization: "Bearer ",
+			wantStatus:    http.StatusUnauthorized,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			restapi.WithBearerToken(mux, tc.token).HandleFunc("GET /admin", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.wantStatus, rr.Code)
+		})
+	}
+}
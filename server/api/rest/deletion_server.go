@@ -0,0 +1,96 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/outbox"
+)
+
+type DeletionQueue interface {
+	Pending() int
+	DeadLetters() []outbox.Entry
+	Requeue(id uint64) error
+}
+
+// DeletionServer implements the operator endpoints inspecting the queue of objects to delete. It must only be
+// registered behind WithBearerToken.
+type DeletionServer struct {
+	logger *logrus.Logger
+	queue  DeletionQueue
+}
+
+func NewDeletionServer(logger *logrus.Logger, queue DeletionQueue) *DeletionServer {
+	return &DeletionServer{
+		logger: logger,
+		queue:  queue,
+	}
+}
+
+// GetDeletions returns the number of objects waiting to be deleted and the dead letters, i.e. the objects the janitor
+// failed to delete too many times and gave up on.
+func (s *DeletionServer) GetDeletions(_ context.Context, _ *GetDeletionsRequest) (*DeletionsResponse, error) {
+	deadLetters := s.queue.DeadLetters()
+	resp := &DeletionsResponse{
+		Pending:     s.queue.Pending(),
+		DeadLetters: make([]DeadLetter, 0, len(deadLetters)),
+	}
+	for e := range slices.Values(deadLetters) {
+		resp.DeadLetters = append(resp.DeadLetters, DeadLetter{
+			ID:         e.ID,
+			Namespace:  e.Namespace,
+			Key:        e.Key,
+			ObjectID:   e.ObjectID,
+			EnqueuedAt: e.EnqueuedAt,
+			Attempts:   e.Attempts,
+			LastError:  e.LastError,
+		})
+	}
+	return resp, nil
+}
+
+// RequeueDeletion makes a dead letter pending again, e.g. once the cause of its failures is fixed.
+func (s *DeletionServer) RequeueDeletion(ctx context.Context, req *RequeueDeletionRequest) (*RequeueDeletionResponse, error) {
+	logger := s.logger.WithContext(ctx).WithField("entry_id", req.ID)
+
+	err := s.queue.Requeue(req.ID)
+	if err != nil {
+		if errors.Is(err, outbox.ErrNotFound) {
+			return nil, NewErrf(http.StatusNotFound, "dead letter %d not found", req.ID)
+		}
+		logger.WithError(err).Error("Failed to requeue dead letter")
+		return nil, NewErrf(http.StatusInternalServerError, "requeue dead letter: %v", err)
+	}
+	logger.Info("Requeued dead letter")
+
+	return &RequeueDeletionResponse{}, nil
+}
+
+type GetDeletionsRequest struct{}
+
+type DeletionsResponse struct {
+	Pending     int          `json:"pending"`
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+type DeadLetter struct {
+	ID         uint64    `json:"id"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	ObjectID   string    `json:"object_id"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error"`
+}
+
+type RequeueDeletionRequest struct {
+	// ID is a path value, hence a string.
+	ID uint64 `json:"id,string"`
+}
+
+type RequeueDeletionResponse struct{}
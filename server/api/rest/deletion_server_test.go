@@ -0,0 +1,89 @@
+package rest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	restapi "github.com/hedisam/filesync/server/api/rest"
+	"github.com/hedisam/filesync/server/api/rest/mocks"
+	"github.com/hedisam/filesync/server/internal/outbox"
+)
+
+//go:generate moq -out mocks/deletion_queue.go -pkg mocks -skip-ensure . DeletionQueue
+
+func TestGetDeletions(t *testing.T) {
+	enqueuedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	queue := &mocks.DeletionQueueMock{
+		PendingFunc: func() int {
+			return 3
+		},
+		DeadLettersFunc: func() []outbox.Entry {
+			return []outbox.Entry{
+				{ID: 7, Namespace: "docs", Key: "a.txt", ObjectID: "a", EnqueuedAt: enqueuedAt, Attempts: 10, LastError: "access denied"},
+			}
+		},
+	}
+
+	s := restapi.NewDeletionServer(logrus.New(), queue)
+	resp, err := s.GetDeletions(context.Background(), &restapi.GetDeletionsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, &restapi.DeletionsResponse{
+		Pending: 3,
+		DeadLetters: []restapi.DeadLetter{
+			{ID: 7, Namespace: "docs", Key: "a.txt", ObjectID: "a", EnqueuedAt: enqueuedAt, Attempts: 10, LastError: "access denied"},
+		},
+	}, resp)
+}
+
+func TestRequeueDeletion(t *testing.T) {
+	tests := map[string]struct {
+		requeueErr error
+
+		expectedErr *restapi.Err
+	}{
+		"requeued": {},
+		"not found": {
+			requeueErr: fmt.Errorf("%w: 7", outbox.ErrNotFound),
+			expectedErr: &restapi.Err{
+				Message: "dead letter 7 not found",
+				Status:  http.StatusNotFound,
+			},
+		},
+		"requeue failure": {
+			requeueErr: errors.New("disk full"),
+			expectedErr: &restapi.Err{
+				Message: "requeue dead letter: disk full",
+				Status:  http.StatusInternalServerError,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			queue := &mocks.DeletionQueueMock{
+				RequeueFunc: func(id uint64) error {
+					assert.Equal(t, uint64(7), id)
+					return tc.requeueErr
+				},
+			}
+
+			s := restapi.NewDeletionServer(logrus.New(), queue)
+			resp, err := s.RequeueDeletion(context.Background(), &restapi.RequeueDeletionRequest{ID: 7})
+			if tc.expectedErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, &restapi.RequeueDeletionResponse{}, resp)
+		})
+	}
+}
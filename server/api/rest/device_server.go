@@ -0,0 +1,241 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/devices"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+var deviceIDRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type DeviceRegistry interface {
+	Register(ctx context.Context, reg devices.Registration) (devices.Device, error)
+	ReportSync(ctx context.Context, id string, report devices.SyncReport) (devices.Device, error)
+	Get(ctx context.Context, id string) (devices.Device, error)
+	List(ctx context.Context, namespace string) ([]devices.Device, error)
+	Remove(ctx context.Context, id string) error
+	Staleness(ctx context.Context, d devices.Device) (string, error)
+}
+
+// DeviceServer implements the endpoints clients register with and report their sync state to, and the operator ones
+// inspecting the devices. The latter must only be registered behind WithBearerToken.
+type DeviceServer struct {
+	logger   *logrus.Logger
+	registry DeviceRegistry
+}
+
+func NewDeviceServer(logger *logrus.Logger, registry DeviceRegistry) *DeviceServer {
+	return &DeviceServer{
+		logger:   logger,
+		registry: registry,
+	}
+}
+
+// RegisterDevice registers a device, or updates the registration of a known one. Devices are identified by the IDs
+// they pick, which must be unique, e.g. random ones.
+func (s *DeviceServer) RegisterDevice(ctx context.Context, req *RegisterDeviceRequest) (*Device, error) {
+	logger := s.logger.WithContext(ctx).WithField("device_id", req.DeviceID)
+
+	if !deviceIDRegex.MatchString(req.DeviceID) {
+		return nil, NewErrf(http.StatusBadRequest, "invalid device id %q: must be 1 to 128 letters, digits, '.', '_' or '-'", req.DeviceID)
+	}
+
+	d, err := s.registry.Register(ctx, devices.Registration{
+		ID:            req.DeviceID,
+		Name:          req.Name,
+		Namespace:     req.Namespace,
+		ClientVersion: req.ClientVersion,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to register device")
+		return nil, NewErrf(http.StatusInternalServerError, "register device: %v", err)
+	}
+	logger.WithFields(logrus.Fields{
+		"name":           d.Name,
+		"namespace":      d.Namespace,
+		"client_version": d.ClientVersion,
+	}).Debug("Registered device")
+
+	return newDevice(d, ""), nil
+}
+
+// ReportDeviceSync records the sync state of a registered device. It responds with 404 if the device isn't registered,
+// e.g. after a restart, so it must register again.
+func (s *DeviceServer) ReportDeviceSync(ctx context.Context, req *ReportDeviceSyncRequest) (*Device, error) {
+	logger := s.logger.WithContext(ctx).WithField("device_id", req.DeviceID)
+
+	var cursor store.Cursor
+	if req.Cursor != "" {
+		var err error
+		cursor, err = decodeCursor(req.Cursor)
+		if err != nil {
+			return nil, NewErrf(http.StatusBadRequest, "invalid cursor: %v", err)
+		}
+	}
+
+	d, err := s.registry.ReportSync(ctx, req.DeviceID, devices.SyncReport{
+		Cursor:        cursor,
+		ClientVersion: req.ClientVersion,
+		SyncRoot: devices.SyncRoot{
+			Files:    req.SyncRoot.Files,
+			Bytes:    req.SyncRoot.Bytes,
+			RootHash: req.SyncRoot.RootHash,
+		},
+	})
+	if err != nil {
+		if errors.Is(err, devices.ErrNotFound) {
+			return nil, NewErrf(http.StatusNotFound, "device %q is not registered", req.DeviceID)
+		}
+		logger.WithError(err).Error("Failed to record device sync state")
+		return nil, NewErrf(http.StatusInternalServerError, "record device sync state: %v", err)
+	}
+
+	return newDevice(d, ""), nil
+}
+
+// ListDevices returns the devices syncing the given namespace, or all of them, along with whether they're stale.
+func (s *DeviceServer) ListDevices(ctx context.Context, req *ListDevicesRequest) (*ListDevicesResponse, error) {
+	logger := s.logger.WithContext(ctx).WithField("namespace", req.Namespace)
+
+	list, err := s.registry.List(ctx, req.Namespace)
+	if err != nil {
+		logger.WithError(err).Error("Failed to list devices")
+		return nil, NewErrf(http.StatusInternalServerError, "list devices: %v", err)
+	}
+
+	resp := &ListDevicesResponse{
+		Devices: make([]*Device, 0, len(list)),
+	}
+	for d := range slices.Values(list) {
+		staleness, err := s.registry.Staleness(ctx, d)
+		if err != nil {
+			logger.WithError(err).Error("Failed to check device staleness")
+			return nil, NewErrf(http.StatusInternalServerError, "check device staleness: %v", err)
+		}
+		resp.Devices = append(resp.Devices, newDevice(d, staleness))
+	}
+	return resp, nil
+}
+
+// GetDevice returns the device with the given ID along with whether it's stale.
+func (s *DeviceServer) GetDevice(ctx context.Context, req *GetDeviceRequest) (*Device, error) {
+	logger := s.logger.WithContext(ctx).WithField("device_id", req.DeviceID)
+
+	d, err := s.registry.Get(ctx, req.DeviceID)
+	if err != nil {
+		if errors.Is(err, devices.ErrNotFound) {
+			return nil, NewErrf(http.StatusNotFound, "device %q not found", req.DeviceID)
+		}
+		logger.WithError(err).Error("Failed to get device")
+		return nil, NewErrf(http.StatusInternalServerError, "get device: %v", err)
+	}
+	staleness, err := s.registry.Staleness(ctx, d)
+	if err != nil {
+		logger.WithError(err).Error("Failed to check device staleness")
+		return nil, NewErrf(http.StatusInternalServerError, "check device staleness: %v", err)
+	}
+
+	return newDevice(d, staleness), nil
+}
+
+// DeleteDevice forgets a device, e.g. one decommissioned. A device still syncing registers again.
+func (s *DeviceServer) DeleteDevice(ctx context.Context, req *DeleteDeviceRequest) (*DeleteDeviceResponse, error) {
+	logger := s.logger.WithContext(ctx).WithField("device_id", req.DeviceID)
+
+	err := s.registry.Remove(ctx, req.DeviceID)
+	if err != nil {
+		if errors.Is(err, devices.ErrNotFound) {
+			return nil, NewErrf(http.StatusNotFound, "device %q not found", req.DeviceID)
+		}
+		logger.WithError(err).Error("Failed to delete device")
+		return nil, NewErrf(http.StatusInternalServerError, "delete device: %v", err)
+	}
+	logger.Info("Deleted device")
+
+	return &DeleteDeviceResponse{}, nil
+}
+
+func newDevice(d devices.Device, staleness string) *Device {
+	device := &Device{
+		ID:            d.ID,
+		Name:          d.Name,
+		Namespace:     d.Namespace,
+		ClientVersion: d.ClientVersion,
+		RegisteredAt:  d.RegisteredAt,
+		LastSeen:      d.LastSeen,
+		SyncRoot: SyncRootSummary{
+			Files:    d.SyncRoot.Files,
+			Bytes:    d.SyncRoot.Bytes,
+			RootHash: d.SyncRoot.RootHash,
+		},
+		Stale:     staleness != "",
+		Staleness: staleness,
+	}
+	if d.Cursor != (store.Cursor{}) {
+		device.Cursor = encodeCursor(d.Cursor)
+	}
+	return device
+}
+
+type RegisterDeviceRequest struct {
+	DeviceID      string `json:"device_id"`
+	Name          string `json:"name"`
+	Namespace     string `json:"namespace"`
+	ClientVersion string `json:"client_version"`
+}
+
+type ReportDeviceSyncRequest struct {
+	DeviceID string `json:"device_id"`
+	// Cursor is the cursor of the changes the device has synced.
+	Cursor        string          `json:"cursor"`
+	ClientVersion string          `json:"client_version"`
+	SyncRoot      SyncRootSummary `json:"sync_root"`
+}
+
+type ListDevicesRequest struct {
+	Namespace string `json:"namespace"`
+}
+
+type ListDevicesResponse struct {
+	Devices []*Device `json:"devices"`
+}
+
+type GetDeviceRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+type DeleteDeviceRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+type DeleteDeviceResponse struct{}
+
+type Device struct {
+	ID            string          `json:"device_id"`
+	Name          string          `json:"name"`
+	Namespace     string          `json:"namespace"`
+	ClientVersion string          `json:"client_version,omitempty"`
+	RegisteredAt  time.Time       `json:"registered_at"`
+	LastSeen      time.Time       `json:"last_seen"`
+	Cursor        string          `json:"cursor,omitempty"`
+	SyncRoot      SyncRootSummary `json:"sync_root"`
+	// Stale is set for devices not seen for too long, or whose cursors have expired, which may have missed deletions.
+	// Staleness tells which.
+	Stale     bool   `json:"stale,omitempty"`
+	Staleness string `json:"staleness,omitempty"`
+}
+
+// SyncRootSummary summarizes the files of the directory a device syncs.
+type SyncRootSummary struct {
+	Files    int64  `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	RootHash string `json:"root_hash,omitempty"`
+}
@@ -0,0 +1,195 @@
+package rest_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	restapi "github.com/hedisam/filesync/server/api/rest"
+	"github.com/hedisam/filesync/server/api/rest/mocks"
+	"github.com/hedisam/filesync/server/internal/devices"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+//go:generate moq -out mocks/device_registry.go -pkg mocks -skip-ensure . DeviceRegistry
+
+func TestRegisterDevice(t *testing.T) {
+	seen := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		req *restapi.RegisterDeviceRequest
+
+		expectedResp *restapi.Device
+		expectedErr  *restapi.Err
+	}{
+		"registered": {
+			req: &restapi.RegisterDeviceRequest{DeviceID: "laptop-1", Name: "laptop", Namespace: "docs", ClientVersion: "v1.0.0"},
+			expectedResp: &restapi.Device{
+				ID:            "laptop-1",
+				Name:          "laptop",
+				Namespace:     "docs",
+				ClientVersion: "v1.0.0",
+				RegisteredAt:  seen,
+				LastSeen:      seen,
+			},
+		},
+		"missing device id": {
+			req: &restapi.RegisterDeviceRequest{Name: "laptop"},
+			expectedErr: &restapi.Err{
+				Message: `invalid device id "": must be 1 to 128 letters, digits, '.', '_' or '-'`,
+				Status:  http.StatusBadRequest,
+			},
+		},
+		"invalid device id": {
+			req: &restapi.RegisterDeviceRequest{DeviceID: "../laptop"},
+			expectedErr: &restapi.Err{
+				Message: `invalid device id "../laptop": must be 1 to 128 letters, digits, '.', '_' or '-'`,
+				Status:  http.StatusBadRequest,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			registry := &mocks.DeviceRegistryMock{
+				RegisterFunc: func(ctx context.Context, reg devices.Registration) (devices.Device, error) {
+					return devices.Device{
+						ID:            reg.ID,
+						Name:          reg.Name,
+						Namespace:     reg.Namespace,
+						ClientVersion: reg.ClientVersion,
+						RegisteredAt:  seen,
+						LastSeen:      seen,
+					}, nil
+				},
+			}
+
+			s := restapi.NewDeviceServer(logrus.New(), registry)
+			resp, err := s.RegisterDevice(context.Background(), tc.req)
+			if tc.expectedErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErr, err)
+				assert.Empty(t, registry.RegisterCalls())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedResp, resp)
+		})
+	}
+}
+
+func TestReportDeviceSync(t *testing.T) {
+	tests := map[string]struct {
+		req       *restapi.ReportDeviceSyncRequest
+		reportErr error
+
+		expectedReport devices.SyncReport
+		expectedErr    *restapi.Err
+	}{
+		"reported": {
+			req: &restapi.ReportDeviceSyncRequest{
+				DeviceID:      "laptop-1",
+				Cursor:        "epoch.7",
+				ClientVersion: "v1.0.0",
+				SyncRoot:      restapi.SyncRootSummary{Files: 3, Bytes: 1024, RootHash: "abc"},
+			},
+			expectedReport: devices.SyncReport{
+				Cursor:        store.Cursor{Epoch: "epoch", Seq: 7},
+				ClientVersion: "v1.0.0",
+				SyncRoot:      devices.SyncRoot{Files: 3, Bytes: 1024, RootHash: "abc"},
+			},
+		},
+		"not synced yet": {
+			req: &restapi.ReportDeviceSyncRequest{DeviceID: "laptop-1"},
+		},
+		"invalid cursor": {
+			req: &restapi.ReportDeviceSyncRequest{DeviceID: "laptop-1", Cursor: "7"},
+			expectedErr: &restapi.Err{
+				Message: `invalid cursor: malformed cursor "7"`,
+				Status:  http.StatusBadRequest,
+			},
+		},
+		"not registered": {
+			req:       &restapi.ReportDeviceSyncRequest{DeviceID: "laptop-1"},
+			reportErr: fmt.Errorf("device %q: %w", "laptop-1", devices.ErrNotFound),
+			expectedErr: &restapi.Err{
+				Message: `device "laptop-1" is not registered`,
+				Status:  http.StatusNotFound,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			registry := &mocks.DeviceRegistryMock{
+				ReportSyncFunc: func(ctx context.Context, id string, report devices.SyncReport) (devices.Device, error) {
+					assert.Equal(t, "laptop-1", id)
+					assert.Equal(t, tc.expectedReport, report)
+					return devices.Device{ID: id, Cursor: report.Cursor}, tc.reportErr
+				},
+			}
+
+			s := restapi.NewDeviceServer(logrus.New(), registry)
+			resp, err := s.ReportDeviceSync(context.Background(), tc.req)
+			if tc.expectedErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.req.Cursor, resp.Cursor)
+		})
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	seen := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	registry := &mocks.DeviceRegistryMock{
+		ListFunc: func(ctx context.Context, namespace string) ([]devices.Device, error) {
+			assert.Equal(t, "docs", namespace)
+			return []devices.Device{
+				{ID: "desktop-1", Namespace: "docs", LastSeen: seen, Cursor: store.Cursor{Epoch: "epoch", Seq: 2}},
+				{ID: "laptop-1", Namespace: "docs", LastSeen: seen, Cursor: store.Cursor{Epoch: "epoch", Seq: 9}},
+			}, nil
+		},
+		StalenessFunc: func(ctx context.Context, d devices.Device) (string, error) {
+			if d.ID == "desktop-1" {
+				return "its cursor has expired", nil
+			}
+			return "", nil
+		},
+	}
+
+	s := restapi.NewDeviceServer(logrus.New(), registry)
+	resp, err := s.ListDevices(context.Background(), &restapi.ListDevicesRequest{Namespace: "docs"})
+	require.NoError(t, err)
+	assert.Equal(t, &restapi.ListDevicesResponse{
+		Devices: []*restapi.Device{
+			{ID: "desktop-1", Namespace: "docs", LastSeen: seen, Cursor: "epoch.2", Stale: true, Staleness: "its cursor has expired"},
+			{ID: "laptop-1", Namespace: "docs", LastSeen: seen, Cursor: "epoch.9"},
+		},
+	}, resp)
+}
+
+func TestDeleteDevice(t *testing.T) {
+	registry := &mocks.DeviceRegistryMock{
+		RemoveFunc: func(ctx context.Context, id string) error {
+			if id == "laptop-1" {
+				return nil
+			}
+			return fmt.Errorf("device %q: %w", id, devices.ErrNotFound)
+		},
+	}
+
+	s := restapi.NewDeviceServer(logrus.New(), registry)
+	_, err := s.DeleteDevice(context.Background(), &restapi.DeleteDeviceRequest{DeviceID: "laptop-1"})
+	require.NoError(t, err)
+	_, err = s.DeleteDevice(context.Background(), &restapi.DeleteDeviceRequest{DeviceID: "desktop-1"})
+	assert.Equal(t, &restapi.Err{Message: `device "desktop-1" not found`, Status: http.StatusNotFound}, err)
+}
@@ -0,0 +1,138 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/lib/compression"
+	"github.com/hedisam/filesync/lib/psurls"
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+type ObjectReader interface {
+	GetObject(ctx context.Context, objectID string) (io.ReadCloser, error)
+}
+
+type DownloadMetadataStore interface {
+	Get(ctx context.Context, namespace, key string) (*store.ObjectMetadata, error)
+}
+
+// DownloadServer streams the content of stored files from the blob storage backend.
+type DownloadServer struct {
+	logger  *logrus.Logger
+	storage ObjectReader
+	mdStore DownloadMetadataStore
+	auth    Auth
+}
+
+func NewDownloadServer(logger *logrus.Logger, storage ObjectReader, mdStore DownloadMetadataStore, auth Auth) *DownloadServer {
+	return &DownloadServer{
+		logger:  logger,
+		storage: storage,
+		mdStore: mdStore,
+		auth:    auth,
+	}
+}
+
+// DownloadFile accepts a presigned download url and streams the content of the file stored under its key. If the url
+// carries a checksum, the file is only served if its content still has that checksum; it responds with 412
+// otherwise, e.g. if the file has been replaced since the url was generated. The content is compressed with the most
+// preferred encoding accepted by the client, if any, which objects compressed at rest with it are served as is.
+func (s *DownloadServer) DownloadFile(w http.ResponseWriter, r *http.Request) {
+	urlData, logger, ok := validatePresignedURL(s.logger, s.auth, w, r, psurls.OpDownload)
+	if !ok {
+		return
+	}
+
+	md, err := s.mdStore.Get(r.Context(), urlData.Namespace, urlData.ObjectKey)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		logger.WithError(err).Error("Failed to get object metadata when downloading file")
+		http.Error(w, fmt.Sprintf("could not get object metadata: %q", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if urlData.SHA256Checksum != "" && urlData.SHA256Checksum != md.SHA256Checksum {
+		http.Error(w, "file content has changed", http.StatusPreconditionFailed)
+		return
+	}
+	logger = logger.WithField("object_id", md.ObjectID)
+
+	rc, err := s.storage.GetObject(r.Context(), md.ObjectID)
+	if err != nil {
+		if errors.Is(err, blobstorage.ErrNotFound) {
+			// the file has been replaced or deleted since we got its metadata
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		logger.WithError(err).Error("Failed to get object from storage when downloading file")
+		http.Error(w, fmt.Sprintf("could not get object from storage: %q", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	content, encoding, err := encodeContent(rc, compression.Encoding(md.ContentEncoding), compression.Negotiate(r.Header.Get("Accept-Encoding")))
+	if err != nil {
+		logger.WithError(err).Error("Failed to decode stored object when downloading file")
+		http.Error(w, fmt.Sprintf("could not decode stored object: %q", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if encoding == compression.Identity {
+		w.Header().Set("Content-Length", strconv.FormatInt(md.Size, 10))
+		w.Header().Set("ETag", strconv.Quote(md.SHA256Checksum))
+	} else {
+		// the size of the compressed content isn't known upfront
+		w.Header().Set("Content-Encoding", string(encoding))
+		w.Header().Set("ETag", "W/"+strconv.Quote(md.SHA256Checksum))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(w, content)
+	if err != nil {
+		// too late to respond with an error; the client sees a short body
+		logger.WithError(err).Warn("Failed to stream object when downloading file")
+		return
+	}
+	logger.Debug("Successfully downloaded file from storage")
+}
+
+// encodeContent returns the content of an object stored with the given encoding, encoded with the accepted one.
+func encodeContent(rc io.Reader, stored, accepted compression.Encoding) (io.ReadCloser, compression.Encoding, error) {
+	if stored == accepted {
+		return io.NopCloser(rc), stored, nil
+	}
+
+	content, err := compression.NewReader(rc, stored)
+	if err != nil {
+		return nil, "", err
+	}
+	if accepted == compression.Identity {
+		return content, compression.Identity, nil
+	}
+	compressed := compression.Compress(content, accepted)
+	return &recodingReader{ReadCloser: compressed, decoder: content}, accepted, nil
+}
+
+// recodingReader compresses the content of a decoder with another encoding.
+type recodingReader struct {
+	io.ReadCloser
+	decoder io.Closer
+}
+
+func (r *recodingReader) Close() error {
+	err := r.ReadCloser.Close()
+	return errors.Join(err, r.decoder.Close())
+}
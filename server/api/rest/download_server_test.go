@@ -0,0 +1,220 @@
+package rest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/lib/compression"
+	"github.com/hedisam/filesync/lib/psurls"
+	"github.com/hedisam/filesync/server/api/rest"
+	"github.com/hedisam/filesync/server/api/rest/mocks"
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+//go:generate moq -out mocks/object_reader.go -pkg mocks -skip-ensure . ObjectReader
+//go:generate moq -out mocks/download_md_store.go -pkg mocks -skip-ensure . DownloadMetadataStore
+
+func TestDownloadFile(t *testing.T) {
+	md := &store.ObjectMetadata{
+		Namespace:      store.DefaultNamespace,
+		Key:            "file.txt",
+		ObjectID:       "object-id",
+		SHA256Checksum: "abc",
+		Size:           11,
+	}
+
+	tests := map[string]struct {
+		urlData psurls.URLData
+		getErr  error
+		openErr error
+
+		wantStatus     int
+		wantBodySubstr string
+	}{
+		"success": {
+			urlData:        psurls.URLData{ObjectKey: "file.txt", Operation: psurls.OpDownload},
+			wantStatus:     http.StatusOK,
+			wantBodySubstr: "hello world",
+		},
+		"matching checksum": {
+			urlData:        psurls.URLData{ObjectKey: "file.txt", SHA256Checksum: "abc", Operation: psurls.OpDownload},
+			wantStatus:     http.StatusOK,
+			wantBodySubstr: "hello world",
+		},
+		"changed content": {
+			urlData:        psurls.URLData{ObjectKey: "file.txt", SHA256Checksum: "def", Operation: psurls.OpDownload},
+			wantStatus:     http.StatusPreconditionFailed,
+			wantBodySubstr: "file content has changed",
+		},
+		"upload url": {
+			urlData:        psurls.URLData{ObjectKey: "file.txt"},
+			wantStatus:     http.StatusForbidden,
+			wantBodySubstr: "presigned URL is not valid for download",
+		},
+		"file not found": {
+			urlData:        psurls.URLData{ObjectKey: "file.txt", Operation: psurls.OpDownload},
+			getErr:         store.ErrNotFound,
+			wantStatus:     http.StatusNotFound,
+			wantBodySubstr: "file not found",
+		},
+		"object deleted meanwhile": {
+			urlData:        psurls.URLData{ObjectKey: "file.txt", Operation: psurls.OpDownload},
+			openErr:        blobstorage.ErrNotFound,
+			wantStatus:     http.StatusNotFound,
+			wantBodySubstr: "file not found",
+		},
+		"storage failure": {
+			urlData:        psurls.URLData{ObjectKey: "file.txt", Operation: psurls.OpDownload},
+			openErr:        errors.New("boom"),
+			wantStatus:     http.StatusInternalServerError,
+			wantBodySubstr: "could not get object from storage",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authMock := &mocks.AuthMock{
+				GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+					return "secret", true
+				},
+			}
+			mdMock := &mocks.DownloadMetadataStoreMock{
+				GetFunc: func(ctx context.Context, namespace, key string) (*store.ObjectMetadata, error) {
+					assert.Equal(t, store.DefaultNamespace, namespace)
+					assert.Equal(t, "file.txt", key)
+					if tc.getErr != nil {
+						return nil, tc.getErr
+					}
+					return md, nil
+				},
+			}
+			readerMock := &mocks.ObjectReaderMock{
+				GetObjectFunc: func(ctx context.Context, objectID string) (io.ReadCloser, error) {
+					assert.Equal(t, "object-id", objectID)
+					if tc.openErr != nil {
+						return nil, tc.openErr
+					}
+					return io.NopCloser(strings.NewReader("hello world")), nil
+				},
+			}
+
+			u := presignedURL(t, "http://localhost/v1/files/download", tc.urlData)
+			srv := rest.NewDownloadServer(logrus.New(), readerMock, mdMock, authMock)
+			rr := httptest.NewRecorder()
+			srv.DownloadFile(rr, httptest.NewRequest(http.MethodGet, u, nil))
+
+			assert.Equal(t, tc.wantStatus, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.wantBodySubstr)
+			if tc.wantStatus == http.StatusOK {
+				assert.Equal(t, "11", rr.Header().Get("Content-Length"))
+				assert.Equal(t, `"abc"`, rr.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestDownloadFileContentEncoding(t *testing.T) {
+	content := []byte(strings.Repeat("hello world\n", 100))
+	compress := func(enc compression.Encoding, data []byte) []byte {
+		rc := compression.Compress(bytes.NewReader(data), enc)
+		defer rc.Close()
+		compressed, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		return compressed
+	}
+
+	tests := map[string]struct {
+		storedEncoding compression.Encoding
+		stored         []byte
+		acceptEncoding string
+
+		wantEncoding compression.Encoding
+		wantETag     string
+	}{
+		"identity": {
+			stored:   content,
+			wantETag: `"abc"`,
+		},
+		"compressed on the fly": {
+			stored:         content,
+			acceptEncoding: "gzip, zstd",
+			wantEncoding:   compression.Zstd,
+			wantETag:       `W/"abc"`,
+		},
+		"compressed at rest served as is": {
+			storedEncoding: compression.Zstd,
+			stored:         compress(compression.Zstd, content),
+			acceptEncoding: "zstd",
+			wantEncoding:   compression.Zstd,
+			wantETag:       `W/"abc"`,
+		},
+		"compressed at rest recompressed": {
+			storedEncoding: compression.Zstd,
+			stored:         compress(compression.Zstd, content),
+			acceptEncoding: "gzip",
+			wantEncoding:   compression.Gzip,
+			wantETag:       `W/"abc"`,
+		},
+		"compressed at rest decompressed": {
+			storedEncoding: compression.Gzip,
+			stored:         compress(compression.Gzip, content),
+			acceptEncoding: "br",
+			wantETag:       `"abc"`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authMock := &mocks.AuthMock{
+				GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+					return "secret", true
+				},
+			}
+			mdMock := &mocks.DownloadMetadataStoreMock{
+				GetFunc: func(ctx context.Context, namespace, key string) (*store.ObjectMetadata, error) {
+					return &store.ObjectMetadata{
+						Namespace:       store.DefaultNamespace,
+						Key:             "file.txt",
+						ObjectID:        "object-id",
+						SHA256Checksum:  "abc",
+						Size:            int64(len(content)),
+						ContentEncoding: string(tc.storedEncoding),
+					}, nil
+				},
+			}
+			readerMock := &mocks.ObjectReaderMock{
+				GetObjectFunc: func(ctx context.Context, objectID string) (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(tc.stored)), nil
+				},
+			}
+
+			u := presignedURL(t, "http://localhost/v1/files/download", psurls.URLData{ObjectKey: "file.txt", Operation: psurls.OpDownload})
+			srv := rest.NewDownloadServer(logrus.New(), readerMock, mdMock, authMock)
+			req := httptest.NewRequest(http.MethodGet, u, nil)
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			rr := httptest.NewRecorder()
+			srv.DownloadFile(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, string(tc.wantEncoding), rr.Header().Get("Content-Encoding"))
+			assert.Equal(t, tc.wantETag, rr.Header().Get("ETag"))
+			assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+			r, err := compression.NewReader(rr.Body, tc.wantEncoding)
+			require.NoError(t, err)
+			body, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, content, body)
+		})
+	}
+}
@@ -1,21 +1,56 @@
 package rest
 
 import (
+	"bufio"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"iter"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/hashtree"
+	"github.com/hedisam/filesync/lib/psurls"
 	"github.com/hedisam/filesync/server/internal/store"
 )
 
+const (
+	// DefaultChangesLimit is the default, and maximum, number of changes returned at once.
+	DefaultChangesLimit = 1000
+	// DefaultListLimit is the default, and maximum, number of files and common prefixes listed at once.
+	DefaultListLimit = 1000
+	// MaxTreePrefixes is the maximum number of tree nodes returned at once.
+	MaxTreePrefixes = 1000
+)
+
 type FileMetadataStore interface {
-	Delete(ctx context.Context, key string) error
-	Snapshot(context.Context) (map[string]store.ObjectMetadata, error)
+	Delete(ctx context.Context, namespace, key string, ifMatch *uint64, by store.Attribution) error
+	Move(ctx context.Context, namespace, fromKey, toKey string, by store.Attribution) error
+	SnapshotWithCursor(ctx context.Context, namespace string) (map[string]store.ObjectMetadata, store.Cursor, error)
+	SnapshotSeq(ctx context.Context, namespace string) (iter.Seq[store.ObjectMetadata], store.Cursor, error)
+	Changes(ctx context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error)
+	List(ctx context.Context, namespace string, opts store.ListOptions) (*store.ListPage, error)
+	TreeNodes(ctx context.Context, namespace string, prefixes []string) ([]*hashtree.Node, store.Cursor, error)
+	History(ctx context.Context, namespace, key string) ([]store.Change, error)
+	SetAttributes(ctx context.Context, namespace, key string, attrs *fileattr.Attributes, ifMatch *uint64, by store.Attribution) (uint64, error)
 }
 
+// The headers clients identify themselves with on requests changing files, which are signed with their access keys,
+// see WithAccessKeys. Uploads carry the same in their presigned urls instead.
+const (
+	DeviceIDHeader = "X-Filesync-Device-Id"
+	HostnameHeader = "X-Filesync-Hostname"
+	UserHeader     = "X-Filesync-User"
+)
+
 // FileServer is an implementation of our Restful server.
 type FileServer struct {
 	logger            *logrus.Logger
@@ -29,9 +64,10 @@ func NewFilesServer(logger *logrus.Logger, fileMetadataStore FileMetadataStore)
 	}
 }
 
-func (s *FileServer) Snapshot(ctx context.Context, _ *GetSnapshotRequest) (*GetSnapshotResponse, error) {
-	logger := s.logger.WithContext(ctx)
-	snapshot, err := s.fileMetadataStore.Snapshot(ctx)
+func (s *FileServer) Snapshot(ctx context.Context, req *GetSnapshotRequest) (*GetSnapshotResponse, error) {
+	namespace := store.NamespaceOrDefault(req.Namespace)
+	logger := s.logger.WithContext(ctx).WithField("namespace", namespace)
+	snapshot, cursor, err := s.fileMetadataStore.SnapshotWithCursor(ctx, namespace)
 	if err != nil {
 		logger.WithError(err).Error("Failed to get metadata snapshot")
 		return nil, NewErrf(http.StatusInternalServerError, "get snapshot from store: %v", err)
@@ -39,20 +75,324 @@ func (s *FileServer) Snapshot(ctx context.Context, _ *GetSnapshotRequest) (*GetS
 
 	keyToObject := make(map[string]*Metadata, len(snapshot))
 	for k, md := range snapshot {
-		keyToObject[k] = &Metadata{
-			Key:            k,
-			Size:           md.Size,
-			SHA256Checksum: md.SHA256Checksum,
-		}
+		keyToObject[k] = newMetadata(&md)
 	}
 
 	return &GetSnapshotResponse{
 		KeyToMetadata: keyToObject,
+		Cursor:        encodeCursor(cursor),
+	}, nil
+}
+
+// StreamSnapshot streams the files of a namespace as newline-delimited JSON records, in the order of their keys, so
+// neither end has to hold a large namespace in memory at once. The first record has the cursor to follow the changes
+// made after the snapshot with, then there's one record per file, and the last one has the number of files, which
+// tells a complete snapshot from one cut short.
+func (s *FileServer) StreamSnapshot(w http.ResponseWriter, r *http.Request) {
+	namespace := store.NamespaceOrDefault(r.URL.Query().Get("namespace"))
+	logger := s.logger.WithContext(r.Context()).WithField("namespace", namespace)
+
+	objects, cursor, err := s.fileMetadataStore.SnapshotSeq(r.Context(), namespace)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get metadata snapshot")
+		http.Error(w, fmt.Sprintf("get snapshot from store: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err = enc.Encode(&SnapshotRecord{Cursor: encodeCursor(cursor)})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to stream snapshot")
+		return
+	}
+	var count int
+	for md := range objects {
+		err = enc.Encode(&SnapshotRecord{File: newMetadata(&md)})
+		if err != nil {
+			// too late to respond with an error; the client sees no trailer
+			logger.WithError(err).Warn("Failed to stream snapshot")
+			return
+		}
+		count++
+	}
+	err = enc.Encode(&SnapshotRecord{End: true, Count: count})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to stream snapshot")
+		return
+	}
+	logger.WithField("files", count).Debug("Streamed snapshot")
+}
+
+func newMetadata(md *store.ObjectMetadata) *Metadata {
+	return &Metadata{
+		Key:            md.Key,
+		Size:           md.Size,
+		SHA256Checksum: md.SHA256Checksum,
+		ContentMAC:     md.ContentMAC,
+		MTime:          md.MTime,
+		Version:        md.Version,
+		Attributes:     md.Attributes,
+		Attribution:    newAttributionJSON(md.Attribution),
+		Type:           string(md.Type),
+	}
+}
+
+// newAttributionJSON returns nil for changes attributed to no one, e.g. those made before changes were attributed.
+func newAttributionJSON(a store.Attribution) *Attribution {
+	if a == (store.Attribution{}) {
+		return nil
+	}
+	return &Attribution{
+		Operation:   string(a.Operation),
+		AccessKeyID: a.AccessKeyID,
+		DeviceID:    a.DeviceID,
+		Hostname:    a.Hostname,
+		User:        a.User,
+	}
+}
+
+// requestAttribution attributes a change made by the request in ctx to the access key it's authenticated with, and
+// the client identified by its headers.
+func requestAttribution(ctx context.Context) store.Attribution {
+	accessKeyID, _ := ctx.Value(accessKeyIDKey{}).(string)
+	return store.Attribution{
+		AccessKeyID: accessKeyID,
+		DeviceID:    header(ctx, DeviceIDHeader),
+		Hostname:    header(ctx, HostnameHeader),
+		User:        header(ctx, UserHeader),
+	}
+}
+
+type accessKeyIDKey struct{}
+
+// ContextWithAccessKeyID returns a copy of ctx carrying the ID of the access key the request in ctx is authenticated
+// with, which the changes it makes are attributed to.
+func ContextWithAccessKeyID(ctx context.Context, accessKeyID string) context.Context {
+	return context.WithValue(ctx, accessKeyIDKey{}, accessKeyID)
+}
+
+// WithAccessKeys returns a Mux authenticating the requests signed with an access key, see psurls.SignRequest, before
+// they're handled, so the changes they make are attributed to it. Requests with an invalid signature are rejected,
+// and unsigned ones are handled unattributed to any access key.
+func WithAccessKeys(mux Mux, auth Auth) Mux {
+	return &accessKeyMux{
+		mux:  mux,
+		auth: auth,
+	}
+}
+
+type accessKeyMux struct {
+	mux  Mux
+	auth Auth
+}
+
+func (m *accessKeyMux) HandleFunc(pattern string, f func(w http.ResponseWriter, r *http.Request)) {
+	m.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		accessKeyID := r.Header.Get(psurls.AccessKeyIDHeader)
+		if accessKeyID == "" {
+			f(w, r)
+			return
+		}
+		secretKey, ok := m.auth.GetSecretKeyByID(accessKeyID)
+		if !ok {
+			http.Error(w, "invalid access key id", http.StatusUnauthorized)
+			return
+		}
+		err := psurls.ValidateRequest(r, secretKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid request signature: %q", err.Error()), http.StatusUnauthorized)
+			return
+		}
+		f(w, r.WithContext(ContextWithAccessKeyID(r.Context(), accessKeyID)))
+	})
+}
+
+// ListFiles lists the files of a namespace in the order of their keys, a page at a time. Given a delimiter, the keys
+// containing it after the prefix are rolled up into common prefixes, like directories. The next page is listed with
+// the page token of the previous one, and the same prefix and delimiter.
+func (s *FileServer) ListFiles(ctx context.Context, req *ListFilesRequest) (*ListFilesResponse, error) {
+	namespace := store.NamespaceOrDefault(req.Namespace)
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"namespace": namespace,
+		"prefix":    req.Prefix,
+		"delimiter": req.Delimiter,
+	})
+
+	after, err := base64.RawURLEncoding.DecodeString(req.PageToken)
+	if err != nil {
+		return nil, NewErrf(http.StatusBadRequest, "invalid page token: %v", err)
+	}
+	limit := DefaultListLimit
+	if req.Limit > 0 {
+		limit = min(req.Limit, DefaultListLimit)
+	}
+
+	page, err := s.fileMetadataStore.List(ctx, namespace, store.ListOptions{
+		Prefix:    req.Prefix,
+		Delimiter: req.Delimiter,
+		After:     string(after),
+		Limit:     limit,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to list files in store")
+		return nil, NewErrf(http.StatusInternalServerError, "list files in store: %v", err)
+	}
+
+	resp := &ListFilesResponse{
+		Files:          make([]*Metadata, 0, len(page.Objects)),
+		CommonPrefixes: page.CommonPrefixes,
+	}
+	for md := range slices.Values(page.Objects) {
+		resp.Files = append(resp.Files, newMetadata(&md))
+	}
+	if resp.CommonPrefixes == nil {
+		resp.CommonPrefixes = []string{}
+	}
+	if page.Next != "" {
+		resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(page.Next))
+	}
+	return resp, nil
+}
+
+// TreeNodes returns the nodes of the hash tree over the files of a namespace under the given prefixes, so a client can
+// reconcile its files with the server's by descending into the directories whose hashes differ from its own only,
+// fetching a whole level of them at once. Prefixes with no directory under them are left out. The cursor is the one
+// to get the changes made after the nodes were read with.
+func (s *FileServer) TreeNodes(ctx context.Context, req *GetTreeNodesRequest) (*GetTreeNodesResponse, error) {
+	namespace := store.NamespaceOrDefault(req.Namespace)
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"namespace": namespace,
+		"prefixes":  len(req.Prefixes),
+	})
+
+	if len(req.Prefixes) == 0 {
+		return nil, NewErrf(http.StatusBadRequest, "no prefixes given")
+	}
+	if len(req.Prefixes) > MaxTreePrefixes {
+		return nil, NewErrf(http.StatusBadRequest, "too many prefixes: %d, at most %d are allowed", len(req.Prefixes), MaxTreePrefixes)
+	}
+
+	nodes, cursor, err := s.fileMetadataStore.TreeNodes(ctx, namespace, req.Prefixes)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get tree nodes from store")
+		return nil, NewErrf(http.StatusInternalServerError, "get tree nodes from store: %v", err)
+	}
+	if nodes == nil {
+		nodes = []*hashtree.Node{}
+	}
+
+	return &GetTreeNodesResponse{
+		Nodes:  nodes,
+		Cursor: encodeCursor(cursor),
 	}, nil
 }
 
+// Changes returns the changes of a namespace made after the given cursor, oldest first, and the cursor to get the
+// next ones with. Cursors come from snapshots or previous changes. It responds with 410 if the cursor has expired, in
+// which case the client has to take a new snapshot.
+func (s *FileServer) Changes(ctx context.Context, req *GetChangesRequest) (*GetChangesResponse, error) {
+	namespace := store.NamespaceOrDefault(req.Namespace)
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"namespace": namespace,
+		"since":     req.Since,
+	})
+
+	since, err := decodeCursor(req.Since)
+	if err != nil {
+		return nil, NewErrf(http.StatusBadRequest, "invalid cursor: %v", err)
+	}
+	limit := DefaultChangesLimit
+	if req.Limit > 0 {
+		limit = min(req.Limit, DefaultChangesLimit)
+	}
+
+	changes, cursor, err := s.fileMetadataStore.Changes(ctx, namespace, since, limit)
+	if err != nil {
+		if errors.Is(err, store.ErrCursorExpired) {
+			return nil, NewErrf(http.StatusGone, "cursor too old, take a new snapshot: %v", err)
+		}
+		logger.WithError(err).Error("Failed to get changes from store")
+		return nil, NewErrf(http.StatusInternalServerError, "get changes from store: %v", err)
+	}
+
+	resp := &GetChangesResponse{
+		Changes: make([]Change, 0, len(changes)),
+		Cursor:  encodeCursor(cursor),
+		HasMore: len(changes) == limit,
+	}
+	for c := range slices.Values(changes) {
+		resp.Changes = append(resp.Changes, newChange(c))
+	}
+	return resp, nil
+}
+
+func newChange(c store.Change) Change {
+	change := Change{
+		Seq:         c.Seq,
+		Op:          string(c.Op),
+		Key:         c.Key,
+		Time:        c.Time,
+		Attribution: newAttributionJSON(c.Attribution),
+	}
+	if c.Object != nil {
+		change.Metadata = newMetadata(c.Object)
+	}
+	return change
+}
+
+// encodeCursor returns the opaque form of the given cursor clients pass around.
+func encodeCursor(c store.Cursor) string {
+	return fmt.Sprintf("%s.%d", c.Epoch, c.Seq)
+}
+
+// formatETag returns the entity tag of the given version of a file.
+func formatETag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// parseETag parses the entity tag of a version of a file, as formatted by formatETag. It returns nil if there's none.
+func parseETag(etag string) (*uint64, error) {
+	if etag == "" {
+		return nil, nil
+	}
+	unquoted, err := strconv.Unquote(etag)
+	if err != nil {
+		return nil, fmt.Errorf("malformed entity tag %q", etag)
+	}
+	version, err := strconv.ParseUint(unquoted, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed entity tag %q: %w", etag, err)
+	}
+	return &version, nil
+}
+
+func decodeCursor(s string) (store.Cursor, error) {
+	epoch, seq, ok := strings.Cut(s, ".")
+	if !ok {
+		return store.Cursor{}, fmt.Errorf("malformed cursor %q", s)
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return store.Cursor{}, fmt.Errorf("malformed cursor %q: %w", s, err)
+	}
+	return store.Cursor{Epoch: epoch, Seq: n}, nil
+}
+
+// DeleteFile deletes the file under the given key. Given an If-Match header with the entity tag of a version, the
+// file is only deleted if it's still at that version, or, for version 0, if there's none; it responds with 412
+// otherwise.
 func (s *FileServer) DeleteFile(ctx context.Context, req *DeleteFileRequest) (*DeleteFileResponse, error) {
-	logger := s.logger.WithContext(ctx).WithField("key", req.Key)
+	namespace := store.NamespaceOrDefault(req.Namespace)
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"namespace": namespace,
+		"key":       req.Key,
+	})
 
 	key := strings.TrimSpace(req.Key)
 	if key == "" {
@@ -60,8 +400,17 @@ func (s *FileServer) DeleteFile(ctx context.Context, req *DeleteFileRequest) (*D
 		return nil, NewErrf(http.StatusBadRequest, "invalid request body: 'key' is required")
 	}
 
-	err := s.fileMetadataStore.Delete(ctx, key)
+	ifMatch, err := parseETag(header(ctx, "If-Match"))
+	if err != nil {
+		return nil, NewErrf(http.StatusBadRequest, "invalid If-Match: %v", err)
+	}
+
+	err = s.fileMetadataStore.Delete(ctx, namespace, key, ifMatch, requestAttribution(ctx))
 	if err != nil {
+		if errors.Is(err, store.ErrPreconditionFailed) {
+			logger.WithError(err).Info("Rejected deletion of a file changed since")
+			return nil, NewErrf(http.StatusPreconditionFailed, "file %q is not at the expected version", key)
+		}
 		logger.WithError(err).Error("Failed to delete file metadata in store")
 		return nil, fmt.Errorf("could not delete file metadata: %w", err)
 	}
@@ -71,20 +420,231 @@ func (s *FileServer) DeleteFile(ctx context.Context, req *DeleteFileRequest) (*D
 	return &DeleteFileResponse{}, nil
 }
 
+// MoveFile moves the file under the given key to another key, replacing any file under that key. Uploads of the
+// original key in progress still complete under it.
+func (s *FileServer) MoveFile(ctx context.Context, req *MoveFileRequest) (*MoveFileResponse, error) {
+	namespace := store.NamespaceOrDefault(req.Namespace)
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"namespace": namespace,
+		"key":       req.Key,
+		"to":        req.To,
+	})
+
+	key := strings.TrimSpace(req.Key)
+	to := strings.TrimSpace(req.To)
+	if key == "" || to == "" {
+		logger.Warn("Empty file key provided in file move request")
+		return nil, NewErrf(http.StatusBadRequest, "invalid request body: 'key' and 'to' are required")
+	}
+
+	err := s.fileMetadataStore.Move(ctx, namespace, key, to, requestAttribution(ctx))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, NewErrf(http.StatusNotFound, "file %q not found", key)
+		}
+		logger.WithError(err).Error("Failed to move file metadata in store")
+		return nil, fmt.Errorf("could not move file metadata: %w", err)
+	}
+
+	logger.Debug("Object moved")
+
+	return &MoveFileResponse{}, nil
+}
+
+// SetFileAttributes changes the attributes of the file under the given key, keeping its content, as a new version of
+// the file. Given an If-Match header with the entity tag of a version, the attributes are only changed if the file is
+// still at that version; it responds with 412 otherwise.
+func (s *FileServer) SetFileAttributes(ctx context.Context, req *SetFileAttributesRequest) (*SetFileAttributesResponse, error) {
+	namespace := store.NamespaceOrDefault(req.Namespace)
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"namespace": namespace,
+		"key":       req.Key,
+	})
+
+	key := strings.TrimSpace(req.Key)
+	if key == "" || req.Attributes == nil {
+		return nil, NewErrf(http.StatusBadRequest, "invalid request body: 'key' and 'attributes' are required")
+	}
+	ifMatch, err := parseETag(header(ctx, "If-Match"))
+	if err != nil {
+		return nil, NewErrf(http.StatusBadRequest, "invalid If-Match: %v", err)
+	}
+
+	version, err := s.fileMetadataStore.SetAttributes(ctx, namespace, key, req.Attributes, ifMatch, requestAttribution(ctx))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, NewErrf(http.StatusNotFound, "file %q not found", key)
+		}
+		if errors.Is(err, store.ErrPreconditionFailed) {
+			logger.WithError(err).Info("Rejected attributes change of a file changed since")
+			return nil, NewErrf(http.StatusPreconditionFailed, "file %q is not at the expected version", key)
+		}
+		logger.WithError(err).Error("Failed to set file attributes in store")
+		return nil, NewErrf(http.StatusInternalServerError, "set file attributes in store: %v", err)
+	}
+
+	logger.WithField("version", version).Debug("File attributes changed")
+
+	return &SetFileAttributesResponse{Version: version}, nil
+}
+
+// FileHistory returns the changes of the file under the given key, newest first, along with who made them. Only the
+// changes still kept in the change log are returned; there are none once they've all been dropped.
+func (s *FileServer) FileHistory(ctx context.Context, req *GetFileHistoryRequest) (*GetFileHistoryResponse, error) {
+	namespace := store.NamespaceOrDefault(req.Namespace)
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"namespace": namespace,
+		"key":       req.Key,
+	})
+
+	key := strings.TrimSpace(req.Key)
+	if key == "" {
+		return nil, NewErrf(http.StatusBadRequest, "invalid request: 'key' is required")
+	}
+
+	history, err := s.fileMetadataStore.History(ctx, namespace, key)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get file history from store")
+		return nil, NewErrf(http.StatusInternalServerError, "get file history from store: %v", err)
+	}
+
+	resp := &GetFileHistoryResponse{
+		Changes: make([]Change, 0, len(history)),
+	}
+	for c := range slices.Values(history) {
+		resp.Changes = append(resp.Changes, newChange(c))
+	}
+	return resp, nil
+}
+
 type Metadata struct {
 	Key            string `json:"key"`
 	Size           int64  `json:"size"`
 	SHA256Checksum string `json:"sha256_checksum"`
+	ContentMAC     string `json:"content_mac,omitempty"`
+	MTime          int64  `json:"mtime,omitempty"`
+	// Version changes whenever the key is given another file.
+	Version uint64 `json:"version,omitempty"`
+	// Attributes are the file's mode, precise mtime, owner and extended attributes, if the uploader reported them.
+	Attributes *fileattr.Attributes `json:"attributes,omitempty"`
+	// Attribution tells who put this version of the file.
+	Attribution *Attribution `json:"attribution,omitempty"`
+	// Type is "symlink" for symlinks, whose content is their target, "dir" for directories, which have no content, and
+	// empty for regular files.
+	Type string `json:"type,omitempty"`
+}
+
+// Attribution tells who changed a file, and how. The access key is recorded for every signed change: uploads, and the
+// deletes, moves and attribute changes of clients with credentials. The device, host and user are as reported by the
+// client.
+type Attribution struct {
+	Operation   string `json:"operation"`
+	AccessKeyID string `json:"access_key_id,omitempty"`
+	DeviceID    string `json:"device_id,omitempty"`
+	Hostname    string `json:"hostname,omitempty"`
+	User        string `json:"user,omitempty"`
+}
+
+type ListFilesRequest struct {
+	Namespace string `json:"namespace"`
+	Prefix    string `json:"prefix"`
+	Delimiter string `json:"delimiter"`
+	PageToken string `json:"page_token"`
+	// Limit is a query value, hence a string.
+	Limit int `json:"limit,string"`
+}
+
+type ListFilesResponse struct {
+	Files          []*Metadata `json:"files"`
+	CommonPrefixes []string    `json:"common_prefixes"`
+	// NextPageToken is set if there are more files to list.
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+type GetTreeNodesRequest struct {
+	Namespace string   `json:"namespace"`
+	Prefixes  []string `json:"prefixes"`
+}
+
+type GetTreeNodesResponse struct {
+	Nodes []*hashtree.Node `json:"nodes"`
+	// Cursor is the cursor to get the changes made after the nodes were read with.
+	Cursor string `json:"cursor"`
 }
 
-type GetSnapshotRequest struct{}
+type GetSnapshotRequest struct {
+	Namespace string `json:"namespace"`
+}
 
 type GetSnapshotResponse struct {
 	KeyToMetadata map[string]*Metadata `json:"key_to_metadata"`
+	// Cursor is the cursor to get the changes made after the snapshot with.
+	Cursor string `json:"cursor"`
+}
+
+// SnapshotRecord is a record of a streamed snapshot: the header with the cursor, a file, or the trailer.
+type SnapshotRecord struct {
+	Cursor string    `json:"cursor,omitempty"`
+	File   *Metadata `json:"file,omitempty"`
+	End    bool      `json:"end,omitempty"`
+	// Count is the number of files streamed, set on the trailer.
+	Count int `json:"count,omitempty"`
+}
+
+type GetChangesRequest struct {
+	Namespace string `json:"namespace"`
+	Since     string `json:"since"`
+	// Limit is a query value, hence a string.
+	Limit int `json:"limit,string"`
+}
+
+type GetChangesResponse struct {
+	Changes []Change `json:"changes"`
+	Cursor  string   `json:"cursor"`
+	// HasMore reports whether there might be more changes to get right away.
+	HasMore bool `json:"has_more"`
+}
+
+// Change is a change of the file under a key. Metadata is only set for puts.
+type Change struct {
+	Seq         uint64       `json:"seq"`
+	Op          string       `json:"op"`
+	Key         string       `json:"key"`
+	Time        time.Time    `json:"time,omitzero"`
+	Attribution *Attribution `json:"attribution,omitempty"`
+	Metadata    *Metadata    `json:"metadata,omitempty"`
+}
+
+type SetFileAttributesRequest struct {
+	Namespace  string               `json:"namespace"`
+	Key        string               `json:"key"`
+	Attributes *fileattr.Attributes `json:"attributes"`
+}
+
+type SetFileAttributesResponse struct {
+	Version uint64 `json:"version"`
+}
+
+type GetFileHistoryRequest struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+}
+
+type GetFileHistoryResponse struct {
+	Changes []Change `json:"changes"`
 }
 
 type DeleteFileRequest struct {
-	Key string `json:"key"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
 }
 
 type DeleteFileResponse struct{}
+
+type MoveFileRequest struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	To        string `json:"to"`
+}
+
+type MoveFileResponse struct{}
@@ -3,13 +3,21 @@ package rest_test
 import (
 	"context"
 	"errors"
+	"fmt"
+	"iter"
 	"net/http"
+	"net/http/httptest"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/hashtree"
+	"github.com/hedisam/filesync/lib/psurls"
 	restapi "github.com/hedisam/filesync/server/api/rest"
 	"github.com/hedisam/filesync/server/api/rest/mocks"
 	"github.com/hedisam/filesync/server/internal/store"
@@ -19,10 +27,15 @@ import (
 
 func TestDeleteFile(t *testing.T) {
 	tests := map[string]struct {
-		req *restapi.DeleteFileRequest
+		req         *restapi.DeleteFileRequest
+		ifMatch     string
+		deviceID    string
+		accessKeyID string
 
-		existingFiles  map[string]*store.ObjectMetadata
-		storeDeleteErr error
+		existingFiles   map[string]*store.ObjectMetadata
+		storeDeleteErr  error
+		expectedIfMatch *uint64
+		expectedBy      store.Attribution
 
 		expectedStoreCalls int
 		expectedResp       *restapi.DeleteFileResponse
@@ -49,6 +62,48 @@ func TestDeleteFile(t *testing.T) {
 			expectedStoreCalls: 1,
 			expectedResp:       &restapi.DeleteFileResponse{},
 		},
+		"conditional on the version": {
+			req: &restapi.DeleteFileRequest{
+				Key: "/data/file.csv",
+			},
+			ifMatch:            `"7"`,
+			expectedIfMatch:    ptr(uint64(7)),
+			expectedStoreCalls: 1,
+			expectedResp:       &restapi.DeleteFileResponse{},
+		},
+		"attributed to the client": {
+			req: &restapi.DeleteFileRequest{
+				Key: "/data/file.csv",
+			},
+			deviceID:           "laptop-1",
+			accessKeyID:        "aki",
+			expectedBy:         store.Attribution{AccessKeyID: "aki", DeviceID: "laptop-1"},
+			expectedStoreCalls: 1,
+			expectedResp:       &restapi.DeleteFileResponse{},
+		},
+		"changed since": {
+			req: &restapi.DeleteFileRequest{
+				Key: "/data/file.csv",
+			},
+			ifMatch:            `"7"`,
+			storeDeleteErr:     fmt.Errorf("%w: at version 8", store.ErrPreconditionFailed),
+			expectedIfMatch:    ptr(uint64(7)),
+			expectedStoreCalls: 1,
+			expectedErr: &restapi.Err{
+				Message: `file "/data/file.csv" is not at the expected version`,
+				Status:  http.StatusPreconditionFailed,
+			},
+		},
+		"invalid If-Match": {
+			req: &restapi.DeleteFileRequest{
+				Key: "/data/file.csv",
+			},
+			ifMatch: "7",
+			expectedErr: &restapi.Err{
+				Message: `invalid If-Match: malformed entity tag "7"`,
+				Status:  http.StatusBadRequest,
+			},
+		},
 		"key is missing": {
 			req: &restapi.DeleteFileRequest{},
 			expectedErr: &restapi.Err{
@@ -74,8 +129,11 @@ func TestDeleteFile(t *testing.T) {
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
 			mdStore := &mocks.FileMetadataStoreMock{
-				DeleteFunc: func(ctx context.Context, key string) error {
+				DeleteFunc: func(ctx context.Context, namespace, key string, ifMatch *uint64, by store.Attribution) error {
+					assert.Equal(t, store.DefaultNamespace, namespace)
 					assert.Equal(t, test.req.Key, key)
+					assert.Equal(t, test.expectedIfMatch, ifMatch)
+					assert.Equal(t, test.expectedBy, by)
 					if test.storeDeleteErr != nil {
 						return test.storeDeleteErr
 					}
@@ -85,7 +143,19 @@ func TestDeleteFile(t *testing.T) {
 
 			s := restapi.NewFilesServer(logrus.New(), mdStore)
 
-			resp, err := s.DeleteFile(context.Background(), test.req)
+			ctx := context.Background()
+			if test.ifMatch != "" {
+				// as put by FuncAdapter
+				ctx = context.WithValue(ctx, "If-Match", []string{test.ifMatch})
+			}
+			if test.deviceID != "" {
+				ctx = context.WithValue(ctx, restapi.DeviceIDHeader, []string{test.deviceID})
+			}
+			if test.accessKeyID != "" {
+				// as put by the Mux of WithAccessKeys
+				ctx = restapi.ContextWithAccessKeyID(ctx, test.accessKeyID)
+			}
+			resp, err := s.DeleteFile(ctx, test.req)
 			assert.Equal(t, test.expectedStoreCalls, len(mdStore.DeleteCalls()))
 			if test.expectedErr != nil {
 				require.Error(t, err)
@@ -102,3 +172,589 @@ func TestDeleteFile(t *testing.T) {
 		})
 	}
 }
+
+func TestWithAccessKeys(t *testing.T) {
+	tests := map[string]struct {
+		sign func(req *http.Request)
+
+		wantStatus int
+		wantBy     store.Attribution
+	}{
+		"signed": {
+			sign: func(req *http.Request) {
+				psurls.SignRequest(req, "aki", "secret")
+			},
+			wantStatus: http.StatusOK,
+			wantBy:     store.Attribution{AccessKeyID: "aki"},
+		},
+		"unsigned": {
+			sign:       func(req *http.Request) {},
+			wantStatus: http.StatusOK,
+		},
+		"signed with another secret": {
+			sign: func(req *http.Request) {
+				psurls.SignRequest(req, "aki", "other")
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		"signed with an unknown access key": {
+			sign: func(req *http.Request) {
+				psurls.SignRequest(req, "unknown", "secret")
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		"signed for another path": {
+			sign: func(req *http.Request) {
+				psurls.SignRequest(req, "aki", "secret")
+				req.URL.Path = "/v1/files/b.txt"
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdStore := &mocks.FileMetadataStoreMock{
+				DeleteFunc: func(ctx context.Context, namespace, key string, ifMatch *uint64, by store.Attribution) error {
+					assert.Equal(t, tc.wantBy, by)
+					return nil
+				},
+			}
+			authMock := &mocks.AuthMock{
+				GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+					return "secret", keyID == "aki"
+				},
+			}
+			mux := http.NewServeMux()
+			s := restapi.NewFilesServer(logrus.New(), mdStore)
+			restapi.RegisterFunc(logrus.New(), restapi.WithAccessKeys(mux, authMock), http.MethodDelete, "/v1/files/{key}", s.DeleteFile)
+
+			req := httptest.NewRequest(http.MethodDelete, "/v1/files/a.txt", nil)
+			tc.sign(req)
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.wantStatus, rr.Code)
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	mdStore := &mocks.FileMetadataStoreMock{
+		SnapshotWithCursorFunc: func(ctx context.Context, namespace string) (map[string]store.ObjectMetadata, store.Cursor, error) {
+			assert.Equal(t, store.DefaultNamespace, namespace)
+			return map[string]store.ObjectMetadata{
+				"plain.txt":     {Key: "plain.txt", Size: 5, SHA256Checksum: "sha-1"},
+				"encrypted.bin": {Key: "encrypted.bin", Size: 50, SHA256Checksum: "sha-2", ContentMAC: "mac-2"},
+			}, store.Cursor{Epoch: "epoch", Seq: 7}, nil
+		},
+	}
+
+	s := restapi.NewFilesServer(logrus.New(), mdStore)
+	resp, err := s.Snapshot(context.Background(), &restapi.GetSnapshotRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, &restapi.GetSnapshotResponse{
+		KeyToMetadata: map[string]*restapi.Metadata{
+			"plain.txt":     {Key: "plain.txt", Size: 5, SHA256Checksum: "sha-1"},
+			"encrypted.bin": {Key: "encrypted.bin", Size: 50, SHA256Checksum: "sha-2", ContentMAC: "mac-2"},
+		},
+		Cursor: "epoch.7",
+	}, resp)
+}
+
+func TestChanges(t *testing.T) {
+	changes := []store.Change{
+		{Seq: 8, Op: store.ChangePut, Key: "a.txt", Object: &store.ObjectMetadata{Key: "a.txt", Size: 5, SHA256Checksum: "sha-1"}},
+		{Seq: 9, Op: store.ChangeDelete, Key: "b.txt", Attribution: store.Attribution{DeviceID: "laptop-1", Operation: store.OpDelete}},
+	}
+
+	tests := map[string]struct {
+		req      *restapi.GetChangesRequest
+		storeErr error
+
+		expectedLimit int
+		expectedResp  *restapi.GetChangesResponse
+		expectedErr   *restapi.Err
+	}{
+		"changes": {
+			req:           &restapi.GetChangesRequest{Since: "epoch.7"},
+			expectedLimit: restapi.DefaultChangesLimit,
+			expectedResp: &restapi.GetChangesResponse{
+				Changes: []restapi.Change{
+					{Seq: 8, Op: "put", Key: "a.txt", Metadata: &restapi.Metadata{Key: "a.txt", Size: 5, SHA256Checksum: "sha-1"}},
+					{Seq: 9, Op: "delete", Key: "b.txt", Attribution: &restapi.Attribution{Operation: "delete", DeviceID: "laptop-1"}},
+				},
+				Cursor: "epoch.9",
+			},
+		},
+		"more changes": {
+			req:           &restapi.GetChangesRequest{Since: "epoch.7", Limit: 2},
+			expectedLimit: 2,
+			expectedResp: &restapi.GetChangesResponse{
+				Changes: []restapi.Change{
+					{Seq: 8, Op: "put", Key: "a.txt", Metadata: &restapi.Metadata{Key: "a.txt", Size: 5, SHA256Checksum: "sha-1"}},
+					{Seq: 9, Op: "delete", Key: "b.txt", Attribution: &restapi.Attribution{Operation: "delete", DeviceID: "laptop-1"}},
+				},
+				Cursor:  "epoch.9",
+				HasMore: true,
+			},
+		},
+		"malformed cursor": {
+			req: &restapi.GetChangesRequest{Since: "7"},
+			expectedErr: &restapi.Err{
+				Message: `invalid cursor: malformed cursor "7"`,
+				Status:  http.StatusBadRequest,
+			},
+		},
+		"expired cursor": {
+			req:           &restapi.GetChangesRequest{Since: "epoch.1"},
+			storeErr:      store.ErrCursorExpired,
+			expectedLimit: restapi.DefaultChangesLimit,
+			expectedErr: &restapi.Err{
+				Message: "cursor too old, take a new snapshot: cursor expired",
+				Status:  http.StatusGone,
+			},
+		},
+		"store failure": {
+			req:           &restapi.GetChangesRequest{Since: "epoch.7"},
+			storeErr:      errors.New("boom"),
+			expectedLimit: restapi.DefaultChangesLimit,
+			expectedErr: &restapi.Err{
+				Message: "get changes from store: boom",
+				Status:  http.StatusInternalServerError,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdStore := &mocks.FileMetadataStoreMock{
+				ChangesFunc: func(ctx context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error) {
+					assert.Equal(t, store.DefaultNamespace, namespace)
+					assert.Equal(t, "epoch", since.Epoch)
+					assert.Equal(t, tc.expectedLimit, limit)
+					if tc.storeErr != nil {
+						return nil, store.Cursor{}, tc.storeErr
+					}
+					return changes, store.Cursor{Epoch: "epoch", Seq: 9}, nil
+				},
+			}
+
+			s := restapi.NewFilesServer(logrus.New(), mdStore)
+			resp, err := s.Changes(context.Background(), tc.req)
+			if tc.expectedErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedResp, resp)
+		})
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	tests := map[string]struct {
+		req          *restapi.MoveFileRequest
+		storeMoveErr error
+
+		expectedStoreCalls int
+		expectedErr        *restapi.Err
+	}{
+		"moved": {
+			req:                &restapi.MoveFileRequest{Key: "a.txt", To: "b.txt"},
+			expectedStoreCalls: 1,
+		},
+		"target is missing": {
+			req: &restapi.MoveFileRequest{Key: "a.txt"},
+			expectedErr: &restapi.Err{
+				Message: "invalid request body: 'key' and 'to' are required",
+				Status:  http.StatusBadRequest,
+			},
+		},
+		"file not found": {
+			req:                &restapi.MoveFileRequest{Key: "a.txt", To: "b.txt"},
+			storeMoveErr:       store.ErrNotFound,
+			expectedStoreCalls: 1,
+			expectedErr: &restapi.Err{
+				Message: `file "a.txt" not found`,
+				Status:  http.StatusNotFound,
+			},
+		},
+		"store call fails": {
+			req:                &restapi.MoveFileRequest{Key: "a.txt", To: "b.txt"},
+			storeMoveErr:       errors.New("dummy error"),
+			expectedStoreCalls: 1,
+			expectedErr: &restapi.Err{
+				Message: "could not move file metadata: dummy error",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdStore := &mocks.FileMetadataStoreMock{
+				MoveFunc: func(ctx context.Context, namespace, fromKey, toKey string, by store.Attribution) error {
+					assert.Equal(t, store.DefaultNamespace, namespace)
+					assert.Equal(t, test.req.Key, fromKey)
+					assert.Equal(t, test.req.To, toKey)
+					assert.Equal(t, store.Attribution{AccessKeyID: "aki"}, by)
+					return test.storeMoveErr
+				},
+			}
+
+			s := restapi.NewFilesServer(logrus.New(), mdStore)
+			resp, err := s.MoveFile(restapi.ContextWithAccessKeyID(context.Background(), "aki"), test.req)
+			assert.Equal(t, test.expectedStoreCalls, len(mdStore.MoveCalls()))
+			if test.expectedErr != nil {
+				require.Error(t, err)
+				castedErr := &restapi.Err{}
+				if errors.As(err, &castedErr) {
+					assert.Equal(t, test.expectedErr, castedErr)
+					return
+				}
+				assert.Equal(t, test.expectedErr.Message, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, &restapi.MoveFileResponse{}, resp)
+		})
+	}
+}
+
+func TestSetFileAttributes(t *testing.T) {
+	attrs := &fileattr.Attributes{Mode: 0o755, MTime: 1717243200123456789}
+
+	tests := map[string]struct {
+		req      *restapi.SetFileAttributesRequest
+		ifMatch  string
+		storeErr error
+
+		expectedIfMatch *uint64
+		expectedResp    *restapi.SetFileAttributesResponse
+		expectedErr     *restapi.Err
+	}{
+		"set": {
+			req:             &restapi.SetFileAttributesRequest{Key: "run.sh", Attributes: attrs},
+			ifMatch:         `"7"`,
+			expectedIfMatch: ptr(uint64(7)),
+			expectedResp:    &restapi.SetFileAttributesResponse{Version: 8},
+		},
+		"attributes are missing": {
+			req: &restapi.SetFileAttributesRequest{Key: "run.sh"},
+			expectedErr: &restapi.Err{
+				Message: "invalid request body: 'key' and 'attributes' are required",
+				Status:  http.StatusBadRequest,
+			},
+		},
+		"file not found": {
+			req:      &restapi.SetFileAttributesRequest{Key: "run.sh", Attributes: attrs},
+			storeErr: store.ErrNotFound,
+			expectedErr: &restapi.Err{
+				Message: `file "run.sh" not found`,
+				Status:  http.StatusNotFound,
+			},
+		},
+		"changed since": {
+			req:             &restapi.SetFileAttributesRequest{Key: "run.sh", Attributes: attrs},
+			ifMatch:         `"7"`,
+			storeErr:        fmt.Errorf("%w: at version 9", store.ErrPreconditionFailed),
+			expectedIfMatch: ptr(uint64(7)),
+			expectedErr: &restapi.Err{
+				Message: `file "run.sh" is not at the expected version`,
+				Status:  http.StatusPreconditionFailed,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdStore := &mocks.FileMetadataStoreMock{
+				SetAttributesFunc: func(ctx context.Context, namespace, key string, got *fileattr.Attributes, ifMatch *uint64, by store.Attribution) (uint64, error) {
+					assert.Equal(t, store.DefaultNamespace, namespace)
+					assert.Equal(t, "run.sh", key)
+					assert.Equal(t, attrs, got)
+					assert.Equal(t, tc.expectedIfMatch, ifMatch)
+					return 8, tc.storeErr
+				},
+			}
+
+			s := restapi.NewFilesServer(logrus.New(), mdStore)
+			ctx := context.Background()
+			if tc.ifMatch != "" {
+				ctx = context.WithValue(ctx, "If-Match", []string{tc.ifMatch})
+			}
+			resp, err := s.SetFileAttributes(ctx, tc.req)
+			if tc.expectedErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedResp, resp)
+		})
+	}
+}
+
+func TestFileHistory(t *testing.T) {
+	made := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	by := store.Attribution{AccessKeyID: "aki", DeviceID: "laptop-1", Hostname: "laptop", User: "alice", Operation: store.OpUpload}
+	mdStore := &mocks.FileMetadataStoreMock{
+		HistoryFunc: func(ctx context.Context, namespace, key string) ([]store.Change, error) {
+			assert.Equal(t, store.DefaultNamespace, namespace)
+			if key != "a.txt" {
+				return nil, nil
+			}
+			return []store.Change{
+				{Seq: 9, Op: store.ChangeDelete, Key: "a.txt", Time: made.Add(time.Hour), Attribution: store.Attribution{Operation: store.OpDelete}},
+				{Seq: 8, Op: store.ChangePut, Key: "a.txt", Time: made, Attribution: by, Object: &store.ObjectMetadata{Key: "a.txt", Size: 5, Version: 8, Attribution: by}},
+			}, nil
+		},
+	}
+	attribution := &restapi.Attribution{Operation: "upload", AccessKeyID: "aki", DeviceID: "laptop-1", Hostname: "laptop", User: "alice"}
+
+	s := restapi.NewFilesServer(logrus.New(), mdStore)
+	resp, err := s.FileHistory(context.Background(), &restapi.GetFileHistoryRequest{Key: "a.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, &restapi.GetFileHistoryResponse{
+		Changes: []restapi.Change{
+			{Seq: 9, Op: "delete", Key: "a.txt", Time: made.Add(time.Hour), Attribution: &restapi.Attribution{Operation: "delete"}},
+			{Seq: 8, Op: "put", Key: "a.txt", Time: made, Attribution: attribution, Metadata: &restapi.Metadata{Key: "a.txt", Size: 5, Version: 8, Attribution: attribution}},
+		},
+	}, resp)
+
+	resp, err = s.FileHistory(context.Background(), &restapi.GetFileHistoryRequest{Key: "b.txt"})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Changes)
+
+	_, err = s.FileHistory(context.Background(), &restapi.GetFileHistoryRequest{})
+	assert.Equal(t, &restapi.Err{Message: "invalid request: 'key' is required", Status: http.StatusBadRequest}, err)
+}
+
+func TestListFiles(t *testing.T) {
+	page := &store.ListPage{
+		Objects: []store.ObjectMetadata{
+			{Key: "docs/a.txt", Size: 5, SHA256Checksum: "sha-1", MTime: 1700000000, Version: 3},
+		},
+		CommonPrefixes: []string{"docs/b/"},
+	}
+
+	tests := map[string]struct {
+		req      *restapi.ListFilesRequest
+		page     *store.ListPage
+		storeErr error
+
+		expectedOpts store.ListOptions
+		expectedResp *restapi.ListFilesResponse
+		expectedErr  *restapi.Err
+	}{
+		"first page": {
+			req:  &restapi.ListFilesRequest{Prefix: "docs/", Delimiter: "/", Limit: 2},
+			page: &store.ListPage{Objects: page.Objects, CommonPrefixes: page.CommonPrefixes, Next: "docs/b/"},
+			expectedOpts: store.ListOptions{
+				Prefix:    "docs/",
+				Delimiter: "/",
+				Limit:     2,
+			},
+			expectedResp: &restapi.ListFilesResponse{
+				Files: []*restapi.Metadata{
+					{Key: "docs/a.txt", Size: 5, SHA256Checksum: "sha-1", MTime: 1700000000, Version: 3},
+				},
+				CommonPrefixes: []string{"docs/b/"},
+				NextPageToken:  "ZG9jcy9iLw",
+			},
+		},
+		"next page": {
+			req:  &restapi.ListFilesRequest{Prefix: "docs/", Delimiter: "/", PageToken: "ZG9jcy9iLw", Limit: 5000},
+			page: &store.ListPage{},
+			expectedOpts: store.ListOptions{
+				Prefix:    "docs/",
+				Delimiter: "/",
+				After:     "docs/b/",
+				Limit:     restapi.DefaultListLimit,
+			},
+			expectedResp: &restapi.ListFilesResponse{
+				Files:          []*restapi.Metadata{},
+				CommonPrefixes: []string{},
+			},
+		},
+		"invalid page token": {
+			req: &restapi.ListFilesRequest{PageToken: "!"},
+			expectedErr: &restapi.Err{
+				Message: "invalid page token: illegal base64 data at input byte 0",
+				Status:  http.StatusBadRequest,
+			},
+		},
+		"store failure": {
+			req:          &restapi.ListFilesRequest{},
+			storeErr:     errors.New("boom"),
+			expectedOpts: store.ListOptions{Limit: restapi.DefaultListLimit},
+			expectedErr: &restapi.Err{
+				Message: "list files in store: boom",
+				Status:  http.StatusInternalServerError,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdStore := &mocks.FileMetadataStoreMock{
+				ListFunc: func(ctx context.Context, namespace string, opts store.ListOptions) (*store.ListPage, error) {
+					assert.Equal(t, store.DefaultNamespace, namespace)
+					assert.Equal(t, tc.expectedOpts, opts)
+					if tc.storeErr != nil {
+						return nil, tc.storeErr
+					}
+					return tc.page, nil
+				},
+			}
+
+			s := restapi.NewFilesServer(logrus.New(), mdStore)
+			resp, err := s.ListFiles(context.Background(), tc.req)
+			if tc.expectedErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedResp, resp)
+		})
+	}
+}
+
+func TestTreeNodes(t *testing.T) {
+	nodes := []*hashtree.Node{
+		{Prefix: "", Hash: "hash-root", Dirs: []hashtree.Entry{{Name: "docs", Hash: "hash-docs"}}, Files: []hashtree.Entry{}},
+		{Prefix: "docs/", Hash: "hash-docs", Dirs: []hashtree.Entry{}, Files: []hashtree.Entry{{Name: "a.txt", Hash: "sha-1"}}},
+	}
+
+	tests := map[string]struct {
+		req      *restapi.GetTreeNodesRequest
+		nodes    []*hashtree.Node
+		storeErr error
+
+		expectedResp *restapi.GetTreeNodesResponse
+		expectedErr  *restapi.Err
+	}{
+		"nodes": {
+			req:   &restapi.GetTreeNodesRequest{Prefixes: []string{"", "docs/"}},
+			nodes: nodes,
+			expectedResp: &restapi.GetTreeNodesResponse{
+				Nodes:  nodes,
+				Cursor: "epoch.7",
+			},
+		},
+		"no nodes": {
+			req: &restapi.GetTreeNodesRequest{Prefixes: []string{"missing/"}},
+			expectedResp: &restapi.GetTreeNodesResponse{
+				Nodes:  []*hashtree.Node{},
+				Cursor: "epoch.7",
+			},
+		},
+		"no prefixes": {
+			req: &restapi.GetTreeNodesRequest{},
+			expectedErr: &restapi.Err{
+				Message: "no prefixes given",
+				Status:  http.StatusBadRequest,
+			},
+		},
+		"too many prefixes": {
+			req: &restapi.GetTreeNodesRequest{Prefixes: make([]string, restapi.MaxTreePrefixes+1)},
+			expectedErr: &restapi.Err{
+				Message: "too many prefixes: 1001, at most 1000 are allowed",
+				Status:  http.StatusBadRequest,
+			},
+		},
+		"store failure": {
+			req:      &restapi.GetTreeNodesRequest{Prefixes: []string{""}},
+			storeErr: errors.New("boom"),
+			expectedErr: &restapi.Err{
+				Message: "get tree nodes from store: boom",
+				Status:  http.StatusInternalServerError,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdStore := &mocks.FileMetadataStoreMock{
+				TreeNodesFunc: func(ctx context.Context, namespace string, prefixes []string) ([]*hashtree.Node, store.Cursor, error) {
+					assert.Equal(t, store.DefaultNamespace, namespace)
+					assert.Equal(t, tc.req.Prefixes, prefixes)
+					if tc.storeErr != nil {
+						return nil, store.Cursor{}, tc.storeErr
+					}
+					return tc.nodes, store.Cursor{Epoch: "epoch", Seq: 7}, nil
+				},
+			}
+
+			s := restapi.NewFilesServer(logrus.New(), mdStore)
+			resp, err := s.TreeNodes(context.Background(), tc.req)
+			if tc.expectedErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedResp, resp)
+		})
+	}
+}
+
+func TestStreamSnapshot(t *testing.T) {
+	tests := map[string]struct {
+		objects  []store.ObjectMetadata
+		storeErr error
+
+		expectedStatus int
+		expectedBody   string
+	}{
+		"files": {
+			objects: []store.ObjectMetadata{
+				{Key: "a.txt", Size: 5, SHA256Checksum: "sha-1", Version: 1},
+				{Key: "b.txt", Size: 7, SHA256Checksum: "sha-2", Version: 2},
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody: `{"cursor":"epoch.2"}
+{"file":{"key":"a.txt","size":5,"sha256_checksum":"sha-1","version":1}}
+{"file":{"key":"b.txt","size":7,"sha256_checksum":"sha-2","version":2}}
+{"end":true,"count":2}
+`,
+		},
+		"empty namespace": {
+			expectedStatus: http.StatusOK,
+			expectedBody: `{"cursor":"epoch.2"}
+{"end":true}
+`,
+		},
+		"store failure": {
+			storeErr:       errors.New("boom"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   "get snapshot from store: boom\n",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdStore := &mocks.FileMetadataStoreMock{
+				SnapshotSeqFunc: func(ctx context.Context, namespace string) (iter.Seq[store.ObjectMetadata], store.Cursor, error) {
+					assert.Equal(t, "docs", namespace)
+					if tc.storeErr != nil {
+						return nil, store.Cursor{}, tc.storeErr
+					}
+					return slices.Values(tc.objects), store.Cursor{Epoch: "epoch", Seq: 2}, nil
+				},
+			}
+
+			s := restapi.NewFilesServer(logrus.New(), mdStore)
+			w := httptest.NewRecorder()
+			s.StreamSnapshot(w, httptest.NewRequest(http.MethodGet, "/v1/snapshot/stream?namespace=docs", nil))
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,91 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+// ChangeFeedMock is a mock implementation of rest.ChangeFeed.
+//
+//	func TestSomethingThatUsesChangeFeed(t *testing.T) {
+//
+//		// make and configure a mocked rest.ChangeFeed
+//		mockedChangeFeed := &ChangeFeedMock{
+//			ChangesFunc: func(ctx context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error) {
+//				panic("mock out the Changes method")
+//			},
+//		}
+//
+//		// use mockedChangeFeed in code that requires rest.ChangeFeed
+//		// and then make assertions.
+//
+//	}
+type ChangeFeedMock struct {
+	// ChangesFunc mocks the Changes method.
+	ChangesFunc func(ctx context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Changes holds details about calls to the Changes method.
+		Changes []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// Since is the since argument value.
+			Since store.Cursor
+			// Limit is the limit argument value.
+			Limit int
+		}
+	}
+	lockChanges sync.RWMutex
+}
+
+// Changes calls ChangesFunc.
+func (mock *ChangeFeedMock) Changes(ctx context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error) {
+	if mock.ChangesFunc == nil {
+		panic("ChangeFeedMock.ChangesFunc: method is nil but ChangeFeed.Changes was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+		Since     store.Cursor
+		Limit     int
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+		Since:     since,
+		Limit:     limit,
+	}
+	mock.lockChanges.Lock()
+	mock.calls.Changes = append(mock.calls.Changes, callInfo)
+	mock.lockChanges.Unlock()
+	return mock.ChangesFunc(ctx, namespace, since, limit)
+}
+
+// ChangesCalls gets all the calls that were made to Changes.
+// Check the length with:
+//
+//	len(mockedChangeFeed.ChangesCalls())
+func (mock *ChangeFeedMock) ChangesCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	Since     store.Cursor
+	Limit     int
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+		Since     store.Cursor
+		Limit     int
+	}
+	mock.lockChanges.RLock()
+	calls = mock.calls.Changes
+	mock.lockChanges.RUnlock()
+	return calls
+}
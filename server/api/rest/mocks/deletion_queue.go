@@ -0,0 +1,146 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package mocks
+
+import (
+	"sync"
+
+	"github.com/hedisam/filesync/server/internal/outbox"
+)
+
+// DeletionQueueMock is a mock implementation of rest.DeletionQueue.
+//
+//	func TestSomethingThatUsesDeletionQueue(t *testing.T) {
+//
+//		// make and configure a mocked rest.DeletionQueue
+//		mockedDeletionQueue := &DeletionQueueMock{
+//			DeadLettersFunc: func() []outbox.Entry {
+//				panic("mock out the DeadLetters method")
+//			},
+//			PendingFunc: func() int {
+//				panic("mock out the Pending method")
+//			},
+//			RequeueFunc: func(id uint64) error {
+//				panic("mock out the Requeue method")
+//			},
+//		}
+//
+//		// use mockedDeletionQueue in code that requires rest.DeletionQueue
+//		// and then make assertions.
+//
+//	}
+type DeletionQueueMock struct {
+	// DeadLettersFunc mocks the DeadLetters method.
+	DeadLettersFunc func() []outbox.Entry
+
+	// PendingFunc mocks the Pending method.
+	PendingFunc func() int
+
+	// RequeueFunc mocks the Requeue method.
+	RequeueFunc func(id uint64) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// DeadLetters holds details about calls to the DeadLetters method.
+		DeadLetters []struct {
+		}
+		// Pending holds details about calls to the Pending method.
+		Pending []struct {
+		}
+		// Requeue holds details about calls to the Requeue method.
+		Requeue []struct {
+			// ID is the id argument value.
+			ID uint64
+		}
+	}
+	lockDeadLetters sync.RWMutex
+	lockPending     sync.RWMutex
+	lockRequeue     sync.RWMutex
+}
+
+// DeadLetters calls DeadLettersFunc.
+func (mock *DeletionQueueMock) DeadLetters() []outbox.Entry {
+	if mock.DeadLettersFunc == nil {
+		panic("DeletionQueueMock.DeadLettersFunc: method is nil but DeletionQueue.DeadLetters was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockDeadLetters.Lock()
+	mock.calls.DeadLetters = append(mock.calls.DeadLetters, callInfo)
+	mock.lockDeadLetters.Unlock()
+	return mock.DeadLettersFunc()
+}
+
+// DeadLettersCalls gets all the calls that were made to DeadLetters.
+// Check the length with:
+//
+//	len(mockedDeletionQueue.DeadLettersCalls())
+func (mock *DeletionQueueMock) DeadLettersCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockDeadLetters.RLock()
+	calls = mock.calls.DeadLetters
+	mock.lockDeadLetters.RUnlock()
+	return calls
+}
+
+// Pending calls PendingFunc.
+func (mock *DeletionQueueMock) Pending() int {
+	if mock.PendingFunc == nil {
+		panic("DeletionQueueMock.PendingFunc: method is nil but DeletionQueue.Pending was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockPending.Lock()
+	mock.calls.Pending = append(mock.calls.Pending, callInfo)
+	mock.lockPending.Unlock()
+	return mock.PendingFunc()
+}
+
+// PendingCalls gets all the calls that were made to Pending.
+// Check the length with:
+//
+//	len(mockedDeletionQueue.PendingCalls())
+func (mock *DeletionQueueMock) PendingCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockPending.RLock()
+	calls = mock.calls.Pending
+	mock.lockPending.RUnlock()
+	return calls
+}
+
+// Requeue calls RequeueFunc.
+func (mock *DeletionQueueMock) Requeue(id uint64) error {
+	if mock.RequeueFunc == nil {
+		panic("DeletionQueueMock.RequeueFunc: method is nil but DeletionQueue.Requeue was just called")
+	}
+	callInfo := struct {
+		ID uint64
+	}{
+		ID: id,
+	}
+	mock.lockRequeue.Lock()
+	mock.calls.Requeue = append(mock.calls.Requeue, callInfo)
+	mock.lockRequeue.Unlock()
+	return mock.RequeueFunc(id)
+}
+
+// RequeueCalls gets all the calls that were made to Requeue.
+// Check the length with:
+//
+//	len(mockedDeletionQueue.RequeueCalls())
+func (mock *DeletionQueueMock) RequeueCalls() []struct {
+	ID uint64
+} {
+	var calls []struct {
+		ID uint64
+	}
+	mock.lockRequeue.RLock()
+	calls = mock.calls.Requeue
+	mock.lockRequeue.RUnlock()
+	return calls
+}
@@ -0,0 +1,335 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hedisam/filesync/server/internal/devices"
+)
+
+// DeviceRegistryMock is a mock implementation of rest.DeviceRegistry.
+//
+//	func TestSomethingThatUsesDeviceRegistry(t *testing.T) {
+//
+//		// make and configure a mocked rest.DeviceRegistry
+//		mockedDeviceRegistry := &DeviceRegistryMock{
+//			GetFunc: func(ctx context.Context, id string) (devices.Device, error) {
+//				panic("mock out the Get method")
+//			},
+//			ListFunc: func(ctx context.Context, namespace string) ([]devices.Device, error) {
+//				panic("mock out the List method")
+//			},
+//			RegisterFunc: func(ctx context.Context, reg devices.Registration) (devices.Device, error) {
+//				panic("mock out the Register method")
+//			},
+//			RemoveFunc: func(ctx context.Context, id string) error {
+//				panic("mock out the Remove method")
+//			},
+//			ReportSyncFunc: func(ctx context.Context, id string, report devices.SyncReport) (devices.Device, error) {
+//				panic("mock out the ReportSync method")
+//			},
+//			StalenessFunc: func(ctx context.Context, d devices.Device) (string, error) {
+//				panic("mock out the Staleness method")
+//			},
+//		}
+//
+//		// use mockedDeviceRegistry in code that requires rest.DeviceRegistry
+//		// and then make assertions.
+//
+//	}
+type DeviceRegistryMock struct {
+	// GetFunc mocks the Get method.
+	GetFunc func(ctx context.Context, id string) (devices.Device, error)
+
+	// ListFunc mocks the List method.
+	ListFunc func(ctx context.Context, namespace string) ([]devices.Device, error)
+
+	// RegisterFunc mocks the Register method.
+	RegisterFunc func(ctx context.Context, reg devices.Registration) (devices.Device, error)
+
+	// RemoveFunc mocks the Remove method.
+	RemoveFunc func(ctx context.Context, id string) error
+
+	// ReportSyncFunc mocks the ReportSync method.
+	ReportSyncFunc func(ctx context.Context, id string, report devices.SyncReport) (devices.Device, error)
+
+	// StalenessFunc mocks the Staleness method.
+	StalenessFunc func(ctx context.Context, d devices.Device) (string, error)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Get holds details about calls to the Get method.
+		Get []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+		}
+		// List holds details about calls to the List method.
+		List []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+		}
+		// Register holds details about calls to the Register method.
+		Register []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Reg is the reg argument value.
+			Reg devices.Registration
+		}
+		// Remove holds details about calls to the Remove method.
+		Remove []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+		}
+		// ReportSync holds details about calls to the ReportSync method.
+		ReportSync []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+			// Report is the report argument value.
+			Report devices.SyncReport
+		}
+		// Staleness holds details about calls to the Staleness method.
+		Staleness []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// D is the d argument value.
+			D devices.Device
+		}
+	}
+	lockGet        sync.RWMutex
+	lockList       sync.RWMutex
+	lockRegister   sync.RWMutex
+	lockRemove     sync.RWMutex
+	lockReportSync sync.RWMutex
+	lockStaleness  sync.RWMutex
+}
+
+// Get calls GetFunc.
+func (mock *DeviceRegistryMock) Get(ctx context.Context, id string) (devices.Device, error) {
+	if mock.GetFunc == nil {
+		panic("DeviceRegistryMock.GetFunc: method is nil but DeviceRegistry.Get was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		ID  string
+	}{
+		Ctx: ctx,
+		ID:  id,
+	}
+	mock.lockGet.Lock()
+	mock.calls.Get = append(mock.calls.Get, callInfo)
+	mock.lockGet.Unlock()
+	return mock.GetFunc(ctx, id)
+}
+
+// GetCalls gets all the calls that were made to Get.
+// Check the length with:
+//
+//	len(mockedDeviceRegistry.GetCalls())
+func (mock *DeviceRegistryMock) GetCalls() []struct {
+	Ctx context.Context
+	ID  string
+} {
+	var calls []struct {
+		Ctx context.Context
+		ID  string
+	}
+	mock.lockGet.RLock()
+	calls = mock.calls.Get
+	mock.lockGet.RUnlock()
+	return calls
+}
+
+// List calls ListFunc.
+func (mock *DeviceRegistryMock) List(ctx context.Context, namespace string) ([]devices.Device, error) {
+	if mock.ListFunc == nil {
+		panic("DeviceRegistryMock.ListFunc: method is nil but DeviceRegistry.List was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+	}
+	mock.lockList.Lock()
+	mock.calls.List = append(mock.calls.List, callInfo)
+	mock.lockList.Unlock()
+	return mock.ListFunc(ctx, namespace)
+}
+
+// ListCalls gets all the calls that were made to List.
+// Check the length with:
+//
+//	len(mockedDeviceRegistry.ListCalls())
+func (mock *DeviceRegistryMock) ListCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+	}
+	mock.lockList.RLock()
+	calls = mock.calls.List
+	mock.lockList.RUnlock()
+	return calls
+}
+
+// Register calls RegisterFunc.
+func (mock *DeviceRegistryMock) Register(ctx context.Context, reg devices.Registration) (devices.Device, error) {
+	if mock.RegisterFunc == nil {
+		panic("DeviceRegistryMock.RegisterFunc: method is nil but DeviceRegistry.Register was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		Reg devices.Registration
+	}{
+		Ctx: ctx,
+		Reg: reg,
+	}
+	mock.lockRegister.Lock()
+	mock.calls.Register = append(mock.calls.Register, callInfo)
+	mock.lockRegister.Unlock()
+	return mock.RegisterFunc(ctx, reg)
+}
+
+// RegisterCalls gets all the calls that were made to Register.
+// Check the length with:
+//
+//	len(mockedDeviceRegistry.RegisterCalls())
+func (mock *DeviceRegistryMock) RegisterCalls() []struct {
+	Ctx context.Context
+	Reg devices.Registration
+} {
+	var calls []struct {
+		Ctx context.Context
+		Reg devices.Registration
+	}
+	mock.lockRegister.RLock()
+	calls = mock.calls.Register
+	mock.lockRegister.RUnlock()
+	return calls
+}
+
+// Remove calls RemoveFunc.
+func (mock *DeviceRegistryMock) Remove(ctx context.Context, id string) error {
+	if mock.RemoveFunc == nil {
+		panic("DeviceRegistryMock.RemoveFunc: method is nil but DeviceRegistry.Remove was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		ID  string
+	}{
+		Ctx: ctx,
+		ID:  id,
+	}
+	mock.lockRemove.Lock()
+	mock.calls.Remove = append(mock.calls.Remove, callInfo)
+	mock.lockRemove.Unlock()
+	return mock.RemoveFunc(ctx, id)
+}
+
+// RemoveCalls gets all the calls that were made to Remove.
+// Check the length with:
+//
+//	len(mockedDeviceRegistry.RemoveCalls())
+func (mock *DeviceRegistryMock) RemoveCalls() []struct {
+	Ctx context.Context
+	ID  string
+} {
+	var calls []struct {
+		Ctx context.Context
+		ID  string
+	}
+	mock.lockRemove.RLock()
+	calls = mock.calls.Remove
+	mock.lockRemove.RUnlock()
+	return calls
+}
+
+// ReportSync calls ReportSyncFunc.
+func (mock *DeviceRegistryMock) ReportSync(ctx context.Context, id string, report devices.SyncReport) (devices.Device, error) {
+	if mock.ReportSyncFunc == nil {
+		panic("DeviceRegistryMock.ReportSyncFunc: method is nil but DeviceRegistry.ReportSync was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		ID     string
+		Report devices.SyncReport
+	}{
+		Ctx:    ctx,
+		ID:     id,
+		Report: report,
+	}
+	mock.lockReportSync.Lock()
+	mock.calls.ReportSync = append(mock.calls.ReportSync, callInfo)
+	mock.lockReportSync.Unlock()
+	return mock.ReportSyncFunc(ctx, id, report)
+}
+
+// ReportSyncCalls gets all the calls that were made to ReportSync.
+// Check the length with:
+//
+//	len(mockedDeviceRegistry.ReportSyncCalls())
+func (mock *DeviceRegistryMock) ReportSyncCalls() []struct {
+	Ctx    context.Context
+	ID     string
+	Report devices.SyncReport
+} {
+	var calls []struct {
+		Ctx    context.Context
+		ID     string
+		Report devices.SyncReport
+	}
+	mock.lockReportSync.RLock()
+	calls = mock.calls.ReportSync
+	mock.lockReportSync.RUnlock()
+	return calls
+}
+
+// Staleness calls StalenessFunc.
+func (mock *DeviceRegistryMock) Staleness(ctx context.Context, d devices.Device) (string, error) {
+	if mock.StalenessFunc == nil {
+		panic("DeviceRegistryMock.StalenessFunc: method is nil but DeviceRegistry.Staleness was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		D   devices.Device
+	}{
+		Ctx: ctx,
+		D:   d,
+	}
+	mock.lockStaleness.Lock()
+	mock.calls.Staleness = append(mock.calls.Staleness, callInfo)
+	mock.lockStaleness.Unlock()
+	return mock.StalenessFunc(ctx, d)
+}
+
+// StalenessCalls gets all the calls that were made to Staleness.
+// Check the length with:
+//
+//	len(mockedDeviceRegistry.StalenessCalls())
+func (mock *DeviceRegistryMock) StalenessCalls() []struct {
+	Ctx context.Context
+	D   devices.Device
+} {
+	var calls []struct {
+		Ctx context.Context
+		D   devices.Device
+	}
+	mock.lockStaleness.RLock()
+	calls = mock.calls.Staleness
+	mock.lockStaleness.RUnlock()
+	return calls
+}
@@ -0,0 +1,85 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+// DownloadMetadataStoreMock is a mock implementation of rest.DownloadMetadataStore.
+//
+//	func TestSomethingThatUsesDownloadMetadataStore(t *testing.T) {
+//
+//		// make and configure a mocked rest.DownloadMetadataStore
+//		mockedDownloadMetadataStore := &DownloadMetadataStoreMock{
+//			GetFunc: func(ctx context.Context, namespace string, key string) (*store.ObjectMetadata, error) {
+//				panic("mock out the Get method")
+//			},
+//		}
+//
+//		// use mockedDownloadMetadataStore in code that requires rest.DownloadMetadataStore
+//		// and then make assertions.
+//
+//	}
+type DownloadMetadataStoreMock struct {
+	// GetFunc mocks the Get method.
+	GetFunc func(ctx context.Context, namespace string, key string) (*store.ObjectMetadata, error)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Get holds details about calls to the Get method.
+		Get []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// Key is the key argument value.
+			Key string
+		}
+	}
+	lockGet sync.RWMutex
+}
+
+// Get calls GetFunc.
+func (mock *DownloadMetadataStoreMock) Get(ctx context.Context, namespace string, key string) (*store.ObjectMetadata, error) {
+	if mock.GetFunc == nil {
+		panic("DownloadMetadataStoreMock.GetFunc: method is nil but DownloadMetadataStore.Get was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+		Key:       key,
+	}
+	mock.lockGet.Lock()
+	mock.calls.Get = append(mock.calls.Get, callInfo)
+	mock.lockGet.Unlock()
+	return mock.GetFunc(ctx, namespace, key)
+}
+
+// GetCalls gets all the calls that were made to Get.
+// Check the length with:
+//
+//	len(mockedDownloadMetadataStore.GetCalls())
+func (mock *DownloadMetadataStoreMock) GetCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	Key       string
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+	}
+	mock.lockGet.RLock()
+	calls = mock.calls.Get
+	mock.lockGet.RUnlock()
+	return calls
+}
@@ -5,8 +5,11 @@ package mocks
 
 import (
 	"context"
+	"iter"
 	"sync"
 
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/hashtree"
 	"github.com/hedisam/filesync/server/internal/store"
 )
 
@@ -16,11 +19,32 @@ import (
 //
 //		// make and configure a mocked rest.FileMetadataStore
 //		mockedFileMetadataStore := &FileMetadataStoreMock{
-//			DeleteFunc: func(ctx context.Context, key string) error {
+//			ChangesFunc: func(ctx context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error) {
+//				panic("mock out the Changes method")
+//			},
+//			DeleteFunc: func(ctx context.Context, namespace string, key string, ifMatch *uint64, by store.Attribution) error {
 //				panic("mock out the Delete method")
 //			},
-//			SnapshotFunc: func(contextMoqParam context.Context) (map[string]store.ObjectMetadata, error) {
-//				panic("mock out the Snapshot method")
+//			HistoryFunc: func(ctx context.Context, namespace string, key string) ([]store.Change, error) {
+//				panic("mock out the History method")
+//			},
+//			ListFunc: func(ctx context.Context, namespace string, opts store.ListOptions) (*store.ListPage, error) {
+//				panic("mock out the List method")
+//			},
+//			MoveFunc: func(ctx context.Context, namespace string, fromKey string, toKey string, by store.Attribution) error {
+//				panic("mock out the Move method")
+//			},
+//			SetAttributesFunc: func(ctx context.Context, namespace string, key string, attrs *fileattr.Attributes, ifMatch *uint64, by store.Attribution) (uint64, error) {
+//				panic("mock out the SetAttributes method")
+//			},
+//			SnapshotSeqFunc: func(ctx context.Context, namespace string) (iter.Seq[store.ObjectMetadata], store.Cursor, error) {
+//				panic("mock out the SnapshotSeq method")
+//			},
+//			SnapshotWithCursorFunc: func(ctx context.Context, namespace string) (map[string]store.ObjectMetadata, store.Cursor, error) {
+//				panic("mock out the SnapshotWithCursor method")
+//			},
+//			TreeNodesFunc: func(ctx context.Context, namespace string, prefixes []string) ([]*hashtree.Node, store.Cursor, error) {
+//				panic("mock out the TreeNodes method")
 //			},
 //		}
 //
@@ -29,47 +53,206 @@ import (
 //
 //	}
 type FileMetadataStoreMock struct {
+	// ChangesFunc mocks the Changes method.
+	ChangesFunc func(ctx context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error)
+
 	// DeleteFunc mocks the Delete method.
-	DeleteFunc func(ctx context.Context, key string) error
+	DeleteFunc func(ctx context.Context, namespace string, key string, ifMatch *uint64, by store.Attribution) error
+
+	// HistoryFunc mocks the History method.
+	HistoryFunc func(ctx context.Context, namespace string, key string) ([]store.Change, error)
 
-	// SnapshotFunc mocks the Snapshot method.
-	SnapshotFunc func(contextMoqParam context.Context) (map[string]store.ObjectMetadata, error)
+	// ListFunc mocks the List method.
+	ListFunc func(ctx context.Context, namespace string, opts store.ListOptions) (*store.ListPage, error)
+
+	// MoveFunc mocks the Move method.
+	MoveFunc func(ctx context.Context, namespace string, fromKey string, toKey string, by store.Attribution) error
+
+	// SetAttributesFunc mocks the SetAttributes method.
+	SetAttributesFunc func(ctx context.Context, namespace string, key string, attrs *fileattr.Attributes, ifMatch *uint64, by store.Attribution) (uint64, error)
+
+	// SnapshotSeqFunc mocks the SnapshotSeq method.
+	SnapshotSeqFunc func(ctx context.Context, namespace string) (iter.Seq[store.ObjectMetadata], store.Cursor, error)
+
+	// SnapshotWithCursorFunc mocks the SnapshotWithCursor method.
+	SnapshotWithCursorFunc func(ctx context.Context, namespace string) (map[string]store.ObjectMetadata, store.Cursor, error)
+
+	// TreeNodesFunc mocks the TreeNodes method.
+	TreeNodesFunc func(ctx context.Context, namespace string, prefixes []string) ([]*hashtree.Node, store.Cursor, error)
 
 	// calls tracks calls to the methods.
 	calls struct {
+		// Changes holds details about calls to the Changes method.
+		Changes []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// Since is the since argument value.
+			Since store.Cursor
+			// Limit is the limit argument value.
+			Limit int
+		}
 		// Delete holds details about calls to the Delete method.
 		Delete []struct {
 			// Ctx is the ctx argument value.
 			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
 			// Key is the key argument value.
 			Key string
+			// IfMatch is the ifMatch argument value.
+			IfMatch *uint64
+			// By is the by argument value.
+			By store.Attribution
+		}
+		// History holds details about calls to the History method.
+		History []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// Key is the key argument value.
+			Key string
+		}
+		// List holds details about calls to the List method.
+		List []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// Opts is the opts argument value.
+			Opts store.ListOptions
+		}
+		// Move holds details about calls to the Move method.
+		Move []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// FromKey is the fromKey argument value.
+			FromKey string
+			// ToKey is the toKey argument value.
+			ToKey string
+			// By is the by argument value.
+			By store.Attribution
+		}
+		// SetAttributes holds details about calls to the SetAttributes method.
+		SetAttributes []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// Key is the key argument value.
+			Key string
+			// Attrs is the attrs argument value.
+			Attrs *fileattr.Attributes
+			// IfMatch is the ifMatch argument value.
+			IfMatch *uint64
+			// By is the by argument value.
+			By store.Attribution
+		}
+		// SnapshotSeq holds details about calls to the SnapshotSeq method.
+		SnapshotSeq []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
 		}
-		// Snapshot holds details about calls to the Snapshot method.
-		Snapshot []struct {
-			// ContextMoqParam is the contextMoqParam argument value.
-			ContextMoqParam context.Context
+		// SnapshotWithCursor holds details about calls to the SnapshotWithCursor method.
+		SnapshotWithCursor []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
 		}
+		// TreeNodes holds details about calls to the TreeNodes method.
+		TreeNodes []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// Prefixes is the prefixes argument value.
+			Prefixes []string
+		}
+	}
+	lockChanges            sync.RWMutex
+	lockDelete             sync.RWMutex
+	lockHistory            sync.RWMutex
+	lockList               sync.RWMutex
+	lockMove               sync.RWMutex
+	lockSetAttributes      sync.RWMutex
+	lockSnapshotSeq        sync.RWMutex
+	lockSnapshotWithCursor sync.RWMutex
+	lockTreeNodes          sync.RWMutex
+}
+
+// Changes calls ChangesFunc.
+func (mock *FileMetadataStoreMock) Changes(ctx context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error) {
+	if mock.ChangesFunc == nil {
+		panic("FileMetadataStoreMock.ChangesFunc: method is nil but FileMetadataStore.Changes was just called")
 	}
-	lockDelete   sync.RWMutex
-	lockSnapshot sync.RWMutex
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+		Since     store.Cursor
+		Limit     int
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+		Since:     since,
+		Limit:     limit,
+	}
+	mock.lockChanges.Lock()
+	mock.calls.Changes = append(mock.calls.Changes, callInfo)
+	mock.lockChanges.Unlock()
+	return mock.ChangesFunc(ctx, namespace, since, limit)
+}
+
+// ChangesCalls gets all the calls that were made to Changes.
+// Check the length with:
+//
+//	len(mockedFileMetadataStore.ChangesCalls())
+func (mock *FileMetadataStoreMock) ChangesCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	Since     store.Cursor
+	Limit     int
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+		Since     store.Cursor
+		Limit     int
+	}
+	mock.lockChanges.RLock()
+	calls = mock.calls.Changes
+	mock.lockChanges.RUnlock()
+	return calls
 }
 
 // Delete calls DeleteFunc.
-func (mock *FileMetadataStoreMock) Delete(ctx context.Context, key string) error {
+func (mock *FileMetadataStoreMock) Delete(ctx context.Context, namespace string, key string, ifMatch *uint64, by store.Attribution) error {
 	if mock.DeleteFunc == nil {
 		panic("FileMetadataStoreMock.DeleteFunc: method is nil but FileMetadataStore.Delete was just called")
 	}
 	callInfo := struct {
-		Ctx context.Context
-		Key string
+		Ctx       context.Context
+		Namespace string
+		Key       string
+		IfMatch   *uint64
+		By        store.Attribution
 	}{
-		Ctx: ctx,
-		Key: key,
+		Ctx:       ctx,
+		Namespace: namespace,
+		Key:       key,
+		IfMatch:   ifMatch,
+		By:        by,
 	}
 	mock.lockDelete.Lock()
 	mock.calls.Delete = append(mock.calls.Delete, callInfo)
 	mock.lockDelete.Unlock()
-	return mock.DeleteFunc(ctx, key)
+	return mock.DeleteFunc(ctx, namespace, key, ifMatch, by)
 }
 
 // DeleteCalls gets all the calls that were made to Delete.
@@ -77,12 +260,18 @@ func (mock *FileMetadataStoreMock) Delete(ctx context.Context, key string) error
 //
 //	len(mockedFileMetadataStore.DeleteCalls())
 func (mock *FileMetadataStoreMock) DeleteCalls() []struct {
-	Ctx context.Context
-	Key string
+	Ctx       context.Context
+	Namespace string
+	Key       string
+	IfMatch   *uint64
+	By        store.Attribution
 } {
 	var calls []struct {
-		Ctx context.Context
-		Key string
+		Ctx       context.Context
+		Namespace string
+		Key       string
+		IfMatch   *uint64
+		By        store.Attribution
 	}
 	mock.lockDelete.RLock()
 	calls = mock.calls.Delete
@@ -90,34 +279,294 @@ func (mock *FileMetadataStoreMock) DeleteCalls() []struct {
 	return calls
 }
 
-// Snapshot calls SnapshotFunc.
-func (mock *FileMetadataStoreMock) Snapshot(contextMoqParam context.Context) (map[string]store.ObjectMetadata, error) {
-	if mock.SnapshotFunc == nil {
-		panic("FileMetadataStoreMock.SnapshotFunc: method is nil but FileMetadataStore.Snapshot was just called")
+// History calls HistoryFunc.
+func (mock *FileMetadataStoreMock) History(ctx context.Context, namespace string, key string) ([]store.Change, error) {
+	if mock.HistoryFunc == nil {
+		panic("FileMetadataStoreMock.HistoryFunc: method is nil but FileMetadataStore.History was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+		Key:       key,
+	}
+	mock.lockHistory.Lock()
+	mock.calls.History = append(mock.calls.History, callInfo)
+	mock.lockHistory.Unlock()
+	return mock.HistoryFunc(ctx, namespace, key)
+}
+
+// HistoryCalls gets all the calls that were made to History.
+// Check the length with:
+//
+//	len(mockedFileMetadataStore.HistoryCalls())
+func (mock *FileMetadataStoreMock) HistoryCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	Key       string
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+	}
+	mock.lockHistory.RLock()
+	calls = mock.calls.History
+	mock.lockHistory.RUnlock()
+	return calls
+}
+
+// List calls ListFunc.
+func (mock *FileMetadataStoreMock) List(ctx context.Context, namespace string, opts store.ListOptions) (*store.ListPage, error) {
+	if mock.ListFunc == nil {
+		panic("FileMetadataStoreMock.ListFunc: method is nil but FileMetadataStore.List was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+		Opts      store.ListOptions
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+		Opts:      opts,
+	}
+	mock.lockList.Lock()
+	mock.calls.List = append(mock.calls.List, callInfo)
+	mock.lockList.Unlock()
+	return mock.ListFunc(ctx, namespace, opts)
+}
+
+// ListCalls gets all the calls that were made to List.
+// Check the length with:
+//
+//	len(mockedFileMetadataStore.ListCalls())
+func (mock *FileMetadataStoreMock) ListCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	Opts      store.ListOptions
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+		Opts      store.ListOptions
+	}
+	mock.lockList.RLock()
+	calls = mock.calls.List
+	mock.lockList.RUnlock()
+	return calls
+}
+
+// Move calls MoveFunc.
+func (mock *FileMetadataStoreMock) Move(ctx context.Context, namespace string, fromKey string, toKey string, by store.Attribution) error {
+	if mock.MoveFunc == nil {
+		panic("FileMetadataStoreMock.MoveFunc: method is nil but FileMetadataStore.Move was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+		FromKey   string
+		ToKey     string
+		By        store.Attribution
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+		FromKey:   fromKey,
+		ToKey:     toKey,
+		By:        by,
+	}
+	mock.lockMove.Lock()
+	mock.calls.Move = append(mock.calls.Move, callInfo)
+	mock.lockMove.Unlock()
+	return mock.MoveFunc(ctx, namespace, fromKey, toKey, by)
+}
+
+// MoveCalls gets all the calls that were made to Move.
+// Check the length with:
+//
+//	len(mockedFileMetadataStore.MoveCalls())
+func (mock *FileMetadataStoreMock) MoveCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	FromKey   string
+	ToKey     string
+	By        store.Attribution
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+		FromKey   string
+		ToKey     string
+		By        store.Attribution
+	}
+	mock.lockMove.RLock()
+	calls = mock.calls.Move
+	mock.lockMove.RUnlock()
+	return calls
+}
+
+// SetAttributes calls SetAttributesFunc.
+func (mock *FileMetadataStoreMock) SetAttributes(ctx context.Context, namespace string, key string, attrs *fileattr.Attributes, ifMatch *uint64, by store.Attribution) (uint64, error) {
+	if mock.SetAttributesFunc == nil {
+		panic("FileMetadataStoreMock.SetAttributesFunc: method is nil but FileMetadataStore.SetAttributes was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+		Attrs     *fileattr.Attributes
+		IfMatch   *uint64
+		By        store.Attribution
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+		Key:       key,
+		Attrs:     attrs,
+		IfMatch:   ifMatch,
+		By:        by,
+	}
+	mock.lockSetAttributes.Lock()
+	mock.calls.SetAttributes = append(mock.calls.SetAttributes, callInfo)
+	mock.lockSetAttributes.Unlock()
+	return mock.SetAttributesFunc(ctx, namespace, key, attrs, ifMatch, by)
+}
+
+// SetAttributesCalls gets all the calls that were made to SetAttributes.
+// Check the length with:
+//
+//	len(mockedFileMetadataStore.SetAttributesCalls())
+func (mock *FileMetadataStoreMock) SetAttributesCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	Key       string
+	Attrs     *fileattr.Attributes
+	IfMatch   *uint64
+	By        store.Attribution
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+		Attrs     *fileattr.Attributes
+		IfMatch   *uint64
+		By        store.Attribution
+	}
+	mock.lockSetAttributes.RLock()
+	calls = mock.calls.SetAttributes
+	mock.lockSetAttributes.RUnlock()
+	return calls
+}
+
+// SnapshotSeq calls SnapshotSeqFunc.
+func (mock *FileMetadataStoreMock) SnapshotSeq(ctx context.Context, namespace string) (iter.Seq[store.ObjectMetadata], store.Cursor, error) {
+	if mock.SnapshotSeqFunc == nil {
+		panic("FileMetadataStoreMock.SnapshotSeqFunc: method is nil but FileMetadataStore.SnapshotSeq was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+	}
+	mock.lockSnapshotSeq.Lock()
+	mock.calls.SnapshotSeq = append(mock.calls.SnapshotSeq, callInfo)
+	mock.lockSnapshotSeq.Unlock()
+	return mock.SnapshotSeqFunc(ctx, namespace)
+}
+
+// SnapshotSeqCalls gets all the calls that were made to SnapshotSeq.
+// Check the length with:
+//
+//	len(mockedFileMetadataStore.SnapshotSeqCalls())
+func (mock *FileMetadataStoreMock) SnapshotSeqCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+	}
+	mock.lockSnapshotSeq.RLock()
+	calls = mock.calls.SnapshotSeq
+	mock.lockSnapshotSeq.RUnlock()
+	return calls
+}
+
+// SnapshotWithCursor calls SnapshotWithCursorFunc.
+func (mock *FileMetadataStoreMock) SnapshotWithCursor(ctx context.Context, namespace string) (map[string]store.ObjectMetadata, store.Cursor, error) {
+	if mock.SnapshotWithCursorFunc == nil {
+		panic("FileMetadataStoreMock.SnapshotWithCursorFunc: method is nil but FileMetadataStore.SnapshotWithCursor was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+	}
+	mock.lockSnapshotWithCursor.Lock()
+	mock.calls.SnapshotWithCursor = append(mock.calls.SnapshotWithCursor, callInfo)
+	mock.lockSnapshotWithCursor.Unlock()
+	return mock.SnapshotWithCursorFunc(ctx, namespace)
+}
+
+// SnapshotWithCursorCalls gets all the calls that were made to SnapshotWithCursor.
+// Check the length with:
+//
+//	len(mockedFileMetadataStore.SnapshotWithCursorCalls())
+func (mock *FileMetadataStoreMock) SnapshotWithCursorCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+	}
+	mock.lockSnapshotWithCursor.RLock()
+	calls = mock.calls.SnapshotWithCursor
+	mock.lockSnapshotWithCursor.RUnlock()
+	return calls
+}
+
+// TreeNodes calls TreeNodesFunc.
+func (mock *FileMetadataStoreMock) TreeNodes(ctx context.Context, namespace string, prefixes []string) ([]*hashtree.Node, store.Cursor, error) {
+	if mock.TreeNodesFunc == nil {
+		panic("FileMetadataStoreMock.TreeNodesFunc: method is nil but FileMetadataStore.TreeNodes was just called")
 	}
 	callInfo := struct {
-		ContextMoqParam context.Context
+		Ctx       context.Context
+		Namespace string
+		Prefixes  []string
 	}{
-		ContextMoqParam: contextMoqParam,
+		Ctx:       ctx,
+		Namespace: namespace,
+		Prefixes:  prefixes,
 	}
-	mock.lockSnapshot.Lock()
-	mock.calls.Snapshot = append(mock.calls.Snapshot, callInfo)
-	mock.lockSnapshot.Unlock()
-	return mock.SnapshotFunc(contextMoqParam)
+	mock.lockTreeNodes.Lock()
+	mock.calls.TreeNodes = append(mock.calls.TreeNodes, callInfo)
+	mock.lockTreeNodes.Unlock()
+	return mock.TreeNodesFunc(ctx, namespace, prefixes)
 }
 
-// SnapshotCalls gets all the calls that were made to Snapshot.
+// TreeNodesCalls gets all the calls that were made to TreeNodes.
 // Check the length with:
 //
-//	len(mockedFileMetadataStore.SnapshotCalls())
-func (mock *FileMetadataStoreMock) SnapshotCalls() []struct {
-	ContextMoqParam context.Context
+//	len(mockedFileMetadataStore.TreeNodesCalls())
+func (mock *FileMetadataStoreMock) TreeNodesCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	Prefixes  []string
 } {
 	var calls []struct {
-		ContextMoqParam context.Context
+		Ctx       context.Context
+		Namespace string
+		Prefixes  []string
 	}
-	mock.lockSnapshot.RLock()
-	calls = mock.calls.Snapshot
-	mock.lockSnapshot.RUnlock()
+	mock.lockTreeNodes.RLock()
+	calls = mock.calls.TreeNodes
+	mock.lockTreeNodes.RUnlock()
 	return calls
 }
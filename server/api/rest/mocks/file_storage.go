@@ -15,7 +15,7 @@ import (
 //
 //		// make and configure a mocked rest.FileStorage
 //		mockedFileStorage := &FileStorageMock{
-//			PutObjectFunc: func(ctx context.Context, r io.Reader, objectID string) (string, int64, error) {
+//			PutObjectFunc: func(ctx context.Context, r io.Reader, objectID string, verify func(checksum string, written int64) error) (string, int64, error) {
 //				panic("mock out the PutObject method")
 //			},
 //		}
@@ -26,7 +26,7 @@ import (
 //	}
 type FileStorageMock struct {
 	// PutObjectFunc mocks the PutObject method.
-	PutObjectFunc func(ctx context.Context, r io.Reader, objectID string) (string, int64, error)
+	PutObjectFunc func(ctx context.Context, r io.Reader, objectID string, verify func(checksum string, written int64) error) (string, int64, error)
 
 	// calls tracks calls to the methods.
 	calls struct {
@@ -38,13 +38,15 @@ type FileStorageMock struct {
 			R io.Reader
 			// ObjectID is the objectID argument value.
 			ObjectID string
+			// Verify is the verify argument value.
+			Verify func(checksum string, written int64) error
 		}
 	}
 	lockPutObject sync.RWMutex
 }
 
 // PutObject calls PutObjectFunc.
-func (mock *FileStorageMock) PutObject(ctx context.Context, r io.Reader, objectID string) (string, int64, error) {
+func (mock *FileStorageMock) PutObject(ctx context.Context, r io.Reader, objectID string, verify func(checksum string, written int64) error) (string, int64, error) {
 	if mock.PutObjectFunc == nil {
 		panic("FileStorageMock.PutObjectFunc: method is nil but FileStorage.PutObject was just called")
 	}
@@ -52,15 +54,17 @@ func (mock *FileStorageMock) PutObject(ctx context.Context, r io.Reader, objectI
 		Ctx      context.Context
 		R        io.Reader
 		ObjectID string
+		Verify   func(checksum string, written int64) error
 	}{
 		Ctx:      ctx,
 		R:        r,
 		ObjectID: objectID,
+		Verify:   verify,
 	}
 	mock.lockPutObject.Lock()
 	mock.calls.PutObject = append(mock.calls.PutObject, callInfo)
 	mock.lockPutObject.Unlock()
-	return mock.PutObjectFunc(ctx, r, objectID)
+	return mock.PutObjectFunc(ctx, r, objectID, verify)
 }
 
 // PutObjectCalls gets all the calls that were made to PutObject.
@@ -71,11 +75,13 @@ func (mock *FileStorageMock) PutObjectCalls() []struct {
 	Ctx      context.Context
 	R        io.Reader
 	ObjectID string
+	Verify   func(checksum string, written int64) error
 } {
 	var calls []struct {
 		Ctx      context.Context
 		R        io.Reader
 		ObjectID string
+		Verify   func(checksum string, written int64) error
 	}
 	mock.lockPutObject.RLock()
 	calls = mock.calls.PutObject
@@ -0,0 +1,79 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hedisam/filesync/server/internal/scrub"
+)
+
+// ObjectCheckerMock is a mock implementation of rest.ObjectChecker.
+//
+//	func TestSomethingThatUsesObjectChecker(t *testing.T) {
+//
+//		// make and configure a mocked rest.ObjectChecker
+//		mockedObjectChecker := &ObjectCheckerMock{
+//			CheckFunc: func(ctx context.Context, opts scrub.CheckOptions) (*scrub.Report, error) {
+//				panic("mock out the Check method")
+//			},
+//		}
+//
+//		// use mockedObjectChecker in code that requires rest.ObjectChecker
+//		// and then make assertions.
+//
+//	}
+type ObjectCheckerMock struct {
+	// CheckFunc mocks the Check method.
+	CheckFunc func(ctx context.Context, opts scrub.CheckOptions) (*scrub.Report, error)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Check holds details about calls to the Check method.
+		Check []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Opts is the opts argument value.
+			Opts scrub.CheckOptions
+		}
+	}
+	lockCheck sync.RWMutex
+}
+
+// Check calls CheckFunc.
+func (mock *ObjectCheckerMock) Check(ctx context.Context, opts scrub.CheckOptions) (*scrub.Report, error) {
+	if mock.CheckFunc == nil {
+		panic("ObjectCheckerMock.CheckFunc: method is nil but ObjectChecker.Check was just called")
+	}
+	callInfo := struct {
+		Ctx  context.Context
+		Opts scrub.CheckOptions
+	}{
+		Ctx:  ctx,
+		Opts: opts,
+	}
+	mock.lockCheck.Lock()
+	mock.calls.Check = append(mock.calls.Check, callInfo)
+	mock.lockCheck.Unlock()
+	return mock.CheckFunc(ctx, opts)
+}
+
+// CheckCalls gets all the calls that were made to Check.
+// Check the length with:
+//
+//	len(mockedObjectChecker.CheckCalls())
+func (mock *ObjectCheckerMock) CheckCalls() []struct {
+	Ctx  context.Context
+	Opts scrub.CheckOptions
+} {
+	var calls []struct {
+		Ctx  context.Context
+		Opts scrub.CheckOptions
+	}
+	mock.lockCheck.RLock()
+	calls = mock.calls.Check
+	mock.lockCheck.RUnlock()
+	return calls
+}
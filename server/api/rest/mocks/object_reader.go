@@ -0,0 +1,78 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package mocks
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// ObjectReaderMock is a mock implementation of rest.ObjectReader.
+//
+//	func TestSomethingThatUsesObjectReader(t *testing.T) {
+//
+//		// make and configure a mocked rest.ObjectReader
+//		mockedObjectReader := &ObjectReaderMock{
+//			GetObjectFunc: func(ctx context.Context, objectID string) (io.ReadCloser, error) {
+//				panic("mock out the GetObject method")
+//			},
+//		}
+//
+//		// use mockedObjectReader in code that requires rest.ObjectReader
+//		// and then make assertions.
+//
+//	}
+type ObjectReaderMock struct {
+	// GetObjectFunc mocks the GetObject method.
+	GetObjectFunc func(ctx context.Context, objectID string) (io.ReadCloser, error)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// GetObject holds details about calls to the GetObject method.
+		GetObject []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ObjectID is the objectID argument value.
+			ObjectID string
+		}
+	}
+	lockGetObject sync.RWMutex
+}
+
+// GetObject calls GetObjectFunc.
+func (mock *ObjectReaderMock) GetObject(ctx context.Context, objectID string) (io.ReadCloser, error) {
+	if mock.GetObjectFunc == nil {
+		panic("ObjectReaderMock.GetObjectFunc: method is nil but ObjectReader.GetObject was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		ObjectID string
+	}{
+		Ctx:      ctx,
+		ObjectID: objectID,
+	}
+	mock.lockGetObject.Lock()
+	mock.calls.GetObject = append(mock.calls.GetObject, callInfo)
+	mock.lockGetObject.Unlock()
+	return mock.GetObjectFunc(ctx, objectID)
+}
+
+// GetObjectCalls gets all the calls that were made to GetObject.
+// Check the length with:
+//
+//	len(mockedObjectReader.GetObjectCalls())
+func (mock *ObjectReaderMock) GetObjectCalls() []struct {
+	Ctx      context.Context
+	ObjectID string
+} {
+	var calls []struct {
+		Ctx      context.Context
+		ObjectID string
+	}
+	mock.lockGetObject.RLock()
+	calls = mock.calls.GetObject
+	mock.lockGetObject.RUnlock()
+	return calls
+}
@@ -0,0 +1,135 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hedisam/filesync/server/internal/quota"
+)
+
+// QuotaMock is a mock implementation of rest.Quota.
+//
+//	func TestSomethingThatUsesQuota(t *testing.T) {
+//
+//		// make and configure a mocked rest.Quota
+//		mockedQuota := &QuotaMock{
+//			ReleaseFunc: func(r *quota.Reservation)  {
+//				panic("mock out the Release method")
+//			},
+//			ReserveFunc: func(ctx context.Context, namespace string, key string, size int64) (*quota.Reservation, error) {
+//				panic("mock out the Reserve method")
+//			},
+//		}
+//
+//		// use mockedQuota in code that requires rest.Quota
+//		// and then make assertions.
+//
+//	}
+type QuotaMock struct {
+	// ReleaseFunc mocks the Release method.
+	ReleaseFunc func(r *quota.Reservation)
+
+	// ReserveFunc mocks the Reserve method.
+	ReserveFunc func(ctx context.Context, namespace string, key string, size int64) (*quota.Reservation, error)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Release holds details about calls to the Release method.
+		Release []struct {
+			// R is the r argument value.
+			R *quota.Reservation
+		}
+		// Reserve holds details about calls to the Reserve method.
+		Reserve []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// Key is the key argument value.
+			Key string
+			// Size is the size argument value.
+			Size int64
+		}
+	}
+	lockRelease sync.RWMutex
+	lockReserve sync.RWMutex
+}
+
+// Release calls ReleaseFunc.
+func (mock *QuotaMock) Release(r *quota.Reservation) {
+	if mock.ReleaseFunc == nil {
+		panic("QuotaMock.ReleaseFunc: method is nil but Quota.Release was just called")
+	}
+	callInfo := struct {
+		R *quota.Reservation
+	}{
+		R: r,
+	}
+	mock.lockRelease.Lock()
+	mock.calls.Release = append(mock.calls.Release, callInfo)
+	mock.lockRelease.Unlock()
+	mock.ReleaseFunc(r)
+}
+
+// ReleaseCalls gets all the calls that were made to Release.
+// Check the length with:
+//
+//	len(mockedQuota.ReleaseCalls())
+func (mock *QuotaMock) ReleaseCalls() []struct {
+	R *quota.Reservation
+} {
+	var calls []struct {
+		R *quota.Reservation
+	}
+	mock.lockRelease.RLock()
+	calls = mock.calls.Release
+	mock.lockRelease.RUnlock()
+	return calls
+}
+
+// Reserve calls ReserveFunc.
+func (mock *QuotaMock) Reserve(ctx context.Context, namespace string, key string, size int64) (*quota.Reservation, error) {
+	if mock.ReserveFunc == nil {
+		panic("QuotaMock.ReserveFunc: method is nil but Quota.Reserve was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+		Size      int64
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+		Key:       key,
+		Size:      size,
+	}
+	mock.lockReserve.Lock()
+	mock.calls.Reserve = append(mock.calls.Reserve, callInfo)
+	mock.lockReserve.Unlock()
+	return mock.ReserveFunc(ctx, namespace, key, size)
+}
+
+// ReserveCalls gets all the calls that were made to Reserve.
+// Check the length with:
+//
+//	len(mockedQuota.ReserveCalls())
+func (mock *QuotaMock) ReserveCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	Key       string
+	Size      int64
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+		Size      int64
+	}
+	mock.lockReserve.RLock()
+	calls = mock.calls.Reserve
+	mock.lockReserve.RUnlock()
+	return calls
+}
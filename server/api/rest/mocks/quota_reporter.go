@@ -0,0 +1,123 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hedisam/filesync/server/internal/quota"
+)
+
+// QuotaReporterMock is a mock implementation of rest.QuotaReporter.
+//
+//	func TestSomethingThatUsesQuotaReporter(t *testing.T) {
+//
+//		// make and configure a mocked rest.QuotaReporter
+//		mockedQuotaReporter := &QuotaReporterMock{
+//			ReportFunc: func(ctx context.Context, namespace string) (*quota.Report, error) {
+//				panic("mock out the Report method")
+//			},
+//			ReportsFunc: func(ctx context.Context) ([]*quota.Report, error) {
+//				panic("mock out the Reports method")
+//			},
+//		}
+//
+//		// use mockedQuotaReporter in code that requires rest.QuotaReporter
+//		// and then make assertions.
+//
+//	}
+type QuotaReporterMock struct {
+	// ReportFunc mocks the Report method.
+	ReportFunc func(ctx context.Context, namespace string) (*quota.Report, error)
+
+	// ReportsFunc mocks the Reports method.
+	ReportsFunc func(ctx context.Context) ([]*quota.Report, error)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Report holds details about calls to the Report method.
+		Report []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+		}
+		// Reports holds details about calls to the Reports method.
+		Reports []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
+	}
+	lockReport  sync.RWMutex
+	lockReports sync.RWMutex
+}
+
+// Report calls ReportFunc.
+func (mock *QuotaReporterMock) Report(ctx context.Context, namespace string) (*quota.Report, error) {
+	if mock.ReportFunc == nil {
+		panic("QuotaReporterMock.ReportFunc: method is nil but QuotaReporter.Report was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+	}
+	mock.lockReport.Lock()
+	mock.calls.Report = append(mock.calls.Report, callInfo)
+	mock.lockReport.Unlock()
+	return mock.ReportFunc(ctx, namespace)
+}
+
+// ReportCalls gets all the calls that were made to Report.
+// Check the length with:
+//
+//	len(mockedQuotaReporter.ReportCalls())
+func (mock *QuotaReporterMock) ReportCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+	}
+	mock.lockReport.RLock()
+	calls = mock.calls.Report
+	mock.lockReport.RUnlock()
+	return calls
+}
+
+// Reports calls ReportsFunc.
+func (mock *QuotaReporterMock) Reports(ctx context.Context) ([]*quota.Report, error) {
+	if mock.ReportsFunc == nil {
+		panic("QuotaReporterMock.ReportsFunc: method is nil but QuotaReporter.Reports was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockReports.Lock()
+	mock.calls.Reports = append(mock.calls.Reports, callInfo)
+	mock.lockReports.Unlock()
+	return mock.ReportsFunc(ctx)
+}
+
+// ReportsCalls gets all the calls that were made to Reports.
+// Check the length with:
+//
+//	len(mockedQuotaReporter.ReportsCalls())
+func (mock *QuotaReporterMock) ReportsCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockReports.RLock()
+	calls = mock.calls.Reports
+	mock.lockReports.RUnlock()
+	return calls
+}
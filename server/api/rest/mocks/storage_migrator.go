@@ -0,0 +1,116 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hedisam/filesync/server/internal/blobstorage/filesystem"
+)
+
+// StorageMigratorMock is a mock implementation of rest.StorageMigrator.
+//
+//	func TestSomethingThatUsesStorageMigrator(t *testing.T) {
+//
+//		// make and configure a mocked rest.StorageMigrator
+//		mockedStorageMigrator := &StorageMigratorMock{
+//			MigrationStatusFunc: func() filesystem.MigrationStatus {
+//				panic("mock out the MigrationStatus method")
+//			},
+//			StartMigrationFunc: func(ctx context.Context, to filesystem.Layout) error {
+//				panic("mock out the StartMigration method")
+//			},
+//		}
+//
+//		// use mockedStorageMigrator in code that requires rest.StorageMigrator
+//		// and then make assertions.
+//
+//	}
+type StorageMigratorMock struct {
+	// MigrationStatusFunc mocks the MigrationStatus method.
+	MigrationStatusFunc func() filesystem.MigrationStatus
+
+	// StartMigrationFunc mocks the StartMigration method.
+	StartMigrationFunc func(ctx context.Context, to filesystem.Layout) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// MigrationStatus holds details about calls to the MigrationStatus method.
+		MigrationStatus []struct {
+		}
+		// StartMigration holds details about calls to the StartMigration method.
+		StartMigration []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// To is the to argument value.
+			To filesystem.Layout
+		}
+	}
+	lockMigrationStatus sync.RWMutex
+	lockStartMigration  sync.RWMutex
+}
+
+// MigrationStatus calls MigrationStatusFunc.
+func (mock *StorageMigratorMock) MigrationStatus() filesystem.MigrationStatus {
+	if mock.MigrationStatusFunc == nil {
+		panic("StorageMigratorMock.MigrationStatusFunc: method is nil but StorageMigrator.MigrationStatus was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockMigrationStatus.Lock()
+	mock.calls.MigrationStatus = append(mock.calls.MigrationStatus, callInfo)
+	mock.lockMigrationStatus.Unlock()
+	return mock.MigrationStatusFunc()
+}
+
+// MigrationStatusCalls gets all the calls that were made to MigrationStatus.
+// Check the length with:
+//
+//	len(mockedStorageMigrator.MigrationStatusCalls())
+func (mock *StorageMigratorMock) MigrationStatusCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockMigrationStatus.RLock()
+	calls = mock.calls.MigrationStatus
+	mock.lockMigrationStatus.RUnlock()
+	return calls
+}
+
+// StartMigration calls StartMigrationFunc.
+func (mock *StorageMigratorMock) StartMigration(ctx context.Context, to filesystem.Layout) error {
+	if mock.StartMigrationFunc == nil {
+		panic("StorageMigratorMock.StartMigrationFunc: method is nil but StorageMigrator.StartMigration was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		To  filesystem.Layout
+	}{
+		Ctx: ctx,
+		To:  to,
+	}
+	mock.lockStartMigration.Lock()
+	mock.calls.StartMigration = append(mock.calls.StartMigration, callInfo)
+	mock.lockStartMigration.Unlock()
+	return mock.StartMigrationFunc(ctx, to)
+}
+
+// StartMigrationCalls gets all the calls that were made to StartMigration.
+// Check the length with:
+//
+//	len(mockedStorageMigrator.StartMigrationCalls())
+func (mock *StorageMigratorMock) StartMigrationCalls() []struct {
+	Ctx context.Context
+	To  filesystem.Layout
+} {
+	var calls []struct {
+		Ctx context.Context
+		To  filesystem.Layout
+	}
+	mock.lockStartMigration.RLock()
+	calls = mock.calls.StartMigration
+	mock.lockStartMigration.RUnlock()
+	return calls
+}
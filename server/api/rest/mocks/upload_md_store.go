@@ -19,9 +19,18 @@ import (
 //			CreateFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
 //				panic("mock out the Create method")
 //			},
-//			PutObjectCompletedFunc: func(ctx context.Context, key string, objectID string) error {
+//			GetFunc: func(ctx context.Context, namespace string, key string) (*store.ObjectMetadata, error) {
+//				panic("mock out the Get method")
+//			},
+//			LinkObjectFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
+//				panic("mock out the LinkObject method")
+//			},
+//			PutObjectCompletedFunc: func(ctx context.Context, namespace string, key string, objectID string) error {
 //				panic("mock out the PutObjectCompleted method")
 //			},
+//			PutObjectFailedFunc: func(ctx context.Context, namespace string, key string, objectID string) error {
+//				panic("mock out the PutObjectFailed method")
+//			},
 //		}
 //
 //		// use mockedUploadMetadataStore in code that requires rest.UploadMetadataStore
@@ -32,8 +41,17 @@ type UploadMetadataStoreMock struct {
 	// CreateFunc mocks the Create method.
 	CreateFunc func(ctx context.Context, md *store.ObjectMetadata) error
 
+	// GetFunc mocks the Get method.
+	GetFunc func(ctx context.Context, namespace string, key string) (*store.ObjectMetadata, error)
+
+	// LinkObjectFunc mocks the LinkObject method.
+	LinkObjectFunc func(ctx context.Context, md *store.ObjectMetadata) error
+
 	// PutObjectCompletedFunc mocks the PutObjectCompleted method.
-	PutObjectCompletedFunc func(ctx context.Context, key string, objectID string) error
+	PutObjectCompletedFunc func(ctx context.Context, namespace string, key string, objectID string) error
+
+	// PutObjectFailedFunc mocks the PutObjectFailed method.
+	PutObjectFailedFunc func(ctx context.Context, namespace string, key string, objectID string) error
 
 	// calls tracks calls to the methods.
 	calls struct {
@@ -44,10 +62,39 @@ type UploadMetadataStoreMock struct {
 			// Md is the md argument value.
 			Md *store.ObjectMetadata
 		}
+		// Get holds details about calls to the Get method.
+		Get []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// Key is the key argument value.
+			Key string
+		}
+		// LinkObject holds details about calls to the LinkObject method.
+		LinkObject []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Md is the md argument value.
+			Md *store.ObjectMetadata
+		}
 		// PutObjectCompleted holds details about calls to the PutObjectCompleted method.
 		PutObjectCompleted []struct {
 			// Ctx is the ctx argument value.
 			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
+			// Key is the key argument value.
+			Key string
+			// ObjectID is the objectID argument value.
+			ObjectID string
+		}
+		// PutObjectFailed holds details about calls to the PutObjectFailed method.
+		PutObjectFailed []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Namespace is the namespace argument value.
+			Namespace string
 			// Key is the key argument value.
 			Key string
 			// ObjectID is the objectID argument value.
@@ -55,7 +102,10 @@ type UploadMetadataStoreMock struct {
 		}
 	}
 	lockCreate             sync.RWMutex
+	lockGet                sync.RWMutex
+	lockLinkObject         sync.RWMutex
 	lockPutObjectCompleted sync.RWMutex
+	lockPutObjectFailed    sync.RWMutex
 }
 
 // Create calls CreateFunc.
@@ -94,24 +144,102 @@ func (mock *UploadMetadataStoreMock) CreateCalls() []struct {
 	return calls
 }
 
+// Get calls GetFunc.
+func (mock *UploadMetadataStoreMock) Get(ctx context.Context, namespace string, key string) (*store.ObjectMetadata, error) {
+	if mock.GetFunc == nil {
+		panic("UploadMetadataStoreMock.GetFunc: method is nil but UploadMetadataStore.Get was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+		Key:       key,
+	}
+	mock.lockGet.Lock()
+	mock.calls.Get = append(mock.calls.Get, callInfo)
+	mock.lockGet.Unlock()
+	return mock.GetFunc(ctx, namespace, key)
+}
+
+// GetCalls gets all the calls that were made to Get.
+// Check the length with:
+//
+//	len(mockedUploadMetadataStore.GetCalls())
+func (mock *UploadMetadataStoreMock) GetCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	Key       string
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+	}
+	mock.lockGet.RLock()
+	calls = mock.calls.Get
+	mock.lockGet.RUnlock()
+	return calls
+}
+
+// LinkObject calls LinkObjectFunc.
+func (mock *UploadMetadataStoreMock) LinkObject(ctx context.Context, md *store.ObjectMetadata) error {
+	if mock.LinkObjectFunc == nil {
+		panic("UploadMetadataStoreMock.LinkObjectFunc: method is nil but UploadMetadataStore.LinkObject was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		Md  *store.ObjectMetadata
+	}{
+		Ctx: ctx,
+		Md:  md,
+	}
+	mock.lockLinkObject.Lock()
+	mock.calls.LinkObject = append(mock.calls.LinkObject, callInfo)
+	mock.lockLinkObject.Unlock()
+	return mock.LinkObjectFunc(ctx, md)
+}
+
+// LinkObjectCalls gets all the calls that were made to LinkObject.
+// Check the length with:
+//
+//	len(mockedUploadMetadataStore.LinkObjectCalls())
+func (mock *UploadMetadataStoreMock) LinkObjectCalls() []struct {
+	Ctx context.Context
+	Md  *store.ObjectMetadata
+} {
+	var calls []struct {
+		Ctx context.Context
+		Md  *store.ObjectMetadata
+	}
+	mock.lockLinkObject.RLock()
+	calls = mock.calls.LinkObject
+	mock.lockLinkObject.RUnlock()
+	return calls
+}
+
 // PutObjectCompleted calls PutObjectCompletedFunc.
-func (mock *UploadMetadataStoreMock) PutObjectCompleted(ctx context.Context, key string, objectID string) error {
+func (mock *UploadMetadataStoreMock) PutObjectCompleted(ctx context.Context, namespace string, key string, objectID string) error {
 	if mock.PutObjectCompletedFunc == nil {
 		panic("UploadMetadataStoreMock.PutObjectCompletedFunc: method is nil but UploadMetadataStore.PutObjectCompleted was just called")
 	}
 	callInfo := struct {
-		Ctx      context.Context
-		Key      string
-		ObjectID string
+		Ctx       context.Context
+		Namespace string
+		Key       string
+		ObjectID  string
 	}{
-		Ctx:      ctx,
-		Key:      key,
-		ObjectID: objectID,
+		Ctx:       ctx,
+		Namespace: namespace,
+		Key:       key,
+		ObjectID:  objectID,
 	}
 	mock.lockPutObjectCompleted.Lock()
 	mock.calls.PutObjectCompleted = append(mock.calls.PutObjectCompleted, callInfo)
 	mock.lockPutObjectCompleted.Unlock()
-	return mock.PutObjectCompletedFunc(ctx, key, objectID)
+	return mock.PutObjectCompletedFunc(ctx, namespace, key, objectID)
 }
 
 // PutObjectCompletedCalls gets all the calls that were made to PutObjectCompleted.
@@ -119,17 +247,63 @@ func (mock *UploadMetadataStoreMock) PutObjectCompleted(ctx context.Context, key
 //
 //	len(mockedUploadMetadataStore.PutObjectCompletedCalls())
 func (mock *UploadMetadataStoreMock) PutObjectCompletedCalls() []struct {
-	Ctx      context.Context
-	Key      string
-	ObjectID string
+	Ctx       context.Context
+	Namespace string
+	Key       string
+	ObjectID  string
 } {
 	var calls []struct {
-		Ctx      context.Context
-		Key      string
-		ObjectID string
+		Ctx       context.Context
+		Namespace string
+		Key       string
+		ObjectID  string
 	}
 	mock.lockPutObjectCompleted.RLock()
 	calls = mock.calls.PutObjectCompleted
 	mock.lockPutObjectCompleted.RUnlock()
 	return calls
 }
+
+// PutObjectFailed calls PutObjectFailedFunc.
+func (mock *UploadMetadataStoreMock) PutObjectFailed(ctx context.Context, namespace string, key string, objectID string) error {
+	if mock.PutObjectFailedFunc == nil {
+		panic("UploadMetadataStoreMock.PutObjectFailedFunc: method is nil but UploadMetadataStore.PutObjectFailed was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+		ObjectID  string
+	}{
+		Ctx:       ctx,
+		Namespace: namespace,
+		Key:       key,
+		ObjectID:  objectID,
+	}
+	mock.lockPutObjectFailed.Lock()
+	mock.calls.PutObjectFailed = append(mock.calls.PutObjectFailed, callInfo)
+	mock.lockPutObjectFailed.Unlock()
+	return mock.PutObjectFailedFunc(ctx, namespace, key, objectID)
+}
+
+// PutObjectFailedCalls gets all the calls that were made to PutObjectFailed.
+// Check the length with:
+//
+//	len(mockedUploadMetadataStore.PutObjectFailedCalls())
+func (mock *UploadMetadataStoreMock) PutObjectFailedCalls() []struct {
+	Ctx       context.Context
+	Namespace string
+	Key       string
+	ObjectID  string
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Namespace string
+		Key       string
+		ObjectID  string
+	}
+	mock.lockPutObjectFailed.RLock()
+	calls = mock.calls.PutObjectFailed
+	mock.lockPutObjectFailed.RUnlock()
+	return calls
+}
@@ -0,0 +1,88 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/quota"
+)
+
+type QuotaReporter interface {
+	Reports(ctx context.Context) ([]*quota.Report, error)
+	Report(ctx context.Context, namespace string) (*quota.Report, error)
+}
+
+// QuotaServer reports the storage limits and consumption of namespaces.
+type QuotaServer struct {
+	logger   *logrus.Logger
+	reporter QuotaReporter
+}
+
+func NewQuotaServer(logger *logrus.Logger, reporter QuotaReporter) *QuotaServer {
+	return &QuotaServer{
+		logger:   logger,
+		reporter: reporter,
+	}
+}
+
+// GetQuotas returns the quota report of the requested namespace, or of every known namespace if none is specified.
+func (s *QuotaServer) GetQuotas(ctx context.Context, req *GetQuotasRequest) (*GetQuotasResponse, error) {
+	logger := s.logger.WithContext(ctx).WithField("namespace", req.Namespace)
+
+	var reports []*quota.Report
+	if req.Namespace != "" {
+		report, err := s.reporter.Report(ctx, req.Namespace)
+		if err != nil {
+			logger.WithError(err).Error("Failed to get namespace quota report")
+			return nil, NewErrf(http.StatusInternalServerError, "get quota report: %v", err)
+		}
+		reports = append(reports, report)
+	} else {
+		var err error
+		reports, err = s.reporter.Reports(ctx)
+		if err != nil {
+			logger.WithError(err).Error("Failed to get quota reports")
+			return nil, NewErrf(http.StatusInternalServerError, "get quota reports: %v", err)
+		}
+	}
+
+	resp := &GetQuotasResponse{
+		Namespaces: make([]*NamespaceQuota, 0, len(reports)),
+	}
+	for report := range slices.Values(reports) {
+		resp.Namespaces = append(resp.Namespaces, &NamespaceQuota{
+			Namespace:       report.Namespace,
+			MaxBytes:        report.Limits.MaxBytes,
+			MaxObjects:      report.Limits.MaxObjects,
+			MaxObjectSize:   report.Limits.MaxObjectSize,
+			UsedBytes:       report.Usage.Bytes,
+			UsedObjects:     report.Usage.Objects,
+			ReservedBytes:   report.Reserved.Bytes,
+			ReservedObjects: report.Reserved.Objects,
+		})
+	}
+
+	return resp, nil
+}
+
+type NamespaceQuota struct {
+	Namespace       string `json:"namespace"`
+	MaxBytes        int64  `json:"max_bytes"`
+	MaxObjects      int64  `json:"max_objects"`
+	MaxObjectSize   int64  `json:"max_object_size"`
+	UsedBytes       int64  `json:"used_bytes"`
+	UsedObjects     int64  `json:"used_objects"`
+	ReservedBytes   int64  `json:"reserved_bytes"`
+	ReservedObjects int64  `json:"reserved_objects"`
+}
+
+type GetQuotasRequest struct {
+	Namespace string `json:"namespace"`
+}
+
+type GetQuotasResponse struct {
+	Namespaces []*NamespaceQuota `json:"namespaces"`
+}
@@ -0,0 +1,91 @@
+package rest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	restapi "github.com/hedisam/filesync/server/api/rest"
+	"github.com/hedisam/filesync/server/api/rest/mocks"
+	"github.com/hedisam/filesync/server/internal/quota"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+//go:generate moq -out mocks/quota_reporter.go -pkg mocks -skip-ensure . QuotaReporter
+
+func TestGetQuotas(t *testing.T) {
+	docsReport := &quota.Report{
+		Namespace: "docs",
+		Limits:    quota.Limits{MaxBytes: 100, MaxObjects: 10, MaxObjectSize: 50},
+		Usage:     store.Usage{Bytes: 40, Objects: 4},
+		Reserved:  store.Usage{Bytes: 5, Objects: 1},
+	}
+	docsQuota := &restapi.NamespaceQuota{
+		Namespace:       "docs",
+		MaxBytes:        100,
+		MaxObjects:      10,
+		MaxObjectSize:   50,
+		UsedBytes:       40,
+		UsedObjects:     4,
+		ReservedBytes:   5,
+		ReservedObjects: 1,
+	}
+
+	tests := map[string]struct {
+		req       *restapi.GetQuotasRequest
+		reportErr error
+
+		expectedResp *restapi.GetQuotasResponse
+		expectedErr  *restapi.Err
+	}{
+		"all namespaces": {
+			req: &restapi.GetQuotasRequest{},
+			expectedResp: &restapi.GetQuotasResponse{
+				Namespaces: []*restapi.NamespaceQuota{docsQuota, {Namespace: store.DefaultNamespace}},
+			},
+		},
+		"single namespace": {
+			req: &restapi.GetQuotasRequest{Namespace: "docs"},
+			expectedResp: &restapi.GetQuotasResponse{
+				Namespaces: []*restapi.NamespaceQuota{docsQuota},
+			},
+		},
+		"reporter fails": {
+			req:       &restapi.GetQuotasRequest{Namespace: "docs"},
+			reportErr: errors.New("boom"),
+			expectedErr: &restapi.Err{
+				Message: "get quota report: boom",
+				Status:  http.StatusInternalServerError,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			reporter := &mocks.QuotaReporterMock{
+				ReportFunc: func(ctx context.Context, namespace string) (*quota.Report, error) {
+					assert.Equal(t, tc.req.Namespace, namespace)
+					return docsReport, tc.reportErr
+				},
+				ReportsFunc: func(ctx context.Context) ([]*quota.Report, error) {
+					return []*quota.Report{docsReport, {Namespace: store.DefaultNamespace}}, nil
+				},
+			}
+
+			s := restapi.NewQuotaServer(logrus.New(), reporter)
+			resp, err := s.GetQuotas(context.Background(), tc.req)
+			if tc.expectedErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedResp, resp)
+		})
+	}
+}
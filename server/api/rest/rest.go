@@ -51,6 +51,15 @@ func RegisterFunc[Req any, Resp any](logger *logrus.Logger, mux Mux, method, end
 	mux.HandleFunc(pattern, FuncAdapter(logger, f, pathParamKeys...))
 }
 
+// header returns the first value of the given request header, which FuncAdapter puts in the context of a Func.
+func header(ctx context.Context, name string) string {
+	values, _ := ctx.Value(http.CanonicalHeaderKey(name)).([]string)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
 // FuncAdapter accepts a server Func and returns a http.HandlerFunc that can be used for API endpoint registration.
 // This saves us from explicitly writing http responses or errors each time we need to terminate or return from the
 // function. It gives us the ability to simply return a response and error, just like gRPC server methods.
@@ -0,0 +1,99 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/scrub"
+)
+
+type ObjectChecker interface {
+	Check(ctx context.Context, opts scrub.CheckOptions) (*scrub.Report, error)
+}
+
+// ScrubServer implements the operator endpoints checking the integrity of the stored objects. It must only be
+// registered behind WithBearerToken.
+type ScrubServer struct {
+	logger  *logrus.Logger
+	checker ObjectChecker
+}
+
+func NewScrubServer(logger *logrus.Logger, checker ObjectChecker) *ScrubServer {
+	return &ScrubServer{
+		logger:  logger,
+		checker: checker,
+	}
+}
+
+// Fsck checks that the object of every completed object metadata is still stored and, if requested, still matches
+// its checksum. It also reports the stored objects no metadata references. The check runs while the request is
+// served, at the rate limit of the background scrubber when verifying.
+func (s *ScrubServer) Fsck(ctx context.Context, req *FsckRequest) (*FsckResponse, error) {
+	logger := s.logger.WithContext(ctx).WithField("verify", req.Verify)
+
+	report, err := s.checker.Check(ctx, scrub.CheckOptions{Verify: req.Verify, Orphans: true})
+	if err != nil {
+		if errors.Is(err, scrub.ErrListingUnsupported) {
+			return nil, NewErrf(http.StatusNotImplemented, "%v", err)
+		}
+		logger.WithError(err).Error("Failed to check stored objects")
+		return nil, NewErrf(http.StatusInternalServerError, "check stored objects: %v", err)
+	}
+	logger.WithFields(logrus.Fields{
+		"checked": report.Checked,
+		"corrupt": len(report.Corrupt),
+		"missing": len(report.Missing),
+		"orphans": len(report.Orphans),
+	}).Info("Checked stored objects")
+
+	return &FsckResponse{
+		Checked:       report.Checked,
+		Verified:      report.Verified,
+		VerifiedBytes: report.VerifiedBytes,
+		Corrupt:       newFsckProblems(report.Corrupt),
+		Missing:       newFsckProblems(report.Missing),
+		Failed:        newFsckProblems(report.Failed),
+		Orphans:       report.Orphans,
+		Took:          report.FinishedAt.Sub(report.StartedAt).String(),
+	}, nil
+}
+
+func newFsckProblems(problems []scrub.Problem) []FsckProblem {
+	result := make([]FsckProblem, 0, len(problems))
+	for p := range slices.Values(problems) {
+		result = append(result, FsckProblem{
+			Namespace: p.Namespace,
+			Key:       p.Key,
+			ObjectID:  p.ObjectID,
+			Error:     p.Err.Error(),
+		})
+	}
+	return result
+}
+
+type FsckRequest struct {
+	// Verify re-hashes the stored objects rather than only checking they exist.
+	Verify bool `json:"verify"`
+}
+
+type FsckResponse struct {
+	Checked       int64         `json:"checked"`
+	Verified      int64         `json:"verified"`
+	VerifiedBytes int64         `json:"verified_bytes"`
+	Corrupt       []FsckProblem `json:"corrupt"`
+	Missing       []FsckProblem `json:"missing"`
+	Failed        []FsckProblem `json:"failed"`
+	Orphans       []string      `json:"orphans"`
+	Took          string        `json:"took"`
+}
+
+type FsckProblem struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	ObjectID  string `json:"object_id"`
+	Error     string `json:"error"`
+}
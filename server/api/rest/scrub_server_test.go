@@ -0,0 +1,100 @@
+package rest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	restapi "github.com/hedisam/filesync/server/api/rest"
+	"github.com/hedisam/filesync/server/api/rest/mocks"
+	"github.com/hedisam/filesync/server/internal/scrub"
+)
+
+//go:generate moq -out mocks/object_checker.go -pkg mocks -skip-ensure . ObjectChecker
+
+func TestFsck(t *testing.T) {
+	startedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	report := &scrub.Report{
+		StartedAt:     startedAt,
+		FinishedAt:    startedAt.Add(2 * time.Second),
+		Checked:       3,
+		Verified:      2,
+		VerifiedBytes: 22,
+		Corrupt: []scrub.Problem{
+			{Namespace: "default", Key: "a.txt", ObjectID: "a", Err: errors.New("checksum mismatch")},
+		},
+		Missing: []scrub.Problem{
+			{Namespace: "docs", Key: "b.txt", ObjectID: "b", Err: errors.New("object not found in storage")},
+		},
+		Orphans: []string{"c"},
+	}
+
+	tests := map[string]struct {
+		req      *restapi.FsckRequest
+		checkErr error
+
+		expectedResp *restapi.FsckResponse
+		expectedErr  *restapi.Err
+	}{
+		"report": {
+			req: &restapi.FsckRequest{Verify: true},
+			expectedResp: &restapi.FsckResponse{
+				Checked:       3,
+				Verified:      2,
+				VerifiedBytes: 22,
+				Corrupt:       []restapi.FsckProblem{{Namespace: "default", Key: "a.txt", ObjectID: "a", Error: "checksum mismatch"}},
+				Missing:       []restapi.FsckProblem{{Namespace: "docs", Key: "b.txt", ObjectID: "b", Error: "object not found in storage"}},
+				Failed:        []restapi.FsckProblem{},
+				Orphans:       []string{"c"},
+				Took:          "2s",
+			},
+		},
+		"listing unsupported": {
+			req:      &restapi.FsckRequest{},
+			checkErr: scrub.ErrListingUnsupported,
+			expectedErr: &restapi.Err{
+				Message: "the storage backend can't list its objects",
+				Status:  http.StatusNotImplemented,
+			},
+		},
+		"check failure": {
+			req:      &restapi.FsckRequest{},
+			checkErr: fmt.Errorf("list namespaces: %w", errors.New("boom")),
+			expectedErr: &restapi.Err{
+				Message: "check stored objects: list namespaces: boom",
+				Status:  http.StatusInternalServerError,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			checker := &mocks.ObjectCheckerMock{
+				CheckFunc: func(ctx context.Context, opts scrub.CheckOptions) (*scrub.Report, error) {
+					assert.Equal(t, scrub.CheckOptions{Verify: tc.req.Verify, Orphans: true}, opts)
+					if tc.checkErr != nil {
+						return nil, tc.checkErr
+					}
+					return report, nil
+				},
+			}
+
+			s := restapi.NewScrubServer(logrus.New(), checker)
+			resp, err := s.Fsck(context.Background(), tc.req)
+			if tc.expectedErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedResp, resp)
+		})
+	}
+}
@@ -1,32 +1,54 @@
 package rest
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 
+	"github.com/hedisam/filesync/lib/compression"
 	"github.com/hedisam/filesync/lib/psurls"
+	"github.com/hedisam/filesync/server/internal/quota"
 	"github.com/hedisam/filesync/server/internal/store"
 )
 
+var (
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errSizeMismatch     = errors.New("size mismatch")
+	errInvalidEncoding  = errors.New("invalid content encoding")
+)
+
 type Auth interface {
 	GetSecretKeyByID(keyID string) (string, bool)
 }
 
 type FileStorage interface {
-	PutObject(ctx context.Context, r io.Reader, objectID string) (checksum string, written int64, err error)
+	PutObject(ctx context.Context, r io.Reader, objectID string, verify func(checksum string, written int64) error) (checksum string, written int64, err error)
 }
 
 type UploadMetadataStore interface {
 	Create(ctx context.Context, md *store.ObjectMetadata) error
-	PutObjectCompleted(ctx context.Context, key, objectID string) error
+	PutObjectCompleted(ctx context.Context, namespace, key, objectID string) error
+	PutObjectFailed(ctx context.Context, namespace, key, objectID string) error
+	LinkObject(ctx context.Context, md *store.ObjectMetadata) error
+	Get(ctx context.Context, namespace, key string) (*store.ObjectMetadata, error)
+}
+
+type Quota interface {
+	Reserve(ctx context.Context, namespace, key string, size int64) (*quota.Reservation, error)
+	Release(r *quota.Reservation)
 }
 
 type UploadServer struct {
@@ -34,34 +56,332 @@ type UploadServer struct {
 	fileStorage FileStorage
 	mdStore     UploadMetadataStore
 	auth        Auth
+	quota       Quota
+
+	contentAddressed  bool
+	encryptionKeyID   string
+	compressionPolicy *compression.Policy
+}
+
+type UploadServerOption func(*UploadServer)
+
+// WithQuota makes the UploadServer reserve storage from the given Quota before accepting any upload.
+func WithQuota(q Quota) UploadServerOption {
+	return func(s *UploadServer) {
+		s.quota = q
+	}
+}
+
+// WithContentAddressing makes the UploadServer store objects under their sha256 checksum so identical content is
+// stored only once, no matter how many keys reference it.
+func WithContentAddressing() UploadServerOption {
+	return func(s *UploadServer) {
+		s.contentAddressed = true
+	}
 }
 
-func NewUploadServer(logger *logrus.Logger, fileStorage FileStorage, mdStore UploadMetadataStore, auth Auth) *UploadServer {
-	return &UploadServer{
+// WithEncryptionKeyID records the ID of the master key the file storage encrypts new objects with in their metadata.
+func WithEncryptionKeyID(keyID string) UploadServerOption {
+	return func(s *UploadServer) {
+		s.encryptionKeyID = keyID
+	}
+}
+
+// WithCompressionPolicy makes the UploadServer compress the objects chosen by the given policy before storing them.
+// Content-addressed objects are chosen by their content only, as they're stored once whatever the keys referencing
+// them, so their extensions are ignored.
+func WithCompressionPolicy(p *compression.Policy) UploadServerOption {
+	return func(s *UploadServer) {
+		s.compressionPolicy = p
+	}
+}
+
+func NewUploadServer(logger *logrus.Logger, fileStorage FileStorage, mdStore UploadMetadataStore, auth Auth, opts ...UploadServerOption) *UploadServer {
+	s := &UploadServer{
 		logger:      logger,
 		fileStorage: fileStorage,
 		mdStore:     mdStore,
 		auth:        auth,
 	}
+	for opt := range slices.Values(opts) {
+		opt(s)
+	}
+	return s
 }
 
+// UploadFile accepts a presigned upload url and stores the request body as the file's content. The body can be
+// compressed with any of the supported Content-Encodings; the checksum and size in the url are the ones of the
+// decompressed content. An upload conditioned on a version of the file it doesn't have is rejected with 412, and a
+// successful one responds with the entity tag of the version it creates.
 func (s *UploadServer) UploadFile(w http.ResponseWriter, r *http.Request) {
-	logger := s.logger.WithContext(r.Context())
+	urlData, logger, ok := validatePresignedURL(s.logger, s.auth, w, r, psurls.OpUpload)
+	if !ok {
+		return
+	}
+
+	encoding, err := compression.ParseEncoding(r.Header.Get("Content-Encoding"))
+	if err != nil {
+		logger.WithError(err).Warn("Unsupported Content-Encoding while uploading file")
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if encoding == compression.Identity && r.ContentLength != -1 && r.ContentLength != urlData.Size {
+		// fail early if Content-Length doesn't match the size value in the
+		// presigned url; no point in wasting resources on an invalid request
+		logger.WithFields(logrus.Fields{
+			"content_length": r.ContentLength,
+			"size":           urlData.Size,
+		}).Warn("Mismatched Content-Length with presigned url size while uploading file")
+		http.Error(w, "mismatched Content-Length and size", http.StatusBadRequest)
+		return
+	}
+
+	release, ok := s.reserveQuota(w, r, logger, urlData)
+	if !ok {
+		return
+	}
+	defer release()
+
+	md := newObjectMetadata(urlData, mustUUIDV7())
+	md.ExpiresAt = time.Unix(urlData.Expiry, 0).UTC()
+	md.EncryptionKeyID = s.encryptionKeyID
+	if s.contentAddressed {
+		if !isSHA256Hex(urlData.SHA256Checksum) {
+			logger.Warn("Invalid sha256 checksum provided for content-addressed upload")
+			http.Error(w, "invalid sha256 checksum", http.StatusBadRequest)
+			return
+		}
+		md.ObjectID = urlData.SHA256Checksum
+
+		// no need to store the same content twice; reference the existing object without reading the body
+		if s.linkUpload(w, r, logger, md) {
+			return
+		}
+	}
+	logger = logger.WithField("object_id", md.ObjectID)
+
+	content, err := compression.NewReader(r.Body, encoding)
+	if err != nil {
+		logger.WithError(err).Warn("Invalid compressed body while uploading file")
+		http.Error(w, fmt.Sprintf("invalid %s body", encoding), http.StatusBadRequest)
+		return
+	}
+	defer content.Close()
+	if encoding != compression.Identity {
+		// a compressed body can expand to anything; reading a byte past the expected size is enough to reject it
+		content = io.NopCloser(&errorTaggingReader{r: io.LimitReader(content, urlData.Size+1), tag: errInvalidEncoding})
+	}
+
+	stored, storedEncoding, err := s.chooseEncoding(content, urlData)
+	if errors.Is(err, errInvalidEncoding) {
+		logger.WithError(err).Warn("Failed to decompress uploaded file")
+		http.Error(w, fmt.Sprintf("invalid %s body", encoding), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to choose the encoding to store the file with")
+		http.Error(w, fmt.Sprintf("could not choose the encoding to store the file with: %q", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	md.ContentEncoding = string(storedEncoding)
+
+	err = s.mdStore.Create(r.Context(), md)
+	if errors.Is(err, store.ErrObjectDeleting) {
+		// the stored content is being deleted; store this copy under its own object ID so it isn't deleted with it
+		logger.Debug("Content is being deleted, storing it under a new object ID")
+		md.ObjectID = mustUUIDV7()
+		logger = logger.WithField("object_id", md.ObjectID)
+		err = s.mdStore.Create(r.Context(), md)
+	}
+	if errors.Is(err, store.ErrObjectStored) {
+		// stored by another upload of the same content meanwhile, which mustn't be stored over
+		if !s.linkUpload(w, r, logger, md) {
+			logger.Error("Failed to link object metadata to content stored meanwhile")
+			http.Error(w, "could not link object metadata to content stored meanwhile", http.StatusInternalServerError)
+		}
+		return
+	}
+	if errors.Is(err, store.ErrPreconditionFailed) {
+		rejectStaleUpload(w, logger, err)
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to create object metadata in store")
+		http.Error(w, fmt.Sprintf("could not create object metadata in store: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		// don't leave the inflight metadata behind; the request context could be already canceled at this point.
+		err := s.mdStore.PutObjectFailed(context.WithoutCancel(r.Context()), md.Namespace, md.Key, md.ObjectID)
+		if err != nil {
+			logger.WithError(err).Error("Failed to remove inflight object metadata of failed upload")
+		}
+	}()
+
+	// the object is only stored under its final name if the uploaded content matches the presigned url
+	verify := func(checksum string, written int64) error {
+		if urlData.SHA256Checksum != checksum {
+			return errChecksumMismatch
+		}
+		if urlData.Size != written {
+			return fmt.Errorf("%w: want %d, got %d", errSizeMismatch, urlData.Size, written)
+		}
+		return nil
+	}
+	if storedEncoding != compression.Identity {
+		// the storage only sees the compressed content, so verify the content as it was uploaded instead
+		digest := &countingHash{Hash: sha256.New()}
+		rc := compression.Compress(io.TeeReader(stored, digest), storedEncoding)
+		defer rc.Close()
+		stored = rc
+		verifyContent := verify
+		verify = func(string, int64) error {
+			return verifyContent(hex.EncodeToString(digest.Sum(nil)), digest.n)
+		}
+	}
+	_, _, err = s.fileStorage.PutObject(r.Context(), stored, md.ObjectID, verify)
+	if err != nil {
+		switch {
+		case errors.Is(err, errChecksumMismatch):
+			logger.Warn("Provided checksum did not match what was uploaded")
+			http.Error(w, "provided checksum did not match what was uploaded", http.StatusBadRequest)
+		case errors.Is(err, errSizeMismatch):
+			logger.WithError(err).Warn("Provided file size did not match what was uploaded")
+			http.Error(w, "provided file size did not match what was uploaded", http.StatusBadRequest)
+		case errors.Is(err, errInvalidEncoding):
+			logger.WithError(err).Warn("Failed to decompress uploaded file")
+			http.Error(w, fmt.Sprintf("invalid %s body", encoding), http.StatusBadRequest)
+		default:
+			logger.WithError(err).Warn("Failed to save file to storage")
+			http.Error(w, fmt.Sprintf("failed to save file to storage: %q", err.Error()), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = s.mdStore.PutObjectCompleted(r.Context(), md.Namespace, md.Key, md.ObjectID)
+	if errors.Is(err, store.ErrPreconditionFailed) {
+		// changed while the content was uploaded
+		rejectStaleUpload(w, logger, err)
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to mark object metadata as completed when uploading file")
+		http.Error(w, fmt.Sprintf("failed to mark object metadata as completed when uploading file: %q", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	completed = true
+
+	s.setETag(r.Context(), w, md)
+	w.WriteHeader(http.StatusCreated)
+	logger.Debug("Successfully uploaded file to storage")
+}
+
+// linkUpload creates the object of the given upload by referencing its content, which is stored already, and writes
+// the response. It reports false, writing nothing, if the content isn't stored so it has to be uploaded.
+func (s *UploadServer) linkUpload(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, md *store.ObjectMetadata) bool {
+	err := s.mdStore.LinkObject(r.Context(), md)
+	switch {
+	case err == nil:
+		s.setETag(r.Context(), w, md)
+		w.WriteHeader(http.StatusCreated)
+		logger.Debug("Linked uploaded file to existing content")
+	case errors.Is(err, store.ErrNotFound):
+		return false
+	case errors.Is(err, store.ErrPreconditionFailed):
+		rejectStaleUpload(w, logger, err)
+	default:
+		logger.WithError(err).Error("Failed to link object metadata to existing content")
+		http.Error(w, fmt.Sprintf("could not link object metadata to existing content: %q", err.Error()), http.StatusInternalServerError)
+	}
+	return true
+}
+
+// LinkFile accepts the same presigned url as UploadFile, without a body, and creates the object by referencing
+// content that is already stored. It responds with 404 if the content is not stored so the client can upload it
+// instead, and with 501 if the server is not storing content-addressed objects.
+func (s *UploadServer) LinkFile(w http.ResponseWriter, r *http.Request) {
+	urlData, logger, ok := validatePresignedURL(s.logger, s.auth, w, r, psurls.OpUpload)
+	if !ok {
+		return
+	}
+
+	if !s.contentAddressed {
+		http.Error(w, "content-addressed storage is not enabled", http.StatusNotImplemented)
+		return
+	}
+	if !isSHA256Hex(urlData.SHA256Checksum) {
+		logger.Warn("Invalid sha256 checksum provided for linking file")
+		http.Error(w, "invalid sha256 checksum", http.StatusBadRequest)
+		return
+	}
+
+	release, ok := s.reserveQuota(w, r, logger, urlData)
+	if !ok {
+		return
+	}
+	defer release()
+
+	md := newObjectMetadata(urlData, urlData.SHA256Checksum)
+	md.Attribution.Operation = store.OpLink
+	err := s.mdStore.LinkObject(r.Context(), md)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "content not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, store.ErrPreconditionFailed) {
+			rejectStaleUpload(w, logger, err)
+			return
+		}
+		logger.WithError(err).Error("Failed to link object metadata to existing content")
+		http.Error(w, fmt.Sprintf("could not link object metadata to existing content: %q", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	s.setETag(r.Context(), w, md)
+	w.WriteHeader(http.StatusCreated)
+	logger.Debug("Linked file to existing content")
+}
+
+// setETag sets the entity tag of the version the given object was stored at on the response, unless the key has been
+// given another object since, whose version the uploader must not take for the one it's created.
+func (s *UploadServer) setETag(ctx context.Context, w http.ResponseWriter, md *store.ObjectMetadata) {
+	object, err := s.mdStore.Get(ctx, md.Namespace, md.Key)
+	if err != nil || object.ObjectID != md.ObjectID {
+		return
+	}
+	w.Header().Set("ETag", formatETag(object.Version))
+}
+
+// rejectStaleUpload responds to an upload conditioned on a version of the file it doesn't have.
+func rejectStaleUpload(w http.ResponseWriter, logger *logrus.Entry, err error) {
+	logger.WithError(err).Info("Rejected upload of a file changed since")
+	http.Error(w, "file is not at the expected version", http.StatusPreconditionFailed)
+}
+
+// validatePresignedURL authorises the request and validates its presigned url, which must grant the given operation.
+// It writes the error response and returns false if the request cannot be accepted.
+func validatePresignedURL(log *logrus.Logger, auth Auth, w http.ResponseWriter, r *http.Request, op string) (psurls.URLData, *logrus.Entry, bool) {
+	logger := log.WithContext(r.Context())
 
 	rawURL := r.URL.String()
 	u, err := url.Parse(rawURL)
 	if err != nil {
 		logger.WithField("url", rawURL).Warn("Failed to parse url when uploading file")
 		http.Error(w, "could not parse url", http.StatusBadRequest)
-		return
+		return psurls.URLData{}, nil, false
 	}
 
 	accessKeyID := u.Query().Get(psurls.AccessKeyID)
-	secretKey, ok := s.auth.GetSecretKeyByID(accessKeyID)
+	secretKey, ok := auth.GetSecretKeyByID(accessKeyID)
 	if !ok {
 		logger.WithField("access_key_id", accessKeyID).Warn("Could not authorise request when uploading file")
 		http.Error(w, "invalid access key id", http.StatusUnauthorized)
-		return
+		return psurls.URLData{}, nil, false
 	}
 
 	urlData, err := psurls.Validate(u.Query(), secretKey)
@@ -69,70 +389,144 @@ func (s *UploadServer) UploadFile(w http.ResponseWriter, r *http.Request) {
 		logger.WithError(err).Warn("Failed to validate presigned URL while uploading file")
 		if errors.Is(err, psurls.ErrURLExpired) || errors.Is(err, psurls.ErrSignatureMismatch) {
 			http.Error(w, err.Error(), http.StatusForbidden)
-			return
+			return psurls.URLData{}, nil, false
 		}
 		http.Error(w, fmt.Sprintf("invalid presigned URL: %q", err.Error()), http.StatusBadRequest)
-		return
+		return psurls.URLData{}, nil, false
 	}
 
-	logger = logger.WithField("key", urlData.ObjectKey)
+	// e.g. a download url, which doesn't commit to any content, must not be usable for uploading
+	if urlData.Operation == "" {
+		urlData.Operation = psurls.OpUpload
+	}
+	if urlData.Operation != op {
+		logger.WithField("operation", urlData.Operation).Warn("Presigned URL used for a different operation")
+		http.Error(w, fmt.Sprintf("presigned URL is not valid for %s", op), http.StatusForbidden)
+		return psurls.URLData{}, nil, false
+	}
 
-	if r.ContentLength != -1 && r.ContentLength != urlData.Size {
-		// fail early if Content-Length doesn't match the size value in the
-		// presigned url; no point in wasting resources on an invalid request
-		logger.WithFields(logrus.Fields{
-			"content_length": r.ContentLength,
-			"size":           urlData.Size,
-		}).Warn("Mismatched Content-Length with presigned url size while uploading file")
-		http.Error(w, "mismatched Content-Length and size", http.StatusBadRequest)
-		return
+	urlData.Namespace = store.NamespaceOrDefault(urlData.Namespace)
+	logger = logger.WithFields(logrus.Fields{
+		"namespace": urlData.Namespace,
+		"key":       urlData.ObjectKey,
+	})
+
+	return urlData, logger, true
+}
+
+// reserveQuota reserves the storage needed by the upload before accepting any bytes so concurrent uploads can't
+// overcommit the namespace. The returned func must be called once we're done; a completed object is accounted for
+// by the store by then. It writes the error response and returns false if the upload is not allowed.
+func (s *UploadServer) reserveQuota(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, urlData psurls.URLData) (func(), bool) {
+	if s.quota == nil {
+		return func() {}, true
 	}
 
-	objectID := mustUUIDV7()
-	err = s.mdStore.Create(r.Context(), &store.ObjectMetadata{
+	reservation, err := s.quota.Reserve(r.Context(), urlData.Namespace, urlData.ObjectKey, urlData.Size)
+	if err != nil {
+		if errors.Is(err, quota.ErrQuotaExceeded) || errors.Is(err, quota.ErrObjectTooLarge) {
+			logger.WithError(err).Warn("Rejected upload due to storage quota")
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		logger.WithError(err).Error("Failed to reserve storage quota for upload")
+		http.Error(w, fmt.Sprintf("could not reserve storage quota: %q", err.Error()), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return func() { s.quota.Release(reservation) }, true
+}
+
+// chooseEncoding returns the encoding the content is stored with as chosen by the compression policy, if any, and
+// the content to store, which still includes the sample the choice was made on.
+func (s *UploadServer) chooseEncoding(content io.Reader, urlData psurls.URLData) (io.Reader, compression.Encoding, error) {
+	if s.compressionPolicy == nil {
+		return content, compression.Identity, nil
+	}
+
+	key := urlData.ObjectKey
+	if s.contentAddressed {
+		// the same content must be encoded the same under any key, or storing it again would change the encoding of
+		// the object the other keys reference
+		key = ""
+	}
+	n := s.compressionPolicy.SampleLen()
+	if n == 0 {
+		enc, err := s.compressionPolicy.Choose(key, nil)
+		return content, enc, err
+	}
+	br := bufio.NewReaderSize(content, n)
+	sample, err := br.Peek(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, "", fmt.Errorf("read sample: %w", err)
+	}
+	enc, err := s.compressionPolicy.Choose(key, sample)
+	return br, enc, err
+}
+
+func newObjectMetadata(urlData psurls.URLData, objectID string) *store.ObjectMetadata {
+	return &store.ObjectMetadata{
+		Namespace:      urlData.Namespace,
 		Key:            urlData.ObjectKey,
 		ObjectID:       objectID,
 		SHA256Checksum: urlData.SHA256Checksum,
 		Size:           urlData.Size,
 		MTime:          urlData.MTime,
 		CreatedAt:      time.Now().UTC(),
-	})
-	if err != nil {
-		logger.WithError(err).Error("Failed to create object metadata in store")
-		http.Error(w, fmt.Sprintf("could not create object metadata in store: %s", err.Error()), http.StatusInternalServerError)
-		return
+		ContentMAC:     urlData.ContentMAC,
+		IfMatch:        urlData.IfMatch,
+		Attributes:     urlData.Attributes,
+		Attribution:    newAttribution(urlData, store.OpUpload),
+		Type:           store.ObjectType(urlData.Type),
 	}
+}
 
-	checksum, written, err := s.fileStorage.PutObject(r.Context(), r.Body, objectID)
-	if err != nil {
-		logger.WithError(err).Warn("Failed to save file to storage")
-		http.Error(w, fmt.Sprintf("failed to save file to storage: %q", err.Error()), http.StatusInternalServerError)
-		return
+// newAttribution attributes a change made with the given presigned url to its access key and the client it was
+// issued to.
+func newAttribution(urlData psurls.URLData, op store.Operation) store.Attribution {
+	return store.Attribution{
+		AccessKeyID: urlData.AccessKeyID,
+		DeviceID:    urlData.DeviceID,
+		Hostname:    urlData.Hostname,
+		User:        urlData.User,
+		Operation:   op,
 	}
+}
 
-	if urlData.SHA256Checksum != checksum {
-		logger.Warn("Provided checksum did not match what was uploaded")
-		http.Error(w, "provided checksum did not match what was uploaded", http.StatusBadRequest)
-		return
-	}
-	if urlData.Size != written {
-		logger.WithFields(logrus.Fields{
-			"size":    urlData.Size,
-			"written": written,
-		}).Warn("Provided file size did not match what was uploaded")
-		http.Error(w, "provided file size did not match what was uploaded", http.StatusBadRequest)
-		return
-	}
+// countingHash is a hash counting the bytes written to it.
+type countingHash struct {
+	hash.Hash
+	n int64
+}
 
-	err = s.mdStore.PutObjectCompleted(r.Context(), urlData.ObjectKey, objectID)
-	if err != nil {
-		logger.WithError(err).Error("Failed to mark object metadata as completed when uploading file")
-		http.Error(w, fmt.Sprintf("failed to mark object metadata as completed when uploading file: %q", err.Error()), http.StatusInternalServerError)
-		return
+func (h *countingHash) Write(p []byte) (int, error) {
+	h.n += int64(len(p))
+	return h.Hash.Write(p)
+}
+
+// errorTaggingReader wraps the errors returned by the underlying reader, other than io.EOF, with a tag.
+type errorTaggingReader struct {
+	r   io.Reader
+	tag error
+}
+
+func (r *errorTaggingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = fmt.Errorf("%w: %w", r.tag, err)
 	}
+	return n, err
+}
 
-	w.WriteHeader(http.StatusCreated)
-	logger.Debug("Successfully uploaded file to storage")
+// isSHA256Hex reports whether s is a hex encoded sha256 checksum as computed by the storage. Content-addressed
+// object IDs are taken from client provided checksums so they must be validated before use.
+func isSHA256Hex(s string) bool {
+	if len(s) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	return strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && (r < 'a' || r > 'f')
+	}) == -1
 }
 
 func mustUUIDV7() string {
@@ -1,20 +1,35 @@
 package rest_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/hedisam/filesync/lib/compression"
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/psurls"
 	"github.com/hedisam/filesync/server/api/rest"
 	"github.com/hedisam/filesync/server/api/rest/mocks"
+	"github.com/hedisam/filesync/server/internal/quota"
 	"github.com/hedisam/filesync/server/internal/store"
 )
 
+//go:generate moq -out mocks/quota.go -pkg mocks -skip-ensure . Quota
+
 func TestUploadFile(t *testing.T) {
 	tests := map[string]struct {
 		url            string
@@ -51,15 +66,16 @@ func TestUploadFile(t *testing.T) {
 				},
 			}
 			fsMock := &mocks.FileStorageMock{
-				PutObjectFunc: func(ctx context.Context, r io.Reader, objectID string) (string, int64, error) {
+				PutObjectFunc: func(ctx context.Context, r io.Reader, objectID string, verify func(string, int64) error) (string, int64, error) {
 					return "", 0, nil
 				},
 			}
 			mdMock := &mocks.UploadMetadataStoreMock{
+				GetFunc: notStored,
 				CreateFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
 					return nil
 				},
-				PutObjectCompletedFunc: func(ctx context.Context, key, objectID string) error {
+				PutObjectCompletedFunc: func(ctx context.Context, namespace, key, objectID string) error {
 					return nil
 				},
 			}
@@ -74,3 +90,791 @@ func TestUploadFile(t *testing.T) {
 		})
 	}
 }
+
+func TestUploadFileQuota(t *testing.T) {
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+
+	tests := map[string]struct {
+		reserveErr error
+
+		wantStatus         int
+		wantBodySubstr     string
+		wantPutObjectCalls int
+	}{
+		"within quota": {
+			wantStatus:         http.StatusCreated,
+			wantPutObjectCalls: 1,
+		},
+		"quota exceeded": {
+			reserveErr:     fmt.Errorf("%w: namespace \"docs\" would use 20 bytes out of 10", quota.ErrQuotaExceeded),
+			wantStatus:     http.StatusRequestEntityTooLarge,
+			wantBodySubstr: "quota exceeded",
+		},
+		"object too large": {
+			reserveErr:     fmt.Errorf("%w: size 11 exceeds the maximum object size 10", quota.ErrObjectTooLarge),
+			wantStatus:     http.StatusRequestEntityTooLarge,
+			wantBodySubstr: "object too large",
+		},
+		"reservation failure": {
+			reserveErr:     assert.AnError,
+			wantStatus:     http.StatusInternalServerError,
+			wantBodySubstr: "could not reserve storage quota",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authMock := &mocks.AuthMock{
+				GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+					return "secret", true
+				},
+			}
+			fsMock := &mocks.FileStorageMock{
+				PutObjectFunc: storeAndVerify(hex.EncodeToString(sum[:])),
+			}
+			mdMock := &mocks.UploadMetadataStoreMock{
+				GetFunc: notStored,
+				CreateFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
+					assert.Equal(t, "docs", md.Namespace)
+					return nil
+				},
+				PutObjectCompletedFunc: func(ctx context.Context, namespace, key, objectID string) error {
+					return nil
+				},
+			}
+			reservation := &quota.Reservation{Namespace: "docs", Bytes: int64(len(data)), Objects: 1}
+			quotaMock := &mocks.QuotaMock{
+				ReserveFunc: func(ctx context.Context, namespace, key string, size int64) (*quota.Reservation, error) {
+					assert.Equal(t, "docs", namespace)
+					assert.Equal(t, "file.txt", key)
+					assert.EqualValues(t, len(data), size)
+					if tc.reserveErr != nil {
+						return nil, tc.reserveErr
+					}
+					return reservation, nil
+				},
+				ReleaseFunc: func(r *quota.Reservation) {
+					assert.Equal(t, reservation, r)
+				},
+			}
+
+			u := presignedURL(t, "http://localhost/v1/files/upload", psurls.URLData{
+				Namespace:      "docs",
+				ObjectKey:      "file.txt",
+				SHA256Checksum: hex.EncodeToString(sum[:]),
+				Size:           int64(len(data)),
+			})
+
+			srv := rest.NewUploadServer(logrus.New(), fsMock, mdMock, authMock, rest.WithQuota(quotaMock))
+			req := httptest.NewRequest("PUT", u, bytes.NewReader(data))
+			rr := httptest.NewRecorder()
+			srv.UploadFile(rr, req)
+
+			assert.Equal(t, tc.wantStatus, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.wantBodySubstr)
+			assert.Len(t, fsMock.PutObjectCalls(), tc.wantPutObjectCalls)
+			if tc.reserveErr == nil {
+				assert.Len(t, quotaMock.ReleaseCalls(), 1)
+			}
+		})
+	}
+}
+
+func TestUploadFileContentAddressed(t *testing.T) {
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := map[string]struct {
+		checksum string
+		linkErr  error
+		// deleting makes the content's object being deleted, so it's stored under another object ID
+		deleting bool
+		// storedMeanwhile makes the content stored by another upload once it's been looked up
+		storedMeanwhile bool
+
+		wantStatus         int
+		wantPutObjectCalls int
+		wantCreateCalls    int
+	}{
+		"content already stored": {
+			checksum:   checksum,
+			wantStatus: http.StatusCreated,
+		},
+		"content not stored": {
+			checksum:           checksum,
+			linkErr:            store.ErrNotFound,
+			wantStatus:         http.StatusCreated,
+			wantPutObjectCalls: 1,
+			wantCreateCalls:    1,
+		},
+		"content being deleted": {
+			checksum:           checksum,
+			linkErr:            store.ErrNotFound,
+			deleting:           true,
+			wantStatus:         http.StatusCreated,
+			wantPutObjectCalls: 1,
+			wantCreateCalls:    2,
+		},
+		"content stored meanwhile": {
+			checksum:        checksum,
+			linkErr:         store.ErrNotFound,
+			storedMeanwhile: true,
+			wantStatus:      http.StatusCreated,
+			wantCreateCalls: 1,
+		},
+		"link failure": {
+			checksum:   checksum,
+			linkErr:    errors.New("boom"),
+			wantStatus: http.StatusInternalServerError,
+		},
+		"invalid checksum": {
+			checksum:   "../../etc/passwd",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authMock := &mocks.AuthMock{
+				GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+					return "secret", true
+				},
+			}
+			fsMock := &mocks.FileStorageMock{
+				PutObjectFunc: func(ctx context.Context, r io.Reader, objectID string, verify func(string, int64) error) (string, int64, error) {
+					assert.Equal(t, !tc.deleting, objectID == checksum)
+					return storeAndVerify(checksum)(ctx, r, objectID, verify)
+				},
+			}
+			stored := false
+			mdMock := &mocks.UploadMetadataStoreMock{
+				GetFunc: notStored,
+				LinkObjectFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
+					assert.Equal(t, checksum, md.ObjectID)
+					if stored {
+						return nil
+					}
+					return tc.linkErr
+				},
+				CreateFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
+					if tc.deleting && md.ObjectID == checksum {
+						return store.ErrObjectDeleting
+					}
+					if tc.storedMeanwhile {
+						stored = true
+						return store.ErrObjectStored
+					}
+					return nil
+				},
+				PutObjectCompletedFunc: func(ctx context.Context, namespace, key, objectID string) error {
+					return nil
+				},
+			}
+
+			u := presignedURL(t, "http://localhost/v1/files/upload", psurls.URLData{
+				ObjectKey:      "file.txt",
+				SHA256Checksum: tc.checksum,
+				Size:           int64(len(data)),
+			})
+
+			srv := rest.NewUploadServer(logrus.New(), fsMock, mdMock, authMock, rest.WithContentAddressing())
+			req := httptest.NewRequest("PUT", u, bytes.NewReader(data))
+			rr := httptest.NewRecorder()
+			srv.UploadFile(rr, req)
+
+			assert.Equal(t, tc.wantStatus, rr.Code)
+			assert.Len(t, fsMock.PutObjectCalls(), tc.wantPutObjectCalls)
+			assert.Len(t, mdMock.CreateCalls(), tc.wantCreateCalls)
+		})
+	}
+}
+
+func TestLinkFile(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello world"))
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := map[string]struct {
+		contentAddressed bool
+		linkErr          error
+
+		wantStatus int
+		wantLinks  int
+	}{
+		"linked": {
+			contentAddressed: true,
+			wantStatus:       http.StatusCreated,
+			wantLinks:        1,
+		},
+		"content not stored": {
+			contentAddressed: true,
+			linkErr:          store.ErrNotFound,
+			wantStatus:       http.StatusNotFound,
+			wantLinks:        1,
+		},
+		"changed since": {
+			contentAddressed: true,
+			linkErr:          store.ErrPreconditionFailed,
+			wantStatus:       http.StatusPreconditionFailed,
+			wantLinks:        1,
+		},
+		"content addressing disabled": {
+			wantStatus: http.StatusNotImplemented,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authMock := &mocks.AuthMock{
+				GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+					return "secret", true
+				},
+			}
+			mdMock := &mocks.UploadMetadataStoreMock{
+				GetFunc: notStored,
+				LinkObjectFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
+					assert.Equal(t, store.ObjectMetadata{
+						Namespace:      store.DefaultNamespace,
+						Key:            "file.txt",
+						ObjectID:       checksum,
+						SHA256Checksum: checksum,
+						Size:           11,
+						MTime:          1717243200,
+						CreatedAt:      md.CreatedAt,
+						Attributes:     &fileattr.Attributes{Mode: 0o755, MTime: 1717243200123456789},
+						Attribution: store.Attribution{
+							AccessKeyID: "aki",
+							DeviceID:    "laptop-1",
+							Hostname:    "laptop",
+							User:        "alice",
+							Operation:   store.OpLink,
+						},
+					}, *md)
+					return tc.linkErr
+				},
+			}
+
+			var opts []rest.UploadServerOption
+			if tc.contentAddressed {
+				opts = append(opts, rest.WithContentAddressing())
+			}
+			srv := rest.NewUploadServer(logrus.New(), &mocks.FileStorageMock{}, mdMock, authMock, opts...)
+
+			u := presignedURL(t, "http://localhost/v1/files/link", psurls.URLData{
+				ObjectKey:      "file.txt",
+				SHA256Checksum: checksum,
+				Size:           11,
+				MTime:          1717243200,
+				DeviceID:       "laptop-1",
+				Hostname:       "laptop",
+				User:           "alice",
+				Attributes:     &fileattr.Attributes{Mode: 0o755, MTime: 1717243200123456789},
+			})
+			req := httptest.NewRequest("PUT", u, nil)
+			rr := httptest.NewRecorder()
+			srv.LinkFile(rr, req)
+
+			assert.Equal(t, tc.wantStatus, rr.Code)
+			assert.Len(t, mdMock.LinkObjectCalls(), tc.wantLinks)
+		})
+	}
+}
+
+func TestUploadFileVerification(t *testing.T) {
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := map[string]struct {
+		checksum      string
+		size          int64
+		storedContent []byte
+		putErr        error
+
+		wantStatus          int
+		wantBodySubstr      string
+		wantCompletedCalls  int
+		wantFailedPutsCalls int
+	}{
+		"success": {
+			checksum:           checksum,
+			size:               int64(len(data)),
+			wantStatus:         http.StatusCreated,
+			wantCompletedCalls: 1,
+		},
+		"checksum mismatch": {
+			checksum:            strings.Repeat("0", 64),
+			size:                int64(len(data)),
+			wantStatus:          http.StatusBadRequest,
+			wantBodySubstr:      "provided checksum did not match",
+			wantFailedPutsCalls: 1,
+		},
+		"size mismatch": {
+			checksum:            checksum,
+			size:                int64(len(data)) + 1,
+			wantStatus:          http.StatusBadRequest,
+			wantBodySubstr:      "provided file size did not match",
+			wantFailedPutsCalls: 1,
+		},
+		"storage failure": {
+			checksum:            checksum,
+			size:                int64(len(data)),
+			putErr:              errors.New("disk full"),
+			wantStatus:          http.StatusInternalServerError,
+			wantBodySubstr:      "disk full",
+			wantFailedPutsCalls: 1,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authMock := &mocks.AuthMock{
+				GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+					return "secret", true
+				},
+			}
+			fsMock := &mocks.FileStorageMock{
+				PutObjectFunc: func(ctx context.Context, r io.Reader, objectID string, verify func(string, int64) error) (string, int64, error) {
+					if tc.putErr != nil {
+						return "", 0, tc.putErr
+					}
+					return storeAndVerify(checksum)(ctx, r, objectID, verify)
+				},
+			}
+			var objectID string
+			mdMock := &mocks.UploadMetadataStoreMock{
+				GetFunc: notStored,
+				CreateFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
+					objectID = md.ObjectID
+					return nil
+				},
+				PutObjectCompletedFunc: func(ctx context.Context, namespace, key, id string) error {
+					return nil
+				},
+				PutObjectFailedFunc: func(ctx context.Context, namespace, key, id string) error {
+					assert.Equal(t, store.DefaultNamespace, namespace)
+					assert.Equal(t, "file.txt", key)
+					assert.Equal(t, objectID, id)
+					return nil
+				},
+			}
+
+			u := presignedURL(t, "http://localhost/v1/files/upload", psurls.URLData{
+				ObjectKey:      "file.txt",
+				SHA256Checksum: tc.checksum,
+				Size:           tc.size,
+			})
+
+			srv := rest.NewUploadServer(logrus.New(), fsMock, mdMock, authMock)
+			req := httptest.NewRequest("PUT", u, bytes.NewReader(data))
+			req.ContentLength = -1
+			rr := httptest.NewRecorder()
+			srv.UploadFile(rr, req)
+
+			assert.Equal(t, tc.wantStatus, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.wantBodySubstr)
+			assert.Len(t, mdMock.PutObjectCompletedCalls(), tc.wantCompletedCalls)
+			assert.Len(t, mdMock.PutObjectFailedCalls(), tc.wantFailedPutsCalls)
+		})
+	}
+}
+
+func TestUploadFileWithDownloadURL(t *testing.T) {
+	authMock := &mocks.AuthMock{
+		GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+			return "secret", true
+		},
+	}
+	fsMock := &mocks.FileStorageMock{}
+	mdMock := &mocks.UploadMetadataStoreMock{}
+
+	// a download url doesn't commit to any content so it must not be usable for uploading
+	u := presignedURL(t, "http://localhost/v1/files/upload", psurls.URLData{
+		ObjectKey: "file.txt",
+		Operation: psurls.OpDownload,
+	})
+
+	srv := rest.NewUploadServer(logrus.New(), fsMock, mdMock, authMock)
+	rr := httptest.NewRecorder()
+	srv.UploadFile(rr, httptest.NewRequest("PUT", u, bytes.NewReader(nil)))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "presigned URL is not valid for upload")
+	assert.Empty(t, fsMock.PutObjectCalls())
+	assert.Empty(t, mdMock.CreateCalls())
+}
+
+// storeAndVerify returns a FileStorage.PutObject mock that consumes the reader, as if it's been stored with the given
+// checksum, and calls the verify func.
+func storeAndVerify(checksum string) func(context.Context, io.Reader, string, func(string, int64) error) (string, int64, error) {
+	return func(ctx context.Context, r io.Reader, objectID string, verify func(string, int64) error) (string, int64, error) {
+		written, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return "", 0, err
+		}
+		if verify != nil {
+			err = verify(checksum, written)
+			if err != nil {
+				return "", 0, err
+			}
+		}
+		return checksum, written, nil
+	}
+}
+
+// presignedURL returns a presigned url for the given data, signed by access key 'aki' with secret 'secret'.
+// notStored is the Get of a metadata store that has none of the uploaded objects, so no ETag is set.
+func notStored(context.Context, string, string) (*store.ObjectMetadata, error) {
+	return nil, store.ErrNotFound
+}
+
+func presignedURL(t *testing.T, baseURL string, data psurls.URLData) string {
+	t.Helper()
+
+	data.Expiry = time.Now().Add(time.Minute).Unix()
+	data.AccessKeyID = "aki"
+	u, err := psurls.Generate(data, baseURL, "secret")
+	require.NoError(t, err)
+
+	return u
+}
+
+func TestUploadFileEncryptionKeyID(t *testing.T) {
+	authMock := &mocks.AuthMock{
+		GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+			return "secret", true
+		},
+	}
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	fsMock := &mocks.FileStorageMock{
+		PutObjectFunc: storeAndVerify(checksum),
+	}
+	mdMock := &mocks.UploadMetadataStoreMock{
+		GetFunc: notStored,
+		CreateFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
+			assert.Equal(t, "k1", md.EncryptionKeyID)
+			return nil
+		},
+		PutObjectCompletedFunc: func(ctx context.Context, namespace, key, id string) error {
+			return nil
+		},
+	}
+
+	u := presignedURL(t, "http://localhost/v1/files/upload", psurls.URLData{
+		ObjectKey:      "file.txt",
+		SHA256Checksum: checksum,
+		Size:           int64(len(data)),
+	})
+
+	srv := rest.NewUploadServer(logrus.New(), fsMock, mdMock, authMock, rest.WithEncryptionKeyID("k1"))
+	rr := httptest.NewRecorder()
+	srv.UploadFile(rr, httptest.NewRequest("PUT", u, bytes.NewReader(data)))
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Len(t, mdMock.CreateCalls(), 1)
+}
+
+func TestUploadFileIfMatch(t *testing.T) {
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := map[string]struct {
+		createErr   error
+		completeErr error
+
+		wantStatus         int
+		wantETag           string
+		wantPutObjectCalls int
+		wantFailedCalls    int
+	}{
+		"at the expected version": {
+			wantStatus:         http.StatusCreated,
+			wantETag:           `"8"`,
+			wantPutObjectCalls: 1,
+		},
+		"changed before the upload": {
+			createErr:  store.ErrPreconditionFailed,
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		"changed during the upload": {
+			completeErr:        store.ErrPreconditionFailed,
+			wantStatus:         http.StatusPreconditionFailed,
+			wantPutObjectCalls: 1,
+			wantFailedCalls:    1,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authMock := &mocks.AuthMock{
+				GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+					return "secret", true
+				},
+			}
+			fsMock := &mocks.FileStorageMock{
+				PutObjectFunc: storeAndVerify(checksum),
+			}
+			var objectID string
+			mdMock := &mocks.UploadMetadataStoreMock{
+				CreateFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
+					require.NotNil(t, md.IfMatch)
+					assert.Equal(t, uint64(7), *md.IfMatch)
+					objectID = md.ObjectID
+					return tc.createErr
+				},
+				PutObjectCompletedFunc: func(ctx context.Context, namespace, key, id string) error {
+					return tc.completeErr
+				},
+				PutObjectFailedFunc: func(ctx context.Context, namespace, key, id string) error {
+					return nil
+				},
+				GetFunc: func(ctx context.Context, namespace, key string) (*store.ObjectMetadata, error) {
+					return &store.ObjectMetadata{Key: key, ObjectID: objectID, Version: 8}, nil
+				},
+			}
+
+			version := uint64(7)
+			u := presignedURL(t, "http://localhost/v1/files/upload", psurls.URLData{
+				ObjectKey:      "file.txt",
+				SHA256Checksum: checksum,
+				Size:           int64(len(data)),
+				IfMatch:        &version,
+			})
+
+			srv := rest.NewUploadServer(logrus.New(), fsMock, mdMock, authMock)
+			rr := httptest.NewRecorder()
+			srv.UploadFile(rr, httptest.NewRequest("PUT", u, bytes.NewReader(data)))
+
+			assert.Equal(t, tc.wantStatus, rr.Code)
+			assert.Equal(t, tc.wantETag, rr.Header().Get("ETag"))
+			assert.Len(t, fsMock.PutObjectCalls(), tc.wantPutObjectCalls)
+			assert.Len(t, mdMock.PutObjectFailedCalls(), tc.wantFailedCalls)
+		})
+	}
+}
+
+func TestUploadFileContentEncoding(t *testing.T) {
+	content := []byte(strings.Repeat("2024-06-01 INFO request served\n", 100))
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	compress := func(enc compression.Encoding, data []byte) []byte {
+		rc := compression.Compress(bytes.NewReader(data), enc)
+		defer rc.Close()
+		compressed, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		return compressed
+	}
+	policy := &compression.Policy{Encoding: compression.Zstd, Extensions: []string{".log"}}
+
+	tests := map[string]struct {
+		key             string
+		contentEncoding string
+		body            []byte
+		policy          *compression.Policy
+
+		wantStatus         int
+		wantBodySubstr     string
+		wantStoredEncoding compression.Encoding
+	}{
+		"gzip body": {
+			key:             "app.txt",
+			contentEncoding: "gzip",
+			body:            compress(compression.Gzip, content),
+			wantStatus:      http.StatusCreated,
+		},
+		"zstd body": {
+			key:             "app.txt",
+			contentEncoding: "zstd",
+			body:            compress(compression.Zstd, content),
+			wantStatus:      http.StatusCreated,
+		},
+		"unsupported encoding": {
+			key:             "app.txt",
+			contentEncoding: "br",
+			body:            content,
+			wantStatus:      http.StatusUnsupportedMediaType,
+			wantBodySubstr:  "unsupported content encoding",
+		},
+		"corrupted body": {
+			key:             "app.txt",
+			contentEncoding: "zstd",
+			body:            compress(compression.Zstd, content)[:20],
+			wantStatus:      http.StatusBadRequest,
+			wantBodySubstr:  "invalid zstd body",
+		},
+		"body expanding past the size": {
+			key:             "app.txt",
+			contentEncoding: "gzip",
+			body:            compress(compression.Gzip, append(bytes.Clone(content), make([]byte, 1<<20)...)),
+			wantStatus:      http.StatusBadRequest,
+			wantBodySubstr:  "provided checksum did not match",
+		},
+		"compressed at rest": {
+			key:                "app.log",
+			body:               content,
+			policy:             policy,
+			wantStatus:         http.StatusCreated,
+			wantStoredEncoding: compression.Zstd,
+		},
+		"compressed in transit and at rest": {
+			key:                "app.log",
+			contentEncoding:    "gzip",
+			body:               compress(compression.Gzip, content),
+			policy:             policy,
+			wantStatus:         http.StatusCreated,
+			wantStoredEncoding: compression.Zstd,
+		},
+		"not chosen by the policy": {
+			key:        "app.bin",
+			body:       content,
+			policy:     policy,
+			wantStatus: http.StatusCreated,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authMock := &mocks.AuthMock{
+				GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+					return "secret", true
+				},
+			}
+			var stored []byte
+			fsMock := &mocks.FileStorageMock{
+				PutObjectFunc: func(ctx context.Context, r io.Reader, objectID string, verify func(string, int64) error) (string, int64, error) {
+					data, err := io.ReadAll(r)
+					if err != nil {
+						return "", 0, err
+					}
+					sum := sha256.Sum256(data)
+					err = verify(hex.EncodeToString(sum[:]), int64(len(data)))
+					if err != nil {
+						return "", 0, err
+					}
+					stored = data
+					return hex.EncodeToString(sum[:]), int64(len(data)), nil
+				},
+			}
+			var md *store.ObjectMetadata
+			mdMock := &mocks.UploadMetadataStoreMock{
+				GetFunc: notStored,
+				CreateFunc: func(ctx context.Context, m *store.ObjectMetadata) error {
+					md = m
+					return nil
+				},
+				PutObjectCompletedFunc: func(ctx context.Context, namespace, key, id string) error {
+					return nil
+				},
+				PutObjectFailedFunc: func(ctx context.Context, namespace, key, id string) error {
+					return nil
+				},
+			}
+
+			u := presignedURL(t, "http://localhost/v1/files/upload", psurls.URLData{
+				ObjectKey:      tc.key,
+				SHA256Checksum: checksum,
+				Size:           int64(len(content)),
+			})
+			var opts []rest.UploadServerOption
+			if tc.policy != nil {
+				opts = append(opts, rest.WithCompressionPolicy(tc.policy))
+			}
+			srv := rest.NewUploadServer(logrus.New(), fsMock, mdMock, authMock, opts...)
+			req := httptest.NewRequest("PUT", u, bytes.NewReader(tc.body))
+			req.Header.Set("Content-Encoding", tc.contentEncoding)
+			rr := httptest.NewRecorder()
+			srv.UploadFile(rr, req)
+
+			assert.Equal(t, tc.wantStatus, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.wantBodySubstr)
+			if tc.wantStatus != http.StatusCreated {
+				return
+			}
+			assert.Equal(t, string(tc.wantStoredEncoding), md.ContentEncoding)
+			r, err := compression.NewReader(bytes.NewReader(stored), tc.wantStoredEncoding)
+			require.NoError(t, err)
+			decoded, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, content, decoded)
+			if tc.wantStoredEncoding != compression.Identity {
+				assert.Less(t, len(stored), len(content))
+			}
+		})
+	}
+}
+
+func TestUploadFileContentAddressedEncoding(t *testing.T) {
+	content := []byte(strings.Repeat("2024-06-01 INFO request served\n", 100))
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := map[string]struct {
+		policy *compression.Policy
+
+		wantStoredEncoding compression.Encoding
+	}{
+		"chosen by extension": {
+			policy: &compression.Policy{Encoding: compression.Zstd, Extensions: []string{".log"}},
+		},
+		"chosen by ratio": {
+			policy:             &compression.Policy{Encoding: compression.Zstd, Extensions: []string{".log"}, MaxRatio: 0.5},
+			wantStoredEncoding: compression.Zstd,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authMock := &mocks.AuthMock{
+				GetSecretKeyByIDFunc: func(keyID string) (string, bool) {
+					return "secret", true
+				},
+			}
+			fsMock := &mocks.FileStorageMock{
+				PutObjectFunc: func(ctx context.Context, r io.Reader, objectID string, verify func(string, int64) error) (string, int64, error) {
+					_, err := io.Copy(io.Discard, r)
+					if err != nil {
+						return "", 0, err
+					}
+					return checksum, int64(len(content)), verify(checksum, int64(len(content)))
+				},
+			}
+			// both uploads are inflight at once, so neither is linked to the other's content
+			mdMock := &mocks.UploadMetadataStoreMock{
+				GetFunc: notStored,
+				LinkObjectFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
+					return store.ErrNotFound
+				},
+				CreateFunc: func(ctx context.Context, md *store.ObjectMetadata) error {
+					return nil
+				},
+				PutObjectCompletedFunc: func(ctx context.Context, namespace, key, id string) error {
+					return nil
+				},
+			}
+			srv := rest.NewUploadServer(logrus.New(), fsMock, mdMock, authMock, rest.WithContentAddressing(), rest.WithCompressionPolicy(tc.policy))
+
+			// the same content under keys the policy treats differently must be stored with the same encoding, as
+			// it's stored under the same object ID
+			for key := range slices.Values([]string{"app.log", "app.bin"}) {
+				u := presignedURL(t, "http://localhost/v1/files/upload", psurls.URLData{
+					ObjectKey:      key,
+					SHA256Checksum: checksum,
+					Size:           int64(len(content)),
+				})
+				rr := httptest.NewRecorder()
+				srv.UploadFile(rr, httptest.NewRequest("PUT", u, bytes.NewReader(content)))
+				require.Equal(t, http.StatusCreated, rr.Code)
+			}
+
+			require.Len(t, mdMock.CreateCalls(), 2)
+			for call := range slices.Values(mdMock.CreateCalls()) {
+				assert.Equal(t, checksum, call.Md.ObjectID)
+				assert.Equal(t, string(tc.wantStoredEncoding), call.Md.ContentEncoding)
+			}
+		})
+	}
+}
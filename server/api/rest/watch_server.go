@@ -0,0 +1,290 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/events"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+const (
+	// DefaultHeartbeat is how often a heartbeat is sent on an idle change stream, so clients and proxies can tell a
+	// quiet stream from a dead connection.
+	DefaultHeartbeat = 15 * time.Second
+	// DefaultPollWait is how long a long-poll waits for changes, unless told otherwise.
+	DefaultPollWait = 30 * time.Second
+	// MaxPollWait is the longest a long-poll waits for changes.
+	MaxPollWait = time.Minute
+)
+
+type ChangeFeed interface {
+	Changes(ctx context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error)
+}
+
+// ChangeNotifier notifies its subscribers of the changes committed in the metadata store.
+type ChangeNotifier interface {
+	Subscribe(name string, opts ...events.SubscribeOption) *events.Subscription
+}
+
+// WatchServer pushes the changes of a namespace to clients as they're committed, so they don't have to poll for
+// them.
+type WatchServer struct {
+	logger    *logrus.Logger
+	feed      ChangeFeed
+	notifier  ChangeNotifier
+	heartbeat time.Duration
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type WatchOption func(*WatchServer)
+
+// WithHeartbeat sets how often a heartbeat is sent on an idle change stream.
+func WithHeartbeat(d time.Duration) WatchOption {
+	return func(s *WatchServer) {
+		s.heartbeat = d
+	}
+}
+
+func NewWatchServer(logger *logrus.Logger, feed ChangeFeed, notifier ChangeNotifier, opts ...WatchOption) *WatchServer {
+	s := &WatchServer{
+		logger:    logger,
+		feed:      feed,
+		notifier:  notifier,
+		heartbeat: DefaultHeartbeat,
+		done:      make(chan struct{}),
+	}
+	for opt := range slices.Values(opts) {
+		opt(s)
+	}
+	return s
+}
+
+// Close ends the open streams and long-polls, which would otherwise hold up a graceful shutdown. It's safe to call
+// more than once.
+func (s *WatchServer) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// WatchChanges sends the changes of a namespace made after the given cursor, optionally only the ones under a key
+// prefix, as they're committed. Clients accepting text/event-stream get a stream of server-sent events, one per
+// change with its cursor as the event ID, so reconnecting with Last-Event-ID resumes right after the last change
+// received; an "expired" event ends the stream if the cursor has expired, in which case the client has to take a new
+// snapshot. Other clients get a long-poll: the response is the same as for the changes endpoint, sent as soon as
+// there are changes, or with none once the wait is over.
+func (s *WatchServer) WatchChanges(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	namespace := store.NamespaceOrDefault(query.Get("namespace"))
+	prefix := query.Get("prefix")
+	since := query.Get("since")
+	stream := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if id := r.Header.Get("Last-Event-ID"); stream && id != "" {
+		since = id
+	}
+	logger := s.logger.WithContext(r.Context()).WithFields(logrus.Fields{
+		"namespace": namespace,
+		"prefix":    prefix,
+		"since":     since,
+		"stream":    stream,
+	})
+
+	cursor, err := decodeCursor(since)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid cursor: %v", err), http.StatusBadRequest)
+		return
+	}
+	wait := DefaultPollWait
+	if v := query.Get("wait"); v != "" {
+		wait, err = time.ParseDuration(v)
+		if err != nil || wait < 0 {
+			http.Error(w, fmt.Sprintf("invalid wait duration %q", v), http.StatusBadRequest)
+			return
+		}
+		wait = min(wait, MaxPollWait)
+	}
+
+	// subscribe before reading the changes so none committed in between is missed. Notifications only tell there's
+	// something to read, so the ones published while one is pending can be dropped.
+	sub := s.notifier.Subscribe("change-watch", events.WithBuffer(1))
+	defer sub.Close()
+
+	if stream {
+		s.stream(r.Context(), w, logger, sub, namespace, prefix, cursor)
+		return
+	}
+	s.poll(r.Context(), w, logger, sub, namespace, prefix, cursor, wait)
+}
+
+func (s *WatchServer) stream(ctx context.Context, w http.ResponseWriter, logger *logrus.Entry, sub *events.Subscription, namespace, prefix string, cursor store.Cursor) {
+	rc := http.NewResponseController(w)
+	// a stream outlives any write timeout of the server
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	err := rc.Flush()
+	if err != nil {
+		logger.WithError(err).Error("Failed to flush change stream")
+		return
+	}
+
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		changes, next, hasMore, err := s.changes(ctx, namespace, prefix, cursor)
+		if errors.Is(err, store.ErrCursorExpired) {
+			_, _ = fmt.Fprint(w, "event: expired\ndata: cursor too old, take a new snapshot\n\n")
+			_ = rc.Flush()
+			return
+		}
+		if err != nil {
+			// too late to respond with an error; the client reconnects
+			logger.WithError(err).Error("Failed to get changes from store for change stream")
+			return
+		}
+		for c := range slices.Values(changes) {
+			data, err := json.Marshal(newChange(c))
+			if err != nil {
+				logger.WithError(err).Error("Failed to marshal change for change stream")
+				return
+			}
+			id := encodeCursor(store.Cursor{Epoch: next.Epoch, Seq: c.Seq})
+			_, _ = fmt.Fprintf(w, "id: %s\nevent: change\ndata: %s\n\n", id, data)
+		}
+		cursor = next
+		if len(changes) > 0 {
+			err = rc.Flush()
+			if err != nil {
+				logger.WithError(err).Debug("Change stream closed")
+				return
+			}
+			heartbeat.Reset(s.heartbeat)
+		}
+		if hasMore {
+			continue
+		}
+
+	notified:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			case ev, ok := <-sub.Events():
+				if !ok {
+					return
+				}
+				if notifies(ev, namespace, prefix) {
+					break notified
+				}
+			case <-heartbeat.C:
+				_, _ = fmt.Fprint(w, ": heartbeat\n\n")
+				err = rc.Flush()
+				if err != nil {
+					logger.WithError(err).Debug("Change stream closed")
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *WatchServer) poll(ctx context.Context, w http.ResponseWriter, logger *logrus.Entry, sub *events.Subscription, namespace, prefix string, cursor store.Cursor, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		changes, next, hasMore, err := s.changes(ctx, namespace, prefix, cursor)
+		if errors.Is(err, store.ErrCursorExpired) {
+			http.Error(w, fmt.Sprintf("cursor too old, take a new snapshot: %v", err), http.StatusGone)
+			return
+		}
+		if err != nil {
+			logger.WithError(err).Error("Failed to get changes from store for long-poll")
+			http.Error(w, fmt.Sprintf("get changes from store: %v", err), http.StatusInternalServerError)
+			return
+		}
+		cursor = next
+		if len(changes) > 0 || hasMore {
+			s.respond(w, logger, changes, cursor, hasMore)
+			return
+		}
+
+	notified:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				s.respond(w, logger, nil, cursor, false)
+				return
+			case <-timer.C:
+				s.respond(w, logger, nil, cursor, false)
+				return
+			case ev, ok := <-sub.Events():
+				if !ok {
+					s.respond(w, logger, nil, cursor, false)
+					return
+				}
+				if notifies(ev, namespace, prefix) {
+					break notified
+				}
+			}
+		}
+	}
+}
+
+func (s *WatchServer) respond(w http.ResponseWriter, logger *logrus.Entry, changes []store.Change, cursor store.Cursor, hasMore bool) {
+	resp := &GetChangesResponse{
+		Changes: make([]Change, 0, len(changes)),
+		Cursor:  encodeCursor(cursor),
+		HasMore: hasMore,
+	}
+	for c := range slices.Values(changes) {
+		resp.Changes = append(resp.Changes, newChange(c))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logger.WithError(err).Error("Failed to write long-poll response")
+	}
+}
+
+// changes returns the next changes after the given cursor under the given prefix, and the cursor to get the ones
+// after with, which is past the changes left out too. It reports whether there might be more to get right away.
+func (s *WatchServer) changes(ctx context.Context, namespace, prefix string, since store.Cursor) ([]store.Change, store.Cursor, bool, error) {
+	changes, cursor, err := s.feed.Changes(ctx, namespace, since, DefaultChangesLimit)
+	if err != nil {
+		return nil, store.Cursor{}, false, err
+	}
+	hasMore := len(changes) == DefaultChangesLimit
+	changes = slices.DeleteFunc(changes, func(c store.Change) bool {
+		return !strings.HasPrefix(c.Key, prefix)
+	})
+	return changes, cursor, hasMore, nil
+}
+
+// notifies reports whether the given event may have changes of the given namespace under the given prefix.
+func notifies(ev events.Event, namespace, prefix string) bool {
+	if store.NamespaceOrDefault(ev.Namespace) != namespace {
+		return false
+	}
+	return strings.HasPrefix(ev.Key, prefix) || (ev.FromKey != "" && strings.HasPrefix(ev.FromKey, prefix))
+}
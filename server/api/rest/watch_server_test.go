@@ -0,0 +1,237 @@
+package rest_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/server/api/rest"
+	"github.com/hedisam/filesync/server/api/rest/mocks"
+	"github.com/hedisam/filesync/server/internal/events"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+//go:generate moq -out mocks/change_feed.go -pkg mocks -skip-ensure . ChangeFeed
+
+// changeLog is a change feed of the default namespace, publishing its changes on the bus like the metadata store.
+type changeLog struct {
+	bus *events.Bus
+
+	mu      sync.Mutex
+	changes []store.Change
+}
+
+func newChangeLog(keys ...string) *changeLog {
+	l := &changeLog{bus: events.New(logrus.New())}
+	for key := range slices.Values(keys) {
+		l.put(key)
+	}
+	return l
+}
+
+func (l *changeLog) put(key string) {
+	l.mu.Lock()
+	l.changes = append(l.changes, store.Change{
+		Seq:    uint64(len(l.changes) + 1),
+		Op:     store.ChangePut,
+		Key:    key,
+		Object: &store.ObjectMetadata{Key: key, SHA256Checksum: "sha-" + key},
+	})
+	l.mu.Unlock()
+
+	l.bus.Publish(events.Event{Type: events.Created, Namespace: store.DefaultNamespace, Key: key})
+}
+
+func (l *changeLog) feed() *mocks.ChangeFeedMock {
+	return &mocks.ChangeFeedMock{
+		ChangesFunc: func(_ context.Context, _ string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			if since.Epoch != "epoch" || since.Seq > uint64(len(l.changes)) {
+				return nil, store.Cursor{}, store.ErrCursorExpired
+			}
+			changes := l.changes[since.Seq:]
+			changes = slices.Clone(changes[:min(limit, len(changes))])
+			if len(changes) == 0 {
+				return nil, since, nil
+			}
+			return changes, store.Cursor{Epoch: "epoch", Seq: changes[len(changes)-1].Seq}, nil
+		},
+	}
+}
+
+func TestWatchChangesPoll(t *testing.T) {
+	tests := map[string]struct {
+		existing []string
+		query    url.Values
+		// committed is committed while waiting
+		committed string
+
+		expectedStatus  int
+		expectedKeys    []string
+		expectedCursor  string
+		expectedErrBody string
+	}{
+		"changes committed already": {
+			existing:       []string{"a/1", "b/2", "a/3"},
+			query:          url.Values{"since": {"epoch.1"}, "prefix": {"a/"}},
+			expectedStatus: http.StatusOK,
+			expectedKeys:   []string{"a/3"},
+			expectedCursor: "epoch.3",
+		},
+		"waits for changes": {
+			existing:       []string{"a/1"},
+			query:          url.Values{"since": {"epoch.1"}},
+			committed:      "a/2",
+			expectedStatus: http.StatusOK,
+			expectedKeys:   []string{"a/2"},
+			expectedCursor: "epoch.2",
+		},
+		"no changes under the prefix": {
+			existing:       []string{"a/1", "b/2"},
+			query:          url.Values{"since": {"epoch.1"}, "prefix": {"a/"}, "wait": {"10ms"}},
+			expectedStatus: http.StatusOK,
+			expectedKeys:   []string{},
+			// past the changes left out
+			expectedCursor: "epoch.2",
+		},
+		"expired cursor": {
+			query:           url.Values{"since": {"old-epoch.1"}},
+			expectedStatus:  http.StatusGone,
+			expectedErrBody: "cursor too old, take a new snapshot",
+		},
+		"invalid cursor": {
+			query:           url.Values{"since": {"nope"}},
+			expectedStatus:  http.StatusBadRequest,
+			expectedErrBody: "invalid cursor",
+		},
+		"invalid wait": {
+			query:           url.Values{"since": {"epoch.0"}, "wait": {"forever"}},
+			expectedStatus:  http.StatusBadRequest,
+			expectedErrBody: "invalid wait duration",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			log := newChangeLog(tc.existing...)
+			srv := rest.NewWatchServer(logrus.New(), log.feed(), log.bus)
+			defer srv.Close()
+
+			if tc.committed != "" {
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					log.put(tc.committed)
+				}()
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/v1/changes/watch?"+tc.query.Encode(), nil)
+			srv.WatchChanges(w, r)
+
+			require.Equal(t, tc.expectedStatus, w.Code)
+			if tc.expectedErrBody != "" {
+				assert.Contains(t, w.Body.String(), tc.expectedErrBody)
+				return
+			}
+			var resp rest.GetChangesResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			keys := []string{}
+			for change := range slices.Values(resp.Changes) {
+				keys = append(keys, change.Key)
+			}
+			assert.Equal(t, tc.expectedKeys, keys)
+			assert.Equal(t, tc.expectedCursor, resp.Cursor)
+		})
+	}
+}
+
+// readEvent returns the lines of the next event, or comment, of a server-sent event stream.
+func readEvent(t *testing.T, sc *bufio.Scanner) []string {
+	t.Helper()
+
+	var lines []string
+	for sc.Scan() {
+		if sc.Text() == "" {
+			return lines
+		}
+		lines = append(lines, sc.Text())
+	}
+	require.NoError(t, sc.Err())
+	require.Fail(t, "change stream ended")
+	return nil
+}
+
+// openStream opens a change stream, resuming after the given event ID.
+func openStream(t *testing.T, ctx context.Context, serverURL, lastEventID string) *bufio.Scanner {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+"/v1/changes/watch?since=epoch.0", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewScanner(resp.Body)
+}
+
+func TestWatchChangesStream(t *testing.T) {
+	log := newChangeLog("a/1")
+	watchServer := rest.NewWatchServer(logrus.New(), log.feed(), log.bus, rest.WithHeartbeat(10*time.Millisecond))
+	srv := httptest.NewServer(http.HandlerFunc(watchServer.WatchChanges))
+	defer srv.Close()
+	defer watchServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := openStream(t, ctx, srv.URL, "")
+	assert.Equal(t, []string{
+		"id: epoch.1",
+		"event: change",
+		`data: {"seq":1,"op":"put","key":"a/1","metadata":{"key":"a/1","size":0,"sha256_checksum":"sha-a/1"}}`,
+	}, readEvent(t, sc))
+
+	// an idle stream gets heartbeats
+	assert.Equal(t, []string{": heartbeat"}, readEvent(t, sc))
+
+	// changes are pushed as they're committed
+	log.put("a/2")
+	event := readEvent(t, sc)
+	for slices.Equal(event, []string{": heartbeat"}) {
+		event = readEvent(t, sc)
+	}
+	require.Len(t, event, 3)
+	assert.Equal(t, "id: epoch.2", event[0])
+	cancel()
+
+	// reconnecting resumes after the last event received
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	sc = openStream(t, ctx, srv.URL, "epoch.1")
+	event = readEvent(t, sc)
+	require.Len(t, event, 3)
+	assert.Equal(t, "id: epoch.2", event[0])
+
+	sc = openStream(t, ctx, srv.URL, "old-epoch.1")
+	event = readEvent(t, sc)
+	require.NotEmpty(t, event)
+	assert.Equal(t, "event: expired", event[0])
+	assert.False(t, sc.Scan(), "the stream must end once the cursor has expired")
+	assert.True(t, strings.HasPrefix(event[1], "data: cursor too old"))
+}
@@ -0,0 +1,385 @@
+// filesync-admin is the operator tool for a running filesync server. It talks to the admin endpoints, which are
+// only enabled when the server is started with -admin-token. Offline commands work on the storage directly instead,
+// while the server is stopped.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	restapi "github.com/hedisam/filesync/server/api/rest"
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+	"github.com/hedisam/filesync/server/internal/blobstorage/encrypted"
+	"github.com/hedisam/filesync/server/internal/blobstorage/filesystem"
+)
+
+type Options struct {
+	ServerAddr string
+	AdminToken string
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *client, args []string) error
+	// offline commands don't talk to the server, so they don't need the admin token
+	offline bool
+}
+
+var commands = map[string]command{
+	"layout": {
+		usage: "Print the storage layout and the progress of any layout migration",
+		run:   runLayout,
+	},
+	"fsck": {
+		usage: "Check every file's object is still stored, and intact with -verify, and list orphan objects, e.g. fsck -verify",
+		run:   runFsck,
+	},
+	"deletions": {
+		usage: "Print the number of objects waiting to be deleted and the dead letters the janitor gave up on",
+		run:   runDeletions,
+	},
+	"requeue-deletion": {
+		usage: "Retry deleting the object of a dead letter, e.g. requeue-deletion -id 42",
+		run:   runRequeueDeletion,
+	},
+	"migrate-layout": {
+		usage: "Migrate the storage layout while the server keeps serving, e.g. migrate-layout -layout fanout",
+		run:   runMigrateLayout,
+	},
+	"devices": {
+		usage: "List the devices syncing with the server and flag the stale ones, e.g. devices -namespace docs",
+		run:   runDevices,
+	},
+	"remove-device": {
+		usage: "Forget a decommissioned device, e.g. remove-device -id 3f2a9c",
+		run:   runRemoveDevice,
+	},
+	"rewrap": {
+		usage:   "Re-wrap the data keys of encrypted objects with the active master key, offline, e.g. rewrap -dest-dir d -key-file k",
+		run:     runRewrap,
+		offline: true,
+	},
+}
+
+func main() {
+	var opts Options
+	flag.StringVar(&opts.ServerAddr, "server-addr", "http://localhost:8080", "FileServer address to connect to.")
+	flag.StringVar(&opts.AdminToken, "admin-token", os.Getenv("FILESYNC_ADMIN_TOKEN"), "Admin token the server was started with; defaults to $FILESYNC_ADMIN_TOKEN.")
+	flag.Usage = usage
+	flag.Parse()
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok || (!cmd.offline && opts.AdminToken == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	c := &client{
+		baseURL: strings.TrimSuffix(opts.ServerAddr, "/"),
+		token:   opts.AdminToken,
+	}
+	err := cmd.run(ctx, c, flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] <command> [command flags]\n\nCommands:\n", os.Args[0])
+	for name := range slices.Values(slices.Sorted(maps.Keys(commands))) {
+		fmt.Fprintf(out, "  %-16s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func runLayout(ctx context.Context, c *client, _ []string) error {
+	var resp restapi.StorageLayoutResponse
+	err := c.do(ctx, http.MethodGet, "/v1/admin/storage/layout", nil, &resp)
+	if err != nil {
+		return err
+	}
+	printLayout(&resp)
+	return nil
+}
+
+func runMigrateLayout(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	layout := fs.String("layout", "", "Layout to migrate to: flat or fanout (required)")
+	wait := fs.Bool("wait", true, "Wait for the migration to complete")
+	_ = fs.Parse(args)
+	if *layout == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var resp restapi.StorageLayoutResponse
+	err := c.do(ctx, http.MethodPost, "/v1/admin/storage/layout", &restapi.MigrateStorageLayoutRequest{Layout: *layout}, &resp)
+	if err != nil {
+		return err
+	}
+	printLayout(&resp)
+
+	for *wait && resp.Running {
+		select {
+		case <-ctx.Done():
+			fmt.Println("Stopped waiting; the migration keeps running on the server")
+			return nil
+		case <-time.After(time.Second):
+		}
+
+		// omitted fields must not keep their previous values
+		resp = restapi.StorageLayoutResponse{}
+		err = c.do(ctx, http.MethodGet, "/v1/admin/storage/layout", nil, &resp)
+		if err != nil {
+			return err
+		}
+		printLayout(&resp)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("migration failed: %s", resp.Error)
+	}
+	if !resp.Running {
+		fmt.Printf("Restart the server with -storage-layout %s from now on\n", resp.Layout)
+	}
+
+	return nil
+}
+
+func runFsck(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	verify := fs.Bool("verify", false, "Re-hash the stored objects rather than only checking they exist")
+	_ = fs.Parse(args)
+
+	var resp restapi.FsckResponse
+	err := c.do(ctx, http.MethodPost, "/v1/admin/fsck", &restapi.FsckRequest{Verify: *verify}, &resp)
+	if err != nil {
+		return err
+	}
+
+	printProblems := func(kind string, problems []restapi.FsckProblem) {
+		for p := range slices.Values(problems) {
+			fmt.Printf("%s: %s/%s (object %s): %s\n", kind, p.Namespace, p.Key, p.ObjectID, p.Error)
+		}
+	}
+	printProblems("corrupt", resp.Corrupt)
+	printProblems("missing", resp.Missing)
+	printProblems("failed", resp.Failed)
+	for objectID := range slices.Values(resp.Orphans) {
+		fmt.Printf("orphan: object %s\n", objectID)
+	}
+	fmt.Printf("checked: %d, verified: %d (%d bytes), corrupt: %d, missing: %d, failed: %d, orphans: %d, took %s\n",
+		resp.Checked, resp.Verified, resp.VerifiedBytes, len(resp.Corrupt), len(resp.Missing), len(resp.Failed), len(resp.Orphans), resp.Took)
+
+	if len(resp.Corrupt) > 0 || len(resp.Missing) > 0 || len(resp.Failed) > 0 {
+		return errors.New("found problems with stored objects")
+	}
+	return nil
+}
+
+func runDeletions(ctx context.Context, c *client, _ []string) error {
+	var resp restapi.DeletionsResponse
+	err := c.do(ctx, http.MethodGet, "/v1/admin/deletions", nil, &resp)
+	if err != nil {
+		return err
+	}
+
+	for dl := range slices.Values(resp.DeadLetters) {
+		fmt.Printf("dead letter %d: object %s (%s/%s), enqueued at %s, %d attempts: %s\n",
+			dl.ID, dl.ObjectID, dl.Namespace, dl.Key, dl.EnqueuedAt.Format(time.RFC3339), dl.Attempts, dl.LastError)
+	}
+	fmt.Printf("pending: %d, dead letters: %d\n", resp.Pending, len(resp.DeadLetters))
+	return nil
+}
+
+func runRequeueDeletion(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("requeue-deletion", flag.ExitOnError)
+	id := fs.Uint64("id", 0, "ID of the dead letter to requeue (required)")
+	_ = fs.Parse(args)
+	if *id == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var resp restapi.RequeueDeletionResponse
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/v1/admin/deletions/%d/requeue", *id), nil, &resp)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Requeued dead letter %d\n", *id)
+	return nil
+}
+
+func runDevices(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("devices", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "Only list the devices syncing this namespace")
+	_ = fs.Parse(args)
+
+	path := "/v1/admin/devices"
+	if *namespace != "" {
+		path += "?" + url.Values{"namespace": {*namespace}}.Encode()
+	}
+	var resp restapi.ListDevicesResponse
+	err := c.do(ctx, http.MethodGet, path, nil, &resp)
+	if err != nil {
+		return err
+	}
+
+	stale := 0
+	for d := range slices.Values(resp.Devices) {
+		fmt.Printf("device %s (%s): namespace %s, client %s, last seen %s, cursor %q, %d files (%d bytes)",
+			d.ID, d.Name, d.Namespace, d.ClientVersion, d.LastSeen.Format(time.RFC3339), d.Cursor, d.SyncRoot.Files, d.SyncRoot.Bytes)
+		if d.Stale {
+			stale++
+			fmt.Printf(", STALE: %s", d.Staleness)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("devices: %d, stale: %d\n", len(resp.Devices), stale)
+	return nil
+}
+
+func runRemoveDevice(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("remove-device", flag.ExitOnError)
+	id := fs.String("id", "", "ID of the device to forget (required)")
+	_ = fs.Parse(args)
+	if *id == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var resp restapi.DeleteDeviceResponse
+	err := c.do(ctx, http.MethodDelete, "/v1/admin/devices/"+url.PathEscape(*id), nil, &resp)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed device %s\n", *id)
+	return nil
+}
+
+func runRewrap(ctx context.Context, _ *client, args []string) error {
+	fs := flag.NewFlagSet("rewrap", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "Key file of the server, with the new master key active and the old ones still present (required)")
+	destDir := fs.String("dest-dir", "", "Destination directory the server stores objects in (required unless -storage-config is set)")
+	layout := fs.String("storage-layout", string(filesystem.LayoutFlat), "Layout of the objects in the destination directory: flat or fanout")
+	backendName := fs.String("storage-backend", "filesystem", fmt.Sprintf("Backend the server stores objects in, one of %v", blobstorage.Backends()))
+	storageConfig := fs.String("storage-config", "", "Path to the JSON config of the storage backend the server uses")
+	verbose := fs.Bool("v", false, "Verbose output")
+	_ = fs.Parse(args)
+	if *keyFile == "" || (*storageConfig == "" && *destDir == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	logger := logrus.New()
+	if *verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+
+	keyring, err := encrypted.LoadKeyring(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	var config json.RawMessage
+	if *storageConfig != "" {
+		config, err = os.ReadFile(*storageConfig)
+	} else {
+		config, err = json.Marshal(&filesystem.Config{RootDir: *destDir, Layout: filesystem.Layout(*layout)})
+	}
+	if err != nil {
+		return fmt.Errorf("storage backend config: %w", err)
+	}
+	backend, err := blobstorage.Open(ctx, logger, *backendName, config)
+	if err != nil {
+		return err
+	}
+	rewriter, ok := backend.(encrypted.HeaderRewriter)
+	if !ok {
+		return fmt.Errorf("the %s storage backend can't re-wrap objects in place", *backendName)
+	}
+
+	// metadata isn't persisted yet, so the server has none of the objects stored before it restarts to record their new
+	// master key in; the objects it stores from then on record the active one
+	stats, err := encrypted.Rewrap(ctx, logger, rewriter, keyring, nil)
+	fmt.Printf("re-wrapped: %d, already using %s: %d, unencrypted: %d\n", stats.Rewrapped, keyring.ActiveKeyID(), stats.Unchanged, stats.Unencrypted)
+	if err != nil {
+		return fmt.Errorf("rewrap: %w; it's safe to run again", err)
+	}
+	fmt.Println("Old master keys can be removed from the key file now")
+
+	return nil
+}
+
+func printLayout(resp *restapi.StorageLayoutResponse) {
+	if resp.MigratingFrom == "" {
+		fmt.Printf("layout: %s\n", resp.Layout)
+		return
+	}
+	state := "interrupted"
+	if resp.Running {
+		state = "running"
+	}
+	fmt.Printf("layout: %s, migrating from %s (%s), %d objects moved\n", resp.Layout, resp.MigratingFrom, state, resp.Moved)
+}
+
+type client struct {
+	baseURL string
+	token   string
+}
+
+func (c *client) do(ctx context.Context, method, path string, reqBody, respBody any) error {
+	var body io.Reader
+	if reqBody != nil {
+		data, err := json.Marshal(reqBody)
+		if err != nil {
+			return fmt.Errorf("marshal request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(respBody)
+	if err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Package blobstorage defines the interface implemented by the blob storage backends, and a registry the backends
+// register themselves with so the server can pick one by name. Backends register in their init func, the same way
+// database/sql drivers do, so importing a backend package is enough to make it available.
+package blobstorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNotFound           = errors.New("object not found")
+	ErrVerificationFailed = errors.New("object verification failed")
+)
+
+// Backend stores the objects, i.e. the content of the files. Metadata is kept by the server regardless of where the
+// objects are stored.
+type Backend interface {
+	// PutObject stores the data read from r under the given objectID and returns its sha256 checksum and size. The
+	// object must only become visible once the provided verify func, if not nil, has accepted the checksum and size.
+	// A verification error is wrapped in ErrVerificationFailed.
+	PutObject(ctx context.Context, r io.Reader, objectID string, verify func(checksum string, written int64) error) (checksum string, written int64, err error)
+	// GetObject returns a reader streaming the content of the given object, or ErrNotFound.
+	GetObject(ctx context.Context, objectID string) (io.ReadCloser, error)
+	// DeleteObject removes the given object. It's not an error if the object doesn't exist.
+	DeleteObject(ctx context.Context, objectID string) error
+}
+
+// Factory creates a Backend from its JSON encoded config.
+type Factory func(ctx context.Context, logger *logrus.Logger, config json.RawMessage) (Backend, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a backend available by the given name. It panics if a backend is registered twice.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("blobstorage: backend %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Backends returns the sorted names of the registered backends.
+func Backends() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return slices.Sorted(maps.Keys(factories))
+}
+
+// Open creates the backend registered by the given name.
+func Open(ctx context.Context, logger *logrus.Logger, name string, config json.RawMessage) (Backend, error) {
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q, available backends: %v", name, Backends())
+	}
+
+	backend, err := factory(ctx, logger, config)
+	if err != nil {
+		return nil, fmt.Errorf("open %s storage backend: %w", name, err)
+	}
+	return backend, nil
+}
@@ -0,0 +1,40 @@
+package blobstorage_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+)
+
+func TestRegistry(t *testing.T) {
+	var gotConfig json.RawMessage
+	blobstorage.Register("test", func(ctx context.Context, logger *logrus.Logger, config json.RawMessage) (blobstorage.Backend, error) {
+		gotConfig = config
+		if string(config) == `{"fail":true}` {
+			return nil, errors.New("boom")
+		}
+		return nil, nil
+	})
+	assert.Contains(t, blobstorage.Backends(), "test")
+
+	_, err := blobstorage.Open(context.Background(), logrus.New(), "test", json.RawMessage(`{"a":1}`))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"a":1}`, string(gotConfig))
+
+	_, err = blobstorage.Open(context.Background(), logrus.New(), "test", json.RawMessage(`{"fail":true}`))
+	assert.EqualError(t, err, "open test storage backend: boom")
+
+	_, err = blobstorage.Open(context.Background(), logrus.New(), "missing", nil)
+	assert.ErrorContains(t, err, `unknown storage backend "missing"`)
+
+	assert.Panics(t, func() {
+		blobstorage.Register("test", nil)
+	})
+}
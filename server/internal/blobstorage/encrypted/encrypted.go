@@ -0,0 +1,248 @@
+// Package encrypted provides a blob storage backend that encrypts objects at rest before storing them in another
+// backend, using envelope encryption: every object is encrypted with its own random data key, and the data key is
+// stored next to it, wrapped with a master key. Rotating the master key only requires re-wrapping the data keys, not
+// re-encrypting the objects.
+//
+// Stored objects start with a fixed-size header holding the ID of the master key and the wrapped data key, followed
+// by the object content encrypted with streamcrypt, so objects are encrypted and decrypted without being buffered.
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/lib/streamcrypt"
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+)
+
+const (
+	// HeaderSize is the size of the header encrypted objects start with.
+	HeaderSize = len(magic) + 1 + MaxKeyIDLen + nonceSize + KeySize + tagSize
+
+	magic     = "FSE1"
+	nonceSize = 12
+	tagSize   = 16
+
+	keyIDOffset   = len(magic) + 1
+	nonceOffset   = keyIDOffset + MaxKeyIDLen
+	wrappedOffset = nonceOffset + nonceSize
+)
+
+var (
+	ErrInvalidHeader = errors.New("invalid encrypted object header")
+)
+
+// Storage is a blobstorage.Backend encrypting objects before storing them in another backend, and decrypting them
+// when they're read. Objects without an encryption header are refused unless WithUnencryptedReads is given.
+type Storage struct {
+	logger  *logrus.Logger
+	backend blobstorage.Backend
+	keyring *Keyring
+	// unencryptedReads makes objects without an encryption header read as is
+	unencryptedReads bool
+}
+
+type Option func(*Storage)
+
+// WithUnencryptedReads makes the Storage read the objects without an encryption header, stored before encryption was
+// enabled, as they are. It's meant for migrating to encryption at rest only: those objects aren't authenticated, so
+// anyone able to write to the underlying backend could have them served in place of the stored content.
+func WithUnencryptedReads() Option {
+	return func(s *Storage) {
+		s.unencryptedReads = true
+	}
+}
+
+func New(logger *logrus.Logger, backend blobstorage.Backend, keyring *Keyring, opts ...Option) *Storage {
+	s := &Storage{
+		logger:  logger,
+		backend: backend,
+		keyring: keyring,
+	}
+	for opt := range slices.Values(opts) {
+		opt(s)
+	}
+	return s
+}
+
+// ActiveKeyID returns the ID of the master key new objects are encrypted with.
+func (s *Storage) ActiveKeyID() string {
+	return s.keyring.ActiveKeyID()
+}
+
+// PutObject encrypts the content read from r with a new data key and stores it in the underlying backend. The
+// checksum and size passed to verify, and returned, are the ones of the plaintext, so encryption is transparent to
+// the caller.
+func (s *Storage) PutObject(ctx context.Context, r io.Reader, objectID string, verify func(checksum string, written int64) error) (string, int64, error) {
+	dataKey := make([]byte, KeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", 0, fmt.Errorf("generate data key: %w", err)
+	}
+	header, err := s.newHeader(s.keyring.ActiveKeyID(), dataKey, objectID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash := sha256.New()
+	counter := &countingReader{r: io.TeeReader(r, hash)}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(encrypt(pw, counter, header, dataKey))
+	}()
+	defer func() {
+		// unblocks the encryption if the backend gave up before reading everything, so r isn't read after we return
+		_ = pr.Close()
+		<-done
+	}()
+
+	var checksum string
+	_, _, err = s.backend.PutObject(ctx, pr, objectID, func(string, int64) error {
+		// the backend has read everything at this point, so the plaintext has been hashed and counted
+		<-done
+		checksum = hex.EncodeToString(hash.Sum(nil))
+		if verify == nil {
+			return nil
+		}
+		return verify(checksum, counter.n)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	return checksum, counter.n, nil
+}
+
+// GetObject opens the given object from the underlying backend and decrypts it as it's read. Objects without an
+// encryption header are refused with ErrInvalidHeader, unless WithUnencryptedReads is given, in which case they're
+// returned as is. Reading fails with streamcrypt.ErrInvalidStream if the object has been
+// tampered with.
+func (s *Storage) GetObject(ctx context.Context, objectID string) (io.ReadCloser, error) {
+	rc, err := s.backend.GetObject(ctx, objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, HeaderSize)
+	n, err := io.ReadFull(rc, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		_ = rc.Close()
+		return nil, fmt.Errorf("read object header: %w", err)
+	}
+	if !hasHeader(header[:n]) {
+		if !s.unencryptedReads {
+			_ = rc.Close()
+			return nil, fmt.Errorf("%w: object is not encrypted", ErrInvalidHeader)
+		}
+		s.logger.WithContext(ctx).WithField("object_id", objectID).Debug("Reading unencrypted object")
+		return readCloser{Reader: io.MultiReader(bytes.NewReader(header[:n]), rc), Closer: rc}, nil
+	}
+
+	dataKey, err := s.openHeader(header, objectID)
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	r, err := streamcrypt.NewReader(rc, dataKey)
+	if err != nil {
+		_ = rc.Close()
+		return nil, fmt.Errorf("decrypt object: %w", err)
+	}
+
+	return readCloser{Reader: r, Closer: rc}, nil
+}
+
+// DeleteObject removes the given object from the underlying backend.
+func (s *Storage) DeleteObject(ctx context.Context, objectID string) error {
+	return s.backend.DeleteObject(ctx, objectID)
+}
+
+// newHeader returns the header of an object encrypted with the given data key, wrapped with the given master key.
+// The wrapped data key is bound to the object ID and the master key ID, so headers can't be swapped between objects.
+func (s *Storage) newHeader(keyID string, dataKey []byte, objectID string) ([]byte, error) {
+	header := make([]byte, HeaderSize)
+	copy(header, magic)
+	header[len(magic)] = byte(len(keyID))
+	copy(header[keyIDOffset:], keyID)
+
+	wrapped, err := s.keyring.wrap(keyID, dataKey, header[nonceOffset:wrappedOffset], additionalData(header, objectID))
+	if err != nil {
+		return nil, err
+	}
+	copy(header[wrappedOffset:], wrapped)
+
+	return header, nil
+}
+
+// openHeader returns the data key wrapped in the given header.
+func (s *Storage) openHeader(header []byte, objectID string) ([]byte, error) {
+	keyID, err := headerKeyID(header)
+	if err != nil {
+		return nil, err
+	}
+	return s.keyring.unwrap(keyID, header[wrappedOffset:], header[nonceOffset:wrappedOffset], additionalData(header, objectID))
+}
+
+// hasHeader reports whether the given bytes, read from the start of an object, are an encryption header.
+func hasHeader(header []byte) bool {
+	return len(header) == HeaderSize && bytes.HasPrefix(header, []byte(magic))
+}
+
+// headerKeyID returns the ID of the master key the data key in the given header is wrapped with.
+func headerKeyID(header []byte) (string, error) {
+	if !hasHeader(header) {
+		return "", ErrInvalidHeader
+	}
+	n := int(header[len(magic)])
+	if n == 0 || n > MaxKeyIDLen {
+		return "", fmt.Errorf("%w: invalid key ID length %d", ErrInvalidHeader, n)
+	}
+	return string(header[keyIDOffset : keyIDOffset+n]), nil
+}
+
+func additionalData(header []byte, objectID string) []byte {
+	return append(bytes.Clone(header[:nonceOffset]), objectID...)
+}
+
+func encrypt(w io.Writer, r io.Reader, header, dataKey []byte) error {
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+	ew, err := streamcrypt.NewWriter(w, dataKey, streamcrypt.DefaultChunkSize)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ew, r)
+	if err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
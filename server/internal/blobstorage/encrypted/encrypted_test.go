@@ -0,0 +1,292 @@
+package encrypted_test
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/lib/streamcrypt"
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+	"github.com/hedisam/filesync/server/internal/blobstorage/encrypted"
+	"github.com/hedisam/filesync/server/internal/blobstorage/filesystem"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+func newKey() []byte {
+	key := make([]byte, encrypted.KeySize)
+	_, _ = rand.Read(key)
+	return key
+}
+
+func newStorage(t *testing.T, keyring *encrypted.Keyring) (*encrypted.Storage, *filesystem.FileSystem, string) {
+	t.Helper()
+	dir := t.TempDir()
+	fs, err := filesystem.New(logrus.New(), dir, filesystem.LayoutFlat)
+	require.NoError(t, err)
+	return encrypted.New(logrus.New(), fs, keyring), fs, dir
+}
+
+func readObject(t *testing.T, s *encrypted.Storage, objectID string) ([]byte, error) {
+	t.Helper()
+	rc, err := s.GetObject(context.Background(), objectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func TestPutAndGetObject(t *testing.T) {
+	keyring, err := encrypted.NewKeyring("k1", map[string][]byte{"k1": newKey()})
+	require.NoError(t, err)
+
+	tests := map[string]int{
+		"empty":           0,
+		"small":           11,
+		"multiple chunks": 3*streamcrypt.DefaultChunkSize + 7,
+	}
+
+	for name, size := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, _, dir := newStorage(t, keyring)
+			data := make([]byte, size)
+			_, _ = rand.Read(data)
+			sum := sha256.Sum256(data)
+
+			checksum, written, err := s.PutObject(context.Background(), bytes.NewReader(data), "object-id", func(checksum string, written int64) error {
+				assert.Equal(t, hex.EncodeToString(sum[:]), checksum)
+				assert.EqualValues(t, size, written)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, hex.EncodeToString(sum[:]), checksum)
+			assert.EqualValues(t, size, written)
+
+			stored, err := os.ReadFile(filepath.Join(dir, "object-id"))
+			require.NoError(t, err)
+			assert.EqualValues(t, int64(encrypted.HeaderSize)+streamcrypt.EncryptedSize(int64(size), 0), len(stored))
+			if size > 0 {
+				assert.False(t, bytes.Contains(stored, data), "objects must not be stored in plaintext")
+			}
+
+			content, err := readObject(t, s, "object-id")
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(data, content))
+		})
+	}
+}
+
+func TestPutObjectVerificationFailure(t *testing.T) {
+	keyring, err := encrypted.NewKeyring("k1", map[string][]byte{"k1": newKey()})
+	require.NoError(t, err)
+	s, _, _ := newStorage(t, keyring)
+
+	_, _, err = s.PutObject(context.Background(), bytes.NewReader([]byte("hello world")), "object-id", func(string, int64) error {
+		return errors.New("checksum mismatch")
+	})
+	require.ErrorIs(t, err, blobstorage.ErrVerificationFailed)
+
+	_, err = s.GetObject(context.Background(), "object-id")
+	assert.ErrorIs(t, err, blobstorage.ErrNotFound)
+}
+
+func TestGetObject(t *testing.T) {
+	keyring, err := encrypted.NewKeyring("k1", map[string][]byte{"k1": newKey()})
+	require.NoError(t, err)
+	otherKeyring, err := encrypted.NewKeyring("k1", map[string][]byte{"k1": newKey()})
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		tamper  func(t *testing.T, dir string)
+		keyring *encrypted.Keyring
+		opts    []encrypted.Option
+
+		expectedContent string
+		expectedErr     error
+		expectedErrMsg  string
+	}{
+		"encrypted": {
+			expectedContent: "hello world",
+		},
+		"stored before encryption was enabled": {
+			tamper: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "object-id"), []byte("plain"), 0644))
+			},
+			expectedErr: encrypted.ErrInvalidHeader,
+		},
+		"stored before encryption was enabled, while migrating": {
+			tamper: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "object-id"), []byte("plain"), 0644))
+			},
+			opts:            []encrypted.Option{encrypted.WithUnencryptedReads()},
+			expectedContent: "plain",
+		},
+		"tampered content": {
+			tamper: func(t *testing.T, dir string) {
+				path := filepath.Join(dir, "object-id")
+				data, err := os.ReadFile(path)
+				require.NoError(t, err)
+				data[len(data)-1] ^= 1
+				require.NoError(t, os.WriteFile(path, data, 0644))
+			},
+			expectedErr: streamcrypt.ErrInvalidStream,
+		},
+		"header of another object": {
+			tamper: func(t *testing.T, dir string) {
+				require.NoError(t, os.Rename(filepath.Join(dir, "other-id"), filepath.Join(dir, "object-id")))
+			},
+			expectedErr:    encrypted.ErrInvalidHeader,
+			expectedErrMsg: "unwrap data key",
+		},
+		"unknown master key": {
+			keyring:     mustKeyring(t, "k2", map[string][]byte{"k2": newKey()}),
+			expectedErr: encrypted.ErrUnknownKey,
+		},
+		"wrong master key": {
+			keyring:        otherKeyring,
+			expectedErrMsg: "unwrap data key",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, fs, dir := newStorage(t, keyring)
+			for objectID := range map[string]struct{}{"object-id": {}, "other-id": {}} {
+				_, _, err := s.PutObject(context.Background(), bytes.NewReader([]byte("hello world")), objectID, nil)
+				require.NoError(t, err)
+			}
+			if tc.tamper != nil {
+				tc.tamper(t, dir)
+			}
+			if tc.keyring != nil || tc.opts != nil {
+				s = encrypted.New(logrus.New(), fs, cmp.Or(tc.keyring, keyring), tc.opts...)
+			}
+
+			content, err := readObject(t, s, "object-id")
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			if tc.expectedErrMsg != "" {
+				require.ErrorContains(t, err, tc.expectedErrMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedContent, string(content))
+		})
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	oldKey, newKey := newKey(), newKey()
+	s, fs, dir := newStorage(t, mustKeyring(t, "old", map[string][]byte{"old": oldKey}))
+	for objectID := range map[string]struct{}{"a": {}, "b": {}} {
+		_, _, err := s.PutObject(context.Background(), bytes.NewReader([]byte("content of "+objectID)), objectID, nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plain"), []byte("plain"), 0644))
+	before, err := os.ReadFile(filepath.Join(dir, "a"))
+	require.NoError(t, err)
+
+	// the new key is made active while the old one is still around to unwrap existing data keys
+	rotated := mustKeyring(t, "new", map[string][]byte{"old": oldKey, "new": newKey})
+	// only a has metadata
+	recorded := make(recorder)
+	stats, err := encrypted.Rewrap(context.Background(), logrus.New(), fs, rotated, recorded)
+	require.NoError(t, err)
+	assert.Equal(t, encrypted.RewrapStats{Rewrapped: 2, Unencrypted: 1}, stats)
+	assert.Equal(t, recorder{"a": "new"}, recorded)
+
+	after, err := os.ReadFile(filepath.Join(dir, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, before[encrypted.HeaderSize:], after[encrypted.HeaderSize:], "only the header must be rewritten")
+
+	// the old key isn't needed anymore
+	s = encrypted.New(logrus.New(), fs, mustKeyring(t, "new", map[string][]byte{"new": newKey}))
+	for objectID := range map[string]struct{}{"a": {}, "b": {}} {
+		content, err := readObject(t, s, objectID)
+		require.NoError(t, err)
+		assert.Equal(t, "content of "+objectID, string(content))
+	}
+
+	stats, err = encrypted.Rewrap(context.Background(), logrus.New(), fs, rotated, nil)
+	require.NoError(t, err)
+	assert.Equal(t, encrypted.RewrapStats{Unchanged: 2, Unencrypted: 1}, stats)
+}
+
+// recorder records the master keys of the objects re-wrapped by their IDs, and has no metadata of the others than a.
+type recorder map[string]string
+
+func (r recorder) ObjectRewrapped(_ context.Context, objectID, keyID string) error {
+	if objectID != "a" {
+		return store.ErrNotFound
+	}
+	r[objectID] = keyID
+	return nil
+}
+
+func TestLoadKeyring(t *testing.T) {
+	tests := map[string]struct {
+		content     string
+		expectedErr string
+	}{
+		"valid": {
+			content: `{"active": "k2", "keys": {"k1": "` + b64(32) + `", "k2": "` + b64(32) + `"}}`,
+		},
+		"unknown active key": {
+			content:     `{"active": "k3", "keys": {"k1": "` + b64(32) + `"}}`,
+			expectedErr: "unknown master key",
+		},
+		"short key": {
+			content:     `{"active": "k1", "keys": {"k1": "` + b64(16) + `"}}`,
+			expectedErr: "must be 32 bytes long",
+		},
+		"long key ID": {
+			content:     `{"active": "` + string(bytes.Repeat([]byte("k"), 33)) + `", "keys": {"` + string(bytes.Repeat([]byte("k"), 33)) + `": "` + b64(32) + `"}}`,
+			expectedErr: "must be 1 to 32 bytes long",
+		},
+		"invalid base64": {
+			content:     `{"active": "k1", "keys": {"k1": "not base64!"}}`,
+			expectedErr: "decode master key",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.json")
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0600))
+
+			keyring, err := encrypted.LoadKeyring(path)
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "k2", keyring.ActiveKeyID())
+		})
+	}
+}
+
+func mustKeyring(t *testing.T, active string, keys map[string][]byte) *encrypted.Keyring {
+	t.Helper()
+	keyring, err := encrypted.NewKeyring(active, keys)
+	require.NoError(t, err)
+	return keyring
+}
+
+func b64(n int) string {
+	return base64.StdEncoding.EncodeToString(make([]byte, n))
+}
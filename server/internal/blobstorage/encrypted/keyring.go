@@ -0,0 +1,138 @@
+package encrypted
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+)
+
+const (
+	// KeySize is the size of master keys and data keys, i.e. AES-256.
+	KeySize = 32
+	// MaxKeyIDLen bounds the length of master key IDs so they fit in the fixed-size blob header.
+	MaxKeyIDLen = 32
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown master key")
+)
+
+// Keyring holds the master keys data keys are wrapped with. New data keys are always wrapped with the active key;
+// the others are only kept to unwrap the data keys of objects that haven't been re-wrapped yet.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// keyFile is the format of key files, e.g.
+//
+//	{"active": "2024-06", "keys": {"2024-01": "<base64 key>", "2024-06": "<base64 key>"}}
+type keyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// LoadKeyring loads the master keys from the given key file. Keys are base64 encoded random 32 byte keys, e.g. as
+// generated by `openssl rand -base64 32`.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+
+	var kf keyFile
+	err = json.Unmarshal(data, &kf)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal key file: %w", err)
+	}
+
+	keys := make(map[string][]byte, len(kf.Keys))
+	for id, encoded := range kf.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode master key %q: %w", id, err)
+		}
+		keys[id] = key
+	}
+
+	return NewKeyring(kf.Active, keys)
+}
+
+// NewKeyring returns a Keyring with the given master keys, wrapping new data keys with the active one.
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active master key %q: %w", active, ErrUnknownKey)
+	}
+
+	kr := &Keyring{
+		active: active,
+		keys:   make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id := range slices.Values(slices.Sorted(maps.Keys(keys))) {
+		if id == "" || len(id) > MaxKeyIDLen {
+			return nil, fmt.Errorf("master key ID %q must be 1 to %d bytes long", id, MaxKeyIDLen)
+		}
+		key := keys[id]
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("master key %q must be %d bytes long, got %d", id, KeySize, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("master key %q: %w", id, err)
+		}
+		kr.keys[id] = aead
+	}
+
+	return kr, nil
+}
+
+// ActiveKeyID returns the ID of the master key new data keys are wrapped with.
+func (kr *Keyring) ActiveKeyID() string {
+	return kr.active
+}
+
+// wrap seals the data key with the given master key, authenticating the additional data with it.
+func (kr *Keyring) wrap(keyID string, dataKey, nonce, additionalData []byte) ([]byte, error) {
+	aead, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return aead.Seal(nil, nonce, dataKey, additionalData), nil
+}
+
+// unwrap opens a data key wrapped with the given master key. It fails with ErrInvalidHeader if the wrapped key fails
+// authentication.
+func (kr *Keyring) unwrap(keyID string, wrapped, nonce, additionalData []byte) ([]byte, error) {
+	aead, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	dataKey, err := aead.Open(nil, nonce, wrapped, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unwrap data key with master key %q: %w", ErrInvalidHeader, keyID, err)
+	}
+	return dataKey, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("create gcm: %w", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,91 @@
+package encrypted
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+// HeaderRewriter is implemented by the backends whose objects can be re-wrapped in place.
+type HeaderRewriter interface {
+	ListObjects(ctx context.Context, fn func(objectID string) error) error
+	UpdateObjectHeader(ctx context.Context, objectID string, size int, update func(header []byte) (bool, error)) error
+}
+
+// KeyIDRecorder is implemented by the metadata stores that record the master key every object is wrapped with.
+type KeyIDRecorder interface {
+	ObjectRewrapped(ctx context.Context, objectID, keyID string) error
+}
+
+// RewrapStats counts the objects visited by Rewrap.
+type RewrapStats struct {
+	Rewrapped   int
+	Unchanged   int
+	Unencrypted int
+}
+
+// Rewrap re-wraps the data key of every object stored in the given backend with the active master key of the
+// keyring, which must still hold the master keys they're currently wrapped with. Objects aren't re-encrypted, so it
+// only rewrites their headers. It's meant to be run offline, after a new master key has been made active; once it
+// completes the old master keys can be removed from the key file. It's safe to run again if interrupted. The given
+// recorder, if any, is told the new master key of every object re-wrapped; objects it has no metadata of are skipped.
+func Rewrap(ctx context.Context, logger *logrus.Logger, backend HeaderRewriter, keyring *Keyring, recorder KeyIDRecorder) (RewrapStats, error) {
+	s := New(logger, nil, keyring)
+	activeKeyID := keyring.ActiveKeyID()
+
+	var stats RewrapStats
+	err := backend.ListObjects(ctx, func(objectID string) error {
+		rewrapped := false
+		err := backend.UpdateObjectHeader(ctx, objectID, HeaderSize, func(header []byte) (bool, error) {
+			if !hasHeader(header) {
+				stats.Unencrypted++
+				return false, nil
+			}
+			keyID, err := headerKeyID(header)
+			if err != nil {
+				return false, err
+			}
+			if keyID == activeKeyID {
+				stats.Unchanged++
+				return false, nil
+			}
+
+			dataKey, err := s.openHeader(header, objectID)
+			if err != nil {
+				return false, err
+			}
+			newHeader, err := s.newHeader(activeKeyID, dataKey, objectID)
+			if err != nil {
+				return false, err
+			}
+			copy(header, newHeader)
+			stats.Rewrapped++
+			rewrapped = true
+			return true, nil
+		})
+		if err != nil {
+			return fmt.Errorf("rewrap object %q: %w", objectID, err)
+		}
+		if !rewrapped || recorder == nil {
+			return nil
+		}
+		err = recorder.ObjectRewrapped(ctx, objectID, activeKeyID)
+		if errors.Is(err, store.ErrNotFound) {
+			logger.WithField("object_id", objectID).Debug("Re-wrapped object has no metadata to record its master key in")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("record master key of object %q: %w", objectID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
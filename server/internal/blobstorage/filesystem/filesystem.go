@@ -2,46 +2,176 @@ package filesystem
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+)
+
+const (
+	// tmpDir is where objects are written to until they're verified and moved to their final name.
+	tmpDir = ".tmp"
+)
+
+var (
+	ErrVerificationFailed = blobstorage.ErrVerificationFailed
 )
 
+func init() {
+	blobstorage.Register("filesystem", open)
+}
+
+// Config is the config of the filesystem backend when it's opened via the blobstorage registry.
+type Config struct {
+	RootDir string `json:"root_dir"`
+	Layout  Layout `json:"layout"`
+}
+
+// open creates a FileSystem from its JSON encoded Config. A layout migration interrupted by a restart is resumed
+// right away; objects are looked up in both layouts until it's done.
+func open(ctx context.Context, logger *logrus.Logger, config json.RawMessage) (blobstorage.Backend, error) {
+	cfg := Config{
+		Layout: LayoutFlat,
+	}
+	err := json.Unmarshal(config, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal config: %w", err)
+	}
+	if cfg.RootDir == "" {
+		return nil, errors.New("root_dir is required")
+	}
+	layout, err := ParseLayout(string(cfg.Layout))
+	if err != nil {
+		return nil, err
+	}
+
+	fs, err := New(logger, cfg.RootDir, layout)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.MigrationStatus().MigratingFrom != "" {
+		err = fs.StartMigration(ctx, layout)
+		if err != nil {
+			return nil, fmt.Errorf("resume storage layout migration: %w", err)
+		}
+	}
+
+	return fs, nil
+}
+
 type FileSystem struct {
-	logger *logrus.Logger
-	dir    *os.Root
+	logger  *logrus.Logger
+	rootDir string
+	dir     *os.Root
+
+	// mu guards the manifest. Objects are moved to their final path under the read lock so a layout migration can't
+	// start in between picking the path and renaming the object into it.
+	mu        sync.RWMutex
+	manifest  Manifest
+	migration *migration
 }
 
-func New(logger *logrus.Logger, rootDir string) (*FileSystem, error) {
-	logger.WithField("root_dir", rootDir).Info("Getting directory-limited filesystem access")
+// New returns a FileSystem storing objects under rootDir in the given layout. It refuses to use a store whose
+// manifest records a different layout; such a store must be migrated first.
+func New(logger *logrus.Logger, rootDir string, layout Layout) (*FileSystem, error) {
+	logger.WithFields(logrus.Fields{
+		"root_dir": rootDir,
+		"layout":   layout,
+	}).Info("Getting directory-limited filesystem access")
 
 	dir, err := os.OpenRoot(rootDir)
 	if err != nil {
 		return nil, fmt.Errorf("open root dir: %w", err)
 	}
 
-	return &FileSystem{
-		logger: logger,
-		dir:    dir,
-	}, nil
+	fs := &FileSystem{
+		logger:  logger,
+		rootDir: rootDir,
+		dir:     dir,
+	}
+
+	err = fs.sweepTempFiles()
+	if err != nil {
+		_ = dir.Close()
+		return nil, fmt.Errorf("sweep stale temp files: %w", err)
+	}
+
+	err = fs.initManifest(layout)
+	if err != nil {
+		_ = dir.Close()
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *FileSystem) initManifest(layout Layout) error {
+	m, isNew, err := loadManifest(fs.rootDir, layout)
+	if err != nil {
+		return fmt.Errorf("load manifest: %w", err)
+	}
+	if m.Layout != layout {
+		if m.MigratingFrom != "" {
+			return fmt.Errorf("%w: store is being migrated from %q to %q, configured %q", ErrLayoutMismatch, m.MigratingFrom, m.Layout, layout)
+		}
+		return fmt.Errorf("%w: store is laid out as %q, configured %q", ErrLayoutMismatch, m.Layout, layout)
+	}
+	if isNew {
+		err = writeManifest(fs.rootDir, m)
+		if err != nil {
+			return fmt.Errorf("write manifest: %w", err)
+		}
+	}
+	if m.MigratingFrom != "" {
+		fs.logger.WithFields(logrus.Fields{
+			"from": m.MigratingFrom,
+			"to":   m.Layout,
+		}).Warn("Storage layout migration is incomplete and must be resumed")
+	}
+
+	fs.manifest = m
+	return nil
 }
 
 // PutObject reads data from the provided io.Reader and stores it under the given objectID as name. It calculates
 // the data checksum along the way as well and returns it along with the number of bytes written.
-func (fs *FileSystem) PutObject(ctx context.Context, r io.Reader, objectID string) (checksum string, written int64, err error) {
+// The data is written to a temp file first which is synced and then passed to the verify func, if provided, before
+// being renamed to its final name; an object is either stored in full and verified, or not at all. The temp file is
+// removed if writing or verification fails; a verification error is wrapped in ErrVerificationFailed.
+func (fs *FileSystem) PutObject(ctx context.Context, r io.Reader, objectID string, verify func(checksum string, written int64) error) (checksum string, written int64, err error) {
 	logger := fs.logger.WithContext(ctx).WithField("object_id", objectID)
 
-	f, err := fs.dir.Create(objectID)
+	// os.Root can't rename files yet so the object ID must be a single path element that can't escape the root dir.
+	if filepath.Base(objectID) != objectID || !filepath.IsLocal(objectID) {
+		return "", 0, fmt.Errorf("invalid object id %q", objectID)
+	}
+
+	tmpName := filepath.Join(tmpDir, fmt.Sprintf("%s.%s", objectID, rand.Text()))
+	f, err := fs.dir.OpenFile(tmpName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
 	if err != nil {
 		logger.WithError(err).Error("Could not create when putting object in filesystem")
 		return "", 0, fmt.Errorf("create object file: %w", err)
 	}
-	defer f.Close()
+	defer func() {
+		_ = f.Close()
+		if err != nil {
+			if rmErr := fs.dir.Remove(tmpName); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+				logger.WithError(rmErr).Error("Could not remove temp file of failed object")
+			}
+		}
+	}()
 
 	hasher := sha256.New()
 	mw := io.MultiWriter(f, hasher)
@@ -52,21 +182,196 @@ func (fs *FileSystem) PutObject(ctx context.Context, r io.Reader, objectID strin
 		return "", 0, fmt.Errorf("write to object file: %w", err)
 	}
 
+	err = f.Sync()
+	if err != nil {
+		logger.WithError(err).Error("Could not sync file when putting object in filesystem")
+		return "", 0, fmt.Errorf("sync object file: %w", err)
+	}
+
 	checksum = hex.EncodeToString(hasher.Sum(nil))
 
+	if verify != nil {
+		err = verify(checksum, written)
+		if err != nil {
+			return "", 0, fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+		}
+	}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	path := fs.manifest.Layout.path(objectID)
+	err = os.MkdirAll(filepath.Join(fs.rootDir, filepath.Dir(path)), 0755)
+	if err != nil {
+		logger.WithError(err).Error("Could not create object dir when putting object in filesystem")
+		return "", 0, fmt.Errorf("create object dir: %w", err)
+	}
+
+	err = os.Rename(filepath.Join(fs.rootDir, tmpName), filepath.Join(fs.rootDir, path))
+	if err != nil {
+		logger.WithError(err).Error("Could not rename temp file when putting object in filesystem")
+		return "", 0, fmt.Errorf("rename object file: %w", err)
+	}
+
+	// the rename itself is only durable once the directory is synced
+	err = syncDir(filepath.Join(fs.rootDir, filepath.Dir(path)))
+	if err != nil {
+		logger.WithError(err).Warn("Could not sync object dir after putting object in filesystem")
+	}
+
 	return checksum, written, nil
 }
 
+// GetObject opens the given object for reading. It returns blobstorage.ErrNotFound if the object doesn't exist.
+func (fs *FileSystem) GetObject(ctx context.Context, objectID string) (io.ReadCloser, error) {
+	logger := fs.logger.WithContext(ctx).WithField("object_id", objectID)
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	for path := range slices.Values(fs.objectPaths(objectID)) {
+		f, err := fs.dir.Open(path)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.WithError(err).Error("Could not open object file in filesystem")
+			return nil, fmt.Errorf("open object file: %w", err)
+		}
+	}
+
+	return nil, blobstorage.ErrNotFound
+}
+
+// DeleteObject removes the given object. It's not an error if the object doesn't exist.
 func (fs *FileSystem) DeleteObject(ctx context.Context, objectID string) error {
 	logger := fs.logger.WithContext(ctx).WithField("object_id", objectID)
 
-	err := fs.dir.Remove(objectID)
-	if err != nil {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	for path := range slices.Values(fs.objectPaths(objectID)) {
+		err := fs.dir.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.WithError(err).Error("Could not remove file from filesystem")
+			return fmt.Errorf("remove object file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ListObjects calls fn with the ID of every stored object. While migrating, the old layout is walked before the new
+// one, the same order objects are looked up in, so an object being moved is listed exactly once.
+func (fs *FileSystem) ListObjects(ctx context.Context, fn func(objectID string) error) error {
+	fs.mu.RLock()
+	layouts := []Layout{fs.manifest.Layout}
+	if fs.manifest.MigratingFrom != "" {
+		layouts = []Layout{fs.manifest.MigratingFrom, fs.manifest.Layout}
+	}
+	fs.mu.RUnlock()
+
+	seen := make(map[string]struct{})
+	for layout := range slices.Values(layouts) {
+		err := layout.walk(fs.rootDir, func(objectID, _ string) error {
+			if _, ok := seen[objectID]; ok {
+				return nil
+			}
+			seen[objectID] = struct{}{}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fn(objectID)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpdateObjectHeader reads the first size bytes of the given object and passes them to update, which may change them
+// in place. If update reports a change, the bytes are written back in place and synced. Headers are meant to be small
+// enough to fit in a single disk sector so they're never partially written. It returns blobstorage.ErrNotFound if
+// the object doesn't exist.
+func (fs *FileSystem) UpdateObjectHeader(ctx context.Context, objectID string, size int, update func(header []byte) (bool, error)) error {
+	logger := fs.logger.WithContext(ctx).WithField("object_id", objectID)
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	for path := range slices.Values(fs.objectPaths(objectID)) {
+		f, err := fs.dir.OpenFile(path, os.O_RDWR, 0)
 		if errors.Is(err, os.ErrNotExist) {
-			return nil
+			continue
+		}
+		if err != nil {
+			logger.WithError(err).Error("Could not open object file in filesystem")
+			return fmt.Errorf("open object file: %w", err)
+		}
+		defer f.Close()
+
+		header := make([]byte, size)
+		n, err := io.ReadFull(f, header)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read object header: %w", err)
+		}
+		header = header[:n]
+
+		changed, err := update(header)
+		if err != nil || !changed {
+			return err
+		}
+
+		_, err = f.WriteAt(header, 0)
+		if err != nil {
+			return fmt.Errorf("write object header: %w", err)
+		}
+		err = f.Sync()
+		if err != nil {
+			return fmt.Errorf("sync object file: %w", err)
+		}
+		return nil
+	}
+
+	return blobstorage.ErrNotFound
+}
+
+// objectPaths returns the paths the given object can be found at. While migrating, the path in the old layout comes
+// first; objects are only ever moved from the old layout to the new one so looking them up in this order can't miss
+// an object that's being moved. The caller must hold the read lock.
+func (fs *FileSystem) objectPaths(objectID string) []string {
+	if fs.manifest.MigratingFrom == "" {
+		return []string{fs.manifest.Layout.path(objectID)}
+	}
+	return []string{fs.manifest.MigratingFrom.path(objectID), fs.manifest.Layout.path(objectID)}
+}
+
+// sweepTempFiles removes the temp files left behind by uploads that were interrupted, e.g. by a crash.
+// It's called on startup, when no upload can be in progress.
+func (fs *FileSystem) sweepTempFiles() error {
+	err := fs.dir.Mkdir(tmpDir, 0755)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+
+	d, err := fs.dir.Open(tmpDir)
+	if err != nil {
+		return fmt.Errorf("open temp dir: %w", err)
+	}
+	defer d.Close()
+
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return fmt.Errorf("list temp dir: %w", err)
+	}
+	for name := range slices.Values(names) {
+		err = fs.dir.Remove(filepath.Join(tmpDir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove stale temp file: %w", err)
 		}
-		logger.WithError(err).Error("Could not remove file from filesystem")
-		return fmt.Errorf("remove object file: %w", err)
+		fs.logger.WithField("name", name).Info("Removed stale temp file")
 	}
 
 	return nil
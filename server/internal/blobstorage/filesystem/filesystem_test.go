@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -16,6 +17,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/hedisam/filesync/server/internal/blobstorage"
 	"github.com/hedisam/filesync/server/internal/blobstorage/filesystem"
 )
 
@@ -35,14 +37,14 @@ func TestPutObject(t *testing.T) {
 
 	t.Run("happy path", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		fs, err := filesystem.New(logger, tmpDir)
+		fs, err := filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
 		require.NoError(t, err)
 
 		ctx := context.Background()
 		data := []byte("hello world")
 		objectID := uuid.NewString()
 
-		checksum, written, err := fs.PutObject(ctx, bytes.NewReader(data), objectID)
+		checksum, written, err := fs.PutObject(ctx, bytes.NewReader(data), objectID, nil)
 		require.NoError(t, err)
 		assert.EqualValues(t, len(data), written)
 
@@ -57,28 +59,136 @@ func TestPutObject(t *testing.T) {
 
 	t.Run("read error from reader", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		fs, err := filesystem.New(logger, tmpDir)
+		fs, err := filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
 		require.NoError(t, err)
 
 		r := errorReader{err: errors.New("read error")}
-		_, _, err = fs.PutObject(context.Background(), r, uuid.NewString())
+		_, _, err = fs.PutObject(context.Background(), r, uuid.NewString(), nil)
 		require.Error(t, err)
 		assert.Contains(t, err.Error(), "write to object file: read error")
 	})
 
 	t.Run("create failure due to perms", func(t *testing.T) {
 		roDir := t.TempDir()
-		// remove write perms
-		err := os.Chmod(roDir, 0500)
+		fs, err := filesystem.New(logger, roDir, filesystem.LayoutFlat)
 		require.NoError(t, err)
 
-		fs, err := filesystem.New(logger, roDir)
+		// remove write perms from the temp dir objects are written to first
+		err = os.Chmod(filepath.Join(roDir, ".tmp"), 0500)
 		require.NoError(t, err)
 
-		_, _, err = fs.PutObject(context.Background(), bytes.NewReader([]byte("nope")), uuid.NewString())
+		_, _, err = fs.PutObject(context.Background(), bytes.NewReader([]byte("nope")), uuid.NewString(), nil)
 		require.Error(t, err)
 		assert.Contains(t, err.Error(), "create object file")
 	})
+
+	t.Run("verification passes", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		fs, err := filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
+		require.NoError(t, err)
+
+		data := []byte("hello world")
+		sum := sha256.Sum256(data)
+		objectID := uuid.NewString()
+
+		_, _, err = fs.PutObject(context.Background(), bytes.NewReader(data), objectID, func(checksum string, written int64) error {
+			assert.Equal(t, hex.EncodeToString(sum[:]), checksum)
+			assert.EqualValues(t, len(data), written)
+			// the object must not be visible under its final name before it's verified
+			_, err := os.Stat(filepath.Join(tmpDir, objectID))
+			assert.True(t, os.IsNotExist(err))
+			return nil
+		})
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, objectID))
+		require.NoError(t, err)
+		assert.Equal(t, data, content)
+		assertNoTempFiles(t, tmpDir)
+	})
+
+	t.Run("verification failure", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		fs, err := filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
+		require.NoError(t, err)
+
+		verifyErr := errors.New("checksum mismatch")
+		objectID := uuid.NewString()
+		_, _, err = fs.PutObject(context.Background(), bytes.NewReader([]byte("hello world")), objectID, func(string, int64) error {
+			return verifyErr
+		})
+		require.ErrorIs(t, err, filesystem.ErrVerificationFailed)
+		require.ErrorIs(t, err, verifyErr)
+
+		_, err = os.Stat(filepath.Join(tmpDir, objectID))
+		assert.True(t, os.IsNotExist(err))
+		assertNoTempFiles(t, tmpDir)
+	})
+
+	t.Run("read error leaves no temp file behind", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		fs, err := filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
+		require.NoError(t, err)
+
+		_, _, err = fs.PutObject(context.Background(), errorReader{err: errors.New("read error")}, uuid.NewString(), nil)
+		require.Error(t, err)
+		assertNoTempFiles(t, tmpDir)
+	})
+
+	t.Run("invalid object id", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		fs, err := filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
+		require.NoError(t, err)
+
+		_, _, err = fs.PutObject(context.Background(), bytes.NewReader([]byte("nope")), "../escape", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid object id")
+	})
+}
+
+func TestNewSweepsStaleTempFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	err := os.Mkdir(filepath.Join(tmpDir, ".tmp"), 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(tmpDir, ".tmp", "stale.partial"), []byte("partial"), 0644)
+	require.NoError(t, err)
+	// completed objects must survive the sweep
+	err = os.WriteFile(filepath.Join(tmpDir, "object"), []byte("data"), 0644)
+	require.NoError(t, err)
+
+	_, err = filesystem.New(logrus.New(), tmpDir, filesystem.LayoutFlat)
+	require.NoError(t, err)
+
+	assertNoTempFiles(t, tmpDir)
+	_, err = os.Stat(filepath.Join(tmpDir, "object"))
+	assert.NoError(t, err)
+}
+
+func assertNoTempFiles(t *testing.T, rootDir string) {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(rootDir, ".tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestGetObject(t *testing.T) {
+	tmpDir := t.TempDir()
+	fs, err := filesystem.New(logrus.New(), tmpDir, filesystem.LayoutFlat)
+	require.NoError(t, err)
+
+	objectID := uuid.NewString()
+	err = os.WriteFile(filepath.Join(tmpDir, objectID), []byte("data"), 0644)
+	require.NoError(t, err)
+
+	rc, err := fs.GetObject(context.Background(), objectID)
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), content)
+
+	_, err = fs.GetObject(context.Background(), "missing")
+	assert.ErrorIs(t, err, blobstorage.ErrNotFound)
 }
 
 // I haven't used table testing here because each case can have its own custom setup and putting them
@@ -88,7 +198,7 @@ func TestDeleteObject(t *testing.T) {
 
 	t.Run("happy path", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		fs, err := filesystem.New(logger, tmpDir)
+		fs, err := filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
 		require.NoError(t, err)
 
 		// seed a file to delete
@@ -106,7 +216,7 @@ func TestDeleteObject(t *testing.T) {
 
 	t.Run("no errors when file does not exist", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		fs, err := filesystem.New(logger, tmpDir)
+		fs, err := filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
 		require.NoError(t, err)
 
 		err = fs.DeleteObject(context.Background(), "missing.txt")
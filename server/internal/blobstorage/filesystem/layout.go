@@ -0,0 +1,102 @@
+package filesystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Layout defines how objects are laid out under the root dir.
+type Layout string
+
+const (
+	// LayoutFlat stores every object directly under the root dir.
+	LayoutFlat Layout = "flat"
+	// LayoutFanout stores objects under two levels of prefix directories, e.g. ab/cd/<object id>, so no single
+	// directory grows too large to list or back up.
+	LayoutFanout Layout = "fanout"
+)
+
+// ParseLayout returns the Layout with the given name.
+func ParseLayout(s string) (Layout, error) {
+	switch l := Layout(s); l {
+	case LayoutFlat, LayoutFanout:
+		return l, nil
+	default:
+		return "", fmt.Errorf("unknown storage layout %q", s)
+	}
+}
+
+// path returns the path of the given object relative to the root dir.
+// The fan-out prefixes are taken from the hash of the object ID rather than the ID itself since object IDs are not
+// necessarily uniformly distributed, e.g. UUIDv7s start with a timestamp.
+func (l Layout) path(objectID string) string {
+	if l != LayoutFanout {
+		return objectID
+	}
+
+	sum := sha256.Sum256([]byte(objectID))
+	prefix := hex.EncodeToString(sum[:2])
+	return filepath.Join(prefix[:2], prefix[2:], objectID)
+}
+
+// walk calls fn for every object stored under the given root dir in this layout, in lexical order. Hidden entries,
+// e.g. the temp dir and the manifest, are never objects.
+func (l Layout) walk(rootDir string, fn func(objectID, path string) error) error {
+	depth := 0
+	if l == LayoutFanout {
+		depth = 2
+	}
+	return walkDir(rootDir, "", depth, fn)
+}
+
+func walkDir(rootDir, dir string, depth int, fn func(objectID, path string) error) error {
+	entries, err := os.ReadDir(filepath.Join(rootDir, dir))
+	if err != nil {
+		return fmt.Errorf("read dir %q: %w", dir, err)
+	}
+
+	for entry := range slices.Values(entries) {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+
+		if depth > 0 {
+			if !entry.IsDir() || !isPrefixDir(name) {
+				continue
+			}
+			err = walkDir(rootDir, path, depth-1, fn)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if entry.Type()&fs.ModeType != 0 {
+			// e.g. the prefix dirs of a fan-out layout when walking a flat one
+			continue
+		}
+		err = fn(name, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isPrefixDir reports whether the given name is the name of a fan-out prefix directory.
+func isPrefixDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
@@ -0,0 +1,209 @@
+package filesystem_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/server/internal/blobstorage/filesystem"
+)
+
+func TestFanoutLayout(t *testing.T) {
+	tmpDir := t.TempDir()
+	fs, err := filesystem.New(logrus.New(), tmpDir, filesystem.LayoutFanout)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	objectID := uuid.NewString()
+	_, _, err = fs.PutObject(ctx, bytes.NewReader([]byte("hello world")), objectID, nil)
+	require.NoError(t, err)
+
+	fullPath := fanoutPath(tmpDir, objectID)
+	content, err := os.ReadFile(fullPath)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello world"), content)
+
+	_, err = os.Stat(filepath.Join(tmpDir, objectID))
+	assert.True(t, os.IsNotExist(err))
+
+	err = fs.DeleteObject(ctx, objectID)
+	require.NoError(t, err)
+	_, err = os.Stat(fullPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestManifest(t *testing.T) {
+	logger := logrus.New()
+
+	t.Run("new store records the configured layout", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		_, err := filesystem.New(logger, tmpDir, filesystem.LayoutFanout)
+		require.NoError(t, err)
+
+		_, err = filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
+		require.ErrorIs(t, err, filesystem.ErrLayoutMismatch)
+
+		_, err = filesystem.New(logger, tmpDir, filesystem.LayoutFanout)
+		require.NoError(t, err)
+	})
+
+	t.Run("store without a manifest is flat", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		err := os.WriteFile(filepath.Join(tmpDir, uuid.NewString()), []byte("data"), 0644)
+		require.NoError(t, err)
+
+		_, err = filesystem.New(logger, tmpDir, filesystem.LayoutFanout)
+		require.ErrorIs(t, err, filesystem.ErrLayoutMismatch)
+
+		_, err = filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
+		require.NoError(t, err)
+	})
+
+	t.Run("unknown layout", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		err := os.WriteFile(filepath.Join(tmpDir, ".filesync-manifest.json"), []byte(`{"version":1,"layout":"zigzag"}`), 0644)
+		require.NoError(t, err)
+
+		_, err = filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `unknown storage layout "zigzag"`)
+	})
+}
+
+func TestMigration(t *testing.T) {
+	logger := logrus.New()
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+
+	fs, err := filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
+	require.NoError(t, err)
+
+	objectIDs := make([]string, 10)
+	for i := range objectIDs {
+		objectIDs[i] = uuid.NewString()
+		_, _, err = fs.PutObject(ctx, bytes.NewReader([]byte(objectIDs[i])), objectIDs[i], nil)
+		require.NoError(t, err)
+	}
+
+	err = fs.StartMigration(ctx, filesystem.LayoutFlat)
+	require.ErrorIs(t, err, filesystem.ErrLayoutMismatch)
+
+	err = fs.StartMigration(ctx, filesystem.LayoutFanout)
+	require.NoError(t, err)
+	// objects can be deleted while migrating, wherever they are
+	err = fs.DeleteObject(ctx, objectIDs[0])
+	require.NoError(t, err)
+
+	status := waitForMigration(t, fs)
+	require.NoError(t, status.Err)
+	assert.Equal(t, filesystem.LayoutFanout, status.Layout)
+	assert.Empty(t, status.MigratingFrom)
+
+	for i, objectID := range objectIDs {
+		_, err = os.Stat(filepath.Join(tmpDir, objectID))
+		assert.True(t, os.IsNotExist(err))
+
+		content, err := os.ReadFile(fanoutPath(tmpDir, objectID))
+		if i == 0 {
+			assert.True(t, os.IsNotExist(err))
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, []byte(objectID), content)
+	}
+
+	// the manifest now requires the new layout
+	_, err = filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
+	require.ErrorIs(t, err, filesystem.ErrLayoutMismatch)
+
+	// and back again
+	err = fs.StartMigration(ctx, filesystem.LayoutFlat)
+	require.NoError(t, err)
+	status = waitForMigration(t, fs)
+	require.NoError(t, status.Err)
+	assert.EqualValues(t, len(objectIDs)-1, status.Moved)
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	var names []string
+	for entry := range slices.Values(entries) {
+		if entry.Name()[0] != '.' {
+			names = append(names, entry.Name())
+		}
+	}
+	assert.ElementsMatch(t, objectIDs[1:], names, "the prefix dirs are removed")
+}
+
+func TestResumeMigration(t *testing.T) {
+	logger := logrus.New()
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+
+	// a migration from flat to fan-out interrupted after moving one of the objects
+	movedID, pendingID := uuid.NewString(), uuid.NewString()
+	err := os.WriteFile(filepath.Join(tmpDir, ".filesync-manifest.json"), []byte(`{"version":1,"layout":"fanout","migrating_from":"flat"}`), 0644)
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Dir(fanoutPath(tmpDir, movedID)), 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(fanoutPath(tmpDir, movedID), []byte("moved"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(tmpDir, pendingID), []byte("pending"), 0644)
+	require.NoError(t, err)
+
+	_, err = filesystem.New(logger, tmpDir, filesystem.LayoutFlat)
+	require.ErrorIs(t, err, filesystem.ErrLayoutMismatch)
+
+	fs, err := filesystem.New(logger, tmpDir, filesystem.LayoutFanout)
+	require.NoError(t, err)
+	assert.Equal(t, filesystem.LayoutFlat, fs.MigrationStatus().MigratingFrom)
+
+	// objects are listed from both layouts until the migration completes
+	var listed []string
+	err = fs.ListObjects(ctx, func(objectID string) error {
+		listed = append(listed, objectID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{movedID, pendingID}, listed)
+
+	err = fs.StartMigration(ctx, filesystem.LayoutFlat)
+	require.ErrorIs(t, err, filesystem.ErrLayoutMismatch)
+
+	err = fs.StartMigration(ctx, filesystem.LayoutFanout)
+	require.NoError(t, err)
+	status := waitForMigration(t, fs)
+	require.NoError(t, status.Err)
+	assert.EqualValues(t, 1, status.Moved)
+
+	for objectID := range slices.Values([]string{movedID, pendingID}) {
+		_, err = os.Stat(fanoutPath(tmpDir, objectID))
+		assert.NoError(t, err)
+	}
+}
+
+func waitForMigration(t *testing.T, fs *filesystem.FileSystem) filesystem.MigrationStatus {
+	t.Helper()
+	var status filesystem.MigrationStatus
+	require.Eventually(t, func() bool {
+		status = fs.MigrationStatus()
+		return !status.Running
+	}, 5*time.Second, 10*time.Millisecond)
+	return status
+}
+
+func fanoutPath(rootDir, objectID string) string {
+	sum := sha256.Sum256([]byte(objectID))
+	prefix := hex.EncodeToString(sum[:2])
+	return filepath.Join(rootDir, prefix[:2], prefix[2:], objectID)
+}
@@ -0,0 +1,113 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// manifestFile records the properties of the store, under the root dir, so the server can't be started with a
+	// configuration that doesn't match how the objects are stored.
+	manifestFile    = ".filesync-manifest.json"
+	manifestVersion = 1
+)
+
+var (
+	ErrLayoutMismatch = errors.New("storage layout mismatch")
+)
+
+// Manifest describes the store in the root dir.
+type Manifest struct {
+	Version int    `json:"version"`
+	Layout  Layout `json:"layout"`
+	// MigratingFrom is set while the store is being migrated from this layout to Layout. Objects might be found in
+	// either layout until the migration is done.
+	MigratingFrom Layout `json:"migrating_from,omitempty"`
+}
+
+// loadManifest reads the manifest from the root dir. A store created before manifests were introduced has none; it is
+// either empty, in which case it gets the configured layout, or flat. The returned bool reports whether the manifest
+// needs to be written.
+func loadManifest(rootDir string, layout Layout) (Manifest, bool, error) {
+	data, err := os.ReadFile(filepath.Join(rootDir, manifestFile))
+	if err == nil {
+		var m Manifest
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			return Manifest{}, false, fmt.Errorf("unmarshal manifest: %w", err)
+		}
+		if m.Version != manifestVersion {
+			return Manifest{}, false, fmt.Errorf("unsupported manifest version %d", m.Version)
+		}
+		_, err = ParseLayout(string(m.Layout))
+		if err != nil {
+			return Manifest{}, false, fmt.Errorf("invalid manifest: %w", err)
+		}
+		return m, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return Manifest{}, false, fmt.Errorf("read manifest: %w", err)
+	}
+
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		return Manifest{}, false, fmt.Errorf("read root dir: %w", err)
+	}
+	hasObjects := slices.ContainsFunc(entries, func(entry os.DirEntry) bool {
+		return !strings.HasPrefix(entry.Name(), ".")
+	})
+	if hasObjects {
+		layout = LayoutFlat
+	}
+
+	return Manifest{Version: manifestVersion, Layout: layout}, true, nil
+}
+
+// writeManifest atomically replaces the manifest in the root dir.
+func writeManifest(rootDir string, m Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	tmpName := filepath.Join(rootDir, tmpDir, manifestFile)
+	err = os.WriteFile(tmpName, data, 0644)
+	if err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	f, err := os.Open(tmpName)
+	if err != nil {
+		return fmt.Errorf("open manifest: %w", err)
+	}
+	err = f.Sync()
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("sync manifest: %w", err)
+	}
+
+	err = os.Rename(tmpName, filepath.Join(rootDir, manifestFile))
+	if err != nil {
+		return fmt.Errorf("rename manifest: %w", err)
+	}
+
+	return syncDir(rootDir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrMigrationInProgress = errors.New("storage layout migration in progress")
+)
+
+// migration tracks a layout migration started by this process.
+type migration struct {
+	moved atomic.Int64
+	// done is closed once the migration has finished; err is only set before that.
+	done chan struct{}
+	err  error
+}
+
+// MigrationStatus describes the layout of the store and the progress of any migration.
+type MigrationStatus struct {
+	Layout Layout
+	// MigratingFrom is set until a migration has completed, even if it's not running, e.g. after a restart.
+	MigratingFrom Layout
+	Running       bool
+	Moved         int64
+	Err           error
+}
+
+// MigrationStatus returns the layout of the store and the progress of the migration started last, if any.
+func (fs *FileSystem) MigrationStatus() MigrationStatus {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	status := MigrationStatus{
+		Layout:        fs.manifest.Layout,
+		MigratingFrom: fs.manifest.MigratingFrom,
+	}
+	if fs.migration == nil {
+		return status
+	}
+
+	status.Moved = fs.migration.moved.Load()
+	select {
+	case <-fs.migration.done:
+		status.Err = fs.migration.err
+	default:
+		status.Running = true
+	}
+	return status
+}
+
+// StartMigration starts moving the objects to the given layout in the background, while the store stays in use.
+// Objects are looked up in both layouts until the migration is done, at which point the manifest records the new
+// layout and the server must be configured with it for the next start. An interrupted migration is resumed by
+// starting it again with the same layout.
+func (fs *FileSystem) StartMigration(ctx context.Context, to Layout) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.migration != nil {
+		select {
+		case <-fs.migration.done:
+		default:
+			return ErrMigrationInProgress
+		}
+	}
+
+	m := fs.manifest
+	switch {
+	case m.MigratingFrom != "" && m.Layout != to:
+		return fmt.Errorf("%w: migration from %q to %q must be completed first", ErrLayoutMismatch, m.MigratingFrom, m.Layout)
+	case m.MigratingFrom == "" && m.Layout == to:
+		return fmt.Errorf("%w: store is already laid out as %q", ErrLayoutMismatch, to)
+	case m.MigratingFrom == "":
+		m.MigratingFrom, m.Layout = m.Layout, to
+		err := writeManifest(fs.rootDir, m)
+		if err != nil {
+			return fmt.Errorf("write manifest: %w", err)
+		}
+		fs.manifest = m
+	}
+
+	mig := &migration{
+		done: make(chan struct{}),
+	}
+	fs.migration = mig
+
+	// the migration outlives the request that started it; it's safe to be killed with the process and resumed later.
+	go fs.migrate(context.WithoutCancel(ctx), mig, m.MigratingFrom, m.Layout)
+
+	return nil
+}
+
+func (fs *FileSystem) migrate(ctx context.Context, mig *migration, from, to Layout) {
+	logger := fs.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"from": from,
+		"to":   to,
+	})
+	logger.Info("Migrating storage layout")
+
+	err := fs.moveObjects(mig, from, to)
+	if err == nil {
+		fs.mu.Lock()
+		m := Manifest{Version: manifestVersion, Layout: to}
+		err = writeManifest(fs.rootDir, m)
+		if err == nil {
+			fs.manifest = m
+		}
+		fs.mu.Unlock()
+	}
+
+	mig.err = err
+	close(mig.done)
+
+	logger = logger.WithField("moved", mig.moved.Load())
+	if err != nil {
+		logger.WithError(err).Error("Failed to migrate storage layout")
+		return
+	}
+	logger.Info("Migrated storage layout")
+}
+
+// moveObjects moves every object found in the from layout to its path in the to layout.
+func (fs *FileSystem) moveObjects(mig *migration, from, to Layout) error {
+	dirs := make(map[string]struct{})
+	err := from.walk(fs.rootDir, func(objectID, path string) error {
+		dst := to.path(objectID)
+		dstDir := filepath.Join(fs.rootDir, filepath.Dir(dst))
+		err := os.MkdirAll(dstDir, 0755)
+		if err != nil {
+			return fmt.Errorf("create object dir: %w", err)
+		}
+
+		err = os.Rename(filepath.Join(fs.rootDir, path), filepath.Join(fs.rootDir, dst))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// deleted since we listed it
+				return nil
+			}
+			return fmt.Errorf("move object %q: %w", objectID, err)
+		}
+		dirs[dstDir] = struct{}{}
+		mig.moved.Add(1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the manifest must not record the new layout before the moves are durable
+	for dir := range slices.Values(slices.Sorted(maps.Keys(dirs))) {
+		err = syncDir(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if from == LayoutFanout {
+		removePrefixDirs(fs.rootDir)
+	}
+
+	return nil
+}
+
+// removePrefixDirs removes the empty fan-out prefix dirs left behind after migrating away from the fan-out layout.
+func removePrefixDirs(rootDir string) {
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		return
+	}
+	for entry := range slices.Values(entries) {
+		if !entry.IsDir() || !isPrefixDir(entry.Name()) {
+			continue
+		}
+		subEntries, err := os.ReadDir(filepath.Join(rootDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		for sub := range slices.Values(subEntries) {
+			// fails for non-empty dirs, which is what we want
+			_ = os.Remove(filepath.Join(rootDir, entry.Name(), sub.Name()))
+		}
+		_ = os.Remove(filepath.Join(rootDir, entry.Name()))
+	}
+}
@@ -0,0 +1,419 @@
+// Package s3 implements a blob storage backend storing objects in an S3-compatible object store.
+package s3
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+	"github.com/hedisam/filesync/server/internal/blobstorage/s3/sigv4"
+)
+
+const (
+	// MinPartSize is the minimum size of every part of a multipart upload but the last, as enforced by S3.
+	MinPartSize = 5 << 20
+	// DefaultPartSize is used if no part size is configured. Objects up to this size are uploaded in a single
+	// request; every upload buffers up to one part in memory.
+	DefaultPartSize = 16 << 20
+
+	service = "s3"
+)
+
+func init() {
+	blobstorage.Register("s3", open)
+}
+
+// Config is the config of the s3 backend.
+type Config struct {
+	// Endpoint is the base url of the object store, e.g. https://s3.eu-west-1.amazonaws.com.
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+	// Prefix is prepended to the object IDs to make up the object keys, e.g. "blobs/".
+	Prefix string `json:"prefix"`
+	// AccessKeyID and SecretAccessKey default to the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY env vars.
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	// PathStyle addresses the bucket in the url path rather than the host name, as required by most
+	// S3-compatible stores.
+	PathStyle bool  `json:"path_style"`
+	PartSize  int64 `json:"part_size"`
+}
+
+// Storage stores objects in an S3 bucket.
+type Storage struct {
+	logger *logrus.Logger
+	cfg    Config
+	creds  sigv4.Credentials
+	cli    *http.Client
+}
+
+func open(_ context.Context, logger *logrus.Logger, config json.RawMessage) (blobstorage.Backend, error) {
+	var cfg Config
+	err := json.Unmarshal(config, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal config: %w", err)
+	}
+	return New(logger, cfg)
+}
+
+func New(logger *logrus.Logger, cfg Config) (*Storage, error) {
+	if cfg.Endpoint == "" || cfg.Region == "" || cfg.Bucket == "" {
+		return nil, errors.New("endpoint, region and bucket are required")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", cfg.Endpoint)
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+	if cfg.PartSize < MinPartSize {
+		return nil, fmt.Errorf("part size must be at least %d bytes", MinPartSize)
+	}
+
+	creds := sigv4.Credentials{
+		AccessKeyID:     cmp.Or(cfg.AccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: cmp.Or(cfg.SecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("access key id and secret access key are required")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"endpoint": cfg.Endpoint,
+		"bucket":   cfg.Bucket,
+		"prefix":   cfg.Prefix,
+	}).Info("Storing objects in S3")
+
+	return &Storage{
+		logger: logger,
+		cfg:    cfg,
+		creds:  creds,
+		cli:    &http.Client{},
+	}, nil
+}
+
+// PutObject uploads the data read from r under the given objectID. Objects smaller than the part size are uploaded
+// in a single request once they're verified; larger ones are uploaded in parts and the multipart upload is only
+// completed, making the object visible, once verified. Either way, every request is signed including the hash of
+// its body so the data can't be corrupted on its way.
+func (s *Storage) PutObject(ctx context.Context, r io.Reader, objectID string, verify func(checksum string, written int64) error) (string, int64, error) {
+	logger := s.logger.WithContext(ctx).WithField("object_id", objectID)
+
+	hasher := sha256.New()
+	tee := io.TeeReader(r, hasher)
+	buf := make([]byte, s.cfg.PartSize)
+
+	n, err := io.ReadFull(tee, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", 0, fmt.Errorf("read object data: %w", err)
+	}
+	if err != nil {
+		// the whole object fits in a single part
+		checksum := hex.EncodeToString(hasher.Sum(nil))
+		err = runVerify(verify, checksum, int64(n))
+		if err != nil {
+			return "", 0, err
+		}
+
+		_, err = s.do(ctx, http.MethodPut, objectID, nil, buf[:n])
+		if err != nil {
+			logger.WithError(err).Error("Could not put object in S3")
+			return "", 0, fmt.Errorf("put object: %w", err)
+		}
+		return checksum, int64(n), nil
+	}
+
+	checksum, written, err := s.putMultipart(ctx, tee, buf, hasher, objectID, verify)
+	if err != nil {
+		logger.WithError(err).Error("Could not put object in S3 with multipart upload")
+		return "", 0, err
+	}
+	return checksum, written, nil
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart uploads the object in parts, starting with the full part already read into buf.
+func (s *Storage) putMultipart(ctx context.Context, r io.Reader, buf []byte, hasher hash.Hash, objectID string, verify func(checksum string, written int64) error) (_ string, _ int64, err error) {
+	resp, err := s.do(ctx, http.MethodPost, objectID, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("create multipart upload: %w", err)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.Unmarshal(resp.body, &initiated)
+	if err != nil || initiated.UploadID == "" {
+		return "", 0, fmt.Errorf("invalid create multipart upload response: %q", resp.body)
+	}
+	uploadID := initiated.UploadID
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		// incomplete multipart uploads are kept, and billed, by S3 until they're aborted
+		_, abortErr := s.do(context.WithoutCancel(ctx), http.MethodDelete, objectID, url.Values{"uploadId": {uploadID}}, nil)
+		if abortErr != nil {
+			s.logger.WithContext(ctx).WithError(abortErr).WithField("object_id", objectID).Error("Could not abort multipart upload")
+		}
+	}()
+
+	var parts []completedPart
+	written := int64(0)
+	n := len(buf)
+	for n > 0 {
+		partNumber := len(parts) + 1
+		resp, err = s.do(ctx, http.MethodPut, objectID, url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadID},
+		}, buf[:n])
+		if err != nil {
+			return "", 0, fmt.Errorf("upload part %d: %w", partNumber, err)
+		}
+		parts = append(parts, completedPart{PartNumber: partNumber, ETag: resp.header.Get("ETag")})
+		written += int64(n)
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", 0, fmt.Errorf("read object data: %w", err)
+		}
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	err = runVerify(verify, checksum, written)
+	if err != nil {
+		return "", 0, err
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", 0, fmt.Errorf("marshal complete multipart upload request: %w", err)
+	}
+	resp, err = s.do(ctx, http.MethodPost, objectID, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return "", 0, fmt.Errorf("complete multipart upload: %w", err)
+	}
+	// completing can fail after S3 has already responded with 200, in which case the error is in the body
+	err = parseError(http.StatusOK, resp.body)
+	if err != nil {
+		return "", 0, fmt.Errorf("complete multipart upload: %w", err)
+	}
+
+	return checksum, written, nil
+}
+
+// GetObject returns a reader streaming the content of the given object from S3.
+func (s *Storage) GetObject(ctx context.Context, objectID string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, objectID, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get object: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		_ = resp.Body.Close()
+		return nil, blobstorage.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return nil, fmt.Errorf("get object: %w", parseError(resp.StatusCode, body))
+	}
+
+	return resp.Body, nil
+}
+
+// DeleteObject removes the given object from S3. S3 doesn't fail deleting objects that don't exist.
+func (s *Storage) DeleteObject(ctx context.Context, objectID string) error {
+	_, err := s.do(ctx, http.MethodDelete, objectID, nil, nil)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).WithField("object_id", objectID).Error("Could not delete object from S3")
+		return fmt.Errorf("delete object: %w", err)
+	}
+	return nil
+}
+
+// ListObjects calls fn with the ID of every object stored under the configured prefix, page by page. Incomplete
+// multipart uploads aren't listed.
+func (s *Storage) ListObjects(ctx context.Context, fn func(objectID string) error) error {
+	var token string
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.cfg.Prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return fmt.Errorf("list objects: %w", err)
+		}
+
+		var result struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []struct {
+				Key string
+			}
+		}
+		err = xml.Unmarshal(resp.body, &result)
+		if err != nil {
+			return fmt.Errorf("unmarshal list objects response: %w", err)
+		}
+		for content := range slices.Values(result.Contents) {
+			objectID, ok := strings.CutPrefix(content.Key, s.cfg.Prefix)
+			// objects under a "directory" of the prefix aren't ours
+			if !ok || objectID == "" || strings.Contains(objectID, "/") {
+				continue
+			}
+			err = fn(objectID)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+		if result.NextContinuationToken == "" {
+			return errors.New("list objects: truncated response without a continuation token")
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+type response struct {
+	header http.Header
+	body   []byte
+}
+
+// do sends a signed request for the given object and reads the whole response. Responses other than 2xx are
+// returned as errors.
+func (s *Storage) do(ctx context.Context, method, objectID string, query url.Values, body []byte) (*response, error) {
+	req, err := s.newRequest(ctx, method, objectID, query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, parseError(resp.StatusCode, respBody)
+	}
+
+	return &response{
+		header: resp.Header,
+		body:   respBody,
+	}, nil
+}
+
+// newRequest returns a signed request for the given object. An empty object ID addresses the bucket itself.
+func (s *Storage) newRequest(ctx context.Context, method, objectID string, query url.Values, body []byte) (*http.Request, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse endpoint: %w", err)
+	}
+	var key string
+	if objectID != "" {
+		key = s.cfg.Prefix + objectID
+	}
+	if s.cfg.PathStyle {
+		u.Path = path.Join("/", u.Path, s.cfg.Bucket, key)
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, key)
+	}
+	// the path must be sent exactly as it's encoded for the signature
+	u.RawPath = sigv4.URIEncode(u.Path, false)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	if body == nil {
+		req.Body = http.NoBody
+	}
+
+	sigv4.Sign(req, s.creds, s.cfg.Region, service, sigv4.PayloadHash(body), time.Now())
+	return req, nil
+}
+
+// Error is an error returned by S3.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3 responded with status %d: %s: %s", e.Status, e.Code, e.Message)
+}
+
+// parseError returns the error in the given response body, if any. Non-2xx responses always result in an error.
+func parseError(status int, body []byte) error {
+	var e struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	err := xml.Unmarshal(body, &e)
+	if err == nil && e.XMLName.Local == "Error" {
+		return &Error{Status: status, Code: e.Code, Message: e.Message}
+	}
+	if status < 200 || status > 299 {
+		return &Error{Status: status, Message: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+func runVerify(verify func(checksum string, written int64) error, checksum string, written int64) error {
+	if verify == nil {
+		return nil
+	}
+	err := verify(checksum, written)
+	if err != nil {
+		return fmt.Errorf("%w: %w", blobstorage.ErrVerificationFailed, err)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+	"github.com/hedisam/filesync/server/internal/blobstorage/s3"
+	"github.com/hedisam/filesync/server/internal/blobstorage/s3/s3test"
+	"github.com/hedisam/filesync/server/internal/blobstorage/s3/sigv4"
+)
+
+var creds = sigv4.Credentials{
+	AccessKeyID:     "aki",
+	SecretAccessKey: "secret",
+}
+
+func newStorage(t *testing.T, srv *s3test.Server) *s3.Storage {
+	t.Helper()
+	storage, err := s3.New(logrus.New(), s3.Config{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "bucket",
+		Prefix:          "blobs/",
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		PathStyle:       true,
+		PartSize:        s3.MinPartSize,
+	})
+	require.NoError(t, err)
+	return storage
+}
+
+func TestPutObject(t *testing.T) {
+	tests := map[string]struct {
+		size      int
+		verifyErr error
+
+		expectedErr error
+	}{
+		"single part": {
+			size: 1024,
+		},
+		"empty object": {
+			size: 0,
+		},
+		"multipart": {
+			size: 2*s3.MinPartSize + 1024,
+		},
+		"exactly one part": {
+			size: s3.MinPartSize,
+		},
+		"single part verification failure": {
+			size:        1024,
+			verifyErr:   errors.New("checksum mismatch"),
+			expectedErr: blobstorage.ErrVerificationFailed,
+		},
+		"multipart verification failure": {
+			size:        s3.MinPartSize + 1024,
+			verifyErr:   errors.New("checksum mismatch"),
+			expectedErr: blobstorage.ErrVerificationFailed,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := s3test.NewServer(creds, "bucket")
+			defer srv.Close()
+			storage := newStorage(t, srv)
+
+			data := make([]byte, tc.size)
+			_, _ = rand.Read(data)
+			sum := sha256.Sum256(data)
+
+			checksum, written, err := storage.PutObject(context.Background(), bytes.NewReader(data), "object-id", func(checksum string, written int64) error {
+				assert.Equal(t, hex.EncodeToString(sum[:]), checksum)
+				assert.EqualValues(t, len(data), written)
+				return tc.verifyErr
+			})
+			assert.Zero(t, srv.MultipartUploads(), "multipart uploads must be completed or aborted")
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+				_, ok := srv.Object("bucket", "blobs/object-id")
+				assert.False(t, ok, "unverified objects must not be stored")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, hex.EncodeToString(sum[:]), checksum)
+			assert.EqualValues(t, len(data), written)
+
+			stored, ok := srv.Object("bucket", "blobs/object-id")
+			require.True(t, ok)
+			assert.True(t, bytes.Equal(data, stored))
+		})
+	}
+}
+
+func TestPutObjectReadError(t *testing.T) {
+	srv := s3test.NewServer(creds, "bucket")
+	defer srv.Close()
+	storage := newStorage(t, srv)
+
+	// fails after the first part has been uploaded
+	r := io.MultiReader(bytes.NewReader(make([]byte, s3.MinPartSize+1)), errorReader{err: errors.New("read error")})
+	_, _, err := storage.PutObject(context.Background(), r, "object-id", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "read error")
+	assert.Zero(t, srv.MultipartUploads())
+	_, ok := srv.Object("bucket", "blobs/object-id")
+	assert.False(t, ok)
+}
+
+func TestGetObject(t *testing.T) {
+	srv := s3test.NewServer(creds, "bucket")
+	defer srv.Close()
+	storage := newStorage(t, srv)
+	srv.PutObject("bucket", "blobs/object-id", []byte("hello world"))
+
+	rc, err := storage.GetObject(context.Background(), "object-id")
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello world"), content)
+
+	_, err = storage.GetObject(context.Background(), "missing")
+	assert.ErrorIs(t, err, blobstorage.ErrNotFound)
+}
+
+func TestDeleteObject(t *testing.T) {
+	srv := s3test.NewServer(creds, "bucket")
+	defer srv.Close()
+	storage := newStorage(t, srv)
+	srv.PutObject("bucket", "blobs/object-id", []byte("hello world"))
+
+	err := storage.DeleteObject(context.Background(), "object-id")
+	require.NoError(t, err)
+	_, ok := srv.Object("bucket", "blobs/object-id")
+	assert.False(t, ok)
+
+	err = storage.DeleteObject(context.Background(), "missing")
+	require.NoError(t, err)
+}
+
+func TestListObjects(t *testing.T) {
+	srv := s3test.NewServer(creds, "bucket")
+	defer srv.Close()
+	srv.MaxKeys = 2
+	storage := newStorage(t, srv)
+	for key := range slices.Values([]string{"blobs/a", "blobs/b", "blobs/c", "blobs/d/e", "blobs/f", "other/g"}) {
+		srv.PutObject("bucket", key, []byte("data"))
+	}
+
+	var objectIDs []string
+	err := storage.ListObjects(context.Background(), func(objectID string) error {
+		objectIDs = append(objectIDs, objectID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "f"}, objectIDs)
+
+	err = storage.ListObjects(context.Background(), func(string) error {
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+}
+
+func TestInvalidCredentials(t *testing.T) {
+	srv := s3test.NewServer(creds, "bucket")
+	defer srv.Close()
+	storage, err := s3.New(logrus.New(), s3.Config{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "bucket",
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: "guess",
+		PathStyle:       true,
+	})
+	require.NoError(t, err)
+
+	_, _, err = storage.PutObject(context.Background(), bytes.NewReader([]byte("data")), "object-id", nil)
+	var s3Err *s3.Error
+	require.ErrorAs(t, err, &s3Err)
+	assert.Equal(t, "SignatureDoesNotMatch", s3Err.Code)
+}
+
+func TestOpen(t *testing.T) {
+	srv := s3test.NewServer(creds, "bucket")
+	defer srv.Close()
+
+	backend, err := blobstorage.Open(context.Background(), logrus.New(), "s3", []byte(`{
+		"endpoint": "`+srv.URL+`",
+		"region": "us-east-1",
+		"bucket": "bucket",
+		"access_key_id": "aki",
+		"secret_access_key": "secret",
+		"path_style": true
+	}`))
+	require.NoError(t, err)
+
+	_, _, err = backend.PutObject(context.Background(), bytes.NewReader([]byte("data")), "object-id", nil)
+	require.NoError(t, err)
+	_, ok := srv.Object("bucket", "object-id")
+	assert.True(t, ok)
+
+	_, err = blobstorage.Open(context.Background(), logrus.New(), "s3", []byte(`{"endpoint": "`+srv.URL+`"}`))
+	assert.ErrorContains(t, err, "endpoint, region and bucket are required")
+}
+
+// errorReader always returns an error on Read.
+type errorReader struct {
+	err error
+}
+
+func (e errorReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
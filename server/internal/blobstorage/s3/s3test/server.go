@@ -0,0 +1,286 @@
+// Package s3test provides an in-process fake of an S3-compatible object store for testing, in the spirit of
+// net/http/httptest. It supports path-style addressing of the object, listing and multipart upload APIs used by
+// the s3 backend, and verifies the SigV4 signature and payload hash of every request.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hedisam/filesync/server/internal/blobstorage/s3/sigv4"
+)
+
+type multipartUpload struct {
+	bucket string
+	key    string
+	parts  map[int][]byte
+}
+
+// Server is a fake S3 server. Its buckets must be created up front.
+type Server struct {
+	*httptest.Server
+	// MaxKeys limits the number of keys listed per page, 1000 by default as in S3.
+	MaxKeys int
+
+	creds sigv4.Credentials
+
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	uploads map[string]*multipartUpload
+}
+
+// NewServer starts a fake S3 server accepting requests signed with the given credentials.
+func NewServer(creds sigv4.Credentials, buckets ...string) *Server {
+	s := &Server{
+		creds:   creds,
+		buckets: make(map[string]map[string][]byte),
+		uploads: make(map[string]*multipartUpload),
+	}
+	for bucket := range slices.Values(buckets) {
+		s.buckets[bucket] = make(map[string][]byte)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Object returns the content of the given object.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.buckets[bucket][key]
+	return data, ok
+}
+
+// PutObject stores an object directly, e.g. to seed the server.
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buckets[bucket][key] = data
+}
+
+// MultipartUploads returns the number of multipart uploads that are neither completed nor aborted.
+func (s *Server) MultipartUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.uploads)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	_, err := sigv4.Verify(r, func(accessKeyID string) (string, bool) {
+		return s.creds.SecretAccessKey, accessKeyID == s.creds.AccessKeyID
+	})
+	if err != nil {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if payloadHash := r.Header.Get(sigv4.HeaderContentSHA256); payloadHash != sigv4.UnsignedPayload && payloadHash != sigv4.PayloadHash(body) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "the provided payload hash doesn't match the body")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "the specified bucket does not exist")
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createMultipartUpload(w, bucket, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, query.Get("uploadId"), query.Get("partNumber"), body)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeMultipartUpload(w, query.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.abortMultipartUpload(w, query.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		objects[key] = body
+		w.Header().Set("ETag", etag(body))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		s.listObjects(w, objects, query.Get("prefix"), query.Get("continuation-token"))
+	case r.Method == http.MethodGet:
+		data, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("ETag", etag(data))
+		_, _ = w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "not supported by the fake server")
+	}
+}
+
+// listObjects lists the keys with the given prefix in lexicographical order. The continuation token is simply the
+// last key of the previous page.
+func (s *Server) listObjects(w http.ResponseWriter, objects map[string][]byte, prefix, token string) {
+	maxKeys := s.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+
+	type content struct {
+		Key  string
+		Size int
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Prefix: prefix}
+	for key := range slices.Values(slices.Sorted(maps.Keys(objects))) {
+		if !strings.HasPrefix(key, prefix) || key <= token {
+			continue
+		}
+		if len(result.Contents) == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[len(result.Contents)-1].Key
+			break
+		}
+		result.Contents = append(result.Contents, content{Key: key, Size: len(objects[key])})
+	}
+	result.KeyCount = len(result.Contents)
+
+	writeXML(w, result)
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, bucket, key string) {
+	uploadID := rand.Text()
+	s.uploads[uploadID] = &multipartUpload{
+		bucket: bucket,
+		key:    key,
+		parts:  make(map[int][]byte),
+	}
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadID string `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, uploadID, partNumber string, body []byte) {
+	upload, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist")
+		return
+	}
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return
+	}
+
+	upload.parts[n] = body
+	w.Header().Set("ETag", etag(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, uploadID string, body []byte) {
+	upload, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist")
+		return
+	}
+
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	err := xml.Unmarshal(body, &req)
+	if err != nil || len(req.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "invalid complete multipart upload request")
+		return
+	}
+
+	var data bytes.Buffer
+	for i, part := range req.Parts {
+		partData, ok := upload.parts[part.PartNumber]
+		if !ok || etag(partData) != part.ETag || (i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("invalid part %d", part.PartNumber))
+			return
+		}
+		data.Write(partData)
+	}
+
+	s.buckets[upload.bucket][upload.key] = data.Bytes()
+	delete(s.uploads, uploadID)
+
+	// S3 responds with 200 even if completing fails, with the error in the body, so the body must be checked anyway
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: upload.bucket, Key: upload.key, ETag: etag(data.Bytes())})
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, uploadID string) {
+	if _, ok := s.uploads[uploadID]; !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist")
+		return
+	}
+	delete(s.uploads, uploadID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: msg})
+}
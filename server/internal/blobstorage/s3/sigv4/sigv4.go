@@ -0,0 +1,211 @@
+// Package sigv4 implements AWS Signature Version 4 request signing, as used by S3 and S3-compatible object stores.
+// Requests are signed in their Authorization header; presigned urls are not supported.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	Algorithm = "AWS4-HMAC-SHA256"
+	// UnsignedPayload is used as the payload hash of requests whose body is not covered by the signature.
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	HeaderDate          = "X-Amz-Date"
+	HeaderContentSHA256 = "X-Amz-Content-Sha256"
+
+	timeFormat = "20060102T150405Z"
+	dateFormat = "20060102"
+)
+
+var (
+	// EmptyPayloadHash is the payload hash of requests without a body.
+	EmptyPayloadHash = PayloadHash(nil)
+
+	ErrMissingSignature  = errors.New("missing signature")
+	ErrUnknownAccessKey  = errors.New("unknown access key")
+	ErrSignatureMismatch = errors.New("signature mismatch")
+)
+
+// Credentials are the access keys requests are signed with.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// PayloadHash returns the hex encoded sha256 hash of the given request body.
+func PayloadHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign signs the request at the given time by setting its Authorization header. Every header already set on the
+// request is signed, so headers must not be changed afterward. payloadHash is the hex encoded sha256 hash of the
+// body, or UnsignedPayload.
+func Sign(req *http.Request, creds Credentials, region, service, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set(HeaderDate, t.Format(timeFormat))
+	req.Header.Set(HeaderContentSHA256, payloadHash)
+
+	signedHeaders := []string{"host"}
+	for name := range maps.Keys(req.Header) {
+		name = strings.ToLower(name)
+		if name != "authorization" && name != "host" {
+			signedHeaders = append(signedHeaders, name)
+		}
+	}
+	slices.Sort(signedHeaders)
+
+	scope := strings.Join([]string{t.Format(dateFormat), region, service, "aws4_request"}, "/")
+	sig := signature(req, creds.SecretAccessKey, signedHeaders, payloadHash, t, scope)
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		Algorithm, creds.AccessKeyID, scope, strings.Join(signedHeaders, ";"), sig))
+}
+
+// Verify checks the signature of a request signed by Sign, looking up the secret of the signing access key with the
+// given func. It returns the access key ID the request was signed with. The payload hash is not checked against the
+// body; that's up to the caller since it requires reading the body.
+func Verify(req *http.Request, secretKey func(accessKeyID string) (string, bool)) (string, error) {
+	auth, ok := strings.CutPrefix(req.Header.Get("Authorization"), Algorithm+" ")
+	if !ok {
+		return "", ErrMissingSignature
+	}
+
+	fields := make(map[string]string)
+	for field := range strings.SplitSeq(auth, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[k] = v
+	}
+	accessKeyID, scope, ok := strings.Cut(fields["Credential"], "/")
+	if !ok || fields["SignedHeaders"] == "" || fields["Signature"] == "" {
+		return "", fmt.Errorf("malformed authorization header: %w", ErrMissingSignature)
+	}
+
+	secret, ok := secretKey(accessKeyID)
+	if !ok {
+		return "", ErrUnknownAccessKey
+	}
+
+	t, err := time.Parse(timeFormat, req.Header.Get(HeaderDate))
+	if err != nil {
+		return "", fmt.Errorf("invalid %s header: %w", HeaderDate, err)
+	}
+	if !strings.HasPrefix(scope, t.Format(dateFormat)+"/") {
+		return "", fmt.Errorf("credential scope doesn't match the request date: %w", ErrSignatureMismatch)
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	expected := signature(req, secret, signedHeaders, req.Header.Get(HeaderContentSHA256), t, scope)
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return "", ErrSignatureMismatch
+	}
+
+	return accessKeyID, nil
+}
+
+func signature(req *http.Request, secret string, signedHeaders []string, payloadHash string, t time.Time, scope string) string {
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req),
+		canonicalQuery(req),
+		canonicalHeaders(req, signedHeaders),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		Algorithm,
+		t.Format(timeFormat),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	// the scope is date/region/service/aws4_request, which is exactly how the signing key is derived
+	key := []byte("AWS4" + secret)
+	for part := range strings.SplitSeq(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func canonicalURI(req *http.Request) string {
+	if req.URL.Path == "" {
+		return "/"
+	}
+	return URIEncode(req.URL.Path, false)
+}
+
+func canonicalQuery(req *http.Request) string {
+	query := req.URL.Query()
+	var params []string
+	for k := range slices.Values(slices.Sorted(maps.Keys(query))) {
+		values := slices.Clone(query[k])
+		slices.Sort(values)
+		for v := range slices.Values(values) {
+			params = append(params, URIEncode(k, true)+"="+URIEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func canonicalHeaders(req *http.Request, signedHeaders []string) string {
+	b := &strings.Builder{}
+	for name := range slices.Values(signedHeaders) {
+		var values []string
+		if name == "host" {
+			host := req.Host
+			if host == "" {
+				host = req.URL.Host
+			}
+			values = []string{host}
+		} else {
+			values = slices.Clone(req.Header.Values(name))
+		}
+
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return b.String()
+}
+
+// URIEncode encodes s the way SigV4 expects: every byte except the unreserved characters is percent-encoded, and
+// slashes are kept as is unless encodeSlash is set.
+func URIEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	b := &strings.Builder{}
+	for i := range len(s) {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xf])
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,199 @@
+// Package devices keeps the registry of the clients syncing with the server, and of how far each one has synced. Like
+// the metadata, it's kept in memory; clients register again once they find the server has forgotten them.
+package devices
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+// DefaultStaleAfter is the default time after which a device that hasn't been seen is reported as stale.
+const DefaultStaleAfter = 30 * 24 * time.Hour
+
+var ErrNotFound = errors.New("device not found")
+
+// Device is a client syncing a namespace with the server.
+type Device struct {
+	ID            string
+	Name          string
+	Namespace     string
+	ClientVersion string
+	RegisteredAt  time.Time
+	// LastSeen is when the device last registered or reported its sync state.
+	LastSeen time.Time
+	// Cursor is the cursor of the changes the device had synced as of its last report, zero if it never reported one.
+	Cursor   store.Cursor
+	SyncRoot SyncRoot
+}
+
+// SyncRoot summarizes the files of the directory a device syncs, as of its last report.
+type SyncRoot struct {
+	Files int64
+	Bytes int64
+	// RootHash is the root hash of the device's hash tree, if it keeps one; it's the server's if they're in sync.
+	RootHash string
+}
+
+// Registration is what a device registers with.
+type Registration struct {
+	ID            string
+	Name          string
+	Namespace     string
+	ClientVersion string
+}
+
+// SyncReport is the sync state a device reports.
+type SyncReport struct {
+	Cursor        store.Cursor
+	ClientVersion string
+	SyncRoot      SyncRoot
+}
+
+type ChangeLog interface {
+	Changes(ctx context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error)
+}
+
+type Option func(r *Registry)
+
+// WithStaleAfter sets the time after which a device that hasn't been seen is reported as stale. Zero reports devices
+// as stale by their cursors only.
+func WithStaleAfter(d time.Duration) Option {
+	return func(r *Registry) {
+		r.staleAfter = d
+	}
+}
+
+// Registry is the registry of devices. It's safe for concurrent use.
+type Registry struct {
+	changes    ChangeLog
+	staleAfter time.Duration
+
+	mu      sync.RWMutex
+	devices map[string]*Device
+}
+
+// New returns an empty registry. The change log is what tells the devices whose cursors have expired.
+func New(changes ChangeLog, opts ...Option) *Registry {
+	r := &Registry{
+		changes:    changes,
+		staleAfter: DefaultStaleAfter,
+		devices:    make(map[string]*Device),
+	}
+	for opt := range slices.Values(opts) {
+		opt(r)
+	}
+	return r
+}
+
+// Register registers a device, or updates the registration of a known one, keeping its sync state unless it now syncs
+// another namespace.
+func (r *Registry) Register(_ context.Context, reg Registration) (Device, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	namespace := store.NamespaceOrDefault(reg.Namespace)
+	d, ok := r.devices[reg.ID]
+	if !ok || d.Namespace != namespace {
+		d = &Device{
+			ID:           reg.ID,
+			Namespace:    namespace,
+			RegisteredAt: now,
+		}
+		r.devices[reg.ID] = d
+	}
+	d.Name = reg.Name
+	d.ClientVersion = reg.ClientVersion
+	d.LastSeen = now
+	return *d, nil
+}
+
+// ReportSync records the sync state reported by a registered device. It returns ErrNotFound for unknown devices.
+func (r *Registry) ReportSync(_ context.Context, id string, report SyncReport) (Device, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.devices[id]
+	if !ok {
+		return Device{}, fmt.Errorf("device %q: %w", id, ErrNotFound)
+	}
+	d.Cursor = report.Cursor
+	d.SyncRoot = report.SyncRoot
+	if report.ClientVersion != "" {
+		d.ClientVersion = report.ClientVersion
+	}
+	d.LastSeen = time.Now().UTC()
+	return *d, nil
+}
+
+// Get returns the device with the given ID, or ErrNotFound.
+func (r *Registry) Get(_ context.Context, id string) (Device, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	d, ok := r.devices[id]
+	if !ok {
+		return Device{}, fmt.Errorf("device %q: %w", id, ErrNotFound)
+	}
+	return *d, nil
+}
+
+// List returns the devices syncing the given namespace, or all of them if it's empty, by ID.
+func (r *Registry) List(_ context.Context, namespace string) ([]Device, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	devices := make([]Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		if namespace != "" && d.Namespace != namespace {
+			continue
+		}
+		devices = append(devices, *d)
+	}
+	slices.SortFunc(devices, func(a, b Device) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return devices, nil
+}
+
+// Remove forgets the device with the given ID, e.g. one decommissioned. It returns ErrNotFound for unknown devices.
+func (r *Registry) Remove(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.devices[id]; !ok {
+		return fmt.Errorf("device %q: %w", id, ErrNotFound)
+	}
+	delete(r.devices, id)
+	return nil
+}
+
+// Staleness tells why the given device is stale, if it is: it hasn't been seen for too long, or the server has
+// dropped some of the changes made since its cursor. Either way, it may have missed deletions, which it would bring
+// back if it synced the files it still has as they are.
+func (r *Registry) Staleness(ctx context.Context, d Device) (string, error) {
+	if r.staleAfter > 0 {
+		if since := time.Since(d.LastSeen); since > r.staleAfter {
+			return fmt.Sprintf("not seen for %s", since.Truncate(time.Second)), nil
+		}
+	}
+	if d.Cursor == (store.Cursor{}) {
+		return "", nil
+	}
+
+	_, _, err := r.changes.Changes(ctx, d.Namespace, d.Cursor, 1)
+	if errors.Is(err, store.ErrCursorExpired) {
+		return "its cursor has expired", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("check cursor of device %q: %w", d.ID, err)
+	}
+	return "", nil
+}
@@ -0,0 +1,137 @@
+package devices_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/server/internal/devices"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+// changeLog keeps the changes after oldest, of the "e1" epoch.
+type changeLog struct {
+	oldest uint64
+}
+
+func (l *changeLog) Changes(_ context.Context, _ string, since store.Cursor, _ int) ([]store.Change, store.Cursor, error) {
+	if since.Epoch != "e1" || since.Seq < l.oldest {
+		return nil, store.Cursor{}, fmt.Errorf("cursor %v: %w", since, store.ErrCursorExpired)
+	}
+	return nil, since, nil
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	r := devices.New(&changeLog{})
+
+	_, err := r.ReportSync(ctx, "laptop-1", devices.SyncReport{})
+	require.ErrorIs(t, err, devices.ErrNotFound)
+
+	registered, err := r.Register(ctx, devices.Registration{ID: "laptop-1", Name: "laptop", ClientVersion: "v1.0.0"})
+	require.NoError(t, err)
+	assert.Equal(t, store.DefaultNamespace, registered.Namespace)
+	assert.False(t, registered.RegisteredAt.IsZero())
+	_, err = r.Register(ctx, devices.Registration{ID: "desktop-1", Name: "desktop", Namespace: "docs"})
+	require.NoError(t, err)
+
+	report := devices.SyncReport{
+		Cursor:        store.Cursor{Epoch: "e1", Seq: 7},
+		ClientVersion: "v1.1.0",
+		SyncRoot:      devices.SyncRoot{Files: 3, Bytes: 1024, RootHash: "abc"},
+	}
+	reported, err := r.ReportSync(ctx, "laptop-1", report)
+	require.NoError(t, err)
+	assert.Equal(t, report.Cursor, reported.Cursor)
+	assert.Equal(t, report.SyncRoot, reported.SyncRoot)
+	assert.Equal(t, "v1.1.0", reported.ClientVersion)
+	assert.Equal(t, registered.RegisteredAt, reported.RegisteredAt)
+	assert.False(t, reported.LastSeen.Before(registered.LastSeen))
+
+	// registering again keeps the sync state
+	renamed, err := r.Register(ctx, devices.Registration{ID: "laptop-1", Name: "work laptop", ClientVersion: "v1.1.0"})
+	require.NoError(t, err)
+	assert.Equal(t, "work laptop", renamed.Name)
+	assert.Equal(t, report.Cursor, renamed.Cursor)
+
+	// unless the device now syncs another namespace
+	moved, err := r.Register(ctx, devices.Registration{ID: "laptop-1", Name: "work laptop", Namespace: "docs"})
+	require.NoError(t, err)
+	assert.Equal(t, store.Cursor{}, moved.Cursor)
+
+	all, err := r.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, "desktop-1", all[0].ID)
+	assert.Equal(t, "laptop-1", all[1].ID)
+	docs, err := r.List(ctx, "docs")
+	require.NoError(t, err)
+	assert.Len(t, docs, 2)
+	none, err := r.List(ctx, store.DefaultNamespace)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+
+	require.NoError(t, r.Remove(ctx, "desktop-1"))
+	_, err = r.Get(ctx, "desktop-1")
+	assert.ErrorIs(t, err, devices.ErrNotFound)
+	assert.ErrorIs(t, r.Remove(ctx, "desktop-1"), devices.ErrNotFound)
+}
+
+func TestStaleness(t *testing.T) {
+	tests := map[string]struct {
+		staleAfter time.Duration
+		lastSeen   time.Time
+		cursor     store.Cursor
+		wantReason string
+	}{
+		"fresh": {
+			staleAfter: time.Hour,
+			lastSeen:   time.Now(),
+			cursor:     store.Cursor{Epoch: "e1", Seq: 10},
+		},
+		"never synced": {
+			staleAfter: time.Hour,
+			lastSeen:   time.Now(),
+		},
+		"not seen for too long": {
+			staleAfter: time.Hour,
+			lastSeen:   time.Now().Add(-2 * time.Hour),
+			cursor:     store.Cursor{Epoch: "e1", Seq: 10},
+			wantReason: "not seen for 2h0m0s",
+		},
+		"not seen for long with no limit": {
+			lastSeen: time.Now().Add(-2 * time.Hour),
+			cursor:   store.Cursor{Epoch: "e1", Seq: 10},
+		},
+		"cursor older than the oldest change kept": {
+			staleAfter: time.Hour,
+			lastSeen:   time.Now(),
+			cursor:     store.Cursor{Epoch: "e1", Seq: 2},
+			wantReason: "its cursor has expired",
+		},
+		"cursor of another epoch": {
+			staleAfter: time.Hour,
+			lastSeen:   time.Now(),
+			cursor:     store.Cursor{Epoch: "e0", Seq: 10},
+			wantReason: "its cursor has expired",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := devices.New(&changeLog{oldest: 5}, devices.WithStaleAfter(tc.staleAfter))
+
+			reason, err := r.Staleness(context.Background(), devices.Device{
+				ID:       "laptop-1",
+				LastSeen: tc.lastSeen,
+				Cursor:   tc.cursor,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantReason, reason)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package devices
+
+import (
+	"context"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	devicesDesc = prometheus.NewDesc(
+		"filesync_devices",
+		"Number of devices registered to sync a namespace",
+		[]string{"namespace"}, nil,
+	)
+	staleDevicesDesc = prometheus.NewDesc(
+		"filesync_devices_stale",
+		"Number of devices of a namespace not seen for too long, or whose cursors have expired",
+		[]string{"namespace"}, nil,
+	)
+)
+
+// Describe implements prometheus.Collector.
+func (r *Registry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- devicesDesc
+	ch <- staleDevicesDesc
+}
+
+// Collect implements prometheus.Collector. The gauges are computed from the registry on every scrape.
+func (r *Registry) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	devices, err := r.List(ctx, "")
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(devicesDesc, err)
+		return
+	}
+
+	total := make(map[string]int)
+	stale := make(map[string]int)
+	for d := range slices.Values(devices) {
+		total[d.Namespace]++
+		reason, err := r.Staleness(ctx, d)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(staleDevicesDesc, err)
+			return
+		}
+		if reason != "" {
+			stale[d.Namespace]++
+		}
+	}
+	for namespace, n := range total {
+		ch <- prometheus.MustNewConstMetric(devicesDesc, prometheus.GaugeValue, float64(n), namespace)
+		ch <- prometheus.MustNewConstMetric(staleDevicesDesc, prometheus.GaugeValue, float64(stale[namespace]), namespace)
+	}
+}
@@ -0,0 +1,295 @@
+// Package events implements the bus server features subscribe to in order to react to changes of the object
+// metadata, without the metadata store knowing about them. Events are numbered in the order the changes were made,
+// and every subscriber gets its own buffer and decides what happens when it can't keep up.
+package events
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+// DefaultBuffer is the default number of events buffered for a subscriber.
+const DefaultBuffer = 256
+
+// ErrSlowSubscriber is the error of a subscription closed because its subscriber didn't keep up with the events.
+var ErrSlowSubscriber = errors.New("subscriber fell behind")
+
+type Type string
+
+const (
+	// Created is published when an object is completed, or linked, under a key that had none.
+	Created Type = "created"
+	// Replaced is published when an object is completed, or linked, under a key that had one already.
+	Replaced Type = "replaced"
+	Deleted  Type = "deleted"
+	// Moved is published when an object is moved to another key, replacing the object under that key, if any.
+	Moved Type = "moved"
+)
+
+// Event is a change of the completed object metadata.
+type Event struct {
+	// Seq is the position of the event among all the events published on the bus, starting at 1.
+	Seq       uint64
+	Type      Type
+	Time      time.Time
+	Namespace string
+	Key       string
+	// Object is the metadata of the created, replacing, deleted or moved object.
+	Object store.ObjectMetadata
+	// Previous is the metadata of the object replaced under Key, if any.
+	Previous *store.ObjectMetadata
+	// FromKey is the key a moved object was moved from.
+	FromKey string
+	// By tells who made the change.
+	By store.Attribution
+}
+
+// Policy is what happens to the events published while a subscriber's buffer is full.
+type Policy int
+
+const (
+	// DropNewest drops the events published while the buffer is full.
+	DropNewest Policy = iota
+	// DropOldest drops the oldest buffered event to make room for the new one.
+	DropOldest
+	// Block makes publishers wait for the subscriber. Changes are published while the metadata store is locked, so
+	// it's only for subscribers that never call the store and always keep up eventually.
+	Block
+	// Disconnect closes the subscription, with ErrSlowSubscriber, so the subscriber can resubscribe and resync.
+	Disconnect
+)
+
+func (p Policy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+type SubscribeOption func(s *Subscription)
+
+// WithBuffer sets the number of events buffered for the subscriber.
+func WithBuffer(n int) SubscribeOption {
+	return func(s *Subscription) {
+		s.buffer = n
+	}
+}
+
+// WithPolicy sets what happens to the events published while the subscriber's buffer is full. It's DropNewest by
+// default.
+func WithPolicy(p Policy) SubscribeOption {
+	return func(s *Subscription) {
+		s.policy = p
+	}
+}
+
+// Subscription receives the events published on a bus after it subscribed.
+type Subscription struct {
+	bus    *Bus
+	name   string
+	buffer int
+	policy Policy
+
+	ch        chan Event
+	done      chan struct{}
+	closeOnce sync.Once
+	// err is guarded by the bus lock
+	err error
+}
+
+// Events returns the channel the events are delivered on. It's closed once the subscription is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Err returns ErrSlowSubscriber if the subscription was closed because the subscriber fell behind.
+func (s *Subscription) Err() error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	return s.err
+}
+
+// Close unsubscribes. It's safe to call more than once.
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		// unblock any publisher waiting for this subscriber before taking the lock it's holding
+		close(s.done)
+		s.bus.mu.Lock()
+		defer s.bus.mu.Unlock()
+		s.bus.unsubscribe(s)
+	})
+}
+
+// Bus delivers published events to all of its subscribers.
+type Bus struct {
+	logger *logrus.Logger
+
+	mu          sync.Mutex
+	seq         uint64
+	subscribers []*Subscription
+	metrics     metrics
+}
+
+func New(logger *logrus.Logger) *Bus {
+	return &Bus{
+		logger: logger,
+		metrics: metrics{
+			published: make(map[Type]uint64),
+			dropped:   make(map[string]uint64),
+		},
+	}
+}
+
+// Subscribe subscribes to the events published from now on. The name identifies the subscriber in logs and metrics.
+func (b *Bus) Subscribe(name string, opts ...SubscribeOption) *Subscription {
+	s := &Subscription{
+		bus:    b,
+		name:   name,
+		buffer: DefaultBuffer,
+		policy: DropNewest,
+		done:   make(chan struct{}),
+	}
+	for opt := range slices.Values(opts) {
+		opt(s)
+	}
+	s.ch = make(chan Event, s.buffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscribers = append(b.subscribers, s)
+	b.logger.WithFields(logrus.Fields{
+		"subscriber": name,
+		"buffer":     s.buffer,
+		"policy":     s.policy,
+	}).Debug("Subscribed to events")
+
+	return s
+}
+
+// unsubscribe removes the given subscription and closes its channel. The caller must hold the lock.
+func (b *Bus) unsubscribe(s *Subscription) {
+	i := slices.Index(b.subscribers, s)
+	if i == -1 {
+		return
+	}
+	b.subscribers = slices.Delete(b.subscribers, i, i+1)
+	close(s.ch)
+}
+
+// Publish numbers the given event, timestamping it if it isn't, and delivers it to every subscriber according to
+// their policy. Events are delivered in the order they're published.
+func (b *Bus) Publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	ev.Seq = b.seq
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	b.metrics.published[ev.Type]++
+
+	// subscribers disconnected while delivering are removed from the slice being iterated
+	for s := range slices.Values(slices.Clone(b.subscribers)) {
+		b.deliver(s, ev)
+	}
+}
+
+// deliver delivers the given event to the given subscriber. The caller must hold the lock.
+func (b *Bus) deliver(s *Subscription, ev Event) {
+	select {
+	case s.ch <- ev:
+		return
+	default:
+	}
+
+	switch s.policy {
+	case DropOldest:
+		select {
+		case <-s.ch:
+			b.drop(s)
+		default:
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			b.drop(s)
+		}
+	case Block:
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+		}
+	case Disconnect:
+		b.drop(s)
+		s.err = ErrSlowSubscriber
+		b.unsubscribe(s)
+		b.logger.WithField("subscriber", s.name).Warn("Disconnected subscriber falling behind events")
+	default:
+		b.drop(s)
+	}
+}
+
+// drop counts an event dropped for the given subscriber. The caller must hold the lock.
+func (b *Bus) drop(s *Subscription) {
+	b.metrics.dropped[s.name]++
+}
+
+// LogEvents logs every event of the given subscription until it's closed or the context is done, which closes it.
+func LogEvents(ctx context.Context, logger *logrus.Logger, s *Subscription) {
+	defer s.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-s.Events():
+			if !ok {
+				return
+			}
+			fields := logrus.Fields{
+				"seq":       ev.Seq,
+				"event":     ev.Type,
+				"namespace": ev.Namespace,
+				"key":       ev.Key,
+				"object_id": ev.Object.ObjectID,
+				"size":      ev.Object.Size,
+			}
+			if ev.FromKey != "" {
+				fields["from_key"] = ev.FromKey
+			}
+			if ev.Previous != nil {
+				fields["previous_object_id"] = ev.Previous.ObjectID
+			}
+			for name, value := range map[string]string{
+				"operation":     string(ev.By.Operation),
+				"access_key_id": ev.By.AccessKeyID,
+				"device_id":     ev.By.DeviceID,
+				"hostname":      ev.By.Hostname,
+				"user":          ev.By.User,
+			} {
+				if value != "" {
+					fields[name] = value
+				}
+			}
+			logger.WithContext(ctx).WithFields(fields).Info("Object changed")
+		}
+	}
+}
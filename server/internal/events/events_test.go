@@ -0,0 +1,111 @@
+package events_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/server/internal/events"
+)
+
+// received returns the keys of the events buffered for the given subscription.
+func received(s *events.Subscription) []string {
+	var keys []string
+	for {
+		select {
+		case ev, ok := <-s.Events():
+			if !ok {
+				return keys
+			}
+			keys = append(keys, ev.Key)
+		default:
+			return keys
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	tests := map[string]struct {
+		policy events.Policy
+
+		expectedKeys   []string
+		expectedClosed bool
+	}{
+		"drop newest": {
+			policy:       events.DropNewest,
+			expectedKeys: []string{"a", "b"},
+		},
+		"drop oldest": {
+			policy:       events.DropOldest,
+			expectedKeys: []string{"c", "d"},
+		},
+		"disconnect": {
+			policy:         events.Disconnect,
+			expectedKeys:   []string{"a", "b"},
+			expectedClosed: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			bus := events.New(logrus.New())
+			slow := bus.Subscribe("slow", events.WithBuffer(2), events.WithPolicy(tc.policy))
+			defer slow.Close()
+			other := bus.Subscribe("other", events.WithBuffer(4))
+			defer other.Close()
+
+			for key := range slices.Values([]string{"a", "b", "c", "d"}) {
+				bus.Publish(events.Event{Type: events.Created, Key: key})
+			}
+
+			// a slow subscriber doesn't affect the others
+			assert.Equal(t, []string{"a", "b", "c", "d"}, received(other))
+			assert.Equal(t, tc.expectedKeys, received(slow))
+			if tc.expectedClosed {
+				require.ErrorIs(t, slow.Err(), events.ErrSlowSubscriber)
+				_, ok := <-slow.Events()
+				assert.False(t, ok)
+			} else {
+				require.NoError(t, slow.Err())
+			}
+		})
+	}
+}
+
+func TestBlock(t *testing.T) {
+	bus := events.New(logrus.New())
+	sub := bus.Subscribe("blocking", events.WithBuffer(1), events.WithPolicy(events.Block))
+
+	bus.Publish(events.Event{Key: "a"})
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		bus.Publish(events.Event{Key: "b"})
+	}()
+
+	select {
+	case <-published:
+		t.Fatal("publish didn't wait for the subscriber")
+	case <-time.After(20 * time.Millisecond):
+	}
+	ev := <-sub.Events()
+	assert.Equal(t, uint64(1), ev.Seq)
+	<-published
+	ev = <-sub.Events()
+	assert.Equal(t, uint64(2), ev.Seq)
+	assert.False(t, ev.Time.IsZero())
+
+	// closing the subscription unblocks publishers
+	bus.Publish(events.Event{Key: "c"})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sub.Close()
+	}()
+	bus.Publish(events.Event{Key: "d"})
+	assert.Equal(t, []string{"c"}, received(sub))
+	sub.Close()
+}
@@ -0,0 +1,58 @@
+package events
+
+import (
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	publishedEventsDesc = prometheus.NewDesc(
+		"filesync_events_published_total",
+		"Number of object events published, by type",
+		[]string{"type"}, nil,
+	)
+	droppedEventsDesc = prometheus.NewDesc(
+		"filesync_events_dropped_total",
+		"Number of object events a subscriber missed because it fell behind",
+		[]string{"subscriber"}, nil,
+	)
+	bufferedEventsDesc = prometheus.NewDesc(
+		"filesync_events_buffered",
+		"Number of object events buffered for a subscriber",
+		[]string{"subscriber"}, nil,
+	)
+)
+
+type metrics struct {
+	published map[Type]uint64
+	// dropped is kept by subscriber name so it survives resubscribing
+	dropped map[string]uint64
+}
+
+// Describe implements prometheus.Collector.
+func (b *Bus) Describe(ch chan<- *prometheus.Desc) {
+	ch <- publishedEventsDesc
+	ch <- droppedEventsDesc
+	ch <- bufferedEventsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (b *Bus) Collect(ch chan<- prometheus.Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for typ, n := range b.metrics.published {
+		ch <- prometheus.MustNewConstMetric(publishedEventsDesc, prometheus.CounterValue, float64(n), string(typ))
+	}
+	for name, n := range b.metrics.dropped {
+		ch <- prometheus.MustNewConstMetric(droppedEventsDesc, prometheus.CounterValue, float64(n), name)
+	}
+	buffered := make(map[string]int)
+	for s := range slices.Values(b.subscribers) {
+		buffered[s.name] += len(s.ch)
+	}
+	for name, n := range buffered {
+		ch <- prometheus.MustNewConstMetric(bufferedEventsDesc, prometheus.GaugeValue, float64(n), name)
+	}
+}
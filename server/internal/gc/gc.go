@@ -0,0 +1,206 @@
+// Package gc reclaims the storage of abandoned uploads and of stored objects no metadata references, e.g. ones left
+// behind by a crashed server. Objects are never deleted by the collector itself; it queues them for deletion by the
+// janitor, which makes sure they're still unreferenced first.
+package gc
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+const (
+	// DefaultInterval is the default time between two collections.
+	DefaultInterval = time.Hour
+	// DefaultGracePeriod is the default time inflight uploads are kept after their presigned url expired, and orphan
+	// objects are kept after they were first found.
+	DefaultGracePeriod = 24 * time.Hour
+)
+
+type MetadataStore interface {
+	ExpireInflightUploads(ctx context.Context, before time.Time) ([]store.ObjectMetadata, error)
+	ObjectReferenced(ctx context.Context, objectID string) (bool, error)
+}
+
+type ObjectLister interface {
+	ListObjects(ctx context.Context, fn func(objectID string) error) error
+}
+
+type Emitter interface {
+	Emit(ctx context.Context, obj *store.ObjectMetadata) error
+}
+
+type Option func(c *Collector)
+
+// WithInterval sets the time between two collections.
+func WithInterval(d time.Duration) Option {
+	return func(c *Collector) {
+		c.interval = d
+	}
+}
+
+// WithGracePeriod sets how long inflight uploads are kept after their presigned url expired, since an upload can take
+// longer than its url is valid for, and how long objects must stay unreferenced before they're reclaimed as orphans.
+func WithGracePeriod(d time.Duration) Option {
+	return func(c *Collector) {
+		c.gracePeriod = d
+	}
+}
+
+// WithOrphans makes the collector reclaim the stored objects no metadata references. The lister is usually the
+// underlying backend rather than any wrapper decrypting the objects, since objects are listed by ID.
+func WithOrphans(lister ObjectLister) Option {
+	return func(c *Collector) {
+		c.lister = lister
+	}
+}
+
+// Stats are the outcome of a collection.
+type Stats struct {
+	// ExpiredUploads is the number of abandoned inflight uploads removed.
+	ExpiredUploads int
+	// Orphans is the number of unreferenced objects still within their grace period, and ReclaimedOrphans the number
+	// of those queued for deletion.
+	Orphans          int
+	ReclaimedOrphans int
+}
+
+// Collector periodically expires abandoned inflight uploads and reclaims orphan objects.
+type Collector struct {
+	logger      *logrus.Logger
+	mdStore     MetadataStore
+	emitter     Emitter
+	lister      ObjectLister
+	interval    time.Duration
+	gracePeriod time.Duration
+
+	// orphans holds when every currently unreferenced object was first found unreferenced. It's only accessed by
+	// Collect, which must not be called concurrently.
+	orphans map[string]time.Time
+}
+
+func New(logger *logrus.Logger, mdStore MetadataStore, emitter Emitter, opts ...Option) *Collector {
+	c := &Collector{
+		logger:      logger,
+		mdStore:     mdStore,
+		emitter:     emitter,
+		interval:    DefaultInterval,
+		gracePeriod: DefaultGracePeriod,
+		orphans:     make(map[string]time.Time),
+	}
+	for opt := range slices.Values(opts) {
+		opt(c)
+	}
+	return c
+}
+
+// Run collects every interval until the context is done.
+func (c *Collector) Run(ctx context.Context) {
+	logger := c.logger.WithContext(ctx)
+	logger.WithFields(logrus.Fields{
+		"interval":     c.interval,
+		"grace_period": c.gracePeriod,
+		"orphans":      c.lister != nil,
+	}).Info("Running garbage collector")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.interval):
+		}
+
+		stats, err := c.Collect(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Error("Failed to collect garbage")
+			continue
+		}
+		logger.WithFields(logrus.Fields{
+			"expired_uploads":   stats.ExpiredUploads,
+			"orphans":           stats.Orphans,
+			"reclaimed_orphans": stats.ReclaimedOrphans,
+		}).Info("Collected garbage")
+	}
+}
+
+// Collect expires the inflight uploads whose presigned url expired more than the grace period ago, and queues the
+// objects found unreferenced in every collection for at least the grace period for deletion.
+func (c *Collector) Collect(ctx context.Context) (Stats, error) {
+	logger := c.logger.WithContext(ctx)
+	now := time.Now()
+	var stats Stats
+
+	expired, err := c.mdStore.ExpireInflightUploads(ctx, now.Add(-c.gracePeriod))
+	stats.ExpiredUploads = len(expired)
+	for md := range slices.Values(expired) {
+		logger.WithFields(logrus.Fields{
+			"namespace":  md.Namespace,
+			"key":        md.Key,
+			"object_id":  md.ObjectID,
+			"expired_at": md.ExpiresAt,
+		}).Info("Expired abandoned inflight upload")
+	}
+	if err != nil {
+		return stats, fmt.Errorf("expire inflight uploads: %w", err)
+	}
+
+	if c.lister == nil {
+		return stats, nil
+	}
+
+	var objectIDs []string
+	err = c.lister.ListObjects(ctx, func(objectID string) error {
+		objectIDs = append(objectIDs, objectID)
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("list stored objects: %w", err)
+	}
+
+	// references are checked after listing so objects uploaded meanwhile are never orphans; objects no longer listed
+	// or referenced again are forgotten
+	orphans := make(map[string]time.Time)
+	for objectID := range slices.Values(objectIDs) {
+		referenced, err := c.mdStore.ObjectReferenced(ctx, objectID)
+		if err != nil {
+			return stats, fmt.Errorf("check references of object %q: %w", objectID, err)
+		}
+		if referenced {
+			continue
+		}
+
+		firstSeen, ok := c.orphans[objectID]
+		if !ok {
+			firstSeen = now
+		}
+		if now.Sub(firstSeen) < c.gracePeriod {
+			orphans[objectID] = firstSeen
+			continue
+		}
+
+		err = c.emitter.Emit(ctx, &store.ObjectMetadata{ObjectID: objectID})
+		if err != nil {
+			// keep tracking the objects found so far without forgetting those not checked yet
+			maps.Copy(c.orphans, orphans)
+			return stats, fmt.Errorf("queue orphan object %q for deletion: %w", objectID, err)
+		}
+		logger.WithFields(logrus.Fields{
+			"object_id":  objectID,
+			"first_seen": firstSeen,
+		}).Info("Reclaiming orphan object")
+		stats.ReclaimedOrphans++
+	}
+	c.orphans = orphans
+	stats.Orphans = len(orphans)
+
+	return stats, nil
+}
@@ -0,0 +1,144 @@
+package gc_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/server/internal/gc"
+	"github.com/hedisam/filesync/server/internal/gc/mocks"
+	"github.com/hedisam/filesync/server/internal/store"
+	"github.com/hedisam/filesync/server/internal/store/memdb"
+)
+
+//go:generate moq -out mocks/emitter.go -pkg mocks -skip-ensure . Emitter
+//go:generate moq -out mocks/object_lister.go -pkg mocks -skip-ensure . ObjectLister
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	tests := map[string]struct {
+		gracePeriod time.Duration
+		emitErr     error
+
+		expectedStats   gc.Stats
+		expectedEmitted []string
+		expectedErr     error
+	}{
+		"within the grace period": {
+			gracePeriod: time.Hour,
+			expectedStats: gc.Stats{
+				ExpiredUploads: 1,
+				Orphans:        2,
+			},
+			expectedEmitted: []string{"abandoned"},
+		},
+		"past the grace period": {
+			expectedStats: gc.Stats{
+				ExpiredUploads:   2,
+				ReclaimedOrphans: 2,
+			},
+			expectedEmitted: []string{"abandoned", "expired", "orphan-1", "orphan-2"},
+		},
+		"emit failure": {
+			emitErr:     errors.New("closed"),
+			expectedErr: errors.New("closed"),
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var emitted []string
+			emitter := &mocks.EmitterMock{
+				EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+					if tc.emitErr != nil {
+						return tc.emitErr
+					}
+					emitted = append(emitted, obj.ObjectID)
+					return nil
+				},
+			}
+			mdStore := memdb.NewMetadataStore(emitter)
+			for md := range slices.Values([]*store.ObjectMetadata{
+				{Key: "a", ObjectID: "abandoned", ExpiresAt: now.Add(-2 * time.Hour)},
+				{Key: "b", ObjectID: "expired", ExpiresAt: now.Add(-time.Minute)},
+				{Key: "c", ObjectID: "valid", ExpiresAt: now.Add(time.Minute)},
+			}) {
+				require.NoError(t, mdStore.Create(ctx, md))
+			}
+			lister := &mocks.ObjectListerMock{
+				ListObjectsFunc: func(ctx context.Context, fn func(objectID string) error) error {
+					// the expired uploads have already been released when the objects are listed
+					for objectID := range slices.Values([]string{"orphan-1", "orphan-2", "valid"}) {
+						err := fn(objectID)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+			}
+
+			c := gc.New(logrus.New(), mdStore, emitter, gc.WithGracePeriod(tc.gracePeriod), gc.WithOrphans(lister))
+			stats, err := c.Collect(ctx)
+			if tc.expectedErr != nil {
+				require.ErrorContains(t, err, tc.expectedErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStats, stats)
+			slices.Sort(emitted)
+			assert.Equal(t, tc.expectedEmitted, emitted)
+
+			// the valid upload can still complete
+			require.NoError(t, mdStore.PutObjectCompleted(ctx, store.DefaultNamespace, "c", "valid"))
+		})
+	}
+}
+
+func TestCollectTracksOrphans(t *testing.T) {
+	ctx := context.Background()
+	var emitted []string
+	emitter := &mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			emitted = append(emitted, obj.ObjectID)
+			return nil
+		},
+	}
+	mdStore := memdb.NewMetadataStore(emitter)
+	listed := []string{"orphan", "referenced-later"}
+	lister := &mocks.ObjectListerMock{
+		ListObjectsFunc: func(ctx context.Context, fn func(objectID string) error) error {
+			for objectID := range slices.Values(listed) {
+				require.NoError(t, fn(objectID))
+			}
+			return nil
+		},
+	}
+
+	c := gc.New(logrus.New(), mdStore, emitter, gc.WithGracePeriod(50*time.Millisecond), gc.WithOrphans(lister))
+	stats, err := c.Collect(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, gc.Stats{Orphans: 2}, stats)
+
+	// an object referenced again is no longer an orphan, and has to go through the grace period again afterwards
+	require.NoError(t, mdStore.Create(ctx, &store.ObjectMetadata{Key: "k", ObjectID: "referenced-later"}))
+	time.Sleep(50 * time.Millisecond)
+	stats, err = c.Collect(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, gc.Stats{ReclaimedOrphans: 1}, stats)
+	assert.Equal(t, []string{"orphan"}, emitted)
+
+	require.NoError(t, mdStore.PutObjectFailed(ctx, store.DefaultNamespace, "k", "referenced-later"))
+	listed = []string{"referenced-later"}
+	stats, err = c.Collect(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, gc.Stats{Orphans: 1}, stats)
+}
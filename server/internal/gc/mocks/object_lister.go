@@ -0,0 +1,77 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package mocks
+
+import (
+	"context"
+	"sync"
+)
+
+// ObjectListerMock is a mock implementation of gc.ObjectLister.
+//
+//	func TestSomethingThatUsesObjectLister(t *testing.T) {
+//
+//		// make and configure a mocked gc.ObjectLister
+//		mockedObjectLister := &ObjectListerMock{
+//			ListObjectsFunc: func(ctx context.Context, fn func(objectID string) error) error {
+//				panic("mock out the ListObjects method")
+//			},
+//		}
+//
+//		// use mockedObjectLister in code that requires gc.ObjectLister
+//		// and then make assertions.
+//
+//	}
+type ObjectListerMock struct {
+	// ListObjectsFunc mocks the ListObjects method.
+	ListObjectsFunc func(ctx context.Context, fn func(objectID string) error) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// ListObjects holds details about calls to the ListObjects method.
+		ListObjects []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Fn is the fn argument value.
+			Fn func(objectID string) error
+		}
+	}
+	lockListObjects sync.RWMutex
+}
+
+// ListObjects calls ListObjectsFunc.
+func (mock *ObjectListerMock) ListObjects(ctx context.Context, fn func(objectID string) error) error {
+	if mock.ListObjectsFunc == nil {
+		panic("ObjectListerMock.ListObjectsFunc: method is nil but ObjectLister.ListObjects was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		Fn  func(objectID string) error
+	}{
+		Ctx: ctx,
+		Fn:  fn,
+	}
+	mock.lockListObjects.Lock()
+	mock.calls.ListObjects = append(mock.calls.ListObjects, callInfo)
+	mock.lockListObjects.Unlock()
+	return mock.ListObjectsFunc(ctx, fn)
+}
+
+// ListObjectsCalls gets all the calls that were made to ListObjects.
+// Check the length with:
+//
+//	len(mockedObjectLister.ListObjectsCalls())
+func (mock *ObjectListerMock) ListObjectsCalls() []struct {
+	Ctx context.Context
+	Fn  func(objectID string) error
+} {
+	var calls []struct {
+		Ctx context.Context
+		Fn  func(objectID string) error
+	}
+	mock.lockListObjects.RLock()
+	calls = mock.calls.ListObjects
+	mock.lockListObjects.RUnlock()
+	return calls
+}
@@ -0,0 +1,486 @@
+// Package outbox implements the durable queue of objects to delete. Entries are journaled to a file before they're
+// enqueued, so an object released by a metadata change is deleted eventually even if the server stops before it's
+// done. Entries are only removed once they're acknowledged, retried with an exponential backoff that survives
+// restarts, and parked as dead letters after too many failed attempts, until an operator requeues them.
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+const (
+	// DefaultMaxAttempts is the default number of failed attempts after which an entry becomes a dead letter.
+	DefaultMaxAttempts = 10
+	// DefaultMinBackoff and DefaultMaxBackoff bound the default time between two attempts of the same entry.
+	DefaultMinBackoff = time.Minute
+	DefaultMaxBackoff = 6 * time.Hour
+
+	// the journal is compacted once it has this many more records than live entries
+	compactThreshold = 1000
+
+	opPut  = "put"
+	opDead = "dead"
+	opAck  = "ack"
+)
+
+var (
+	ErrClosed   = errors.New("outbox closed")
+	ErrNotFound = errors.New("outbox entry not found")
+)
+
+// Entry is an object queued for deletion.
+type Entry struct {
+	ID uint64 `json:"id"`
+	// Namespace and Key are the ones of the metadata that released the object, if any. They're only informational.
+	Namespace     string    `json:"namespace,omitempty"`
+	Key           string    `json:"key,omitempty"`
+	ObjectID      string    `json:"object_id"`
+	EnqueuedAt    time.Time `json:"enqueued_at"`
+	Attempts      int       `json:"attempts,omitempty"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// record is a line of the journal. Put and dead records hold the whole state of an entry, pending or dead
+// respectively, and ack records remove it.
+type record struct {
+	Op    string `json:"op"`
+	Entry *Entry `json:"entry,omitempty"`
+	ID    uint64 `json:"id,omitempty"`
+}
+
+type Option func(o *Outbox)
+
+// WithRetries sets the number of failed attempts after which an entry becomes a dead letter, and the bounds of the
+// exponential backoff between two attempts.
+func WithRetries(maxAttempts int, minBackoff, maxBackoff time.Duration) Option {
+	return func(o *Outbox) {
+		o.maxAttempts = maxAttempts
+		o.minBackoff = minBackoff
+		o.maxBackoff = maxBackoff
+	}
+}
+
+// Outbox is a durable queue of objects to delete. It's meant to have a single consumer.
+type Outbox struct {
+	logger      *logrus.Logger
+	path        string
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	mu      sync.Mutex
+	file    *os.File
+	records int
+	nextID  uint64
+	pending map[uint64]*Entry
+	leased  map[uint64]bool
+	dead    map[uint64]*Entry
+	closed  bool
+	// wake is signaled whenever an entry might have become due
+	wake chan struct{}
+	done chan struct{}
+}
+
+// Open opens the outbox journaled in the given file, creating it if it doesn't exist. Entries left by a previous run
+// are enqueued again, including those that were being processed when it stopped.
+func Open(logger *logrus.Logger, path string, opts ...Option) (*Outbox, error) {
+	o := &Outbox{
+		logger:      logger,
+		path:        path,
+		maxAttempts: DefaultMaxAttempts,
+		minBackoff:  DefaultMinBackoff,
+		maxBackoff:  DefaultMaxBackoff,
+		nextID:      1,
+		pending:     make(map[uint64]*Entry),
+		leased:      make(map[uint64]bool),
+		dead:        make(map[uint64]*Entry),
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	for opt := range slices.Values(opts) {
+		opt(o)
+	}
+
+	err := o.replay()
+	if err != nil {
+		return nil, err
+	}
+	// start from a compact journal, which also gets rid of any record partially written before a crash
+	err = o.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"path":         path,
+		"pending":      len(o.pending),
+		"dead_letters": len(o.dead),
+	}).Info("Opened deletion outbox")
+
+	return o, nil
+}
+
+func (o *Outbox) replay() error {
+	f, err := os.Open(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open outbox journal: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var r record
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			// only the last record can be partially written; anything after it would be lost anyway
+			o.logger.WithError(err).WithField("line", line).Warn("Ignoring the rest of the outbox journal after an invalid record")
+			break
+		}
+		o.apply(&r)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read outbox journal: %w", err)
+	}
+
+	return nil
+}
+
+// apply applies the given record to the in memory state. The caller must hold the lock, if needed.
+func (o *Outbox) apply(r *record) {
+	switch r.Op {
+	case opPut:
+		delete(o.dead, r.Entry.ID)
+		o.pending[r.Entry.ID] = r.Entry
+		o.nextID = max(o.nextID, r.Entry.ID+1)
+	case opDead:
+		delete(o.pending, r.Entry.ID)
+		delete(o.leased, r.Entry.ID)
+		o.dead[r.Entry.ID] = r.Entry
+		o.nextID = max(o.nextID, r.Entry.ID+1)
+	case opAck:
+		delete(o.pending, r.ID)
+		delete(o.leased, r.ID)
+		delete(o.dead, r.ID)
+	}
+}
+
+// commit journals the given records and applies them once they're synced to disk. The caller must hold the lock.
+func (o *Outbox) commit(records ...*record) error {
+	if o.closed {
+		return ErrClosed
+	}
+
+	var buf []byte
+	for r := range slices.Values(records) {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("marshal outbox record: %w", err)
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	_, err := o.file.Write(buf)
+	if err != nil {
+		return fmt.Errorf("write outbox journal: %w", err)
+	}
+	err = o.file.Sync()
+	if err != nil {
+		return fmt.Errorf("sync outbox journal: %w", err)
+	}
+
+	for r := range slices.Values(records) {
+		o.apply(r)
+	}
+	o.records += len(records)
+
+	if o.records > 2*(len(o.pending)+len(o.dead))+compactThreshold {
+		err = o.compact()
+		if err != nil {
+			// the journal is still valid, just longer than it needs to be
+			o.logger.WithError(err).Warn("Failed to compact outbox journal")
+		}
+	}
+
+	return nil
+}
+
+// compact rewrites the journal with a single record per live entry, atomically replacing the current one.
+func (o *Outbox) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(o.path), filepath.Base(o.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create outbox journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	records := 0
+	for id := range slices.Values(slices.Sorted(maps.Keys(o.pending))) {
+		err = enc.Encode(&record{Op: opPut, Entry: o.pending[id]})
+		if err != nil {
+			_ = tmp.Close()
+			return fmt.Errorf("write outbox journal: %w", err)
+		}
+		records++
+	}
+	for id := range slices.Values(slices.Sorted(maps.Keys(o.dead))) {
+		err = enc.Encode(&record{Op: opDead, Entry: o.dead[id]})
+		if err != nil {
+			_ = tmp.Close()
+			return fmt.Errorf("write outbox journal: %w", err)
+		}
+		records++
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write outbox journal: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("close outbox journal: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), o.path)
+	if err != nil {
+		return fmt.Errorf("replace outbox journal: %w", err)
+	}
+	err = syncDir(filepath.Dir(o.path))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open outbox journal: %w", err)
+	}
+	if o.file != nil {
+		_ = o.file.Close()
+	}
+	o.file = f
+	o.records = records
+
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open outbox dir: %w", err)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("sync outbox dir: %w", err)
+	}
+	return nil
+}
+
+// Emit queues the object of the given metadata for deletion. The entry is on disk by the time Emit returns, so a
+// metadata change made after Emit succeeded can't leak the object.
+func (o *Outbox) Emit(_ context.Context, md *store.ObjectMetadata) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now().UTC()
+	err := o.commit(&record{
+		Op: opPut,
+		Entry: &Entry{
+			ID:            o.nextID,
+			Namespace:     md.Namespace,
+			Key:           md.Key,
+			ObjectID:      md.ObjectID,
+			EnqueuedAt:    now,
+			NextAttemptAt: now,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	o.signal()
+
+	return nil
+}
+
+// signal wakes up the consumer waiting in Next, if any. The caller must hold the lock.
+func (o *Outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Next returns the pending entry due the earliest, waiting until one is due. The entry isn't returned again until
+// it's nacked, or the outbox is reopened; it's only removed once it's acked.
+func (o *Outbox) Next(ctx context.Context) (Entry, error) {
+	for {
+		o.mu.Lock()
+		if o.closed {
+			o.mu.Unlock()
+			return Entry{}, ErrClosed
+		}
+		var next *Entry
+		for e := range maps.Values(o.pending) {
+			if o.leased[e.ID] {
+				continue
+			}
+			if next == nil || e.NextAttemptAt.Before(next.NextAttemptAt) || (e.NextAttemptAt.Equal(next.NextAttemptAt) && e.ID < next.ID) {
+				next = e
+			}
+		}
+		if next != nil && !next.NextAttemptAt.After(time.Now()) {
+			o.leased[next.ID] = true
+			o.mu.Unlock()
+			return *next, nil
+		}
+		o.mu.Unlock()
+
+		var due <-chan time.Time
+		var timer *time.Timer
+		if next != nil {
+			timer = time.NewTimer(time.Until(next.NextAttemptAt))
+			due = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-o.done:
+		case <-o.wake:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return Entry{}, ctx.Err()
+		}
+	}
+}
+
+// Ack removes the given entry, once its object is deleted or it turns out it must be kept.
+func (o *Outbox) Ack(id uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.pending[id]; !ok {
+		return fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	return o.commit(&record{Op: opAck, ID: id})
+}
+
+// Nack records a failed attempt of the given entry. It's retried after a backoff growing with every attempt, or
+// becomes a dead letter if it has failed too many times.
+func (o *Outbox) Nack(id uint64, cause error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, ok := o.pending[id]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+
+	updated := *e
+	updated.Attempts++
+	updated.LastError = cause.Error()
+	op := opPut
+	if updated.Attempts >= o.maxAttempts {
+		op = opDead
+	} else {
+		updated.NextAttemptAt = time.Now().UTC().Add(o.backoff(updated.Attempts))
+	}
+	err := o.commit(&record{Op: op, Entry: &updated})
+	if err != nil {
+		return err
+	}
+	delete(o.leased, id)
+	o.signal()
+
+	return nil
+}
+
+// backoff returns the time to wait before the next attempt of an entry that failed the given number of times.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	d := o.minBackoff
+	for range attempts - 1 {
+		d *= 2
+		if d >= o.maxBackoff {
+			return o.maxBackoff
+		}
+	}
+	return min(d, o.maxBackoff)
+}
+
+// Pending returns the number of pending entries.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.pending)
+}
+
+// DeadLetters returns the entries that failed too many times, in the order they were enqueued.
+func (o *Outbox) DeadLetters() []Entry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries := make([]Entry, 0, len(o.dead))
+	for id := range slices.Values(slices.Sorted(maps.Keys(o.dead))) {
+		entries = append(entries, *o.dead[id])
+	}
+	return entries
+}
+
+// Requeue makes the given dead letter pending again, with its attempts reset.
+func (o *Outbox) Requeue(id uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, ok := o.dead[id]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+
+	updated := *e
+	updated.Attempts = 0
+	updated.NextAttemptAt = time.Now().UTC()
+	err := o.commit(&record{Op: opPut, Entry: &updated})
+	if err != nil {
+		return err
+	}
+	o.signal()
+
+	return nil
+}
+
+// Close closes the journal. Pending entries are left in it for the next run.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	close(o.done)
+	return o.file.Close()
+}
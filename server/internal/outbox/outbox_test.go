@@ -0,0 +1,144 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/server/internal/outbox"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "deletions.jsonl")
+
+	o, err := outbox.Open(logrus.New(), path)
+	require.NoError(t, err)
+	require.NoError(t, o.Emit(ctx, &store.ObjectMetadata{Namespace: "docs", Key: "a.txt", ObjectID: "a"}))
+	require.NoError(t, o.Emit(ctx, &store.ObjectMetadata{ObjectID: "b"}))
+	assert.Equal(t, 2, o.Pending())
+
+	entry, err := o.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), entry.ID)
+	assert.Equal(t, "docs", entry.Namespace)
+	assert.Equal(t, "a.txt", entry.Key)
+	assert.Equal(t, "a", entry.ObjectID)
+	require.NoError(t, o.Ack(entry.ID))
+
+	// an entry being processed isn't handed out again, but is still pending
+	entry, err = o.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "b", entry.ObjectID)
+	assert.Equal(t, 1, o.Pending())
+	nextCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = o.Next(nextCtx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NoError(t, o.Close())
+
+	_, err = o.Next(ctx)
+	require.ErrorIs(t, err, outbox.ErrClosed)
+	require.ErrorIs(t, o.Emit(ctx, &store.ObjectMetadata{ObjectID: "c"}), outbox.ErrClosed)
+
+	// the unacknowledged entry survives a restart, and new entries don't reuse its ID
+	o, err = outbox.Open(logrus.New(), path)
+	require.NoError(t, err)
+	defer o.Close()
+	assert.Equal(t, 1, o.Pending())
+	entry, err = o.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), entry.ID)
+	assert.Equal(t, "b", entry.ObjectID)
+	require.NoError(t, o.Emit(ctx, &store.ObjectMetadata{ObjectID: "c"}))
+	entry, err = o.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), entry.ID)
+
+	require.ErrorIs(t, o.Ack(42), outbox.ErrNotFound)
+}
+
+func TestOutboxRetries(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "deletions.jsonl")
+
+	o, err := outbox.Open(logrus.New(), path, outbox.WithRetries(3, 20*time.Millisecond, 30*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, o.Emit(ctx, &store.ObjectMetadata{Key: "a.txt", ObjectID: "a"}))
+
+	entry, err := o.Next(ctx)
+	require.NoError(t, err)
+	require.NoError(t, o.Nack(entry.ID, errors.New("unavailable")))
+
+	// the entry is only due again after the backoff
+	start := time.Now()
+	entry, err = o.Next(ctx)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 15*time.Millisecond)
+	assert.Equal(t, 1, entry.Attempts)
+	assert.Equal(t, "unavailable", entry.LastError)
+	require.NoError(t, o.Nack(entry.ID, errors.New("unavailable")))
+
+	// attempts and backoff survive a restart
+	require.NoError(t, o.Close())
+	o, err = outbox.Open(logrus.New(), path, outbox.WithRetries(3, 20*time.Millisecond, 30*time.Millisecond))
+	require.NoError(t, err)
+	defer o.Close()
+	entry, err = o.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, entry.Attempts)
+	require.NoError(t, o.Nack(entry.ID, errors.New("access denied")))
+
+	// it's a dead letter after the last attempt
+	assert.Equal(t, 0, o.Pending())
+	deadLetters := o.DeadLetters()
+	require.Len(t, deadLetters, 1)
+	assert.Equal(t, "a", deadLetters[0].ObjectID)
+	assert.Equal(t, 3, deadLetters[0].Attempts)
+	assert.Equal(t, "access denied", deadLetters[0].LastError)
+	nextCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = o.Next(nextCtx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.ErrorIs(t, o.Requeue(42), outbox.ErrNotFound)
+	require.NoError(t, o.Requeue(entry.ID))
+	assert.Empty(t, o.DeadLetters())
+	entry, err = o.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, entry.Attempts)
+	require.NoError(t, o.Ack(entry.ID))
+	assert.Equal(t, 0, o.Pending())
+}
+
+func TestOpenTruncatedJournal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "deletions.jsonl")
+
+	o, err := outbox.Open(logrus.New(), path)
+	require.NoError(t, err)
+	require.NoError(t, o.Emit(ctx, &store.ObjectMetadata{ObjectID: "a"}))
+	require.NoError(t, o.Close())
+
+	// a record partially written before a crash is ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"put","entry":{"id":2,"obj`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	o, err = outbox.Open(logrus.New(), path)
+	require.NoError(t, err)
+	defer o.Close()
+	assert.Equal(t, 1, o.Pending())
+	require.NoError(t, o.Emit(ctx, &store.ObjectMetadata{ObjectID: "b"}))
+	assert.Equal(t, 2, o.Pending())
+}
@@ -0,0 +1,69 @@
+package quota
+
+import (
+	"context"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	usedBytesDesc = prometheus.NewDesc(
+		"filesync_quota_used_bytes",
+		"Bytes used by the completed objects of a namespace",
+		[]string{"namespace"}, nil,
+	)
+	usedObjectsDesc = prometheus.NewDesc(
+		"filesync_quota_used_objects",
+		"Number of completed objects in a namespace",
+		[]string{"namespace"}, nil,
+	)
+	reservedBytesDesc = prometheus.NewDesc(
+		"filesync_quota_reserved_bytes",
+		"Bytes reserved by the inflight uploads of a namespace",
+		[]string{"namespace"}, nil,
+	)
+	reservedObjectsDesc = prometheus.NewDesc(
+		"filesync_quota_reserved_objects",
+		"Number of objects reserved by the inflight uploads of a namespace",
+		[]string{"namespace"}, nil,
+	)
+	limitBytesDesc = prometheus.NewDesc(
+		"filesync_quota_limit_bytes",
+		"Maximum number of bytes a namespace can use; zero means unlimited",
+		[]string{"namespace"}, nil,
+	)
+	limitObjectsDesc = prometheus.NewDesc(
+		"filesync_quota_limit_objects",
+		"Maximum number of objects a namespace can have; zero means unlimited",
+		[]string{"namespace"}, nil,
+	)
+)
+
+// Describe implements prometheus.Collector.
+func (m *Manager) Describe(ch chan<- *prometheus.Desc) {
+	ch <- usedBytesDesc
+	ch <- usedObjectsDesc
+	ch <- reservedBytesDesc
+	ch <- reservedObjectsDesc
+	ch <- limitBytesDesc
+	ch <- limitObjectsDesc
+}
+
+// Collect implements prometheus.Collector. The gauges are computed from the namespace reports on every scrape.
+func (m *Manager) Collect(ch chan<- prometheus.Metric) {
+	reports, err := m.Reports(context.Background())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(usedBytesDesc, err)
+		return
+	}
+
+	for r := range slices.Values(reports) {
+		ch <- prometheus.MustNewConstMetric(usedBytesDesc, prometheus.GaugeValue, float64(r.Usage.Bytes), r.Namespace)
+		ch <- prometheus.MustNewConstMetric(usedObjectsDesc, prometheus.GaugeValue, float64(r.Usage.Objects), r.Namespace)
+		ch <- prometheus.MustNewConstMetric(reservedBytesDesc, prometheus.GaugeValue, float64(r.Reserved.Bytes), r.Namespace)
+		ch <- prometheus.MustNewConstMetric(reservedObjectsDesc, prometheus.GaugeValue, float64(r.Reserved.Objects), r.Namespace)
+		ch <- prometheus.MustNewConstMetric(limitBytesDesc, prometheus.GaugeValue, float64(r.Limits.MaxBytes), r.Namespace)
+		ch <- prometheus.MustNewConstMetric(limitObjectsDesc, prometheus.GaugeValue, float64(r.Limits.MaxObjects), r.Namespace)
+	}
+}
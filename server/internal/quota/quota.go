@@ -0,0 +1,224 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+var (
+	ErrQuotaExceeded  = errors.New("quota exceeded")
+	ErrObjectTooLarge = errors.New("object too large")
+)
+
+// Limits defines the storage limits of a namespace. A zero value means unlimited.
+type Limits struct {
+	MaxBytes      int64 `json:"max_bytes"`
+	MaxObjects    int64 `json:"max_objects"`
+	MaxObjectSize int64 `json:"max_object_size"`
+}
+
+// Config holds the default limits applied to every namespace along with per namespace overrides.
+type Config struct {
+	Default    Limits            `json:"default"`
+	Namespaces map[string]Limits `json:"namespaces"`
+}
+
+// LoadConfig reads a JSON encoded quota Config from the given file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read quota config file: %w", err)
+	}
+
+	var cfg Config
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal quota config: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// LimitsFor returns the limits that apply to the given namespace.
+func (cfg *Config) LimitsFor(namespace string) Limits {
+	if limits, ok := cfg.Namespaces[namespace]; ok {
+		return limits
+	}
+	return cfg.Default
+}
+
+type UsageStore interface {
+	Usage(ctx context.Context, namespace string) (store.Usage, error)
+	Get(ctx context.Context, namespace, key string) (*store.ObjectMetadata, error)
+	Namespaces(ctx context.Context) ([]string, error)
+}
+
+// Reservation is the storage set aside for an inflight upload. It must be released once the upload is either
+// completed, at which point the object is accounted for in the store usage, or failed.
+type Reservation struct {
+	Namespace string
+	Bytes     int64
+	Objects   int64
+
+	once sync.Once
+}
+
+// Report describes the limits and consumption of a namespace.
+type Report struct {
+	Namespace string
+	Limits    Limits
+	Usage     store.Usage
+	Reserved  store.Usage
+}
+
+// Manager enforces namespace quotas. Usage of completed objects is tracked by the metadata store while the storage
+// needed by inflight uploads is reserved here, when the upload is initiated, so concurrent uploads cannot overcommit
+// a namespace.
+type Manager struct {
+	cfg        *Config
+	usageStore UsageStore
+
+	mu       sync.Mutex
+	reserved map[string]*store.Usage
+}
+
+func New(cfg *Config, usageStore UsageStore) *Manager {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	return &Manager{
+		cfg:        cfg,
+		usageStore: usageStore,
+		reserved:   make(map[string]*store.Usage),
+	}
+}
+
+// Reserve sets aside size bytes, and one object if the key does not exist yet, for an upload to the given namespace.
+// Replacing an existing key reserves the full size of the new object as both versions are stored until the upload
+// completes. It returns an error wrapping ErrObjectTooLarge or ErrQuotaExceeded if the upload is not allowed.
+func (m *Manager) Reserve(ctx context.Context, namespace, key string, size int64) (*Reservation, error) {
+	namespace = store.NamespaceOrDefault(namespace)
+	limits := m.cfg.LimitsFor(namespace)
+
+	if limits.MaxObjectSize > 0 && size > limits.MaxObjectSize {
+		return nil, fmt.Errorf("%w: size %d exceeds the maximum object size %d of namespace %q",
+			ErrObjectTooLarge, size, limits.MaxObjectSize, namespace)
+	}
+
+	r := &Reservation{
+		Namespace: namespace,
+		Bytes:     size,
+		Objects:   1,
+	}
+	_, err := m.usageStore.Get(ctx, namespace, key)
+	if err == nil {
+		// replacing an existing object doesn't change the number of objects
+		r.Objects = 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usage, err := m.usageStore.Usage(ctx, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("get namespace usage: %w", err)
+	}
+	reserved := m.reservedFor(namespace)
+
+	if limits.MaxBytes > 0 && usage.Bytes+reserved.Bytes+r.Bytes > limits.MaxBytes {
+		return nil, fmt.Errorf("%w: namespace %q would use %d bytes out of %d",
+			ErrQuotaExceeded, namespace, usage.Bytes+reserved.Bytes+r.Bytes, limits.MaxBytes)
+	}
+	if limits.MaxObjects > 0 && usage.Objects+reserved.Objects+r.Objects > limits.MaxObjects {
+		return nil, fmt.Errorf("%w: namespace %q would have %d objects out of %d",
+			ErrQuotaExceeded, namespace, usage.Objects+reserved.Objects+r.Objects, limits.MaxObjects)
+	}
+
+	reserved.Bytes += r.Bytes
+	reserved.Objects += r.Objects
+
+	return r, nil
+}
+
+// Release gives back the storage set aside by the reservation. It's safe to call it more than once.
+func (m *Manager) Release(r *Reservation) {
+	if r == nil {
+		return
+	}
+
+	r.once.Do(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		reserved := m.reservedFor(r.Namespace)
+		reserved.Bytes -= r.Bytes
+		reserved.Objects -= r.Objects
+		if *reserved == (store.Usage{}) {
+			delete(m.reserved, r.Namespace)
+		}
+	})
+}
+
+// Reports returns the limits and consumption of every configured or in use namespace, sorted by namespace.
+func (m *Manager) Reports(ctx context.Context) ([]*Report, error) {
+	namespaces, err := m.usageStore.Namespaces(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list namespaces: %w", err)
+	}
+	namespaces = append(namespaces, slices.Collect(maps.Keys(m.cfg.Namespaces))...)
+	slices.Sort(namespaces)
+
+	reports := make([]*Report, 0, len(namespaces))
+	for namespace := range slices.Values(slices.Compact(namespaces)) {
+		report, err := m.Report(ctx, namespace)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// Report returns the limits and consumption of the given namespace.
+func (m *Manager) Report(ctx context.Context, namespace string) (*Report, error) {
+	namespace = store.NamespaceOrDefault(namespace)
+
+	usage, err := m.usageStore.Usage(ctx, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("get usage of namespace %q: %w", namespace, err)
+	}
+
+	m.mu.Lock()
+	var reserved store.Usage
+	if r, ok := m.reserved[namespace]; ok {
+		reserved = *r
+	}
+	m.mu.Unlock()
+
+	return &Report{
+		Namespace: namespace,
+		Limits:    m.cfg.LimitsFor(namespace),
+		Usage:     usage,
+		Reserved:  reserved,
+	}, nil
+}
+
+// reservedFor returns the reserved usage of the given namespace. The caller must hold the lock.
+func (m *Manager) reservedFor(namespace string) *store.Usage {
+	reserved, ok := m.reserved[namespace]
+	if !ok {
+		reserved = &store.Usage{}
+		m.reserved[namespace] = reserved
+	}
+	return reserved
+}
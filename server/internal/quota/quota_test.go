@@ -0,0 +1,169 @@
+package quota_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/server/internal/quota"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+// usageStore is a static quota.UsageStore.
+type usageStore struct {
+	usage map[string]store.Usage
+	keys  map[string]bool
+}
+
+func (s *usageStore) Usage(_ context.Context, namespace string) (store.Usage, error) {
+	return s.usage[namespace], nil
+}
+
+func (s *usageStore) Get(_ context.Context, namespace, key string) (*store.ObjectMetadata, error) {
+	if !s.keys[namespace+"/"+key] {
+		return nil, errors.New("not found")
+	}
+	return &store.ObjectMetadata{Namespace: namespace, Key: key}, nil
+}
+
+func (s *usageStore) Namespaces(context.Context) ([]string, error) {
+	var namespaces []string
+	for ns := range s.usage {
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces, nil
+}
+
+func TestReserve(t *testing.T) {
+	cfg := &quota.Config{
+		Default: quota.Limits{MaxBytes: 100, MaxObjects: 2, MaxObjectSize: 50},
+		Namespaces: map[string]quota.Limits{
+			"unlimited": {},
+		},
+	}
+
+	tests := map[string]struct {
+		usage     store.Usage
+		keys      map[string]bool
+		namespace string
+		key       string
+		sizes     []int64
+
+		wantErr     error
+		wantReports store.Usage
+	}{
+		"within limits": {
+			namespace:   "docs",
+			key:         "a",
+			sizes:       []int64{10},
+			wantReports: store.Usage{Bytes: 10, Objects: 1},
+		},
+		"object too large": {
+			namespace: "docs",
+			key:       "a",
+			sizes:     []int64{51},
+			wantErr:   quota.ErrObjectTooLarge,
+		},
+		"bytes exceeded by existing usage": {
+			usage:     store.Usage{Bytes: 95, Objects: 1},
+			namespace: "docs",
+			key:       "a",
+			sizes:     []int64{10},
+			wantErr:   quota.ErrQuotaExceeded,
+		},
+		"bytes exceeded by concurrent reservations": {
+			namespace: "docs",
+			key:       "a",
+			sizes:     []int64{50, 50, 1},
+			wantErr:   quota.ErrQuotaExceeded,
+		},
+		"objects exceeded": {
+			usage:     store.Usage{Bytes: 10, Objects: 2},
+			namespace: "docs",
+			key:       "a",
+			sizes:     []int64{10},
+			wantErr:   quota.ErrQuotaExceeded,
+		},
+		"replacing an existing key reserves no objects": {
+			usage:       store.Usage{Bytes: 10, Objects: 2},
+			keys:        map[string]bool{"docs/a": true},
+			namespace:   "docs",
+			key:         "a",
+			sizes:       []int64{10},
+			wantReports: store.Usage{Bytes: 10},
+		},
+		"unlimited namespace": {
+			usage:       store.Usage{Bytes: 1000, Objects: 1000},
+			namespace:   "unlimited",
+			key:         "a",
+			sizes:       []int64{1000},
+			wantReports: store.Usage{Bytes: 1000, Objects: 1},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			us := &usageStore{
+				usage: map[string]store.Usage{tc.namespace: tc.usage},
+				keys:  tc.keys,
+			}
+			m := quota.New(cfg, us)
+
+			var reservations []*quota.Reservation
+			var err error
+			for size := range slices.Values(tc.sizes) {
+				var r *quota.Reservation
+				r, err = m.Reserve(context.Background(), tc.namespace, tc.key, size)
+				if err != nil {
+					break
+				}
+				reservations = append(reservations, r)
+			}
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			report, err := m.Report(context.Background(), tc.namespace)
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantReports, report.Reserved)
+			assert.Equal(t, tc.usage, report.Usage)
+
+			for r := range slices.Values(reservations) {
+				m.Release(r)
+				// releasing twice must be a no-op
+				m.Release(r)
+			}
+			report, err = m.Report(context.Background(), tc.namespace)
+			require.NoError(t, err)
+			assert.Equal(t, store.Usage{}, report.Reserved)
+		})
+	}
+}
+
+func TestReports(t *testing.T) {
+	cfg := &quota.Config{
+		Namespaces: map[string]quota.Limits{
+			"configured": {MaxBytes: 10},
+		},
+	}
+	us := &usageStore{
+		usage: map[string]store.Usage{
+			"docs": {Bytes: 5, Objects: 1},
+		},
+	}
+	m := quota.New(cfg, us)
+
+	reports, err := m.Reports(context.Background())
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	assert.Equal(t, "configured", reports[0].Namespace)
+	assert.Equal(t, quota.Limits{MaxBytes: 10}, reports[0].Limits)
+	assert.Equal(t, "docs", reports[1].Namespace)
+	assert.Equal(t, store.Usage{Bytes: 5, Objects: 1}, reports[1].Usage)
+}
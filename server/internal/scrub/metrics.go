@@ -0,0 +1,108 @@
+package scrub
+
+import (
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	verifiedObjectsDesc = prometheus.NewDesc(
+		"filesync_scrub_verified_objects_total",
+		"Number of stored objects re-hashed by checks",
+		nil, nil,
+	)
+	verifiedBytesDesc = prometheus.NewDesc(
+		"filesync_scrub_verified_bytes_total",
+		"Bytes of stored objects re-hashed by checks",
+		nil, nil,
+	)
+	corruptObjectsDesc = prometheus.NewDesc(
+		"filesync_scrub_corrupt_objects",
+		"Number of stored objects found corrupt by the last check that verified them",
+		nil, nil,
+	)
+	missingObjectsDesc = prometheus.NewDesc(
+		"filesync_scrub_missing_objects",
+		"Number of objects found missing from the storage by the last check",
+		nil, nil,
+	)
+	orphanObjectsDesc = prometheus.NewDesc(
+		"filesync_scrub_orphan_objects",
+		"Number of stored objects no metadata referenced in the last check that looked for them",
+		nil, nil,
+	)
+	lastCheckDesc = prometheus.NewDesc(
+		"filesync_scrub_last_check_timestamp_seconds",
+		"When the last check completed, as a unix timestamp",
+		nil, nil,
+	)
+)
+
+type metrics struct {
+	verifiedObjects int64
+	verifiedBytes   int64
+	corruptObjects  int
+	missingObjects  int
+	orphanObjects   int
+	lastCheck       time.Time
+}
+
+func (s *Scrubber) recordVerified(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics.verifiedObjects++
+	s.metrics.verifiedBytes += n
+}
+
+// recordCheck updates the gauges with the outcome of a completed check, leaving those it didn't measure as they were.
+func (s *Scrubber) recordCheck(report *Report, opts CheckOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics.missingObjects = countObjects(report.Missing)
+	if opts.Verify {
+		s.metrics.corruptObjects = countObjects(report.Corrupt)
+	}
+	if opts.Orphans {
+		s.metrics.orphanObjects = len(report.Orphans)
+	}
+	s.metrics.lastCheck = report.FinishedAt
+}
+
+// countObjects returns the number of distinct objects of the given problems.
+func countObjects(problems []Problem) int {
+	objectIDs := make(map[string]struct{}, len(problems))
+	for p := range slices.Values(problems) {
+		objectIDs[p.ObjectID] = struct{}{}
+	}
+	return len(objectIDs)
+}
+
+// Describe implements prometheus.Collector.
+func (s *Scrubber) Describe(ch chan<- *prometheus.Desc) {
+	ch <- verifiedObjectsDesc
+	ch <- verifiedBytesDesc
+	ch <- corruptObjectsDesc
+	ch <- missingObjectsDesc
+	ch <- orphanObjectsDesc
+	ch <- lastCheckDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *Scrubber) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	m := s.metrics
+	s.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(verifiedObjectsDesc, prometheus.CounterValue, float64(m.verifiedObjects))
+	ch <- prometheus.MustNewConstMetric(verifiedBytesDesc, prometheus.CounterValue, float64(m.verifiedBytes))
+	ch <- prometheus.MustNewConstMetric(corruptObjectsDesc, prometheus.GaugeValue, float64(m.corruptObjects))
+	ch <- prometheus.MustNewConstMetric(missingObjectsDesc, prometheus.GaugeValue, float64(m.missingObjects))
+	ch <- prometheus.MustNewConstMetric(orphanObjectsDesc, prometheus.GaugeValue, float64(m.orphanObjects))
+	if !m.lastCheck.IsZero() {
+		ch <- prometheus.MustNewConstMetric(lastCheckDesc, prometheus.GaugeValue, float64(m.lastCheck.Unix()))
+	}
+}
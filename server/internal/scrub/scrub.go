@@ -0,0 +1,421 @@
+// Package scrub re-verifies the stored objects against the checksums recorded in their metadata, so objects the
+// storage has corrupted or lost since they were uploaded are detected before anyone tries to download them.
+package scrub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hedisam/filesync/lib/compression"
+	"github.com/hedisam/filesync/lib/streamcrypt"
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+	"github.com/hedisam/filesync/server/internal/blobstorage/encrypted"
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+const (
+	// DefaultInterval is the default time between two scrubbing passes.
+	DefaultInterval = 24 * time.Hour
+	// DefaultRateLimit is the default number of bytes per second objects are read at while verifying them.
+	DefaultRateLimit = 16 << 20
+)
+
+var (
+	ErrListingUnsupported = errors.New("the storage backend can't list its objects")
+)
+
+type ObjectReader interface {
+	GetObject(ctx context.Context, objectID string) (io.ReadCloser, error)
+}
+
+type ObjectLister interface {
+	ListObjects(ctx context.Context, fn func(objectID string) error) error
+}
+
+type MetadataStore interface {
+	Namespaces(ctx context.Context) ([]string, error)
+	Snapshot(ctx context.Context, namespace string) (map[string]store.ObjectMetadata, error)
+	Get(ctx context.Context, namespace, key string) (*store.ObjectMetadata, error)
+	ObjectReferenced(ctx context.Context, objectID string) (bool, error)
+	ObjectVerified(ctx context.Context, objectID string, at time.Time) error
+}
+
+type Option func(s *Scrubber)
+
+// WithInterval sets the time between two scrubbing passes. Objects verified more recently than that, e.g. by an fsck,
+// are not re-verified by the next pass.
+func WithInterval(d time.Duration) Option {
+	return func(s *Scrubber) {
+		s.interval = d
+	}
+}
+
+// WithRateLimit limits the number of bytes per second objects are read at while verifying them, so scrubbing doesn't
+// starve uploads and downloads. Zero means unlimited.
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(s *Scrubber) {
+		s.rateLimit = bytesPerSecond
+	}
+}
+
+// WithLister lets checks find the stored objects no metadata references. Listing is done by object ID, so the lister
+// is usually the underlying backend rather than any wrapper decrypting the objects.
+func WithLister(lister ObjectLister) Option {
+	return func(s *Scrubber) {
+		s.lister = lister
+	}
+}
+
+// CheckOptions define what a check does.
+type CheckOptions struct {
+	// Verify re-hashes the content of the objects. Only their existence is checked otherwise.
+	Verify bool
+	// SkipVerifiedWithin skips re-hashing the objects verified within the given duration.
+	SkipVerifiedWithin time.Duration
+	// Orphans lists the stored objects to find those no metadata references.
+	Orphans bool
+}
+
+// Problem is an object metadata whose object failed a check.
+type Problem struct {
+	Namespace string
+	Key       string
+	ObjectID  string
+	Err       error
+}
+
+// Report is the outcome of a check.
+type Report struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Checked is the number of completed object metadata checked, and Verified the number of distinct objects
+	// re-hashed for them, with VerifiedBytes the size of their content.
+	Checked       int64
+	Verified      int64
+	VerifiedBytes int64
+	// Corrupt objects don't match their checksum or size anymore, and Missing ones are no longer stored. Failed ones
+	// couldn't be checked, e.g. because the storage was unavailable.
+	Corrupt []Problem
+	Missing []Problem
+	Failed  []Problem
+	// Orphans are the IDs of the stored objects no metadata references. Objects that have just been released might
+	// be listed too, until the janitor deletes them.
+	Orphans []string
+}
+
+// Scrubber verifies the stored objects, periodically in the background or on demand.
+type Scrubber struct {
+	logger    *logrus.Logger
+	storage   ObjectReader
+	mdStore   MetadataStore
+	lister    ObjectLister
+	interval  time.Duration
+	rateLimit int64
+
+	mu      sync.Mutex
+	metrics metrics
+}
+
+func New(logger *logrus.Logger, storage ObjectReader, mdStore MetadataStore, opts ...Option) *Scrubber {
+	s := &Scrubber{
+		logger:    logger,
+		storage:   storage,
+		mdStore:   mdStore,
+		interval:  DefaultInterval,
+		rateLimit: DefaultRateLimit,
+	}
+	for opt := range slices.Values(opts) {
+		opt(s)
+	}
+	return s
+}
+
+// Run verifies all the completed objects every interval until the context is done.
+func (s *Scrubber) Run(ctx context.Context) {
+	logger := s.logger.WithContext(ctx)
+	logger.WithFields(logrus.Fields{
+		"interval":   s.interval,
+		"rate_limit": s.rateLimit,
+	}).Info("Running scrubber")
+
+	for {
+		report, err := s.Check(ctx, CheckOptions{Verify: true, SkipVerifiedWithin: s.interval})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Error("Failed to scrub stored objects")
+		} else {
+			logger.WithFields(logrus.Fields{
+				"checked":  report.Checked,
+				"verified": report.Verified,
+				"corrupt":  len(report.Corrupt),
+				"missing":  len(report.Missing),
+				"failed":   len(report.Failed),
+				"took":     report.FinishedAt.Sub(report.StartedAt),
+			}).Info("Scrubbed stored objects")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+// Check checks the objects of all the completed object metadata, in every namespace. Objects referenced by multiple
+// metadata are only checked once. It returns ErrListingUnsupported if orphans are requested but no lister is set.
+func (s *Scrubber) Check(ctx context.Context, opts CheckOptions) (*Report, error) {
+	if opts.Orphans && s.lister == nil {
+		return nil, ErrListingUnsupported
+	}
+
+	report := &Report{StartedAt: time.Now().UTC()}
+	limiter := newLimiter(s.rateLimit)
+	results := make(map[string]error)
+
+	namespaces, err := s.mdStore.Namespaces(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list namespaces: %w", err)
+	}
+	for namespace := range slices.Values(namespaces) {
+		snapshot, err := s.mdStore.Snapshot(ctx, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot namespace %q: %w", namespace, err)
+		}
+
+		for key := range slices.Values(slices.Sorted(maps.Keys(snapshot))) {
+			md := snapshot[key]
+			report.Checked++
+			if opts.Verify && md.VerifiedAt != nil && time.Since(*md.VerifiedAt) < opts.SkipVerifiedWithin {
+				continue
+			}
+
+			result, ok := results[md.ObjectID]
+			if !ok {
+				result = s.checkObject(ctx, &md, opts.Verify, limiter, report)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				results[md.ObjectID] = result
+			}
+			if result != nil {
+				s.report(ctx, &md, result, report)
+			}
+		}
+	}
+
+	if opts.Orphans {
+		report.Orphans, err = s.orphans(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	s.recordCheck(report, opts)
+
+	return report, nil
+}
+
+var (
+	errMissing = errors.New("object not found in storage")
+	errCorrupt = errors.New("object content does not match its metadata")
+)
+
+// checkObject checks the object of the given metadata, returning nil if it's fine. The returned error wraps
+// errMissing or errCorrupt if the object is missing or corrupt.
+func (s *Scrubber) checkObject(ctx context.Context, md *store.ObjectMetadata, verify bool, limiter *limiter, report *Report) error {
+	rc, err := s.storage.GetObject(ctx, md.ObjectID)
+	if err != nil {
+		if errors.Is(err, blobstorage.ErrNotFound) {
+			return errMissing
+		}
+		return classify(err, err)
+	}
+	defer rc.Close()
+	if !verify {
+		return nil
+	}
+
+	source := &sourceReader{r: rc}
+	content, err := compression.NewReader(&limitedReader{ctx: ctx, r: source, limiter: limiter}, compression.Encoding(md.ContentEncoding))
+	if err != nil {
+		return classify(err, source.err)
+	}
+	defer content.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, content)
+	report.Verified++
+	report.VerifiedBytes += n
+	s.recordVerified(n)
+	if err != nil {
+		return classify(err, source.err)
+	}
+
+	checksum := hex.EncodeToString(h.Sum(nil))
+	if checksum != md.SHA256Checksum || n != md.Size {
+		return fmt.Errorf("%w: got checksum %s and size %d, want checksum %s and size %d", errCorrupt, checksum, n, md.SHA256Checksum, md.Size)
+	}
+
+	err = s.mdStore.ObjectVerified(ctx, md.ObjectID, time.Now().UTC())
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		s.logger.WithContext(ctx).WithError(err).WithField("object_id", md.ObjectID).Warn("Failed to record object verification")
+	}
+
+	return nil
+}
+
+// classify tells whether err, returned while reading an object, means the object is corrupt. Errors that came from
+// the storage, other than failing to decrypt the object, say nothing about the object itself.
+func classify(err, sourceErr error) error {
+	if errors.Is(err, streamcrypt.ErrInvalidStream) || errors.Is(err, encrypted.ErrInvalidHeader) {
+		return fmt.Errorf("%w: %w", errCorrupt, err)
+	}
+	if sourceErr != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	// anything else failed decoding the content
+	return fmt.Errorf("%w: %w", errCorrupt, err)
+}
+
+// report adds a problem found with the object of the given metadata to the report, unless the metadata has been
+// replaced or deleted since the check started, since its object could have been deleted along with it.
+func (s *Scrubber) report(ctx context.Context, md *store.ObjectMetadata, result error, report *Report) {
+	logger := s.logger.WithContext(ctx).WithError(result).WithFields(logrus.Fields{
+		"namespace": md.Namespace,
+		"key":       md.Key,
+		"object_id": md.ObjectID,
+	})
+
+	current, err := s.mdStore.Get(ctx, md.Namespace, md.Key)
+	if (err == nil && current.ObjectID != md.ObjectID) || errors.Is(err, store.ErrNotFound) {
+		logger.Debug("Object metadata changed while checking its object")
+		return
+	}
+
+	problem := Problem{
+		Namespace: md.Namespace,
+		Key:       md.Key,
+		ObjectID:  md.ObjectID,
+		Err:       result,
+	}
+	switch {
+	case errors.Is(result, errMissing):
+		logger.Error("Stored object is missing")
+		report.Missing = append(report.Missing, problem)
+	case errors.Is(result, errCorrupt):
+		logger.Error("Stored object is corrupt")
+		report.Corrupt = append(report.Corrupt, problem)
+	default:
+		logger.Warn("Failed to check stored object")
+		report.Failed = append(report.Failed, problem)
+	}
+}
+
+// orphans returns the sorted IDs of the stored objects that no metadata, inflight or completed, references. The
+// references are checked after listing, so objects uploaded meanwhile are never orphans.
+func (s *Scrubber) orphans(ctx context.Context) ([]string, error) {
+	var objectIDs []string
+	err := s.lister.ListObjects(ctx, func(objectID string) error {
+		objectIDs = append(objectIDs, objectID)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list stored objects: %w", err)
+	}
+
+	orphans := []string{}
+	for objectID := range slices.Values(objectIDs) {
+		referenced, err := s.mdStore.ObjectReferenced(ctx, objectID)
+		if err != nil {
+			return nil, fmt.Errorf("check references of object %q: %w", objectID, err)
+		}
+		if !referenced {
+			orphans = append(orphans, objectID)
+		}
+	}
+	slices.Sort(orphans)
+
+	return orphans, nil
+}
+
+// sourceReader records the error returned by the storage, to tell it apart from errors decoding the content.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		s.err = err
+	}
+	return n, err
+}
+
+// limiter limits the average rate bytes are read at over a whole check.
+type limiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	n              int64
+}
+
+func newLimiter(bytesPerSecond int64) *limiter {
+	return &limiter{
+		bytesPerSecond: bytesPerSecond,
+		start:          time.Now(),
+	}
+}
+
+// wait accounts for n bytes read, blocking until reading them at the limit would have taken.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	if l.bytesPerSecond <= 0 {
+		return nil
+	}
+	l.n += int64(n)
+	d := time.Duration(float64(l.n)/float64(l.bytesPerSecond)*float64(time.Second)) - time.Since(l.start)
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *limiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// don't read much more than a second's worth at once, so the rate stays smooth
+	if l.limiter.bytesPerSecond > 0 {
+		p = p[:min(int64(len(p)), l.limiter.bytesPerSecond)]
+	}
+	n, err := l.r.Read(p)
+	waitErr := l.limiter.wait(l.ctx, n)
+	if err == nil {
+		err = waitErr
+	}
+	return n, err
+}
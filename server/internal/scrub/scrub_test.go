@@ -0,0 +1,146 @@
+package scrub_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hedisam/filesync/lib/compression"
+	"github.com/hedisam/filesync/server/internal/blobstorage/filesystem"
+	"github.com/hedisam/filesync/server/internal/scrub"
+	"github.com/hedisam/filesync/server/internal/store"
+	"github.com/hedisam/filesync/server/internal/store/memdb"
+)
+
+type noopEmitter struct{}
+
+func (noopEmitter) Emit(context.Context, *store.ObjectMetadata) error {
+	return nil
+}
+
+type fixture struct {
+	dir     string
+	fs      *filesystem.FileSystem
+	mdStore *memdb.MetadataStore
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	dir := t.TempDir()
+	fs, err := filesystem.New(logrus.New(), dir, filesystem.LayoutFlat)
+	require.NoError(t, err)
+	return &fixture{
+		dir:     dir,
+		fs:      fs,
+		mdStore: memdb.NewMetadataStore(noopEmitter{}),
+	}
+}
+
+// upload stores the given content under the given key, compressed at rest with the given encoding.
+func (f *fixture) upload(t *testing.T, namespace, key, objectID string, content []byte, enc compression.Encoding) {
+	t.Helper()
+	ctx := context.Background()
+	sum := sha256.Sum256(content)
+	err := f.mdStore.Create(ctx, &store.ObjectMetadata{
+		Namespace:       namespace,
+		Key:             key,
+		ObjectID:        objectID,
+		SHA256Checksum:  hex.EncodeToString(sum[:]),
+		Size:            int64(len(content)),
+		ContentEncoding: string(enc),
+	})
+	require.NoError(t, err)
+
+	stored := io.NopCloser(bytes.NewReader(content))
+	if enc != compression.Identity {
+		stored = compression.Compress(bytes.NewReader(content), enc)
+	}
+	defer stored.Close()
+	_, _, err = f.fs.PutObject(ctx, stored, objectID, nil)
+	require.NoError(t, err)
+	err = f.mdStore.PutObjectCompleted(ctx, namespace, key, objectID)
+	require.NoError(t, err)
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	f.upload(t, "", "ok.txt", "ok", []byte("hello world"), compression.Identity)
+	f.upload(t, "", "compressed.txt", "compressed", bytes.Repeat([]byte("hello world"), 100), compression.Zstd)
+	f.upload(t, "", "corrupt.txt", "corrupt", []byte("hello world"), compression.Identity)
+	f.upload(t, "", "corrupt.gz", "corrupt-gzip", []byte("hello world"), compression.Gzip)
+	f.upload(t, "docs", "missing.txt", "missing", []byte("hello world"), compression.Identity)
+	// referenced by another key too
+	err := f.mdStore.LinkObject(ctx, &store.ObjectMetadata{Namespace: "docs", Key: "corrupt-link.txt", ObjectID: "corrupt", Size: 11})
+	require.NoError(t, err)
+	// inflight uploads aren't checked, but their objects aren't orphans either
+	err = f.mdStore.Create(ctx, &store.ObjectMetadata{Key: "inflight.txt", ObjectID: "inflight"})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(f.dir, "inflight"), []byte("partial"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(f.dir, "orphan"), []byte("orphan"), 0644))
+
+	require.NoError(t, os.WriteFile(filepath.Join(f.dir, "corrupt"), []byte("hello w0rld"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(f.dir, "corrupt-gzip"), []byte("not gzip"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(f.dir, "missing")))
+
+	problems := func(problems []scrub.Problem) []string {
+		var keys []string
+		for p := range slices.Values(problems) {
+			keys = append(keys, p.Namespace+"/"+p.Key)
+		}
+		return keys
+	}
+
+	s := scrub.New(logrus.New(), f.fs, f.mdStore, scrub.WithLister(f.fs), scrub.WithRateLimit(0))
+
+	// without verifying, only missing objects are found
+	report, err := s.Check(ctx, scrub.CheckOptions{Orphans: true})
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, report.Checked)
+	assert.Zero(t, report.Verified)
+	assert.Empty(t, report.Corrupt)
+	assert.Equal(t, []string{"docs/missing.txt"}, problems(report.Missing))
+	assert.Equal(t, []string{"orphan"}, report.Orphans)
+
+	report, err = s.Check(ctx, scrub.CheckOptions{Verify: true})
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, report.Checked)
+	// the linked object is only verified once, and the invalid gzip stream can't be hashed at all
+	assert.EqualValues(t, 3, report.Verified)
+	assert.Equal(t, []string{"default/corrupt.gz", "default/corrupt.txt", "docs/corrupt-link.txt"}, problems(report.Corrupt))
+	assert.Equal(t, []string{"docs/missing.txt"}, problems(report.Missing))
+	assert.Empty(t, report.Failed)
+	assert.Nil(t, report.Orphans)
+
+	md, err := f.mdStore.Get(ctx, "", "compressed.txt")
+	require.NoError(t, err)
+	require.NotNil(t, md.VerifiedAt)
+	md, err = f.mdStore.Get(ctx, "", "corrupt.txt")
+	require.NoError(t, err)
+	assert.Nil(t, md.VerifiedAt)
+
+	// recently verified objects can be skipped
+	report, err = s.Check(ctx, scrub.CheckOptions{Verify: true, SkipVerifiedWithin: time.Hour})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, report.Verified)
+	assert.Len(t, report.Corrupt, 3)
+}
+
+func TestCheckWithoutLister(t *testing.T) {
+	f := newFixture(t)
+	s := scrub.New(logrus.New(), f.fs, f.mdStore)
+
+	_, err := s.Check(context.Background(), scrub.CheckOptions{Orphans: true})
+	assert.ErrorIs(t, err, scrub.ErrListingUnsupported)
+}
@@ -0,0 +1,80 @@
+package memdb
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hedisam/filesync/server/internal/store"
+)
+
+// keyIndex keeps the completed objects of a namespace sorted by key, so they can be listed in order, and by prefix,
+// without sorting the whole namespace every time. They're kept in a sorted slice: adding or removing one is a binary
+// search and a copy, which is cheap next to the upload that comes with it.
+//
+// Completed objects are never modified once stored, only replaced, so the slice is a consistent view of the namespace
+// that can be read without the lock, as long as it's not modified in place. view hands it out and marks it shared;
+// the next change copies it first. The mark is atomic so views can be taken under the read lock, by several readers
+// at once; changes are made under the write lock, so they never race with one.
+type keyIndex struct {
+	objects []*store.ObjectMetadata
+	shared  atomic.Bool
+}
+
+// search returns the position of the given key, or where it'd be, and whether it's there.
+func (idx *keyIndex) search(key string) (int, bool) {
+	return slices.BinarySearchFunc(idx.objects, key, func(md *store.ObjectMetadata, key string) int {
+		return strings.Compare(md.Key, key)
+	})
+}
+
+// put stores the given object under its key, replacing the one already stored, if any.
+func (idx *keyIndex) put(object *store.ObjectMetadata) {
+	idx.unshare()
+	i, found := idx.search(object.Key)
+	if found {
+		idx.objects[i] = object
+		return
+	}
+	idx.objects = slices.Insert(idx.objects, i, object)
+}
+
+func (idx *keyIndex) remove(key string) {
+	i, found := idx.search(key)
+	if !found {
+		return
+	}
+	idx.unshare()
+	idx.objects = slices.Delete(idx.objects, i, i+1)
+}
+
+func (idx *keyIndex) unshare() {
+	if idx.shared.Load() {
+		idx.objects = slices.Clone(idx.objects)
+		idx.shared.Store(false)
+	}
+}
+
+// view returns the objects as they are now, which stay the same whatever changes are made afterwards. It only needs
+// the read lock.
+func (idx *keyIndex) view() []*store.ObjectMetadata {
+	idx.shared.Store(true)
+	return idx.objects
+}
+
+// seek returns the position of the first key under the given prefix that sorts after the given key.
+func (idx *keyIndex) seek(prefix, after string) int {
+	i, _ := idx.search(prefix)
+	return max(i, sort.Search(len(idx.objects), func(i int) bool {
+		return idx.objects[i].Key > after
+	}))
+}
+
+// skip returns the position of the first key after the given position that isn't under the given prefix. The keys
+// under a prefix are contiguous, so it's a binary search too.
+func (idx *keyIndex) skip(i int, prefix string) int {
+	return i + sort.Search(len(idx.objects)-i, func(j int) bool {
+		return !strings.HasPrefix(idx.objects[i+j].Key, prefix)
+	})
+}
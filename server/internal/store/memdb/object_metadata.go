@@ -4,52 +4,499 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"iter"
+	"maps"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
+
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/hashtree"
+	"github.com/hedisam/filesync/server/internal/events"
 	"github.com/hedisam/filesync/server/internal/store"
 )
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound = store.ErrNotFound
 )
 
+// DefaultChangeLogSize is the default number of changes kept per namespace.
+const DefaultChangeLogSize = 10000
+
 type Emitter interface {
 	Emit(ctx context.Context, obj *store.ObjectMetadata) error
 }
 
-// MetadataStore stores objects metadata. The underlying store is a simple map of key to a list file metadata.
-// The map value is a list of metadata instead of a single one to count for existing objects with the same key
-// that are going to be replaced soon by an in progress upload. While the new object is being uploaded, we still need
-// to make sure the existing object is visible to the client.
-type MetadataStore struct {
-	mu                   sync.RWMutex
-	keyToObjectMetadata  map[string]*store.ObjectMetadata
+type Publisher interface {
+	Publish(ev events.Event)
+}
+
+type Option func(s *MetadataStore)
+
+// WithPublisher makes the store publish an event for every change of the completed objects. Events are published
+// while the store is locked, so they're in the order the changes were made.
+func WithPublisher(p Publisher) Option {
+	return func(s *MetadataStore) {
+		s.publisher = p
+	}
+}
+
+// WithChangeLogSize sets the number of changes kept per namespace. Cursors older than the oldest change kept expire.
+func WithChangeLogSize(n int) Option {
+	return func(s *MetadataStore) {
+		s.changeLogSize = n
+	}
+}
+
+// namespace holds the objects of a single namespace. The underlying store is a simple map of key to a list file
+// metadata. The map value is a list of metadata instead of a single one to count for existing objects with the same
+// key that are going to be replaced soon by an in progress upload. While the new object is being uploaded, we still
+// need to make sure the existing object is visible to the client.
+type namespace struct {
+	keyToObjectMetadata map[string]*store.ObjectMetadata
+	// keys holds the objects of keyToObjectMetadata in the order of their keys
+	keys keyIndex
+	// tree is the hash tree over the keys of the completed objects
+	tree                 *hashtree.Tree
 	keyToInflightUploads map[string][]*store.ObjectMetadata
-	emitter              Emitter
+	usage                store.Usage
+	// seq is the Seq of the last change, and changes the latest changes, oldest first.
+	seq     uint64
+	changes []store.Change
 }
 
-func NewMetadataStore(e Emitter) *MetadataStore {
-	return &MetadataStore{
+func newNamespace() *namespace {
+	return &namespace{
 		keyToObjectMetadata:  make(map[string]*store.ObjectMetadata),
+		tree:                 hashtree.New(),
 		keyToInflightUploads: make(map[string][]*store.ObjectMetadata),
-		emitter:              e,
 	}
 }
 
-func (s *MetadataStore) Snapshot(context.Context) (map[string]store.ObjectMetadata, error) {
+// blob tracks the object metadata, inflight or completed, referencing a stored object. Multiple metadata can
+// reference the same object when objects are content-addressed.
+type blob struct {
+	refs   int
+	stored bool
+	// contentEncoding and encryptionKeyID are recorded once the object is stored, so metadata linked to it can record
+	// them too. encryptionKeyID is updated once the object is re-wrapped with another master key.
+	contentEncoding string
+	encryptionKeyID string
+	// verifiedAt is shared by all the metadata referencing the object
+	verifiedAt *time.Time
+}
+
+// MetadataStore stores objects metadata partitioned by namespace. It counts the references to every object so an
+// object is only queued for deletion once nothing references it anymore.
+type MetadataStore struct {
+	mu         sync.RWMutex
+	namespaces map[string]*namespace
+	blobs      map[string]*blob
+	// deleting holds the objects being deleted, which mustn't be referenced again until they're gone
+	deleting  map[string]struct{}
+	emitter   Emitter
+	publisher Publisher
+	// epoch identifies the change logs of this store; they're lost with it
+	epoch         string
+	changeLogSize int
+}
+
+func NewMetadataStore(e Emitter, opts ...Option) *MetadataStore {
+	s := &MetadataStore{
+		namespaces:    make(map[string]*namespace),
+		blobs:         make(map[string]*blob),
+		deleting:      make(map[string]struct{}),
+		emitter:       e,
+		epoch:         uuid.NewString(),
+		changeLogSize: DefaultChangeLogSize,
+	}
+	for opt := range slices.Values(opts) {
+		opt(s)
+	}
+	return s
+}
+
+// record appends a change of the given key, made as the given attribution tells, to the namespace's change log,
+// dropping the oldest changes once it's twice as long as it must be. A put versions the object with the Seq of its
+// change, and attributes it. The caller must hold the write lock.
+func (s *MetadataStore) record(ns *namespace, op store.ChangeOp, key string, object *store.ObjectMetadata, by store.Attribution) {
+	ns.seq++
+	if op == store.ChangePut {
+		object.Version = ns.seq
+		object.Attribution = by
+	}
+	change := store.Change{
+		Seq:         ns.seq,
+		Op:          op,
+		Key:         key,
+		Time:        time.Now().UTC(),
+		Attribution: by,
+	}
+	if object != nil {
+		md := *object
+		change.Object = &md
+	}
+	ns.changes = append(ns.changes, change)
+	if len(ns.changes) >= 2*s.changeLogSize {
+		ns.changes = slices.Clone(ns.changes[len(ns.changes)-s.changeLogSize:])
+	}
+}
+
+// publish publishes an event of the given type for the given object, made as the given attribution tells, if the
+// store has a publisher. The caller must hold the write lock.
+func (s *MetadataStore) publish(typ events.Type, object, previous *store.ObjectMetadata, fromKey string, by store.Attribution) {
+	if s.publisher == nil {
+		return
+	}
+	ev := events.Event{
+		Type:      typ,
+		Namespace: object.Namespace,
+		Key:       object.Key,
+		Object:    s.withObjectState(object),
+		FromKey:   fromKey,
+		By:        by,
+	}
+	if previous != nil {
+		md := *previous
+		ev.Previous = &md
+	}
+	s.publisher.Publish(ev)
+}
+
+// ref adds a reference to the given object. The caller must hold the write lock.
+func (s *MetadataStore) ref(objectID string) *blob {
+	b, ok := s.blobs[objectID]
+	if !ok {
+		b = &blob{}
+		s.blobs[objectID] = b
+	}
+	b.refs++
+	return b
+}
+
+// unref removes a reference to the object of the given metadata, queueing the object for deletion if it was the last
+// one. Nothing is changed if the deletion event cannot be emitted. The caller must hold the write lock.
+func (s *MetadataStore) unref(ctx context.Context, md *store.ObjectMetadata) error {
+	b, ok := s.blobs[md.ObjectID]
+	if ok && b.refs > 1 {
+		b.refs--
+		return nil
+	}
+
+	err := s.emitter.Emit(ctx, md)
+	if err != nil {
+		return err
+	}
+	delete(s.blobs, md.ObjectID)
+
+	return nil
+}
+
+// ObjectReferenced reports whether any object metadata, inflight or completed, references the given object.
+func (s *MetadataStore) ObjectReferenced(_ context.Context, objectID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.blobs[objectID]
+	return ok, nil
+}
+
+// BeginObjectDeletion marks the given object as being deleted unless any object metadata references it, reporting
+// whether it did. Until EndObjectDeletion is called, Create refuses to reference it again with ErrObjectDeleting, and
+// LinkObject with ErrNotFound, so new uploads of its content are stored anew rather than deleted with it.
+func (s *MetadataStore) BeginObjectDeletion(_ context.Context, objectID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.blobs[objectID]; ok {
+		return false, nil
+	}
+	s.deleting[objectID] = struct{}{}
+	return true, nil
+}
+
+// EndObjectDeletion lifts the mark BeginObjectDeletion put on the given object, once it's deleted or failed to be.
+func (s *MetadataStore) EndObjectDeletion(_ context.Context, objectID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.deleting, objectID)
+	return nil
+}
+
+// namespace returns the namespace with the given name, creating it if it doesn't exist yet.
+// The caller must hold the write lock.
+func (s *MetadataStore) namespace(name string) *namespace {
+	name = store.NamespaceOrDefault(name)
+	ns, ok := s.namespaces[name]
+	if !ok {
+		ns = newNamespace()
+		s.namespaces[name] = ns
+	}
+	return ns
+}
+
+func (s *MetadataStore) Snapshot(ctx context.Context, namespace string) (map[string]store.ObjectMetadata, error) {
+	snapshot, _, err := s.SnapshotWithCursor(ctx, namespace)
+	return snapshot, err
+}
+
+// SnapshotWithCursor returns the completed objects of the given namespace, along with the cursor to follow the
+// changes made after the snapshot with.
+func (s *MetadataStore) SnapshotWithCursor(_ context.Context, namespace string) (map[string]store.ObjectMetadata, store.Cursor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cursor := store.Cursor{Epoch: s.epoch}
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return map[string]store.ObjectMetadata{}, cursor, nil
+	}
+
+	snapshot := make(map[string]store.ObjectMetadata, len(ns.keyToObjectMetadata))
+	for k, v := range ns.keyToObjectMetadata {
+		snapshot[k] = s.withObjectState(v)
+	}
+	cursor.Seq = ns.seq
+	return snapshot, cursor, nil
+}
+
+// SnapshotSeq returns the completed objects of the given namespace as of the returned cursor, in the order of their
+// keys. The store is only read locked to take the snapshot, not while it's iterated, which changes made in the
+// meantime don't affect. The objects don't have VerifiedAt set, nor the EncryptionKeyID of a re-wrap, as they're not
+// part of the snapshot.
+func (s *MetadataStore) SnapshotSeq(_ context.Context, namespace string) (iter.Seq[store.ObjectMetadata], store.Cursor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cursor := store.Cursor{Epoch: s.epoch}
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return func(func(store.ObjectMetadata) bool) {}, cursor, nil
+	}
+
+	cursor.Seq = ns.seq
+	objects := ns.keys.view()
+	return func(yield func(store.ObjectMetadata) bool) {
+		for object := range slices.Values(objects) {
+			if !yield(*object) {
+				return
+			}
+		}
+	}, cursor, nil
+}
+
+// TreeNodes returns the nodes of the hash tree over the completed objects of the given namespace under the given
+// prefixes, as of the returned cursor. Prefixes with no directory under them are left out.
+func (s *MetadataStore) TreeNodes(_ context.Context, namespace string, prefixes []string) ([]*hashtree.Node, store.Cursor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cursor := store.Cursor{Epoch: s.epoch}
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return hashtree.New().Nodes(prefixes), cursor, nil
+	}
+
+	cursor.Seq = ns.seq
+	return ns.tree.Nodes(prefixes), cursor, nil
+}
+
+// Changes returns up to limit changes of the given namespace made after the given cursor, oldest first, and the
+// cursor to get the next changes with. It returns ErrCursorExpired if some of the changes after the cursor have been
+// dropped, or the cursor is from another epoch.
+func (s *MetadataStore) Changes(_ context.Context, namespace string, since store.Cursor, limit int) ([]store.Change, store.Cursor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if since.Epoch != s.epoch {
+		return nil, store.Cursor{}, fmt.Errorf("cursor of epoch %q: %w", since.Epoch, store.ErrCursorExpired)
+	}
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		if since.Seq > 0 {
+			return nil, store.Cursor{}, fmt.Errorf("cursor ahead of the namespace: %w", store.ErrCursorExpired)
+		}
+		return nil, since, nil
+	}
+	if since.Seq > ns.seq {
+		return nil, store.Cursor{}, fmt.Errorf("cursor ahead of the namespace: %w", store.ErrCursorExpired)
+	}
+	if since.Seq == ns.seq {
+		return nil, since, nil
+	}
+	// the changes kept are the ones from oldest to ns.seq, with no gaps
+	oldest := ns.seq - uint64(len(ns.changes)) + 1
+	if since.Seq+1 < oldest {
+		return nil, store.Cursor{}, fmt.Errorf("cursor older than the oldest change kept: %w", store.ErrCursorExpired)
+	}
+
+	start := int(since.Seq + 1 - oldest)
+	end := len(ns.changes)
+	if limit > 0 {
+		end = min(end, start+limit)
+	}
+	changes := slices.Clone(ns.changes[start:end])
+	return changes, store.Cursor{Epoch: s.epoch, Seq: changes[len(changes)-1].Seq}, nil
+}
+
+// History returns the changes of the given key still kept in the change log of its namespace, newest first: the
+// versions it was given, and who gave them, and its deletions. Older changes have been dropped along with the rest.
+func (s *MetadataStore) History(_ context.Context, namespace, key string) ([]store.Change, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return nil, nil
+	}
+	var history []store.Change
+	for i := len(ns.changes) - 1; i >= 0; i-- {
+		if ns.changes[i].Key == key {
+			history = append(history, ns.changes[i])
+		}
+	}
+	return history, nil
+}
+
+// List returns the completed objects of a namespace in the order of their keys, a page at a time, as selected by the
+// given options.
+func (s *MetadataStore) List(_ context.Context, namespace string, opts store.ListOptions) (*store.ListPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page := &store.ListPage{}
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return page, nil
+	}
+
+	// last is the last key or common prefix listed
+	last := opts.After
+	full := func() bool {
+		if opts.Limit > 0 && len(page.Objects)+len(page.CommonPrefixes) == opts.Limit {
+			page.Next = last
+			return true
+		}
+		return false
+	}
+
+	objects := ns.keys.objects
+	for i := ns.keys.seek(opts.Prefix, opts.After); i < len(objects) && strings.HasPrefix(objects[i].Key, opts.Prefix); {
+		key := objects[i].Key
+		if opts.Delimiter != "" {
+			if j := strings.Index(key[len(opts.Prefix):], opts.Delimiter); j != -1 {
+				commonPrefix := key[:len(opts.Prefix)+j+len(opts.Delimiter)]
+				// a page may end with a common prefix whose keys are yet to be skipped
+				if commonPrefix > opts.After {
+					if full() {
+						break
+					}
+					page.CommonPrefixes = append(page.CommonPrefixes, commonPrefix)
+					last = commonPrefix
+				}
+				i = ns.keys.skip(i, commonPrefix)
+				continue
+			}
+		}
+
+		if full() {
+			break
+		}
+		page.Objects = append(page.Objects, s.withObjectState(objects[i]))
+		last = key
+		i++
+	}
+	return page, nil
+}
+
+// withObjectState returns a copy of the given metadata with the time its object was last verified, and the master key
+// it's wrapped with now. The caller must hold the read lock.
+func (s *MetadataStore) withObjectState(md *store.ObjectMetadata) store.ObjectMetadata {
+	result := *md
+	if b, ok := s.blobs[md.ObjectID]; ok {
+		result.VerifiedAt = b.verifiedAt
+		if b.encryptionKeyID != "" {
+			result.EncryptionKeyID = b.encryptionKeyID
+		}
+	}
+	return result
+}
+
+// Get returns a copy of the completed object stored under the given key. It returns ErrNotFound if there's none.
+func (s *MetadataStore) Get(_ context.Context, namespace, key string) (*store.ObjectMetadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	md, ok := ns.keyToObjectMetadata[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	result := s.withObjectState(md)
+	return &result, nil
+}
+
+// ObjectVerified records that the given stored object was found to match its checksum at the given time. It returns
+// ErrNotFound if the object isn't stored, e.g. if it has been deleted meanwhile.
+func (s *MetadataStore) ObjectVerified(_ context.Context, objectID string, at time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	snapshot := make(map[string]store.ObjectMetadata, len(s.keyToObjectMetadata))
-	for k, v := range s.keyToObjectMetadata {
-		snapshot[k] = *v
+	b, ok := s.blobs[objectID]
+	if !ok || !b.stored {
+		return fmt.Errorf("object not stored: %w", ErrNotFound)
 	}
-	return snapshot, nil
+	b.verifiedAt = &at
+	return nil
+}
+
+// ObjectRewrapped records that the data key of the given stored object was re-wrapped with the master key of the
+// given ID. It returns ErrNotFound if the object isn't stored, e.g. if no metadata references it.
+func (s *MetadataStore) ObjectRewrapped(_ context.Context, objectID, keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blobs[objectID]
+	if !ok || !b.stored {
+		return fmt.Errorf("object not stored: %w", ErrNotFound)
+	}
+	b.encryptionKeyID = keyID
+	return nil
+}
+
+// Usage returns the storage consumed by the completed objects of the given namespace.
+func (s *MetadataStore) Usage(_ context.Context, namespace string) (store.Usage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return store.Usage{}, nil
+	}
+	return ns.usage, nil
+}
+
+// Namespaces returns the sorted names of the namespaces known to the store.
+func (s *MetadataStore) Namespaces(context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Sorted(maps.Keys(s.namespaces)), nil
 }
 
 // Create creates a file metadata record in the database. It will be marked as completed when the upload is done.
+// It returns ErrPreconditionFailed if the upload is conditioned on a version of the key it doesn't have, so a stale
+// upload fails before its content is stored; the condition is checked again on completion. It returns
+// ErrObjectDeleting if the object is being deleted, and ErrObjectStored if it's stored already, by another upload of
+// the same content-addressed object, which mustn't be stored over the one referenced.
 func (s *MetadataStore) Create(_ context.Context, md *store.ObjectMetadata) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -60,14 +507,35 @@ func (s *MetadataStore) Create(_ context.Context, md *store.ObjectMetadata) erro
 	if md.ObjectID == "" {
 		return errors.New("object ID is required for storing metadata")
 	}
+	if _, ok := s.deleting[md.ObjectID]; ok {
+		return fmt.Errorf("object %q: %w", md.ObjectID, store.ErrObjectDeleting)
+	}
+	if b, ok := s.blobs[md.ObjectID]; ok && b.stored {
+		return fmt.Errorf("object %q: %w", md.ObjectID, store.ErrObjectStored)
+	}
+	err := checkVersion(s.namespaces[store.NamespaceOrDefault(md.Namespace)], md.Key, md.IfMatch)
+	if err != nil {
+		return err
+	}
 
-	s.keyToInflightUploads[md.Key] = append(s.keyToInflightUploads[md.Key], &store.ObjectMetadata{
-		Key:            md.Key,
-		ObjectID:       md.ObjectID,
-		SHA256Checksum: md.SHA256Checksum,
-		Size:           md.Size,
-		MTime:          md.MTime,
-		CreatedAt:      md.CreatedAt,
+	s.ref(md.ObjectID)
+	ns := s.namespace(md.Namespace)
+	ns.keyToInflightUploads[md.Key] = append(ns.keyToInflightUploads[md.Key], &store.ObjectMetadata{
+		Namespace:       store.NamespaceOrDefault(md.Namespace),
+		Key:             md.Key,
+		ObjectID:        md.ObjectID,
+		SHA256Checksum:  md.SHA256Checksum,
+		Size:            md.Size,
+		MTime:           md.MTime,
+		CreatedAt:       md.CreatedAt,
+		ExpiresAt:       md.ExpiresAt,
+		ContentMAC:      md.ContentMAC,
+		ContentEncoding: md.ContentEncoding,
+		EncryptionKeyID: md.EncryptionKeyID,
+		IfMatch:         md.IfMatch,
+		Attribution:     md.Attribution,
+		Attributes:      md.Attributes,
+		Type:            md.Type,
 	})
 
 	return nil
@@ -76,32 +544,137 @@ func (s *MetadataStore) Create(_ context.Context, md *store.ObjectMetadata) erro
 // Delete marks the object with the provided key as deleted.
 // Since we can have multiple object metadata associated with the same key, we should make sure we only mark the one
 // that is marked as completed and not already deleted.
-func (s *MetadataStore) Delete(ctx context.Context, key string) error {
+// Given ifMatch, it returns ErrPreconditionFailed unless the object has that version, or there's none if it's 0. The
+// deletion is attributed as given.
+func (s *MetadataStore) Delete(ctx context.Context, namespace, key string, ifMatch *uint64, by store.Attribution) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	object, ok := s.keyToObjectMetadata[key]
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	err := checkVersion(ns, key, ifMatch)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	object, ok := ns.keyToObjectMetadata[key]
 	if !ok {
 		return nil
 	}
 
-	err := s.emitter.Emit(ctx, object)
+	err = s.unref(ctx, object)
 	if err != nil {
 		return fmt.Errorf("could not emit object deletion event: %w", err)
 	}
 
-	delete(s.keyToObjectMetadata, key)
+	delete(ns.keyToObjectMetadata, key)
+	ns.keys.remove(key)
+	ns.tree.Delete(key)
+	ns.usage.Bytes -= object.Size
+	ns.usage.Objects--
+	by.Operation = store.OpDelete
+	s.record(ns, store.ChangeDelete, key, nil, by)
+	s.publish(events.Deleted, object, nil, "", by)
 
 	return nil
 }
 
+// Move moves the completed object under fromKey to toKey, replacing any existing object under toKey. Inflight uploads
+// of fromKey are left as they are, and complete under fromKey. It returns ErrNotFound if there's no completed object
+// under fromKey. The moved object is attributed as given, as a new version of toKey.
+func (s *MetadataStore) Move(ctx context.Context, namespace, fromKey, toKey string, by store.Attribution) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if toKey == "" {
+		return errors.New("key is required for storing metadata")
+	}
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return ErrNotFound
+	}
+	object, ok := ns.keyToObjectMetadata[fromKey]
+	if !ok {
+		return ErrNotFound
+	}
+	if fromKey == toKey {
+		return nil
+	}
+
+	existingObject, ok := ns.keyToObjectMetadata[toKey]
+	if ok {
+		err := s.unref(ctx, existingObject)
+		if err != nil {
+			return fmt.Errorf("could not emit deletion event for the existing object: %w", err)
+		}
+		ns.usage.Bytes -= existingObject.Size
+		ns.usage.Objects--
+	}
+
+	moved := *object
+	moved.Key = toKey
+	delete(ns.keyToObjectMetadata, fromKey)
+	ns.keys.remove(fromKey)
+	ns.tree.Delete(fromKey)
+	ns.keyToObjectMetadata[toKey] = &moved
+	ns.keys.put(&moved)
+	ns.tree.Put(toKey, treeContentID(&moved))
+	by.Operation = store.OpMove
+	s.record(ns, store.ChangeDelete, fromKey, nil, by)
+	s.record(ns, store.ChangePut, toKey, &moved, by)
+	s.publish(events.Moved, &moved, existingObject, fromKey, by)
+
+	return nil
+}
+
+// SetAttributes gives the object under the given key the given attributes, keeping its content, as a new version
+// attributed as given. It returns the new version. Given ifMatch, it returns ErrPreconditionFailed unless the object
+// has that version.
+func (s *MetadataStore) SetAttributes(_ context.Context, namespace, key string, attrs *fileattr.Attributes, ifMatch *uint64, by store.Attribution) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	object, ok := ns.keyToObjectMetadata[key]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	err := checkVersion(ns, key, ifMatch)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := *object
+	updated.Attributes = attrs
+	updated.MTime = time.Unix(0, attrs.MTime).Unix()
+	ns.keyToObjectMetadata[key] = &updated
+	ns.keys.put(&updated)
+	by.Operation = store.OpSetAttributes
+	s.record(ns, store.ChangePut, key, &updated, by)
+	s.publish(events.Replaced, &updated, object, "", by)
+
+	return updated.Version, nil
+}
+
 // PutObjectCompleted is called to update the file metadata when an object file has been stored on our storage
-// system successfully. It queues any existing object under the same key for deletion.
-func (s *MetadataStore) PutObjectCompleted(ctx context.Context, key, objectID string) error {
+// system successfully. It queues any existing object under the same key for deletion. It returns
+// ErrPreconditionFailed, leaving the upload inflight, if the upload is conditioned on a version of the key it doesn't
+// have anymore.
+func (s *MetadataStore) PutObjectCompleted(ctx context.Context, namespace, key, objectID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	inflightObjects, ok := s.keyToInflightUploads[key]
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return ErrNotFound
+	}
+
+	inflightObjects, ok := ns.keyToInflightUploads[key]
 	if !ok {
 		return ErrNotFound
 	}
@@ -113,27 +686,201 @@ func (s *MetadataStore) PutObjectCompleted(ctx context.Context, key, objectID st
 		return fmt.Errorf("object not found in inflight uploads: %w", ErrNotFound)
 	}
 	object := inflightObjects[i]
+	err := checkVersion(ns, key, object.IfMatch)
+	if err != nil {
+		return err
+	}
+	object.IfMatch = nil
 
-	existingObject, ok := s.keyToObjectMetadata[key]
-	if ok {
-		err := s.emitter.Emit(ctx, existingObject)
-		if err != nil {
-			return fmt.Errorf("could not emit deletion event for the existing object: %w", err)
-		}
+	err = s.replace(ctx, ns, object)
+	if err != nil {
+		return err
 	}
+	s.blobs[objectID].stored = true
+	s.blobs[objectID].contentEncoding = object.ContentEncoding
+	s.blobs[objectID].encryptionKeyID = object.EncryptionKeyID
 
-	now := time.Now().UTC()
-	object.CompletedAt = &now
-	s.keyToObjectMetadata[key] = object
+	// content-addressed uploads of the same content share the object ID; only remove the one we've completed
+	inflightObjects = slices.Delete(inflightObjects, i, i+1)
+	if len(inflightObjects) == 0 {
+		delete(ns.keyToInflightUploads, key)
+		return nil
+	}
+	ns.keyToInflightUploads[key] = inflightObjects
 
-	inflightObjects = slices.DeleteFunc(inflightObjects, func(obj *store.ObjectMetadata) bool {
-		return obj.ObjectID == objectID
+	return nil
+}
+
+// PutObjectFailed is called when an inflight upload has failed. It removes the inflight object metadata and queues
+// its object for deletion, in case anything was stored, unless the object is referenced by other metadata.
+func (s *MetadataStore) PutObjectFailed(ctx context.Context, namespace, key, objectID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns, ok := s.namespaces[store.NamespaceOrDefault(namespace)]
+	if !ok {
+		return ErrNotFound
+	}
+
+	inflightObjects := ns.keyToInflightUploads[key]
+	i := slices.IndexFunc(inflightObjects, func(md *store.ObjectMetadata) bool {
+		return md.ObjectID == objectID
 	})
+	if i == -1 {
+		return fmt.Errorf("object not found in inflight uploads: %w", ErrNotFound)
+	}
+
+	err := s.unref(ctx, inflightObjects[i])
+	if err != nil {
+		return fmt.Errorf("could not emit deletion event for the failed object: %w", err)
+	}
+
+	inflightObjects = slices.Delete(inflightObjects, i, i+1)
 	if len(inflightObjects) == 0 {
-		delete(s.keyToInflightUploads, key)
+		delete(ns.keyToInflightUploads, key)
+		return nil
+	}
+	ns.keyToInflightUploads[key] = inflightObjects
+
+	return nil
+}
+
+// ExpireInflightUploads removes the inflight uploads whose presigned url expired before the given time, queueing their
+// objects for deletion unless other metadata reference them. It returns the removed uploads, which are the ones
+// removed so far if an object can't be queued for deletion.
+func (s *MetadataStore) ExpireInflightUploads(ctx context.Context, before time.Time) ([]store.ObjectMetadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []store.ObjectMetadata
+	for ns := range maps.Values(s.namespaces) {
+		for key, inflightObjects := range ns.keyToInflightUploads {
+			var remaining []*store.ObjectMetadata
+			var err error
+			for md := range slices.Values(inflightObjects) {
+				if err != nil || md.ExpiresAt.IsZero() || !md.ExpiresAt.Before(before) {
+					remaining = append(remaining, md)
+					continue
+				}
+				err = s.unref(ctx, md)
+				if err != nil {
+					remaining = append(remaining, md)
+					continue
+				}
+				expired = append(expired, *md)
+			}
+
+			if len(remaining) == 0 {
+				delete(ns.keyToInflightUploads, key)
+			} else {
+				ns.keyToInflightUploads[key] = remaining
+			}
+			if err != nil {
+				return expired, fmt.Errorf("could not emit deletion event for the expired object: %w", err)
+			}
+		}
+	}
+
+	return expired, nil
+}
+
+// LinkObject creates a completed object metadata that references an already stored object, which is how an upload
+// of existing content is short-circuited when objects are content-addressed. Any existing object under the same key
+// is replaced. It returns ErrNotFound if the referenced object is not stored yet, and ErrPreconditionFailed if the
+// link is conditioned on a version of the key it doesn't have.
+func (s *MetadataStore) LinkObject(ctx context.Context, md *store.ObjectMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if md.Key == "" {
+		return errors.New("key is required for storing metadata")
+	}
+	b, ok := s.blobs[md.ObjectID]
+	if !ok || !b.stored {
+		return fmt.Errorf("object not stored: %w", ErrNotFound)
+	}
+	err := checkVersion(s.namespaces[store.NamespaceOrDefault(md.Namespace)], md.Key, md.IfMatch)
+	if err != nil {
+		return err
+	}
+
+	object := *md
+	object.Namespace = store.NamespaceOrDefault(md.Namespace)
+	object.CompletedAt = nil
+	object.IfMatch = nil
+	// the linked object might have been stored with another encoding or master key than the caller would use
+	object.ContentEncoding = b.contentEncoding
+	object.EncryptionKeyID = b.encryptionKeyID
+
+	// take the new reference first so replacing an object with the same content doesn't queue it for deletion
+	s.ref(md.ObjectID)
+	err = s.replace(ctx, s.namespace(object.Namespace), &object)
+	if err != nil {
+		b.refs--
+		return err
+	}
+
+	return nil
+}
+
+// checkVersion returns ErrPreconditionFailed unless the completed object under the given key of the given namespace,
+// which might not exist yet, has the given version, or there's none if it's 0. Any version matches a nil one. The
+// caller must hold the lock.
+func checkVersion(ns *namespace, key string, ifMatch *uint64) error {
+	if ifMatch == nil {
 		return nil
 	}
-	s.keyToInflightUploads[key] = inflightObjects
+	var version uint64
+	if ns != nil {
+		if object, ok := ns.keyToObjectMetadata[key]; ok {
+			version = object.Version
+		}
+	}
+	if version != *ifMatch {
+		return fmt.Errorf("%w: key %q is at version %d, not %d", store.ErrPreconditionFailed, key, version, *ifMatch)
+	}
+	return nil
+}
+
+// replace stores the given completed object under its key, releasing any existing object under the same key.
+// The caller must hold the write lock.
+func (s *MetadataStore) replace(ctx context.Context, ns *namespace, object *store.ObjectMetadata) error {
+	existingObject, ok := ns.keyToObjectMetadata[object.Key]
+	if ok {
+		err := s.unref(ctx, existingObject)
+		if err != nil {
+			return fmt.Errorf("could not emit deletion event for the existing object: %w", err)
+		}
+		ns.usage.Bytes -= existingObject.Size
+		ns.usage.Objects--
+	}
+
+	if object.CompletedAt == nil {
+		now := time.Now().UTC()
+		object.CompletedAt = &now
+	}
+	ns.keyToObjectMetadata[object.Key] = object
+	ns.keys.put(object)
+	ns.tree.Put(object.Key, treeContentID(object))
+	ns.usage.Bytes += object.Size
+	ns.usage.Objects++
+	s.record(ns, store.ChangePut, object.Key, object, object.Attribution)
+	if existingObject != nil {
+		s.publish(events.Replaced, object, existingObject, "", object.Attribution)
+	} else {
+		s.publish(events.Created, object, nil, "", object.Attribution)
+	}
 
 	return nil
 }
+
+// treeContentID returns what identifies the content of the given object in the hash tree.
+func treeContentID(object *store.ObjectMetadata) string {
+	switch object.Type {
+	case store.TypeSymlink:
+		return hashtree.LinkContentID(object.SHA256Checksum, object.ContentMAC)
+	case store.TypeDir:
+		return hashtree.DirContentID(object.SHA256Checksum, object.ContentMAC)
+	}
+	return hashtree.ContentID(object.SHA256Checksum, object.ContentMAC)
+}
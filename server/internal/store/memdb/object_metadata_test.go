@@ -3,12 +3,19 @@ package memdb_test
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/hedisam/filesync/lib/fileattr"
+	"github.com/hedisam/filesync/lib/hashtree"
+	"github.com/hedisam/filesync/server/internal/events"
 	"github.com/hedisam/filesync/server/internal/store"
 	"github.com/hedisam/filesync/server/internal/store/memdb"
 	"github.com/hedisam/filesync/server/internal/store/memdb/mocks"
@@ -71,12 +78,12 @@ func TestDelete(t *testing.T) {
 		},
 		"with object": {
 			key:                  "k",
-			initial:              &store.ObjectMetadata{Key: "k", ObjectID: "id"},
+			initial:              &store.ObjectMetadata{Namespace: store.DefaultNamespace, Key: "k", ObjectID: "id"},
 			expectedEmitterCalls: 1,
 		},
 		"emitter error": {
 			key:                  "k",
-			initial:              &store.ObjectMetadata{Key: "k", ObjectID: "id"},
+			initial:              &store.ObjectMetadata{Namespace: store.DefaultNamespace, Key: "k", ObjectID: "id"},
 			emitterError:         errors.New("boom"),
 			errContains:          "boom",
 			expectedEmitterCalls: 1,
@@ -89,6 +96,8 @@ func TestDelete(t *testing.T) {
 				EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
 					assert.NotNil(t, obj.CompletedAt)
 					obj.CompletedAt = nil
+					assert.EqualValues(t, 1, obj.Version)
+					obj.Version = 0
 					assert.EqualValues(t, tc.initial, obj)
 					return tc.emitterError
 				},
@@ -98,11 +107,11 @@ func TestDelete(t *testing.T) {
 			if tc.initial != nil {
 				err := ms.Create(ctx, tc.initial)
 				require.NoError(t, err)
-				err = ms.PutObjectCompleted(ctx, tc.initial.Key, tc.initial.ObjectID)
+				err = ms.PutObjectCompleted(ctx, tc.initial.Namespace, tc.initial.Key, tc.initial.ObjectID)
 				require.NoError(t, err)
 			}
 
-			err := ms.Delete(ctx, tc.key)
+			err := ms.Delete(ctx, store.DefaultNamespace, tc.key, nil, store.Attribution{})
 			if tc.errContains != "" {
 				require.Error(t, err)
 				assert.ErrorContains(t, err, tc.errContains)
@@ -173,7 +182,7 @@ func TestPutObjectCompleted(t *testing.T) {
 			if tc.initialOld != nil {
 				err := ms.Create(ctx, tc.initialOld)
 				require.NoError(t, err)
-				err = ms.PutObjectCompleted(ctx, tc.initialOld.Key, tc.initialOld.ObjectID)
+				err = ms.PutObjectCompleted(ctx, tc.initialOld.Namespace, tc.initialOld.Key, tc.initialOld.ObjectID)
 				require.NoError(t, err)
 			}
 			if tc.initialNew != nil {
@@ -181,7 +190,7 @@ func TestPutObjectCompleted(t *testing.T) {
 				require.NoError(t, err)
 			}
 
-			err := ms.PutObjectCompleted(ctx, tc.completedKey, tc.completedObjectID)
+			err := ms.PutObjectCompleted(ctx, store.DefaultNamespace, tc.completedKey, tc.completedObjectID)
 			if tc.errContains != "" {
 				require.ErrorContains(t, err, tc.errContains)
 				return
@@ -191,3 +200,817 @@ func TestPutObjectCompleted(t *testing.T) {
 		})
 	}
 }
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	mock := &mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			return nil
+		},
+	}
+	ms := memdb.NewMetadataStore(mock)
+
+	put := func(namespace, key, objectID string, size int64) {
+		err := ms.Create(ctx, &store.ObjectMetadata{Namespace: namespace, Key: key, ObjectID: objectID, Size: size})
+		require.NoError(t, err)
+		err = ms.PutObjectCompleted(ctx, namespace, key, objectID)
+		require.NoError(t, err)
+	}
+
+	put("docs", "a", "id-1", 10)
+	put("docs", "b", "id-2", 20)
+	put("", "a", "id-3", 5)
+
+	usage, err := ms.Usage(ctx, "docs")
+	require.NoError(t, err)
+	assert.Equal(t, store.Usage{Bytes: 30, Objects: 2}, usage)
+
+	// replacing a key swaps its size without changing the number of objects
+	put("docs", "a", "id-4", 15)
+	usage, err = ms.Usage(ctx, "docs")
+	require.NoError(t, err)
+	assert.Equal(t, store.Usage{Bytes: 35, Objects: 2}, usage)
+
+	// inflight uploads are not accounted for
+	err = ms.Create(ctx, &store.ObjectMetadata{Namespace: "docs", Key: "c", ObjectID: "id-5", Size: 100})
+	require.NoError(t, err)
+
+	err = ms.Delete(ctx, "docs", "b", nil, store.Attribution{})
+	require.NoError(t, err)
+	usage, err = ms.Usage(ctx, "docs")
+	require.NoError(t, err)
+	assert.Equal(t, store.Usage{Bytes: 15, Objects: 1}, usage)
+
+	usage, err = ms.Usage(ctx, store.DefaultNamespace)
+	require.NoError(t, err)
+	assert.Equal(t, store.Usage{Bytes: 5, Objects: 1}, usage)
+
+	md, err := ms.Get(ctx, "docs", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "id-4", md.ObjectID)
+	_, err = ms.Get(ctx, "docs", "b")
+	assert.ErrorIs(t, err, memdb.ErrNotFound)
+
+	namespaces, err := ms.Namespaces(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{store.DefaultNamespace, "docs"}, namespaces)
+}
+
+func TestObjectReferences(t *testing.T) {
+	ctx := context.Background()
+	var emitted []string
+	mock := &mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			emitted = append(emitted, obj.ObjectID)
+			return nil
+		},
+	}
+	ms := memdb.NewMetadataStore(mock)
+
+	// linking content that isn't stored yet is not possible
+	err := ms.LinkObject(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "sha-1"})
+	require.ErrorIs(t, err, memdb.ErrNotFound)
+
+	err = ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "sha-1", Size: 10, EncryptionKeyID: "k1"})
+	require.NoError(t, err)
+	// still inflight
+	err = ms.LinkObject(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "sha-1"})
+	require.ErrorIs(t, err, memdb.ErrNotFound)
+
+	err = ms.PutObjectCompleted(ctx, store.DefaultNamespace, "a", "sha-1")
+	require.NoError(t, err)
+	// stored content is referenced, never stored over
+	err = ms.Create(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "sha-1", Size: 10})
+	require.ErrorIs(t, err, store.ErrObjectStored)
+	err = ms.LinkObject(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "sha-1", Size: 10, EncryptionKeyID: "k2"})
+	require.NoError(t, err)
+	// linking the same content under the same key must not release it
+	err = ms.LinkObject(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "sha-1", Size: 10})
+	require.NoError(t, err)
+
+	md, err := ms.Get(ctx, store.DefaultNamespace, "b")
+	require.NoError(t, err)
+	assert.Equal(t, "sha-1", md.ObjectID)
+	assert.NotNil(t, md.CompletedAt)
+	// the linked object is encrypted with the key it was stored with
+	assert.Equal(t, "k1", md.EncryptionKeyID)
+	// and with the one it's re-wrapped with, once it is
+	require.NoError(t, ms.ObjectRewrapped(ctx, "sha-1", "k3"))
+	md, err = ms.Get(ctx, store.DefaultNamespace, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "k3", md.EncryptionKeyID)
+	require.ErrorIs(t, ms.ObjectRewrapped(ctx, "sha-2", "k3"), memdb.ErrNotFound)
+	usage, err := ms.Usage(ctx, store.DefaultNamespace)
+	require.NoError(t, err)
+	assert.Equal(t, store.Usage{Bytes: 20, Objects: 2}, usage)
+
+	err = ms.Delete(ctx, store.DefaultNamespace, "a", nil, store.Attribution{})
+	require.NoError(t, err)
+	assert.Empty(t, emitted)
+	referenced, err := ms.ObjectReferenced(ctx, "sha-1")
+	require.NoError(t, err)
+	assert.True(t, referenced)
+
+	// replacing the last reference queues the object for deletion
+	err = ms.Create(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "sha-2"})
+	require.NoError(t, err)
+	err = ms.PutObjectCompleted(ctx, store.DefaultNamespace, "b", "sha-2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sha-1"}, emitted)
+	referenced, err = ms.ObjectReferenced(ctx, "sha-1")
+	require.NoError(t, err)
+	assert.False(t, referenced)
+}
+
+func TestObjectDeletion(t *testing.T) {
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			return nil
+		},
+	})
+
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "sha"}))
+	require.NoError(t, ms.PutObjectCompleted(ctx, store.DefaultNamespace, "a", "sha"))
+	// referenced objects aren't deleted
+	unreferenced, err := ms.BeginObjectDeletion(ctx, "sha")
+	require.NoError(t, err)
+	assert.False(t, unreferenced)
+
+	require.NoError(t, ms.Delete(ctx, store.DefaultNamespace, "a", nil, store.Attribution{}))
+	unreferenced, err = ms.BeginObjectDeletion(ctx, "sha")
+	require.NoError(t, err)
+	require.True(t, unreferenced)
+
+	// the object can't be referenced again while it's deleted
+	err = ms.Create(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "sha"})
+	assert.ErrorIs(t, err, store.ErrObjectDeleting)
+	err = ms.LinkObject(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "sha"})
+	assert.ErrorIs(t, err, memdb.ErrNotFound)
+
+	require.NoError(t, ms.EndObjectDeletion(ctx, "sha"))
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "sha"}))
+}
+
+func TestPutObjectCompletedSharedObjectID(t *testing.T) {
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			return nil
+		},
+	})
+
+	// concurrent uploads of the same content under the same key share their object ID
+	for range 2 {
+		err := ms.Create(ctx, &store.ObjectMetadata{Key: "k", ObjectID: "sha"})
+		require.NoError(t, err)
+	}
+	for range 2 {
+		err := ms.PutObjectCompleted(ctx, store.DefaultNamespace, "k", "sha")
+		require.NoError(t, err)
+	}
+
+	referenced, err := ms.ObjectReferenced(ctx, "sha")
+	require.NoError(t, err)
+	assert.True(t, referenced)
+}
+
+func TestPutObjectFailed(t *testing.T) {
+	ctx := context.Background()
+	mock := &mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			return nil
+		},
+	}
+	ms := memdb.NewMetadataStore(mock)
+
+	// two uploads of the same content share the object ID
+	for range 2 {
+		err := ms.Create(ctx, &store.ObjectMetadata{Key: "k", ObjectID: "sha"})
+		require.NoError(t, err)
+	}
+
+	err := ms.PutObjectFailed(ctx, store.DefaultNamespace, "k", "sha")
+	require.NoError(t, err)
+	assert.Empty(t, mock.EmitCalls(), "object still referenced by the other upload")
+
+	err = ms.PutObjectFailed(ctx, store.DefaultNamespace, "k", "sha")
+	require.NoError(t, err)
+	require.Len(t, mock.EmitCalls(), 1)
+	assert.Equal(t, "sha", mock.EmitCalls()[0].Obj.ObjectID)
+
+	referenced, err := ms.ObjectReferenced(ctx, "sha")
+	require.NoError(t, err)
+	assert.False(t, referenced)
+
+	err = ms.PutObjectFailed(ctx, store.DefaultNamespace, "k", "sha")
+	assert.ErrorIs(t, err, memdb.ErrNotFound)
+
+	err = ms.PutObjectCompleted(ctx, store.DefaultNamespace, "k", "sha")
+	assert.ErrorIs(t, err, memdb.ErrNotFound)
+}
+
+func TestObjectVerified(t *testing.T) {
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			return nil
+		},
+	})
+
+	err := ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "sha"})
+	require.NoError(t, err)
+	// not stored yet
+	err = ms.ObjectVerified(ctx, "sha", time.Now())
+	require.ErrorIs(t, err, memdb.ErrNotFound)
+
+	err = ms.PutObjectCompleted(ctx, store.DefaultNamespace, "a", "sha")
+	require.NoError(t, err)
+	err = ms.LinkObject(ctx, &store.ObjectMetadata{Namespace: "docs", Key: "b", ObjectID: "sha"})
+	require.NoError(t, err)
+	md, err := ms.Get(ctx, store.DefaultNamespace, "a")
+	require.NoError(t, err)
+	assert.Nil(t, md.VerifiedAt)
+
+	verifiedAt := time.Now().UTC()
+	err = ms.ObjectVerified(ctx, "sha", verifiedAt)
+	require.NoError(t, err)
+
+	// every metadata referencing the object shares its verification time
+	md, err = ms.Get(ctx, store.DefaultNamespace, "a")
+	require.NoError(t, err)
+	require.NotNil(t, md.VerifiedAt)
+	assert.Equal(t, verifiedAt, *md.VerifiedAt)
+	snapshot, err := ms.Snapshot(ctx, "docs")
+	require.NoError(t, err)
+	require.NotNil(t, snapshot["b"].VerifiedAt)
+	assert.Equal(t, verifiedAt, *snapshot["b"].VerifiedAt)
+}
+
+func TestExpireInflightUploads(t *testing.T) {
+	ctx := context.Background()
+	var emitted []string
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			emitted = append(emitted, obj.ObjectID)
+			return nil
+		},
+	})
+	now := time.Now().UTC()
+
+	for md := range slices.Values([]*store.ObjectMetadata{
+		{Key: "a", ObjectID: "expired", ExpiresAt: now.Add(-time.Minute)},
+		{Key: "a", ObjectID: "valid", ExpiresAt: now.Add(time.Minute)},
+		{Namespace: "docs", Key: "b", ObjectID: "expired-shared", ExpiresAt: now.Add(-time.Minute)},
+		{Namespace: "docs", Key: "c", ObjectID: "expired-shared", ExpiresAt: now.Add(time.Minute)},
+		{Key: "d", ObjectID: "no-expiry"},
+	}) {
+		require.NoError(t, ms.Create(ctx, md))
+	}
+
+	expired, err := ms.ExpireInflightUploads(ctx, now)
+	require.NoError(t, err)
+	var expiredIDs []string
+	for md := range slices.Values(expired) {
+		expiredIDs = append(expiredIDs, md.ObjectID)
+	}
+	assert.ElementsMatch(t, []string{"expired", "expired-shared"}, expiredIDs)
+	// the shared object is still referenced by the other upload
+	assert.Equal(t, []string{"expired"}, emitted)
+
+	err = ms.PutObjectCompleted(ctx, store.DefaultNamespace, "a", "expired")
+	require.ErrorIs(t, err, memdb.ErrNotFound)
+	for md := range slices.Values([]*store.ObjectMetadata{
+		{Key: "a", ObjectID: "valid"},
+		{Namespace: "docs", Key: "c", ObjectID: "expired-shared"},
+		{Key: "d", ObjectID: "no-expiry"},
+	}) {
+		require.NoError(t, ms.PutObjectCompleted(ctx, md.Namespace, md.Key, md.ObjectID))
+	}
+}
+
+func TestMove(t *testing.T) {
+	ctx := context.Background()
+	var emitted []string
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			emitted = append(emitted, obj.ObjectID)
+			return nil
+		},
+	})
+	for md := range slices.Values([]*store.ObjectMetadata{
+		{Namespace: "docs", Key: "a", ObjectID: "1", Size: 10},
+		{Namespace: "docs", Key: "b", ObjectID: "2", Size: 20},
+	}) {
+		require.NoError(t, ms.Create(ctx, md))
+		require.NoError(t, ms.PutObjectCompleted(ctx, md.Namespace, md.Key, md.ObjectID))
+	}
+
+	require.ErrorIs(t, ms.Move(ctx, "docs", "missing", "c", store.Attribution{}), memdb.ErrNotFound)
+	require.ErrorIs(t, ms.Move(ctx, "other", "a", "c", store.Attribution{}), memdb.ErrNotFound)
+
+	require.NoError(t, ms.Move(ctx, "docs", "a", "c", store.Attribution{}))
+	md, err := ms.Get(ctx, "docs", "c")
+	require.NoError(t, err)
+	assert.Equal(t, "1", md.ObjectID)
+	assert.Equal(t, "c", md.Key)
+	_, err = ms.Get(ctx, "docs", "a")
+	require.ErrorIs(t, err, memdb.ErrNotFound)
+	assert.Empty(t, emitted)
+
+	// moving over an existing key releases its object
+	require.NoError(t, ms.Move(ctx, "docs", "c", "b", store.Attribution{}))
+	assert.Equal(t, []string{"2"}, emitted)
+	usage, err := ms.Usage(ctx, "docs")
+	require.NoError(t, err)
+	assert.Equal(t, store.Usage{Bytes: 10, Objects: 1}, usage)
+	referenced, err := ms.ObjectReferenced(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, referenced)
+}
+
+func TestPublishedEvents(t *testing.T) {
+	ctx := context.Background()
+	bus := events.New(logrus.New())
+	sub := bus.Subscribe("test")
+	defer sub.Close()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			return nil
+		},
+	}, memdb.WithPublisher(bus))
+
+	// inflight uploads and failed ones aren't published
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "1"}))
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "2"}))
+	require.NoError(t, ms.PutObjectFailed(ctx, store.DefaultNamespace, "a", "2"))
+	require.NoError(t, ms.PutObjectCompleted(ctx, store.DefaultNamespace, "a", "1"))
+	require.NoError(t, ms.LinkObject(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "1", Size: 5}))
+	require.NoError(t, ms.Move(ctx, store.DefaultNamespace, "a", "b", store.Attribution{}))
+	require.NoError(t, ms.Delete(ctx, store.DefaultNamespace, "b", nil, store.Attribution{}))
+
+	type published struct {
+		seq      uint64
+		typ      events.Type
+		key      string
+		previous string
+		fromKey  string
+	}
+	var got []published
+	for range 4 {
+		ev := <-sub.Events()
+		p := published{seq: ev.Seq, typ: ev.Type, key: ev.Key, fromKey: ev.FromKey}
+		assert.Equal(t, store.DefaultNamespace, ev.Namespace)
+		assert.Equal(t, "1", ev.Object.ObjectID)
+		if ev.Previous != nil {
+			p.previous = ev.Previous.Key
+		}
+		got = append(got, p)
+	}
+	assert.Equal(t, []published{
+		{seq: 1, typ: events.Created, key: "a"},
+		{seq: 2, typ: events.Replaced, key: "a", previous: "a"},
+		{seq: 3, typ: events.Moved, key: "b", fromKey: "a"},
+		{seq: 4, typ: events.Deleted, key: "b"},
+	}, got)
+}
+
+func TestChanges(t *testing.T) {
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			return nil
+		},
+	}, memdb.WithChangeLogSize(3))
+
+	_, start, err := ms.SnapshotWithCursor(ctx, "docs")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), start.Seq)
+	changes, cursor, err := ms.Changes(ctx, "docs", start, 0)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+	assert.Equal(t, start, cursor)
+
+	for md := range slices.Values([]*store.ObjectMetadata{
+		{Namespace: "docs", Key: "a", ObjectID: "1"},
+		{Namespace: "docs", Key: "b", ObjectID: "2"},
+		{Key: "c", ObjectID: "3"},
+	}) {
+		require.NoError(t, ms.Create(ctx, md))
+		require.NoError(t, ms.PutObjectCompleted(ctx, md.Namespace, md.Key, md.ObjectID))
+	}
+	require.NoError(t, ms.Move(ctx, "docs", "a", "c", store.Attribution{}))
+
+	type change struct {
+		seq      uint64
+		op       store.ChangeOp
+		key      string
+		objectID string
+	}
+	summarize := func(changes []store.Change) []change {
+		var result []change
+		for c := range slices.Values(changes) {
+			s := change{seq: c.Seq, op: c.Op, key: c.Key}
+			if c.Object != nil {
+				s.objectID = c.Object.ObjectID
+			}
+			result = append(result, s)
+		}
+		return result
+	}
+
+	// seqs are per namespace
+	changes, cursor, err = ms.Changes(ctx, "docs", start, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []change{
+		{seq: 1, op: store.ChangePut, key: "a", objectID: "1"},
+		{seq: 2, op: store.ChangePut, key: "b", objectID: "2"},
+	}, summarize(changes))
+	assert.Equal(t, uint64(2), cursor.Seq)
+	changes, cursor, err = ms.Changes(ctx, "docs", cursor, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []change{
+		{seq: 3, op: store.ChangeDelete, key: "a"},
+		{seq: 4, op: store.ChangePut, key: "c", objectID: "1"},
+	}, summarize(changes))
+	changes, _, err = ms.Changes(ctx, store.DefaultNamespace, start, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []change{{seq: 1, op: store.ChangePut, key: "c", objectID: "3"}}, summarize(changes))
+
+	// a snapshot's cursor follows the changes made after it
+	snapshot, snapshotCursor, err := ms.SnapshotWithCursor(ctx, "docs")
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 2)
+	assert.Equal(t, cursor, snapshotCursor)
+	require.NoError(t, ms.Delete(ctx, "docs", "b", nil, store.Attribution{}))
+	changes, _, err = ms.Changes(ctx, "docs", snapshotCursor, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []change{{seq: 5, op: store.ChangeDelete, key: "b"}}, summarize(changes))
+
+	// the log is compacted to the latest changes once it's twice as long as it must be
+	require.NoError(t, ms.Delete(ctx, "docs", "c", nil, store.Attribution{}))
+	_, _, err = ms.Changes(ctx, "docs", start, 0)
+	require.ErrorIs(t, err, store.ErrCursorExpired)
+	changes, _, err = ms.Changes(ctx, "docs", store.Cursor{Epoch: start.Epoch, Seq: 3}, 0)
+	require.NoError(t, err)
+	assert.Len(t, changes, 3)
+
+	// cursors of another epoch, e.g. from before a restart, have expired
+	_, _, err = ms.Changes(ctx, "docs", store.Cursor{Epoch: "other", Seq: 3}, 0)
+	require.ErrorIs(t, err, store.ErrCursorExpired)
+	_, _, err = ms.Changes(ctx, "docs", store.Cursor{Epoch: start.Epoch, Seq: 42}, 0)
+	require.ErrorIs(t, err, store.ErrCursorExpired)
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			return nil
+		},
+	})
+
+	laptop := store.Attribution{AccessKeyID: "aki", DeviceID: "laptop-1", Hostname: "laptop", User: "alice"}
+	desktop := store.Attribution{AccessKeyID: "aki", DeviceID: "desktop-1", Hostname: "desktop", User: "bob"}
+	for md := range slices.Values([]*store.ObjectMetadata{
+		{Namespace: "docs", Key: "a", ObjectID: "1", Attribution: store.Attribution{DeviceID: "laptop-1", Operation: store.OpUpload}},
+		{Namespace: "docs", Key: "b", ObjectID: "2", Attribution: store.Attribution{DeviceID: "desktop-1", Operation: store.OpUpload}},
+	}) {
+		md.Attribution.AccessKeyID = "aki"
+		require.NoError(t, ms.Create(ctx, md))
+		require.NoError(t, ms.PutObjectCompleted(ctx, md.Namespace, md.Key, md.ObjectID))
+	}
+	require.NoError(t, ms.Move(ctx, "docs", "a", "c", desktop))
+	require.NoError(t, ms.Delete(ctx, "docs", "c", nil, laptop))
+
+	moved := desktop
+	moved.Operation = store.OpMove
+	deleted := laptop
+	deleted.Operation = store.OpDelete
+
+	history, err := ms.History(ctx, "docs", "c")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, store.ChangeDelete, history[0].Op)
+	assert.Equal(t, deleted, history[0].Attribution)
+	assert.Equal(t, store.ChangePut, history[1].Op)
+	assert.Equal(t, moved, history[1].Attribution)
+	assert.Equal(t, moved, history[1].Object.Attribution)
+	assert.Equal(t, "1", history[1].Object.ObjectID)
+	assert.False(t, history[1].Time.IsZero())
+
+	history, err = ms.History(ctx, "docs", "a")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, moved, history[0].Attribution)
+	assert.Equal(t, store.Attribution{AccessKeyID: "aki", DeviceID: "laptop-1", Operation: store.OpUpload}, history[1].Attribution)
+
+	// the current version is attributed to who put it
+	b, err := ms.Get(ctx, "docs", "b")
+	require.NoError(t, err)
+	assert.Equal(t, store.Attribution{AccessKeyID: "aki", DeviceID: "desktop-1", Operation: store.OpUpload}, b.Attribution)
+
+	history, err = ms.History(ctx, "other", "a")
+	require.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func TestSetAttributes(t *testing.T) {
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(ctx context.Context, obj *store.ObjectMetadata) error {
+			return nil
+		},
+	})
+
+	_, err := ms.SetAttributes(ctx, "docs", "a", &fileattr.Attributes{}, nil, store.Attribution{})
+	require.ErrorIs(t, err, memdb.ErrNotFound)
+
+	md := &store.ObjectMetadata{Namespace: "docs", Key: "a", ObjectID: "1", Size: 5, Attributes: &fileattr.Attributes{Mode: 0o644}}
+	require.NoError(t, ms.Create(ctx, md))
+	require.NoError(t, ms.PutObjectCompleted(ctx, "docs", "a", "1"))
+	uploaded, err := ms.Get(ctx, "docs", "a")
+	require.NoError(t, err)
+	assert.Equal(t, &fileattr.Attributes{Mode: 0o644}, uploaded.Attributes)
+
+	attrs := &fileattr.Attributes{Mode: 0o755, MTime: 1717243200123456789}
+	stale := uploaded.Version + 1
+	_, err = ms.SetAttributes(ctx, "docs", "a", attrs, &stale, store.Attribution{})
+	require.ErrorIs(t, err, store.ErrPreconditionFailed)
+	version, err := ms.SetAttributes(ctx, "docs", "a", attrs, &uploaded.Version, store.Attribution{DeviceID: "laptop-1"})
+	require.NoError(t, err)
+	assert.Greater(t, version, uploaded.Version)
+
+	// a new version of the same content
+	updated, err := ms.Get(ctx, "docs", "a")
+	require.NoError(t, err)
+	assert.Equal(t, version, updated.Version)
+	assert.Equal(t, attrs, updated.Attributes)
+	assert.Equal(t, int64(1717243200), updated.MTime)
+	assert.Equal(t, "1", updated.ObjectID)
+	assert.Equal(t, store.Attribution{DeviceID: "laptop-1", Operation: store.OpSetAttributes}, updated.Attribution)
+	usage, err := ms.Usage(ctx, "docs")
+	require.NoError(t, err)
+	assert.Equal(t, store.Usage{Bytes: 5, Objects: 1}, usage)
+
+	history, err := ms.History(ctx, "docs", "a")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, attrs, history[0].Object.Attributes)
+	assert.Equal(t, &fileattr.Attributes{Mode: 0o644}, history[1].Object.Attributes)
+}
+
+func TestList(t *testing.T) {
+	tests := map[string]struct {
+		opts store.ListOptions
+
+		// expectedPages are the keys and common prefixes of every page, in order
+		expectedPages [][]string
+	}{
+		"all": {
+			expectedPages: [][]string{{"a.txt", "docs/a.txt", "docs/b/c.txt", "docs/b/d.txt", "docs/e.txt", "z.txt"}},
+		},
+		"delimiter": {
+			opts:          store.ListOptions{Delimiter: "/"},
+			expectedPages: [][]string{{"a.txt", "docs/", "z.txt"}},
+		},
+		"prefix and delimiter": {
+			opts:          store.ListOptions{Prefix: "docs/", Delimiter: "/"},
+			expectedPages: [][]string{{"docs/a.txt", "docs/b/", "docs/e.txt"}},
+		},
+		"pages": {
+			opts: store.ListOptions{Limit: 4},
+			expectedPages: [][]string{
+				{"a.txt", "docs/a.txt", "docs/b/c.txt", "docs/b/d.txt"},
+				{"docs/e.txt", "z.txt"},
+			},
+		},
+		"pages with common prefixes": {
+			opts: store.ListOptions{Prefix: "docs/", Delimiter: "/", Limit: 1},
+			expectedPages: [][]string{
+				{"docs/a.txt"},
+				{"docs/b/"},
+				{"docs/e.txt"},
+			},
+		},
+		"no match": {
+			opts:          store.ListOptions{Prefix: "missing/"},
+			expectedPages: [][]string{nil},
+		},
+	}
+
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(context.Context, *store.ObjectMetadata) error { return nil },
+	})
+	for key := range slices.Values([]string{"z.txt", "docs/b/d.txt", "a.txt", "docs/e.txt", "docs/b/c.txt", "docs/a.txt", "gone.txt"}) {
+		require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: key, ObjectID: "id-" + key}))
+		require.NoError(t, ms.PutObjectCompleted(ctx, "", key, "id-"+key))
+	}
+	require.NoError(t, ms.Delete(ctx, "", "gone.txt", nil, store.Attribution{}))
+	// inflight uploads aren't listed
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "inflight.txt", ObjectID: "id-inflight"}))
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var pages [][]string
+			opts := tc.opts
+			for {
+				page, err := ms.List(ctx, "", opts)
+				require.NoError(t, err)
+				var entries []string
+				for md := range slices.Values(page.Objects) {
+					entries = append(entries, md.Key)
+				}
+				entries = append(entries, page.CommonPrefixes...)
+				slices.Sort(entries)
+				pages = append(pages, entries)
+				if page.Next == "" {
+					break
+				}
+				opts.After = page.Next
+			}
+			assert.Equal(t, tc.expectedPages, pages)
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(context.Context, *store.ObjectMetadata) error { return nil },
+	})
+	version := func(key string) uint64 {
+		md, err := ms.Get(ctx, "", key)
+		require.NoError(t, err)
+		return md.Version
+	}
+
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "1"}))
+	require.NoError(t, ms.PutObjectCompleted(ctx, "", "a", "1"))
+	v1 := version("a")
+	assert.NotZero(t, v1)
+
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "2"}))
+	require.NoError(t, ms.PutObjectCompleted(ctx, "", "a", "2"))
+	v2 := version("a")
+	assert.Greater(t, v2, v1)
+
+	require.NoError(t, ms.Move(ctx, "", "a", "b", store.Attribution{}))
+	assert.Greater(t, version("b"), v2)
+	page, err := ms.List(ctx, "", store.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, page.Objects, 1)
+	assert.Equal(t, "b", page.Objects[0].Key)
+}
+
+func TestIfMatch(t *testing.T) {
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(context.Context, *store.ObjectMetadata) error { return nil },
+	})
+	version := func(key string) uint64 {
+		md, err := ms.Get(ctx, "", key)
+		require.NoError(t, err)
+		assert.Nil(t, md.IfMatch)
+		return md.Version
+	}
+	ptr := func(v uint64) *uint64 { return &v }
+
+	// a key that must not exist yet
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "1", IfMatch: ptr(0)}))
+	require.NoError(t, ms.PutObjectCompleted(ctx, "", "a", "1"))
+	v1 := version("a")
+	err := ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "2", IfMatch: ptr(0)})
+	assert.ErrorIs(t, err, store.ErrPreconditionFailed)
+
+	// of two uploads based on the same version, the one completing last fails
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "3", IfMatch: ptr(v1)}))
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "a", ObjectID: "4", IfMatch: ptr(v1)}))
+	require.NoError(t, ms.PutObjectCompleted(ctx, "", "a", "3"))
+	err = ms.PutObjectCompleted(ctx, "", "a", "4")
+	assert.ErrorIs(t, err, store.ErrPreconditionFailed)
+	require.NoError(t, ms.PutObjectFailed(ctx, "", "a", "4"))
+	v2 := version("a")
+
+	err = ms.LinkObject(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "3", IfMatch: ptr(v1)})
+	assert.ErrorIs(t, err, store.ErrPreconditionFailed)
+	require.NoError(t, ms.LinkObject(ctx, &store.ObjectMetadata{Key: "b", ObjectID: "3", IfMatch: ptr(0)}))
+	version("b")
+
+	err = ms.Delete(ctx, "", "a", ptr(v1), store.Attribution{})
+	assert.ErrorIs(t, err, store.ErrPreconditionFailed)
+	assert.Equal(t, v2, version("a"))
+	require.NoError(t, ms.Delete(ctx, "", "a", ptr(v2), store.Attribution{}))
+	_, err = ms.Get(ctx, "", "a")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	err = ms.Delete(ctx, "", "a", ptr(v2), store.Attribution{})
+	assert.ErrorIs(t, err, store.ErrPreconditionFailed)
+	require.NoError(t, ms.Delete(ctx, "", "a", ptr(0), store.Attribution{}))
+	require.NoError(t, ms.Delete(ctx, "missing", "a", ptr(0), store.Attribution{}))
+}
+
+func TestSnapshotSeq(t *testing.T) {
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(context.Context, *store.ObjectMetadata) error { return nil },
+	})
+	put := func(key, objectID string) {
+		require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: key, ObjectID: objectID}))
+		require.NoError(t, ms.PutObjectCompleted(ctx, "", key, objectID))
+	}
+	put("b", "1")
+	put("a", "2")
+	put("c", "3")
+
+	seq, cursor, err := ms.SnapshotSeq(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), cursor.Seq)
+
+	// changes made after the snapshot was taken don't affect it
+	put("b", "4")
+	put("d", "5")
+	require.NoError(t, ms.Delete(ctx, "", "a", nil, store.Attribution{}))
+	require.NoError(t, ms.Move(ctx, "", "c", "e", store.Attribution{}))
+
+	var objects []string
+	for md := range seq {
+		objects = append(objects, md.Key+"="+md.ObjectID)
+	}
+	assert.Equal(t, []string{"a=2", "b=1", "c=3"}, objects)
+
+	changes, _, err := ms.Changes(ctx, "", cursor, 0)
+	require.NoError(t, err)
+	assert.Len(t, changes, 5)
+
+	seq, _, err = ms.SnapshotSeq(ctx, "")
+	require.NoError(t, err)
+	objects = nil
+	for md := range seq {
+		objects = append(objects, md.Key+"="+md.ObjectID)
+	}
+	assert.Equal(t, []string{"b=4", "d=5", "e=3"}, objects)
+
+	// snapshots taken concurrently, with changes made meantime, are consistent too
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				seq, _, err := ms.SnapshotSeq(ctx, "")
+				assert.NoError(t, err)
+				var keys []string
+				for md := range seq {
+					keys = append(keys, md.Key)
+				}
+				assert.True(t, slices.IsSorted(keys))
+			}
+		}()
+	}
+	for i := range 50 {
+		put(fmt.Sprintf("k%02d", i), fmt.Sprintf("%d", 10+i))
+	}
+	wg.Wait()
+}
+
+func TestTreeNodes(t *testing.T) {
+	ctx := context.Background()
+	ms := memdb.NewMetadataStore(&mocks.EmitterMock{
+		EmitFunc: func(context.Context, *store.ObjectMetadata) error { return nil },
+	})
+	put := func(md *store.ObjectMetadata) {
+		require.NoError(t, ms.Create(ctx, md))
+		require.NoError(t, ms.PutObjectCompleted(ctx, "", md.Key, md.ObjectID))
+	}
+	put(&store.ObjectMetadata{Key: "docs/a.txt", ObjectID: "1", SHA256Checksum: "sha-1"})
+	put(&store.ObjectMetadata{Key: "docs/b/c.txt", ObjectID: "2", SHA256Checksum: "sha-2"})
+	// end-to-end encrypted, so identified by its MAC
+	put(&store.ObjectMetadata{Key: "z.txt", ObjectID: "3", SHA256Checksum: "sha-3", ContentMAC: "mac-3"})
+	// a symlink differs from a regular file with its target as content
+	put(&store.ObjectMetadata{Key: "docs/link", ObjectID: "6", SHA256Checksum: "sha-1", Type: store.TypeSymlink})
+	// and a directory from an empty file
+	put(&store.ObjectMetadata{Key: "docs/logs", ObjectID: "7", SHA256Checksum: "sha-0", Type: store.TypeDir})
+	put(&store.ObjectMetadata{Key: "gone.txt", ObjectID: "4", SHA256Checksum: "sha-4"})
+	require.NoError(t, ms.Delete(ctx, "", "gone.txt", nil, store.Attribution{}))
+	require.NoError(t, ms.Move(ctx, "", "docs/b/c.txt", "docs/c.txt", store.Attribution{}))
+	// inflight uploads aren't in the tree
+	require.NoError(t, ms.Create(ctx, &store.ObjectMetadata{Key: "inflight.txt", ObjectID: "5", SHA256Checksum: "sha-5"}))
+
+	expected := hashtree.New()
+	expected.Put("docs/a.txt", "sha-1")
+	expected.Put("docs/c.txt", "sha-2")
+	expected.Put("z.txt", "mac-3")
+	expected.Put("docs/link", hashtree.LinkContentID("sha-1", ""))
+	expected.Put("docs/logs", hashtree.DirContentID("sha-0", ""))
+
+	prefixes := []string{"", "docs/", "docs/b/"}
+	nodes, cursor, err := ms.TreeNodes(ctx, "", prefixes)
+	require.NoError(t, err)
+	assert.Equal(t, expected.Nodes(prefixes), nodes)
+	assert.Equal(t, uint64(9), cursor.Seq)
+
+	nodes, _, err = ms.TreeNodes(ctx, "missing", []string{""})
+	require.NoError(t, err)
+	assert.Equal(t, hashtree.New().Nodes([]string{""}), nodes)
+}
@@ -1,8 +1,33 @@
 package store
 
-import "time"
+import (
+	"errors"
+	"time"
+
+	"github.com/hedisam/filesync/lib/fileattr"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrCursorExpired is returned for a cursor older than the oldest change kept, or from another epoch. The caller
+	// has to take a new snapshot.
+	ErrCursorExpired = errors.New("cursor expired")
+	// ErrPreconditionFailed is returned for a write conditioned on a version of the object under a key it doesn't
+	// have anymore, or never had.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrObjectDeleting is returned for a new reference to an object that is being deleted, whose content must be
+	// stored again under another object ID.
+	ErrObjectDeleting = errors.New("object is being deleted")
+	// ErrObjectStored is returned for a new upload of an object that is stored already, which must be referenced
+	// rather than stored over.
+	ErrObjectStored = errors.New("object is already stored")
+)
+
+// DefaultNamespace is the namespace used for objects whose requests do not name one explicitly.
+const DefaultNamespace = "default"
 
 type ObjectMetadata struct {
+	Namespace      string
 	Key            string
 	ObjectID       string
 	SHA256Checksum string
@@ -10,4 +35,127 @@ type ObjectMetadata struct {
 	MTime          int64
 	CreatedAt      time.Time
 	CompletedAt    *time.Time
+	// ExpiresAt is when the presigned url of an upload expires. Inflight uploads are abandoned some time after.
+	ExpiresAt time.Time
+	// ContentMAC is the MAC of the plaintext content of end-to-end encrypted objects, as computed by clients.
+	ContentMAC string
+	// ContentEncoding is the encoding the object is compressed with at rest, if any.
+	ContentEncoding string
+	// EncryptionKeyID is the ID of the master key the object's data key is wrapped with, if it's encrypted at rest.
+	EncryptionKeyID string
+	// VerifiedAt is when the stored object was last re-hashed and found to match SHA256Checksum, if ever.
+	VerifiedAt *time.Time
+	// Attributes are the attributes of the file as reported by the client that uploaded it, if it reported any.
+	Attributes *fileattr.Attributes
+	// Version is the Seq of the change that put the completed object under its key. It's bumped whenever the key is
+	// given another object, the object is moved to it, or its attributes are changed.
+	Version uint64
+	// IfMatch, if set, is the Version the object under Key must have for an upload, or a link, to complete, 0 if there
+	// must be none. It's only kept for inflight uploads.
+	IfMatch *uint64
+	// Attribution tells who put this version of the object under Key, and how.
+	Attribution Attribution
+	// Type is the type of the filesystem entry the object stands for.
+	Type ObjectType
+}
+
+// ObjectType is the type of filesystem entry an object stands for. Objects with no type are regular files.
+type ObjectType string
+
+const (
+	// TypeSymlink is for symlinks, whose content is their target.
+	TypeSymlink ObjectType = "symlink"
+	// TypeDir is for directories, which have no content. They're objects of their own so empty ones are synced too.
+	TypeDir ObjectType = "dir"
+)
+
+// Operation is the kind of request that changed the object under a key.
+type Operation string
+
+const (
+	OpUpload Operation = "upload"
+	// OpLink is an upload short-circuited by referencing content stored already.
+	OpLink   Operation = "link"
+	OpMove   Operation = "move"
+	OpDelete Operation = "delete"
+	// OpSetAttributes changes the attributes of the object under a key, keeping its content.
+	OpSetAttributes Operation = "set_attributes"
+)
+
+// Attribution tells who changed the object under a key, from where, and how.
+type Attribution struct {
+	// AccessKeyID is the access key the change was authorized with, if it was.
+	AccessKeyID string
+	// DeviceID, Hostname and User are reported by the client that made the change, so they're only as trustworthy as
+	// the client.
+	DeviceID  string
+	Hostname  string
+	User      string
+	Operation Operation
+}
+
+// Usage holds the storage consumed by the completed objects of a namespace.
+type Usage struct {
+	Bytes   int64
+	Objects int64
+}
+
+// NamespaceOrDefault returns the given namespace, or DefaultNamespace if it's empty.
+func NamespaceOrDefault(namespace string) string {
+	if namespace == "" {
+		return DefaultNamespace
+	}
+	return namespace
+}
+
+// ChangeOp is the kind of change made to the completed objects of a namespace.
+type ChangeOp string
+
+const (
+	ChangePut    ChangeOp = "put"
+	ChangeDelete ChangeOp = "delete"
+)
+
+// Change is a change of the completed object under a key. Moving an object is a delete of its old key followed by a
+// put of its new one.
+type Change struct {
+	// Seq is the position of the change in the namespace's change log, starting at 1.
+	Seq uint64
+	Op  ChangeOp
+	Key string
+	// Object is the metadata stored under Key by a put.
+	Object *ObjectMetadata
+	// Time is when the change was made.
+	Time time.Time
+	// Attribution tells who made the change; it's the one of Object for puts.
+	Attribution Attribution
+}
+
+// Cursor is a position in the change log of a namespace: the changes with a greater Seq are yet to be seen. Seqs are
+// only comparable within the same epoch, which changes whenever change logs are lost, e.g. when an in memory store
+// restarts.
+type Cursor struct {
+	Epoch string
+	Seq   uint64
+}
+
+// ListOptions selects the completed objects of a namespace to list.
+type ListOptions struct {
+	// Prefix lists the keys starting with it only.
+	Prefix string
+	// Delimiter, if set, rolls the keys containing it after Prefix up into a common prefix, up to and including its
+	// first occurrence, like the files of a directory.
+	Delimiter string
+	// After lists the keys, and common prefixes, sorting after it only.
+	After string
+	// Limit is the number of objects and common prefixes listed at most. Zero means no limit.
+	Limit int
+}
+
+// ListPage is a page of the completed objects of a namespace, and of the common prefixes of the others, in order.
+type ListPage struct {
+	Objects        []ObjectMetadata
+	CommonPrefixes []string
+	// Next is what to list the next page after, if there's any.
+	Next string
 }
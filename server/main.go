@@ -2,25 +2,38 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
+	"github.com/hedisam/filesync/lib/compression"
 	asyncapi "github.com/hedisam/filesync/server/api/async"
 	restapi "github.com/hedisam/filesync/server/api/rest"
 	"github.com/hedisam/filesync/server/internal/auth"
+	"github.com/hedisam/filesync/server/internal/blobstorage"
+	"github.com/hedisam/filesync/server/internal/blobstorage/encrypted"
 	"github.com/hedisam/filesync/server/internal/blobstorage/filesystem"
-	"github.com/hedisam/filesync/server/internal/emitter"
+	_ "github.com/hedisam/filesync/server/internal/blobstorage/s3"
+	"github.com/hedisam/filesync/server/internal/devices"
+	"github.com/hedisam/filesync/server/internal/events"
+	"github.com/hedisam/filesync/server/internal/gc"
 	"github.com/hedisam/filesync/server/internal/interceptors"
+	"github.com/hedisam/filesync/server/internal/outbox"
+	"github.com/hedisam/filesync/server/internal/quota"
+	"github.com/hedisam/filesync/server/internal/scrub"
 	"github.com/hedisam/filesync/server/internal/store/memdb"
 )
 
@@ -30,9 +43,26 @@ const (
 
 // Options defines a set of config options.
 type Options struct {
-	DestinationDir string
-	ServerAddr     string
-	Verbose        bool
+	DestinationDir   string
+	ServerAddr       string
+	QuotaConfig      string
+	ContentAddressed bool
+	StorageBackend   string
+	StorageConfig    string
+	StorageLayout    string
+	EncryptionKey    string
+	UnencryptedReads bool
+	Compression      string
+	ScrubInterval    time.Duration
+	ScrubRateLimit   int64
+	GCInterval       time.Duration
+	GCGracePeriod    time.Duration
+	GCOrphans        bool
+	StateDir         string
+	DeletionAttempts int
+	AdminToken       string
+	DeviceStaleAfter time.Duration
+	Verbose          bool
 }
 
 func main() {
@@ -40,12 +70,29 @@ func main() {
 	logger.AddHook(&interceptors.TraceHook{})
 
 	var opts Options
-	flag.StringVar(&opts.DestinationDir, "dest-dir", "", "Destination directory to store file objects (required)")
+	flag.StringVar(&opts.DestinationDir, "dest-dir", "", "Destination directory to store file objects (required by the filesystem backend unless -storage-config is set)")
 	flag.StringVar(&opts.ServerAddr, "server-addr", "localhost:8080", "FileServer address to listen on")
+	flag.StringVar(&opts.QuotaConfig, "quota-config", "", "Path to a JSON file defining storage quotas per namespace (optional)")
+	flag.BoolVar(&opts.ContentAddressed, "content-addressed", false, "Store objects by their sha256 checksum so identical content is stored once")
+	flag.StringVar(&opts.StorageBackend, "storage-backend", "filesystem", fmt.Sprintf("Backend to store file objects in, one of %v", blobstorage.Backends()))
+	flag.StringVar(&opts.StorageConfig, "storage-config", "", "Path to a JSON file with the config of the storage backend (required by the s3 backend)")
+	flag.StringVar(&opts.StorageLayout, "storage-layout", string(filesystem.LayoutFlat), "Layout of the objects in the destination directory: flat or fanout")
+	flag.StringVar(&opts.EncryptionKey, "encryption-key-file", "", "Path to a JSON key file with the master keys to encrypt objects at rest with; objects are stored in plaintext if empty")
+	flag.BoolVar(&opts.UnencryptedReads, "encryption-allow-unencrypted", false, "Serve objects stored before encryption at rest was enabled as they are, while migrating to it; they're refused otherwise, as they aren't authenticated")
+	flag.StringVar(&opts.Compression, "compression-policy", "", "Path to a JSON file defining which objects to compress at rest, by extension or by measured ratio (optional)")
+	flag.DurationVar(&opts.ScrubInterval, "scrub-interval", scrub.DefaultInterval, "How often to re-verify the stored objects against their checksums; zero disables the background scrubber")
+	flag.Int64Var(&opts.ScrubRateLimit, "scrub-rate-limit", scrub.DefaultRateLimit, "Bytes per second objects are read at while verifying them; zero means unlimited")
+	flag.DurationVar(&opts.GCInterval, "gc-interval", gc.DefaultInterval, "How often to expire abandoned uploads and reclaim orphan objects; zero disables the garbage collector")
+	flag.DurationVar(&opts.GCGracePeriod, "gc-grace-period", gc.DefaultGracePeriod, "How long uploads are kept after their presigned url expired, and orphan objects after they were first found")
+	flag.BoolVar(&opts.GCOrphans, "gc-orphans", false, "Reclaim stored objects no metadata references; as metadata isn't persisted yet, that includes every object stored before a restart")
+	flag.StringVar(&opts.StateDir, "state-dir", "filesync-state", "Directory to keep the server's durable state in, such as the queue of objects to delete")
+	flag.IntVar(&opts.DeletionAttempts, "deletion-max-attempts", outbox.DefaultMaxAttempts, "Failed attempts after which an object to delete is parked as a dead letter until requeued by an operator")
+	flag.StringVar(&opts.AdminToken, "admin-token", "", "Bearer token required by the admin endpoints; they're disabled if empty")
+	flag.DurationVar(&opts.DeviceStaleAfter, "device-stale-after", devices.DefaultStaleAfter, "How long a device can go unseen before it's reported as stale; zero reports devices as stale by their expired cursors only")
 	flag.BoolVar(&opts.Verbose, "v", false, "Verbose output")
 	flag.Parse()
 
-	if opts.DestinationDir == "" {
+	if opts.StorageConfig == "" && (opts.StorageBackend != "filesystem" || opts.DestinationDir == "") {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -59,25 +106,119 @@ func main() {
 	authService := auth.New()
 	generateAndPrintAccessKey(authService)
 
-	e := emitter.New()
-	defer e.Close()
+	deletions := mustOpenDeletionQueue(logger, &opts)
+	defer deletions.Close()
 
-	mdStore := memdb.NewMetadataStore(e)
+	bus := events.New(logger)
+	prometheus.MustRegister(bus)
+	go events.LogEvents(ctx, logger, bus.Subscribe("audit-log", events.WithPolicy(events.DropOldest)))
+
+	mdStore := memdb.NewMetadataStore(deletions, memdb.WithPublisher(bus))
 	fileServer := restapi.NewFilesServer(logger, mdStore)
 
-	fileStorage, err := filesystem.New(logger, opts.DestinationDir)
-	if err != nil {
-		logger.WithError(err).Fatal("Failed to initialize filesystem")
+	backend := mustOpenStorageBackend(ctx, logger, &opts)
+	fileStorage := backend
+	quotaManager := quota.New(mustLoadQuotaConfig(logger, opts.QuotaConfig), mdStore)
+	prometheus.MustRegister(quotaManager)
+	quotaServer := restapi.NewQuotaServer(logger, quotaManager)
+
+	uploadOpts := []restapi.UploadServerOption{restapi.WithQuota(quotaManager)}
+	if opts.ContentAddressed {
+		uploadOpts = append(uploadOpts, restapi.WithContentAddressing())
+	}
+	if opts.Compression != "" {
+		policy, err := compression.LoadPolicy(opts.Compression)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load compression policy")
+		}
+		if opts.ContentAddressed && len(policy.Extensions) > 0 {
+			logger.Warn("Compression policy extensions are ignored as objects are content-addressed; only the measured ratio is")
+		}
+		uploadOpts = append(uploadOpts, restapi.WithCompressionPolicy(policy))
 	}
-	uploadServer := restapi.NewUploadServer(logger, fileStorage, mdStore, authService)
+	if opts.EncryptionKey != "" {
+		keyring, err := encrypted.LoadKeyring(opts.EncryptionKey)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load encryption keys")
+		}
+		var encryptionOpts []encrypted.Option
+		if opts.UnencryptedReads {
+			encryptionOpts = append(encryptionOpts, encrypted.WithUnencryptedReads())
+			logger.Warn("Serving unencrypted objects as they are; they aren't authenticated")
+		}
+		fileStorage = encrypted.New(logger, backend, keyring, encryptionOpts...)
+		uploadOpts = append(uploadOpts, restapi.WithEncryptionKeyID(keyring.ActiveKeyID()))
+		logger.WithField("key_id", keyring.ActiveKeyID()).Info("Encrypting objects at rest")
+	}
+	uploadServer := restapi.NewUploadServer(logger, fileStorage, mdStore, authService, uploadOpts...)
+	downloadServer := restapi.NewDownloadServer(logger, fileStorage, mdStore, authService)
 
-	janitor := asyncapi.NewJanitor(logger, fileStorage)
-	go janitor.Run(ctx, e.Chan())
+	janitor := asyncapi.NewJanitor(logger, fileStorage, mdStore)
+	go janitor.Run(ctx, deletions)
+
+	gcOpts := []gc.Option{gc.WithInterval(opts.GCInterval), gc.WithGracePeriod(opts.GCGracePeriod)}
+	if lister, ok := backend.(gc.ObjectLister); ok && opts.GCOrphans {
+		gcOpts = append(gcOpts, gc.WithOrphans(lister))
+	}
+	if opts.GCInterval > 0 {
+		go gc.New(logger, mdStore, deletions, gcOpts...).Run(ctx)
+	}
+
+	scrubOpts := []scrub.Option{scrub.WithInterval(opts.ScrubInterval), scrub.WithRateLimit(opts.ScrubRateLimit)}
+	// objects are listed by their IDs, which are the same whether they're encrypted or not
+	if lister, ok := backend.(scrub.ObjectLister); ok {
+		scrubOpts = append(scrubOpts, scrub.WithLister(lister))
+	}
+	scrubber := scrub.New(logger, fileStorage, mdStore, scrubOpts...)
+	prometheus.MustRegister(scrubber)
+	if opts.ScrubInterval > 0 {
+		go scrubber.Run(ctx)
+	}
+
+	deviceRegistry := devices.New(mdStore, devices.WithStaleAfter(opts.DeviceStaleAfter))
+	prometheus.MustRegister(deviceRegistry)
+	deviceServer := restapi.NewDeviceServer(logger, deviceRegistry)
 
 	mux := http.NewServeMux()
-	restapi.RegisterFunc(logger, mux, http.MethodDelete, "/v1/files/{key}", fileServer.DeleteFile)
+	// changes are attributed to the access keys the requests making them are signed with
+	changesMux := restapi.WithAccessKeys(mux, authService)
+	restapi.RegisterFunc(logger, mux, http.MethodGet, "/v1/files", fileServer.ListFiles)
+	restapi.RegisterFunc(logger, changesMux, http.MethodDelete, "/v1/files/{key}", fileServer.DeleteFile)
+	restapi.RegisterFunc(logger, changesMux, http.MethodPost, "/v1/files/{key}/move", fileServer.MoveFile)
+	restapi.RegisterFunc(logger, mux, http.MethodGet, "/v1/files/{key}/history", fileServer.FileHistory)
+	restapi.RegisterFunc(logger, changesMux, http.MethodPut, "/v1/files/{key}/attributes", fileServer.SetFileAttributes)
 	restapi.RegisterFunc(logger, mux, http.MethodGet, "/v1/snapshot", fileServer.Snapshot)
+	restapi.RegisterFunc(logger, mux, http.MethodPost, "/v1/tree", fileServer.TreeNodes)
+	mux.HandleFunc("GET /v1/snapshot/stream", fileServer.StreamSnapshot)
+	restapi.RegisterFunc(logger, mux, http.MethodGet, "/v1/changes", fileServer.Changes)
+	watchServer := restapi.NewWatchServer(logger, mdStore, bus)
+	mux.HandleFunc("GET /v1/changes/watch", watchServer.WatchChanges)
+	restapi.RegisterFunc(logger, mux, http.MethodGet, "/v1/quotas", quotaServer.GetQuotas)
+	restapi.RegisterFunc(logger, mux, http.MethodPut, "/v1/devices/{device_id}", deviceServer.RegisterDevice)
+	restapi.RegisterFunc(logger, mux, http.MethodPost, "/v1/devices/{device_id}/sync", deviceServer.ReportDeviceSync)
 	mux.HandleFunc("PUT /v1/files/upload", uploadServer.UploadFile)
+	mux.HandleFunc("PUT /v1/files/link", uploadServer.LinkFile)
+	mux.HandleFunc("GET /v1/files/download", downloadServer.DownloadFile)
+
+	if opts.AdminToken != "" {
+		adminMux := restapi.WithBearerToken(mux, opts.AdminToken)
+		scrubServer := restapi.NewScrubServer(logger, scrubber)
+		restapi.RegisterFunc(logger, adminMux, http.MethodPost, "/v1/admin/fsck", scrubServer.Fsck)
+		deletionServer := restapi.NewDeletionServer(logger, deletions)
+		restapi.RegisterFunc(logger, adminMux, http.MethodGet, "/v1/admin/deletions", deletionServer.GetDeletions)
+		restapi.RegisterFunc(logger, adminMux, http.MethodPost, "/v1/admin/deletions/{id}/requeue", deletionServer.RequeueDeletion)
+		restapi.RegisterFunc(logger, adminMux, http.MethodGet, "/v1/admin/devices", deviceServer.ListDevices)
+		restapi.RegisterFunc(logger, adminMux, http.MethodGet, "/v1/admin/devices/{device_id}", deviceServer.GetDevice)
+		restapi.RegisterFunc(logger, adminMux, http.MethodDelete, "/v1/admin/devices/{device_id}", deviceServer.DeleteDevice)
+		// only the filesystem backend has a layout to migrate; migrating moves objects as they are, encrypted or not
+		if migrator, ok := backend.(restapi.StorageMigrator); ok {
+			adminServer := restapi.NewAdminServer(logger, migrator)
+			restapi.RegisterFunc(logger, adminMux, http.MethodGet, "/v1/admin/storage/layout", adminServer.GetStorageLayout)
+			restapi.RegisterFunc(logger, adminMux, http.MethodPost, "/v1/admin/storage/layout", adminServer.MigrateStorageLayout)
+		}
+	} else {
+		logger.Info("Admin endpoints are disabled; set -admin-token to enable them")
+	}
 
 	shutdown := mustInitTracer(logger, appName)
 	defer func() {
@@ -93,7 +234,24 @@ func main() {
 	// Expose the registered metrics via HTTP
 	mux.Handle("/metrics", promhttp.Handler())
 
-	mustListenAndServe(ctx, logger, opts.ServerAddr, handler)
+	mustListenAndServe(ctx, logger, opts.ServerAddr, handler, watchServer.Close)
+}
+
+// mustOpenDeletionQueue opens the durable queue of objects to delete in the state directory, creating it if needed.
+func mustOpenDeletionQueue(logger *logrus.Logger, opts *Options) *outbox.Outbox {
+	err := os.MkdirAll(opts.StateDir, 0755)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to create state directory")
+	}
+	queue, err := outbox.Open(
+		logger,
+		filepath.Join(opts.StateDir, "deletions.jsonl"),
+		outbox.WithRetries(opts.DeletionAttempts, outbox.DefaultMinBackoff, outbox.DefaultMaxBackoff),
+	)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to open deletion queue")
+	}
+	return queue
 }
 
 func generateAndPrintAccessKey(authService *auth.Auth) {
@@ -103,6 +261,48 @@ func generateAndPrintAccessKey(authService *auth.Auth) {
 	fmt.Printf("  Access Key Secret: %s\n", accessKey.SecretKey)
 }
 
+// mustOpenStorageBackend opens the configured storage backend. The filesystem backend can be configured by flags
+// instead of a config file, as it used to be the only backend.
+func mustOpenStorageBackend(ctx context.Context, logger *logrus.Logger, opts *Options) blobstorage.Backend {
+	var config json.RawMessage
+	if opts.StorageConfig != "" {
+		var err error
+		config, err = os.ReadFile(opts.StorageConfig)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to read storage backend config")
+		}
+	} else {
+		var err error
+		config, err = json.Marshal(&filesystem.Config{
+			RootDir: opts.DestinationDir,
+			Layout:  filesystem.Layout(opts.StorageLayout),
+		})
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to marshal filesystem backend config")
+		}
+	}
+
+	backend, err := blobstorage.Open(ctx, logger, opts.StorageBackend, config)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to open storage backend")
+	}
+
+	return backend
+}
+
+func mustLoadQuotaConfig(logger *logrus.Logger, path string) *quota.Config {
+	if path == "" {
+		return &quota.Config{}
+	}
+
+	cfg, err := quota.LoadConfig(path)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to load quota config")
+	}
+
+	return cfg
+}
+
 func mustInitTracer(logger *logrus.Logger, appName string) func(context.Context) error {
 	exp, err := interceptors.NewSTDOUTExporter(true)
 	if err != nil {
@@ -117,11 +317,16 @@ func mustInitTracer(logger *logrus.Logger, appName string) func(context.Context)
 	return tp.Shutdown
 }
 
-func mustListenAndServe(ctx context.Context, logger *logrus.Logger, addr string, handler http.Handler) {
+// mustListenAndServe serves the handler until the context is done. The given funcs are called on shutdown to end the
+// long-lived requests, which the server would wait for otherwise.
+func mustListenAndServe(ctx context.Context, logger *logrus.Logger, addr string, handler http.Handler, onShutdown ...func()) {
 	srv := &http.Server{
 		Addr:    addr,
 		Handler: handler,
 	}
+	for f := range slices.Values(onShutdown) {
+		srv.RegisterOnShutdown(f)
+	}
 
 	go func() {
 		logger.WithField("addr", addr).Info("Serving server...")